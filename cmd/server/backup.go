@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/danielgtaylor/huma/v2/humacli"
+	"github.com/spf13/cobra"
+	"github.com/techsquidtv/inkling/internal/database"
+)
+
+// newBackupCommand returns the backup command, which snapshots the SQLite
+// database while the server keeps running.
+func newBackupCommand() *cobra.Command {
+	var output string
+	var compress, noChecksum bool
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Write a consistent snapshot of the SQLite database, safe while the server runs",
+		Args:  cobra.NoArgs,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			offline = true
+			cmd.Root().PersistentPreRun(cmd, args)
+		},
+		Run: humacli.WithOptions(func(cmd *cobra.Command, args []string, options *Options) {
+			if output == "" {
+				output = "inkling-" + time.Now().UTC().Format("20060102T150405Z") + database.BackupExtension
+				if compress {
+					output += ".gz"
+				}
+			}
+
+			db := openMigrationDB(options)
+			info, err := database.Backup(db, output, compress)
+			if err != nil {
+				log.Fatal("backup failed", "err", err)
+			}
+			log.Info("wrote backup", "path", info.Path, "size", info.Size, "schema", info.SchemaVersion, "sha256", info.Checksum)
+			if !noChecksum {
+				path, err := database.WriteChecksumFile(info)
+				if err != nil {
+					log.Fatal("failed to write checksum", "err", err)
+				}
+				log.Info("wrote checksum", "path", path)
+			}
+		}),
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write, inkling-<time>.db by default")
+	cmd.Flags().BoolVarP(&compress, "compress", "z", false, "Compress the backup with gzip")
+	cmd.Flags().BoolVar(&noChecksum, "no-checksum", false, "Do not write a .sha256 file next to the backup")
+	return cmd
+}
+
+// newRestoreCommand returns the restore command, which replaces the SQLite
+// database with a backup. The server must be stopped.
+func newRestoreCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Replace the SQLite database with a backup; stop the server first",
+		Args:  cobra.ExactArgs(1),
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			offline = true
+			cmd.Root().PersistentPreRun(cmd, args)
+		},
+		Run: humacli.WithOptions(func(cmd *cobra.Command, args []string, options *Options) {
+			dbPath, ok := database.SQLitePath(options.databaseURL())
+			if !ok {
+				log.Fatal(database.ErrBackupUnsupported.Error())
+			}
+
+			info, previous, err := database.Restore(args[0], dbPath)
+			if err != nil {
+				log.Fatal("restore failed", "err", err)
+			}
+			log.Info("restored backup", "path", dbPath, "schema", info.SchemaVersion)
+			if previous != "" {
+				log.Info("kept the replaced database", "path", previous)
+			}
+		}),
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"time"
@@ -23,11 +24,13 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/techsquidtv/inkling/internal/api"
 	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/config"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/logs"
+	"github.com/techsquidtv/inkling/internal/mail"
 	appmiddleware "github.com/techsquidtv/inkling/internal/middleware"
 	"github.com/techsquidtv/inkling/internal/telemetry"
 
@@ -37,13 +40,103 @@ import (
 
 // Options for the CLI.
 type Options struct {
-	Port        int    `help:"Port to listen on" short:"p" default:"8080"`
-	DBPath      string `help:"Path to the SQLite database" default:"app.db"`
-	SentryDSN   string `help:"Sentry DSN for error tracking" env:"SENTRY_DSN"`
-	MetricsPort int    `help:"Port to serve Prometheus metrics on" default:"9090" env:"METRICS_PORT"`
-	Spotlight   bool   `help:"Enable Sentry Spotlight" env:"SENTRY_SPOTLIGHT"`
+	Port           int           `help:"Port to listen on" short:"p" default:"8080"`
+	DBPath         string        `help:"Path to the SQLite database, used when --database-url is not set" default:"app.db"`
+	DatabaseURL    string        `help:"Database URL: postgres://..., mysql://... or a SQLite path" env:"DATABASE_URL"`
+	SentryDSN      string        `help:"Sentry DSN for error tracking" env:"SENTRY_DSN"`
+	MetricsPort    int           `help:"Port to serve Prometheus metrics on" default:"9090" env:"METRICS_PORT"`
+	Spotlight      bool          `help:"Enable Sentry Spotlight" env:"SENTRY_SPOTLIGHT"`
+	Environment    string        `help:"Deployment environment (development or production, default development)" env:"INKLING_ENV"`
+	SessionCookies bool          `help:"Also issue sessions as HttpOnly cookies with CSRF protection for the web app" env:"SESSION_COOKIES"`
+	NoAutoMigrate  bool          `help:"Do not apply pending migrations on startup; the server refuses to start until migrate up has run"`
+	BackupDir      string        `help:"Directory for scheduled SQLite backups; scheduled backups are off when empty" env:"BACKUP_DIR"`
+	BackupInterval time.Duration `help:"Time between scheduled backups" default:"24h" env:"BACKUP_INTERVAL"`
+	BackupKeep     int           `help:"Number of scheduled backups to keep, 0 keeps all" default:"7" env:"BACKUP_KEEP"`
+	ReadReplicas   string        `help:"Comma-separated database URLs of read replicas for list endpoints" env:"READ_REPLICAS"`
+	ReplicaMaxLag  time.Duration `help:"Replicas further behind the primary are not read from" default:"10s" env:"REPLICA_MAX_LAG"`
 }
 
+// databaseURL returns the database to connect to: --database-url, then
+// DATABASE_URL, then the SQLite file at --db-path.
+func (o *Options) databaseURL() string {
+	if o.DatabaseURL != "" {
+		return o.DatabaseURL
+	}
+	if url := os.Getenv("DATABASE_URL"); url != "" {
+		return url
+	}
+	return o.DBPath
+}
+
+// environment returns the deployment environment: --environment, then
+// INKLING_ENV, then development.
+func (o *Options) environment() string {
+	if o.Environment != "" {
+		return o.Environment
+	}
+	if env := os.Getenv("INKLING_ENV"); env != "" {
+		return env
+	}
+	return config.EnvDevelopment
+}
+
+// backupSchedule returns the scheduled backup settings from the flags, then
+// BACKUP_DIR, BACKUP_INTERVAL and BACKUP_KEEP, then the flag defaults. Dir is
+// empty when scheduled backups are off.
+func (o *Options) backupSchedule(flags *pflag.FlagSet) (database.BackupSchedule, error) {
+	schedule := database.BackupSchedule{Dir: o.BackupDir, Interval: o.BackupInterval, Keep: o.BackupKeep}
+	if schedule.Dir == "" {
+		schedule.Dir = os.Getenv("BACKUP_DIR")
+	}
+	if v := os.Getenv("BACKUP_INTERVAL"); v != "" && !flags.Changed("backup-interval") {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return schedule, fmt.Errorf("invalid BACKUP_INTERVAL: %w", err)
+		}
+		schedule.Interval = interval
+	}
+	if v := os.Getenv("BACKUP_KEEP"); v != "" && !flags.Changed("backup-keep") {
+		keep, err := strconv.Atoi(v)
+		if err != nil {
+			return schedule, fmt.Errorf("invalid BACKUP_KEEP: %w", err)
+		}
+		schedule.Keep = keep
+	}
+	if schedule.Dir != "" && schedule.Interval <= 0 {
+		return schedule, fmt.Errorf("backup interval must be positive")
+	}
+	return schedule, nil
+}
+
+// replicaConfig returns the read replicas from the flags, then READ_REPLICAS
+// and REPLICA_MAX_LAG, then the flag defaults. URLs is empty when there are
+// none.
+func (o *Options) replicaConfig(flags *pflag.FlagSet) (database.ReplicaConfig, error) {
+	cfg := database.ReplicaConfig{MaxLag: o.ReplicaMaxLag}
+	replicas := o.ReadReplicas
+	if replicas == "" {
+		replicas = os.Getenv("READ_REPLICAS")
+	}
+	for _, replicaURL := range strings.Split(replicas, ",") {
+		if replicaURL = strings.TrimSpace(replicaURL); replicaURL != "" {
+			cfg.URLs = append(cfg.URLs, replicaURL)
+		}
+	}
+	if v := os.Getenv("REPLICA_MAX_LAG"); v != "" && !flags.Changed("replica-max-lag") {
+		maxLag, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid REPLICA_MAX_LAG: %w", err)
+		}
+		cfg.MaxLag = maxLag
+	}
+	return cfg, nil
+}
+
+// offline is set by the migrate, backup and restore commands, which need the
+// parsed options but must not start the server: it would apply migrations
+// and hold the database open.
+var offline bool
+
 //go:embed all:dist
 var distFS embed.FS
 
@@ -57,13 +150,20 @@ func main() {
 
 	var humaAPI huma.API
 
-	// Create a CLI app which takes a port option.
-	cli := humacli.New(func(hooks humacli.Hooks, options *Options) {
+	// Create a CLI app which takes a port option. The options callback runs
+	// once the flags are parsed, so it can look at them through cli.
+	var cli humacli.CLI
+	cli = humacli.New(func(hooks humacli.Hooks, options *Options) {
+		if offline {
+			return
+		}
+
 		// Initialize Telemetry
 		otelShutdown, err := telemetry.Init(context.Background(), telemetry.Config{
 			SentryDSN:   options.SentryDSN,
 			MetricsPort: fmt.Sprintf("%d", options.MetricsPort),
 			ServiceName: config.ServiceName,
+			Environment: options.environment(),
 			Spotlight:   options.Spotlight,
 		})
 		if err != nil {
@@ -109,13 +209,14 @@ func main() {
 		// Middleware
 		router.Use(otelhttp.NewMiddleware(config.ServiceName))
 		router.Use(sentryhttp.New(sentryhttp.Options{Repanic: true}).Handle)
+		router.Use(middleware.RequestID)
 		router.Use(appmiddleware.NewLoggingMiddleware())
 		router.Use(middleware.Recoverer)
 		router.Use(func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.Header().Set("Access-Control-Allow-Origin", "*")
 				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, sentry-trace, baggage, traceparent")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token, sentry-trace, baggage, traceparent")
 				if r.Method == "OPTIONS" {
 					w.WriteHeader(http.StatusNoContent)
 					return
@@ -125,15 +226,100 @@ func main() {
 		})
 
 		// Initialize Database
-		db, err := database.InitDB(options.DBPath)
+		db, err := database.InitDB(options.databaseURL(), !options.NoAutoMigrate)
 		if err != nil {
 			log.Fatal("failed to connect database", "err", err)
 		}
 
-		// Initialize OIDC Provider
+		// Register read replicas
+		replicaConfig, err := options.replicaConfig(cli.Root().PersistentFlags())
+		if err != nil {
+			log.Fatal("invalid read replica configuration", "err", err)
+		}
+		if len(replicaConfig.URLs) > 0 {
+			replicas, err := database.UseReplicas(db, replicaConfig)
+			if err != nil {
+				log.Fatal("failed to register read replicas", "err", err)
+			}
+			replicasCtx, stopReplicas := context.WithCancel(context.Background())
+			replicas.Start(replicasCtx)
+			hooks.OnStop(func() {
+				stopReplicas()
+				replicas.Close()
+			})
+		}
+
+		// Initialize JWT signing keys
+		keyConfig := auth.KeyConfigFromEnv()
+		if err := keyConfig.Validate(options.environment() == config.EnvProduction); err != nil {
+			log.Fatal("invalid JWT key configuration", "err", err)
+		}
+		keyManager, err := auth.NewKeyManager(db, keyConfig)
+		if err != nil {
+			log.Fatal("failed to load JWT signing keys", "err", err)
+		}
+		auth.SetKeyManager(keyManager)
+		auth.SetSessionCookies(options.SessionCookies || os.Getenv("SESSION_COOKIES") == "true")
+		keyCtx, stopKeyRotation := context.WithCancel(context.Background())
+		keyManager.Start(keyCtx)
+		hooks.OnStop(stopKeyRotation)
+
+		// Start scheduled backups
+		backupSchedule, err := options.backupSchedule(cli.Root().PersistentFlags())
+		if err != nil {
+			log.Fatal("invalid backup configuration", "err", err)
+		}
+		if backupSchedule.Dir != "" {
+			if db.Dialector.Name() != "sqlite" {
+				log.Warn("scheduled backups are only supported for SQLite, use your database's own backup tools")
+			} else {
+				backupCtx, stopBackups := context.WithCancel(context.Background())
+				database.StartBackups(backupCtx, db, backupSchedule)
+				hooks.OnStop(stopBackups)
+			}
+		}
+
+		// Initialize OIDC Providers: the env-configured one plus any stored by admins
+		providers := auth.NewRegistry(db, auth.RegistryConfig{
+			Secret:    keyConfig.Secret,
+			PublicURL: os.Getenv("PUBLIC_URL"),
+		})
 		oidcProvider, err := auth.NewOIDCProvider(context.Background())
 		if err != nil {
 			log.Warn("failed to initialize OIDC provider", "err", err)
+		} else if oidcProvider != nil {
+			name := os.Getenv("OIDC_DISPLAY_NAME")
+			if name == "" {
+				name = "Single Sign-On"
+			}
+			providers.Register(database.DefaultOIDCProvider, name, oidcProvider)
+		}
+		if err := providers.Reload(context.Background()); err != nil {
+			log.Warn("failed to load OIDC providers", "err", err)
+		}
+		providersCtx, stopProviders := context.WithCancel(context.Background())
+		providers.Start(providersCtx)
+		hooks.OnStop(stopProviders)
+
+		// Initialize passkeys when a relying party can be determined
+		var passkeys *auth.Passkeys
+		if webauthnConfig, ok := auth.WebAuthnConfigFromEnv(); ok {
+			passkeys, err = auth.NewPasskeys(db, webauthnConfig)
+			if err != nil {
+				log.Warn("failed to initialize passkeys", "err", err)
+			}
+		}
+
+		// Initialize the mailer for password reset and verification emails
+		sender, err := mail.NewSenderFromEnv(options.environment())
+		if err != nil {
+			log.Fatal("invalid mail configuration", "err", err)
+		}
+		var mailer *mail.Mailer
+		if sender != nil {
+			mailer = mail.NewMailer(sender, os.Getenv("PUBLIC_URL"))
+		} else {
+			log.Warn("email is not configured, set SMTP_HOST to enable password reset, verification and invitation emails")
 		}
 
 		// Create Huma API Config
@@ -149,14 +335,26 @@ func main() {
 				In:   "header",
 				Name: "X-API-Key",
 			},
+			"cookieAuth": {
+				Type:        "apiKey",
+				In:          "cookie",
+				Name:        auth.SessionCookie,
+				Description: "Session cookie set on login when session cookies are enabled; accepted wherever bearerAuth is. Unsafe methods must also send the inkling_csrf cookie's value in X-CSRF-Token",
+			},
+			appmiddleware.SCIMSecurityScheme: {
+				Type:        "http",
+				Scheme:      "bearer",
+				Description: "SCIM token created at /admin/scim/tokens; only accepted by the /scim/v2 endpoints",
+			},
 		}
 
 		// API Routes
 		// Create a sub-router for /api so we can easily exclude it from the SPA catch-all
 		apiRouter := chi.NewRouter()
 		humaAPI = humachi.New(apiRouter, apiConfig)
+		humaAPI.UseMiddleware(appmiddleware.NewClientInfoMiddleware())
 		humaAPI.UseMiddleware(appmiddleware.NewAuthMiddleware(humaAPI, db))
-		api.RegisterHandlers(humaAPI, router, db, oidcProvider, logService)
+		api.RegisterHandlers(humaAPI, router, db, providers, passkeys, mailer, logService)
 
 		router.Mount("/api", apiRouter)
 
@@ -234,6 +432,10 @@ func main() {
 		},
 	})
 
+	cli.Root().AddCommand(newMigrateCommand())
+	cli.Root().AddCommand(newBackupCommand())
+	cli.Root().AddCommand(newRestoreCommand())
+
 	// Run the CLI. When passed no commands, it starts the server.
 	cli.Run()
 }
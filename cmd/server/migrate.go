@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/charmbracelet/log"
+	"github.com/danielgtaylor/huma/v2/humacli"
+	"github.com/spf13/cobra"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// newMigrateCommand returns the migrate command and its subcommands.
+func newMigrateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Manage database schema migrations",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			// Parse the options without starting the server
+			offline = true
+			cmd.Root().PersistentPreRun(cmd, args)
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "up",
+		Short: "Apply all pending migrations",
+		Args:  cobra.NoArgs,
+		Run: humacli.WithOptions(func(cmd *cobra.Command, args []string, options *Options) {
+			db := openMigrationDB(options)
+			applied, err := database.Migrate(db)
+			for _, m := range applied {
+				log.Info("applied migration", "version", m.Version, "name", m.Name)
+			}
+			if err != nil {
+				log.Fatal("migration failed", "err", err)
+			}
+			if len(applied) == 0 {
+				log.Info("database is up to date")
+			}
+		}),
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "down [steps]",
+		Short: "Revert the last applied migration, or the last steps migrations",
+		Args:  cobra.MaximumNArgs(1),
+		Run: humacli.WithOptions(func(cmd *cobra.Command, args []string, options *Options) {
+			steps := 1
+			if len(args) == 1 {
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 1 {
+					log.Fatal("steps must be a positive number", "steps", args[0])
+				}
+				steps = n
+			}
+
+			db := openMigrationDB(options)
+			reverted, err := database.Rollback(db, steps)
+			for _, m := range reverted {
+				log.Info("reverted migration", "version", m.Version, "name", m.Name)
+			}
+			if err != nil {
+				log.Fatal("rollback failed", "err", err)
+			}
+			if len(reverted) == 0 {
+				log.Info("no migrations to revert")
+			}
+		}),
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "List migrations and whether they are applied",
+		Args:  cobra.NoArgs,
+		Run: humacli.WithOptions(func(cmd *cobra.Command, args []string, options *Options) {
+			db := openMigrationDB(options)
+			states, err := database.MigrationStatus(db)
+			if err != nil {
+				log.Fatal("failed to read migrations", "err", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+			for _, state := range states {
+				status := "pending"
+				if state.AppliedAt != nil {
+					status = "applied " + state.AppliedAt.Format("2006-01-02 15:04:05")
+				}
+				if state.Unknown {
+					status += " (not in this build)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", state.Version, state.Name, status)
+			}
+			w.Flush()
+		}),
+	})
+
+	var dir string
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Write an empty migration to fill in, e.g. migrate create add_user_locale",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, err := database.CreateMigration(dir, args[0])
+			if err != nil {
+				log.Fatal("failed to create migration", "err", err)
+			}
+			log.Info("created migration", "path", path)
+		},
+	}
+	create.Flags().StringVar(&dir, "dir", "internal/database", "Directory of the database package")
+	cmd.AddCommand(create)
+
+	return cmd
+}
+
+// openMigrationDB connects to the configured database without migrating it.
+func openMigrationDB(options *Options) *gorm.DB {
+	db, err := database.Open(options.databaseURL())
+	if err != nil {
+		log.Fatal("failed to connect database", "err", err)
+	}
+	return db
+}
@@ -6,19 +6,36 @@ import (
 	"github.com/techsquidtv/inkling/internal/api/handlers"
 	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/logs"
+	"github.com/techsquidtv/inkling/internal/mail"
 	"gorm.io/gorm"
 )
 
 // RegisterHandlers registers all API handlers.
-func RegisterHandlers(api huma.API, router chi.Router, db *gorm.DB, oidc *auth.OIDCProvider, logService logs.Service) {
+func RegisterHandlers(api huma.API, router chi.Router, db *gorm.DB, providers *auth.Registry, passkeys *auth.Passkeys, mailer *mail.Mailer, logService logs.Service) {
 	handlers.RegisterHealth(api)
 	handlers.RegisterVersion(api)
 	handlers.RegisterGreeting(api)
 	handlers.RegisterProducts(api, db)
 	handlers.RegisterAPIKeys(api, db)
-	handlers.RegisterAuth(api, db, oidc)
+	handlers.RegisterAuth(api, db, providers, mailer)
+	handlers.RegisterPasswordReset(api, db, mailer)
 	handlers.RegisterAdmin(api, db)
+	handlers.RegisterOIDCProviders(api, db, providers)
 	handlers.RegisterUser(api, db)
+	handlers.RegisterSessions(api, db)
+	handlers.RegisterIdentities(api, db, providers)
+	handlers.RegisterMFA(api, db)
+	handlers.RegisterPasskeys(api, db, passkeys)
 	handlers.RegisterUsers(api, db)
+	handlers.RegisterLockouts(api, db)
+	handlers.RegisterAudit(api, db)
+	handlers.RegisterBackup(api, db)
+	handlers.RegisterOrganizations(api, db, mailer)
+	handlers.RegisterRoles(api, db)
+	handlers.RegisterInvitations(api, db, mailer)
+	handlers.RegisterServiceAccounts(api, db)
+	handlers.RegisterSCIM(api, db)
+	handlers.RegisterLDAP(api, db)
 	handlers.RegisterLogs(router, logService)
+	handlers.RegisterJWKS(router)
 }
@@ -2,50 +2,126 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
 	"gorm.io/gorm"
 )
 
-// AdminSettingsOutput represents the response for admin settings.
+// AdminSettingsOutput represents the response for admin settings. Its
+// schema is generated from the settings registry.
 type AdminSettingsOutput struct {
-	Body struct {
-		RegistrationEnabled bool `json:"registration_enabled" doc:"Whether user registration is enabled"`
-	}
+	Body map[string]any
 }
 
-// UpdateAdminSettingsInput represents the request to update admin settings.
+// UpdateAdminSettingsInput represents the request to update admin settings:
+// any subset of the settings, by key.
 type UpdateAdminSettingsInput struct {
-	Body struct {
-		RegistrationEnabled *bool `json:"registration_enabled,omitempty" doc:"Enable or disable user registration"`
+	Body map[string]json.RawMessage
+}
+
+// PublicSettingsOutput represents the response for public settings.
+type PublicSettingsOutput struct {
+	Body map[string]any
+}
+
+// settingGuards check updates that depend on who makes them, so admins cannot
+// lock themselves out or hand out roles beyond their own permissions. Other
+// settings only need the settings:write permission.
+var settingGuards = map[string]func(ctx context.Context, db *gorm.DB, admin *database.User, value any) error{
+	database.RequireAdminMFA.Key: func(ctx context.Context, db *gorm.DB, admin *database.User, value any) error {
+		if value.(bool) && !auth.HasMFA(db, admin.ID) {
+			return huma.Error400BadRequest("enable MFA on your own account before requiring it for admins")
+		}
+		return nil
+	},
+	database.RequireEmailVerification.Key: func(ctx context.Context, db *gorm.DB, admin *database.User, value any) error {
+		if value.(bool) && admin.EmailVerifiedAt == nil {
+			return huma.Error400BadRequest("verify your own email address before requiring verification")
+		}
+		return nil
+	},
+	auth.OIDCRoleMappings.Key: func(ctx context.Context, db *gorm.DB, admin *database.User, value any) error {
+		return requireMappableRoles(ctx, db, value.([]auth.OIDCRoleMapping), "")
+	},
+	auth.OIDCDefaultRole.Key: func(ctx context.Context, db *gorm.DB, admin *database.User, value any) error {
+		return requireMappableRoles(ctx, db, nil, value.(string))
+	},
+}
+
+// settingsSchema returns the object schema of the settings, generated from
+// the registry. With required set every setting is listed, as in responses.
+func settingsSchema(registry huma.Registry, settings []database.AnySetting, required bool) *huma.Schema {
+	schema := &huma.Schema{Type: huma.TypeObject, Properties: map[string]*huma.Schema{}, AdditionalProperties: false}
+	for _, setting := range settings {
+		info := setting.Info()
+		property := huma.SchemaFromType(registry, info.Type)
+		property.Description = info.Description
+		schema.Properties[info.Key] = property
+		if required {
+			schema.Required = append(schema.Required, info.Key)
+		}
 	}
+	return schema
 }
 
-// RegisterAdmin registers admin-only endpoints.
+// settingsValues returns the values of the settings by key.
+func settingsValues(db *gorm.DB, settings []database.AnySetting) (map[string]any, error) {
+	values := make(map[string]any, len(settings))
+	for _, setting := range settings {
+		value, err := setting.GetAny(db)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to load settings", err)
+		}
+		values[setting.Info().Key] = value
+	}
+	return values, nil
+}
+
+// publicSettings returns the settings readable without authentication.
+func publicSettings() []database.AnySetting {
+	var public []database.AnySetting
+	for _, setting := range database.Settings() {
+		if setting.Info().Public {
+			public = append(public, setting)
+		}
+	}
+	return public
+}
+
+// RegisterAdmin registers the settings endpoints. They are generated from the
+// settings registry, so new settings need no handler code.
 func RegisterAdmin(api huma.API, db *gorm.DB) {
+	registry := api.OpenAPI().Components.Schemas
+
 	// GET /api/admin/settings - Get admin settings
 	huma.Register(api, huma.Operation{
 		OperationID: "get-admin-settings",
 		Method:      http.MethodGet,
 		Path:        "/admin/settings",
 		Summary:     "Get admin settings",
-		Description: "Retrieve application settings. Requires admin role.",
+		Description: "Retrieve application settings. Requires the settings:read permission.",
 		Tags:        []string{"Admin"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsRead},
+		Responses: map[string]*huma.Response{
+			"200": {Content: map[string]*huma.MediaType{
+				"application/json": {Schema: settingsSchema(registry, database.Settings(), true)},
+			}},
 		},
 	}, func(ctx context.Context, input *struct{}) (*AdminSettingsOutput, error) {
-		// Verify admin access
-		if _, err := middleware.RequireAdmin(ctx); err != nil {
+		values, err := settingsValues(db, database.Settings())
+		if err != nil {
 			return nil, err
 		}
-
-		resp := &AdminSettingsOutput{}
-		resp.Body.RegistrationEnabled = database.IsRegistrationEnabled(db)
-		return resp, nil
+		return &AdminSettingsOutput{Body: values}, nil
 	})
 
 	// PUT /api/admin/settings - Update admin settings
@@ -54,26 +130,106 @@ func RegisterAdmin(api huma.API, db *gorm.DB) {
 		Method:      http.MethodPut,
 		Path:        "/admin/settings",
 		Summary:     "Update admin settings",
-		Description: "Update application settings. Requires admin role.",
+		Description: "Update the given application settings; settings left out keep their values. Requires the settings:write permission.",
 		Tags:        []string{"Admin"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsWrite},
+		RequestBody: &huma.RequestBody{
+			Required: true,
+			Content: map[string]*huma.MediaType{
+				"application/json": {Schema: settingsSchema(registry, database.Settings(), false)},
+			},
+		},
+		Responses: map[string]*huma.Response{
+			"200": {Content: map[string]*huma.MediaType{
+				"application/json": {Schema: settingsSchema(registry, database.Settings(), true)},
+			}},
 		},
 	}, func(ctx context.Context, input *UpdateAdminSettingsInput) (*AdminSettingsOutput, error) {
-		// Verify admin access
-		if _, err := middleware.RequireAdmin(ctx); err != nil {
+		admin, err := middleware.RequireAuth(ctx)
+		if err != nil {
 			return nil, err
 		}
 
-		// Update registration setting if provided
-		if input.Body.RegistrationEnabled != nil {
-			if err := database.SetRegistrationEnabled(db, *input.Body.RegistrationEnabled); err != nil {
-				return nil, huma.Error500InternalServerError("failed to update settings", err)
+		// Validate every value before writing any
+		type update struct {
+			setting database.AnySetting
+			value   any
+		}
+		var updates []update
+		for _, setting := range database.Settings() {
+			key := setting.Info().Key
+			raw, ok := input.Body[key]
+			if !ok {
+				continue
+			}
+			value, err := setting.ParseJSON(raw)
+			if err != nil {
+				return nil, huma.Error422UnprocessableEntity("validation failed", &huma.ErrorDetail{
+					Location: "body." + key,
+					Message:  err.Error(),
+					Value:    raw,
+				})
+			}
+			if guard := settingGuards[key]; guard != nil {
+				if err := guard(ctx, db, admin, value); err != nil {
+					return nil, err
+				}
+			}
+			updates = append(updates, update{setting, value})
+		}
+
+		before, err := settingsValues(db, database.Settings())
+		if err != nil {
+			return nil, err
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, u := range updates {
+				if err := u.setting.SetAny(tx, u.value); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+		database.InvalidateSettings(db)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to update settings", err)
 		}
 
-		resp := &AdminSettingsOutput{}
-		resp.Body.RegistrationEnabled = database.IsRegistrationEnabled(db)
-		return resp, nil
+		after, err := settingsValues(db, database.Settings())
+		if err != nil {
+			return nil, err
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditSettingsUpdate,
+			TargetType: "settings",
+			Before:     before,
+			After:      after,
+		})
+		return &AdminSettingsOutput{Body: after}, nil
+	})
+
+	// GET /api/settings/public - Get public settings
+	huma.Register(api, huma.Operation{
+		OperationID: "get-public-settings",
+		Method:      http.MethodGet,
+		Path:        "/settings/public",
+		Summary:     "Get public settings",
+		Description: "Retrieve the settings the web app needs before login, such as the application name. No authentication required.",
+		Tags:        []string{"Settings", "public"},
+		Responses: map[string]*huma.Response{
+			"200": {Content: map[string]*huma.MediaType{
+				"application/json": {Schema: settingsSchema(registry, publicSettings(), true)},
+			}},
+		},
+	}, func(ctx context.Context, input *struct{}) (*PublicSettingsOutput, error) {
+		values, err := settingsValues(db, publicSettings())
+		if err != nil {
+			return nil, err
+		}
+		return &PublicSettingsOutput{Body: values}, nil
 	})
 }
@@ -1,26 +1,22 @@
 package handlers_test
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"testing"
 
 	"github.com/danielgtaylor/huma/v2/humatest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/techsquidtv/inkling/internal/api/handlers"
-	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 func setupAdminTestDB(t *testing.T) *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	if err != nil {
-		t.Fatalf("failed to open database: %v", err)
-	}
-	db.AutoMigrate(&database.User{}, &database.APIKey{}, &database.AppSettings{})
-	return db
+	return openTestDB(t)
 }
 
 func TestFirstUserBecomesAdmin(t *testing.T) {
@@ -31,7 +27,7 @@ func TestFirstUserBecomesAdmin(t *testing.T) {
 	mockOIDC := &MockProvider{}
 
 	// Register Auth Handlers
-	handlers.RegisterAuth(api, db, mockOIDC)
+	handlers.RegisterAuth(api, db, testProviders(mockOIDC), nil)
 
 	// First user signup
 	signupData := map[string]interface{}{
@@ -74,10 +70,10 @@ func TestRegistrationDisabled(t *testing.T) {
 	})
 
 	// Disable registration
-	database.SetRegistrationEnabled(db, false)
+	database.RegistrationEnabled.Set(db, false)
 
 	// Register Auth Handlers
-	handlers.RegisterAuth(api, db, mockOIDC)
+	handlers.RegisterAuth(api, db, testProviders(mockOIDC), nil)
 
 	// Try to signup (should fail)
 	signupData := map[string]interface{}{
@@ -114,8 +110,8 @@ func TestAdminSettingsEndpoints(t *testing.T) {
 	handlers.RegisterAdmin(api, db)
 
 	// Generate tokens
-	adminToken, _ := auth.GenerateJWT(adminUser.ID)
-	userToken, _ := auth.GenerateJWT(normalUser.ID)
+	adminToken := issueToken(t, db, adminUser.ID)
+	userToken := issueToken(t, db, normalUser.ID)
 
 	// Test: Admin can GET settings
 	resp := api.Get("/admin/settings", "Authorization: Bearer "+adminToken)
@@ -133,7 +129,9 @@ func TestAdminSettingsEndpoints(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.Code)
 
 	// Verify setting was updated
-	assert.False(t, database.IsRegistrationEnabled(db))
+	enabled, err := database.RegistrationEnabled.Get(db)
+	require.NoError(t, err)
+	assert.False(t, enabled)
 
 	// Test: Non-admin cannot PUT settings
 	updateData["registration_enabled"] = true
@@ -141,7 +139,9 @@ func TestAdminSettingsEndpoints(t *testing.T) {
 	assert.Equal(t, http.StatusForbidden, resp.Code)
 
 	// Verify setting was NOT changed by non-admin
-	assert.False(t, database.IsRegistrationEnabled(db))
+	enabled, err = database.RegistrationEnabled.Get(db)
+	require.NoError(t, err)
+	assert.False(t, enabled)
 }
 
 func TestAdminSettingsUnauthenticated(t *testing.T) {
@@ -170,7 +170,7 @@ func TestAdminSettingsZombieToken(t *testing.T) {
 	db.Create(&user)
 
 	// Generate token before deleting
-	token, _ := auth.GenerateJWT(user.ID)
+	token := issueToken(t, db, user.ID)
 
 	// Delete the user from DB
 	db.Unscoped().Delete(&user)
@@ -184,3 +184,72 @@ func TestAdminSettingsZombieToken(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
 	assert.Contains(t, resp.Body.String(), "unauthorized: user not found")
 }
+
+func TestSettingsRegistry(t *testing.T) {
+	db := setupAdminTestDB(t)
+	_, api := humatest.New(t)
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAdmin(api, db)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+
+	// Every registered setting is listed with its default
+	resp := api.Get("/admin/settings", adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var settings map[string]any
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &settings))
+	for _, setting := range database.Settings() {
+		assert.Contains(t, settings, setting.Info().Key)
+	}
+	assert.Equal(t, "Inkling", settings["app_name"])
+
+	// Only public settings are readable without authentication
+	resp = api.Get("/settings/public")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"app_name":"Inkling","registration_enabled":true}`, resp.Body.String())
+
+	// Values are checked against their type and validation
+	resp = api.Put("/admin/settings", map[string]any{"app_name": "  "}, adminAuth)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	resp = api.Put("/admin/settings", map[string]any{"registration_enabled": "no"}, adminAuth)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	resp = api.Put("/admin/settings", map[string]any{"unknown_setting": true}, adminAuth)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	// A rejected update changes nothing, even for its valid values
+	resp = api.Put("/admin/settings", map[string]any{"registration_enabled": false, "app_name": ""}, adminAuth)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	enabled, err := database.RegistrationEnabled.Get(db)
+	require.NoError(t, err)
+	assert.True(t, enabled)
+
+	resp = api.Put("/admin/settings", map[string]any{"app_name": "Acme"}, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	resp = api.Get("/settings/public")
+	assert.JSONEq(t, `{"app_name":"Acme","registration_enabled":true}`, resp.Body.String())
+}
+
+func TestSettingsCache(t *testing.T) {
+	db := setupAdminTestDB(t)
+
+	require.NoError(t, database.AppName.Set(db, "Acme"))
+	name, err := database.AppName.Get(db)
+	require.NoError(t, err)
+	assert.Equal(t, "Acme", name)
+
+	// Reads are served from the cache, and writes invalidate it
+	require.NoError(t, db.Model(&database.AppSettings{}).Where("setting_key = ?", "app_name").Update("value", `"Changed"`).Error)
+	name, _ = database.AppName.Get(db)
+	assert.Equal(t, "Acme", name)
+	require.NoError(t, database.AppName.Set(db.WithContext(context.Background()), "Widgets"))
+	name, _ = database.AppName.Get(db)
+	assert.Equal(t, "Widgets", name)
+
+	// Invalid values are refused, and invalid stored values are reported
+	assert.Error(t, database.AppName.Set(db, ""))
+	require.NoError(t, db.Model(&database.AppSettings{}).Where("setting_key = ?", "app_name").Update("value", "not json").Error)
+	database.InvalidateSettings(db)
+	_, err = database.AppName.Get(db)
+	assert.Error(t, err)
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
 	"gorm.io/gorm"
@@ -18,7 +20,9 @@ type APIKey struct {
 	ID        uint       `json:"id"`
 	Name      string     `json:"name"`
 	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
 	LastUsed  *time.Time `json:"last_used,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 	CreatedAt time.Time  `json:"created_at"`
 }
 
@@ -30,16 +34,88 @@ type ListKeysOutput struct {
 
 type CreateKeyInput struct {
 	Body struct {
-		Name string `json:"name,omitempty" doc:"Optional name for the key"`
+		Name          string       `json:"name,omitempty" doc:"Optional name for the key"`
+		Scopes        apiKeyScopes `json:"scopes" required:"true" minItems:"1" uniqueItems:"true" doc:"Scopes granted to the key"`
+		ExpiresInDays *int         `json:"expires_in_days,omitempty" minimum:"1" maximum:"3650" doc:"Optional number of days until the key expires"`
 	}
 }
 
+// apiKeyScopes is a list of scopes to grant, documented and validated
+// against auth.AllScopes.
+type apiKeyScopes []string
+
+// TransformSchema implements huma.SchemaTransformer.
+func (apiKeyScopes) TransformSchema(r huma.Registry, s *huma.Schema) *huma.Schema {
+	s.Items.Enum = nil
+	for _, scope := range auth.AllScopes {
+		s.Items.Enum = append(s.Items.Enum, scope)
+	}
+	s.Items.PrecomputeMessages()
+	return s
+}
+
 type CreateKeyOutput struct {
 	Body struct {
 		Key string `json:"key" doc:"The raw API key. This is only returned once."`
 	}
 }
 
+func newAPIKey(k *database.APIKey) APIKey {
+	return APIKey{
+		ID:        k.ID,
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		Scopes:    auth.ParseScopes(k.Scopes),
+		CreatedAt: k.CreatedAt,
+		LastUsed:  k.LastUsed,
+		ExpiresAt: k.ExpiresAt,
+	}
+}
+
+// createAPIKey generates a key with the requested name, scopes and expiry,
+// stores it for the owner set on apiKey and returns the raw key.
+func createAPIKey(ctx context.Context, db *gorm.DB, apiKey database.APIKey, input *CreateKeyInput) (*CreateKeyOutput, error) {
+	// A key can only mint keys with a subset of its own scopes
+	if callerKey := middleware.GetAPIKey(ctx); callerKey != nil {
+		if !auth.HasScopes(auth.ParseScopes(callerKey.Scopes), input.Body.Scopes) {
+			return nil, huma.Error403Forbidden("cannot grant scopes the current API key does not have")
+		}
+	}
+
+	// Generate random key
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return nil, huma.Error500InternalServerError("failed to generate key", err)
+	}
+	rawKey := "sk_live_" + hex.EncodeToString(bytes)
+
+	// Hash key
+	hash := sha256.Sum256([]byte(rawKey))
+	apiKey.KeyHash = hex.EncodeToString(hash[:])
+	apiKey.Name = input.Body.Name
+	apiKey.Prefix = rawKey[:12]
+	apiKey.Scopes = auth.EncodeScopes(input.Body.Scopes)
+	if input.Body.ExpiresInDays != nil {
+		expiresAt := time.Now().AddDate(0, 0, *input.Body.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	if err := db.Create(&apiKey).Error; err != nil {
+		return nil, huma.Error500InternalServerError("failed to create key", err)
+	}
+	recordAudit(ctx, db, auditEntry{
+		Action:     auditAPIKeyCreate,
+		TargetType: "api_key",
+		TargetID:   auditID(apiKey.ID),
+		After:      newAPIKey(&apiKey),
+		Details:    orgAuditDetails(apiKey.OrganizationID),
+	})
+
+	resp := &CreateKeyOutput{}
+	resp.Body.Key = rawKey
+	return resp, nil
+}
+
 // RegisterAPIKeys registers the API key management endpoints.
 func RegisterAPIKeys(api huma.API, db *gorm.DB) {
 	// List Keys
@@ -51,6 +127,7 @@ func RegisterAPIKeys(api huma.API, db *gorm.DB) {
 		Tags:        []string{"API Keys"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeKeysRead}},
 		},
 	}, func(ctx context.Context, input *struct{}) (*ListKeysOutput, error) {
 		user := middleware.GetUser(ctx)
@@ -65,14 +142,8 @@ func RegisterAPIKeys(api huma.API, db *gorm.DB) {
 
 		resp := &ListKeysOutput{}
 		resp.Body.Keys = make([]APIKey, len(keys))
-		for i, k := range keys {
-			resp.Body.Keys[i] = APIKey{
-				ID:        k.ID,
-				Name:      k.Name,
-				Prefix:    k.Prefix,
-				CreatedAt: k.CreatedAt,
-				LastUsed:  k.LastUsed,
-			}
+		for i := range keys {
+			resp.Body.Keys[i] = newAPIKey(&keys[i])
 		}
 
 		return resp, nil
@@ -87,42 +158,16 @@ func RegisterAPIKeys(api huma.API, db *gorm.DB) {
 		Tags:        []string{"API Keys"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeKeysWrite}},
 		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
 	}, func(ctx context.Context, input *CreateKeyInput) (*CreateKeyOutput, error) {
 		user := middleware.GetUser(ctx)
 		if user == nil {
 			return nil, huma.Error401Unauthorized("unauthorized")
 		}
 
-		// Generate random key
-		bytes := make([]byte, 32)
-		if _, err := rand.Read(bytes); err != nil {
-			return nil, huma.Error500InternalServerError("failed to generate key", err)
-		}
-		rawKey := "sk_live_" + hex.EncodeToString(bytes)
-
-		// Hash key
-		hash := sha256.Sum256([]byte(rawKey))
-		hashString := hex.EncodeToString(hash[:])
-
-		apiKey := database.APIKey{
-			UserID:  user.ID,
-			KeyHash: hashString,
-			Name:    input.Body.Name,
-			Prefix:  rawKey[:12],
-		}
-
-		if err := db.Create(&apiKey).Error; err != nil {
-			return nil, huma.Error500InternalServerError("failed to create key", err)
-		}
-
-		return &CreateKeyOutput{
-			Body: struct {
-				Key string `json:"key" doc:"The raw API key. This is only returned once."`
-			}{
-				Key: rawKey,
-			},
-		}, nil
+		return createAPIKey(ctx, db, database.APIKey{UserID: user.ID}, input)
 	})
 
 	// Revoke Key
@@ -134,6 +179,7 @@ func RegisterAPIKeys(api huma.API, db *gorm.DB) {
 		Tags:        []string{"API Keys"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeKeysWrite}},
 		},
 	}, func(ctx context.Context, input *struct {
 		ID uint `path:"id"`
@@ -143,14 +189,109 @@ func RegisterAPIKeys(api huma.API, db *gorm.DB) {
 			return nil, huma.Error401Unauthorized("unauthorized")
 		}
 
-		result := db.Where("id = ? AND user_id = ?", input.ID, user.ID).Delete(&database.APIKey{})
-		if result.Error != nil {
-			return nil, huma.Error500InternalServerError("database error", result.Error)
+		return nil, revokeAPIKey(ctx, db, db.Where("id = ? AND user_id = ?", input.ID, user.ID))
+	})
+
+	// List organization keys
+	huma.Register(api, huma.Operation{
+		OperationID: "list-org-api-keys",
+		Method:      http.MethodGet,
+		Path:        "/orgs/{org}/keys",
+		Summary:     "List organization API keys",
+		Description: "List the keys owned by the organization. Requires the organization admin role.",
+		Tags:        []string{"API Keys", "Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeKeysRead}},
+		},
+	}, func(ctx context.Context, input *OrgPathInput) (*ListKeysOutput, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
 		}
-		if result.RowsAffected == 0 {
-			return nil, huma.Error404NotFound("key not found")
+
+		var keys []database.APIKey
+		if err := db.Where("organization_id = ?", org.ID).Find(&keys).Error; err != nil {
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+
+		resp := &ListKeysOutput{}
+		resp.Body.Keys = make([]APIKey, len(keys))
+		for i := range keys {
+			resp.Body.Keys[i] = newAPIKey(&keys[i])
+		}
+		return resp, nil
+	})
+
+	// Create organization key
+	huma.Register(api, huma.Operation{
+		OperationID: "create-org-api-key",
+		Method:      http.MethodPost,
+		Path:        "/orgs/{org}/keys",
+		Summary:     "Create organization API key",
+		Description: "Create a key owned by the organization rather than a user. It keeps working if its creator leaves, and cannot be used for user endpoints such as /me. Requires the organization admin role.",
+		Tags:        []string{"API Keys", "Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeKeysWrite}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *struct {
+		OrgPathInput
+		CreateKeyInput
+	}) (*CreateKeyOutput, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+
+		user := middleware.GetUser(ctx)
+		return createAPIKey(ctx, db, database.APIKey{OrganizationID: &org.ID, CreatedByID: &user.ID}, &input.CreateKeyInput)
+	})
+
+	// Revoke organization key
+	huma.Register(api, huma.Operation{
+		OperationID: "revoke-org-api-key",
+		Method:      http.MethodDelete,
+		Path:        "/orgs/{org}/keys/{id}",
+		Summary:     "Revoke organization API key",
+		Description: "Requires the organization admin role.",
+		Tags:        []string{"API Keys", "Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeKeysWrite}},
+		},
+	}, func(ctx context.Context, input *struct {
+		OrgPathInput
+		ID uint `path:"id"`
+	}) (*struct{}, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, nil
+		return nil, revokeAPIKey(ctx, db, db.Where("id = ? AND organization_id = ?", input.ID, org.ID))
+	})
+}
+
+// revokeAPIKey deletes the key matched by query.
+func revokeAPIKey(ctx context.Context, db *gorm.DB, query *gorm.DB) error {
+	var key database.APIKey
+	if err := query.First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return huma.Error404NotFound("key not found")
+		}
+		return huma.Error500InternalServerError("database error", err)
+	}
+	if err := db.Delete(&key).Error; err != nil {
+		return huma.Error500InternalServerError("database error", err)
+	}
+	recordAudit(ctx, db, auditEntry{
+		Action:     auditAPIKeyRevoke,
+		TargetType: "api_key",
+		TargetID:   auditID(key.ID),
+		Before:     newAPIKey(&key),
+		Details:    orgAuditDetails(key.OrganizationID),
 	})
+	return nil
 }
@@ -5,24 +5,20 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/humatest"
 	"github.com/stretchr/testify/assert"
 	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 func setupTestDB(t *testing.T) *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	if err != nil {
-		t.Fatalf("failed to connect database: %v", err)
-	}
-	db.AutoMigrate(&database.User{}, &database.APIKey{})
-	return db
+	return openTestDB(t)
 }
 
 func TestAPIKeys_CreateAndList(t *testing.T) {
@@ -46,7 +42,8 @@ func TestAPIKeys_CreateAndList(t *testing.T) {
 
 	// Test Create Key with Name
 	createInput := map[string]interface{}{
-		"name": "My Test Key",
+		"name":   "My Test Key",
+		"scopes": []string{"keys:read"},
 	}
 	resp := api.Post("/keys", createInput)
 	assert.Equal(t, http.StatusOK, resp.Code)
@@ -67,9 +64,13 @@ func TestAPIKeys_CreateAndList(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, listResp.Keys, 1)
 	assert.Equal(t, "My Test Key", listResp.Keys[0].Name)
+	assert.Equal(t, []string{"keys:read"}, listResp.Keys[0].Scopes)
+	assert.Nil(t, listResp.Keys[0].ExpiresAt)
 
 	// Test Create Key WITHOUT Name
-	createInputNoName := map[string]interface{}{}
+	createInputNoName := map[string]interface{}{
+		"scopes": []string{"profile:read"},
+	}
 	resp = api.Post("/keys", createInputNoName)
 	assert.Equal(t, http.StatusOK, resp.Code)
 
@@ -123,3 +124,120 @@ func TestAPIKeys_Revoke(t *testing.T) {
 	json.Unmarshal(resp.Body.Bytes(), &listResp)
 	assert.Len(t, listResp.Keys, 0)
 }
+
+func TestAPIKeys_CreateRequiresValidScopes(t *testing.T) {
+	db := setupTestDB(t)
+	_, api := humatest.New(t)
+
+	user := database.User{Email: "scopes@example.com", Name: "Scopes User"}
+	db.Create(&user)
+
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		ctx = huma.WithValue(ctx, middleware.UserContextKey{}, &user)
+		next(ctx)
+	})
+
+	handlers.RegisterAPIKeys(api, db)
+
+	// Missing scopes
+	resp := api.Post("/keys", map[string]interface{}{"name": "No Scopes"})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	// Unknown scope
+	resp = api.Post("/keys", map[string]interface{}{"scopes": []string{"everything"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	// Scopes with TTL
+	resp = api.Post("/keys", map[string]interface{}{
+		"scopes":          []string{"keys:read"},
+		"expires_in_days": 7,
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var key database.APIKey
+	db.First(&key)
+	assert.NotNil(t, key.ExpiresAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 7), *key.ExpiresAt, time.Minute)
+}
+
+func TestAPIKeys_MiddlewareEnforcesScopesAndExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	_, api := humatest.New(t)
+
+	user := database.User{Email: "keyauth@example.com", Name: "Key Auth User"}
+	db.Create(&user)
+
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAPIKeys(api, db)
+	handlers.RegisterUser(api, db)
+
+	createKey := func(raw string, scopes []string, expiresAt *time.Time) database.APIKey {
+		key := database.APIKey{
+			UserID:    user.ID,
+			Name:      raw,
+			Prefix:    raw[:8],
+			KeyHash:   auth.HashKey(raw),
+			Scopes:    auth.EncodeScopes(scopes),
+			ExpiresAt: expiresAt,
+		}
+		db.Create(&key)
+		return key
+	}
+
+	readKey := createKey("sk_live_read", []string{auth.ScopeKeysRead}, nil)
+
+	// Granted scope
+	resp := api.Get("/keys", "X-API-Key: sk_live_read")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Last use is recorded
+	db.First(&readKey, readKey.ID)
+	assert.NotNil(t, readKey.LastUsed)
+
+	// Missing scope
+	resp = api.Post("/keys", map[string]interface{}{"scopes": []string{"keys:read"}}, "X-API-Key: sk_live_read")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Get("/me", "X-API-Key: sk_live_read")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Operations that do not declare an API key scope reject keys
+	resp = api.Put("/me/password", map[string]interface{}{
+		"current_password": "whatever",
+		"new_password":     "whatever123",
+	}, "X-API-Key: sk_live_read")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// A key cannot mint a key with broader scopes than its own
+	createKey("sk_live_write", []string{auth.ScopeKeysRead, auth.ScopeKeysWrite}, nil)
+	resp = api.Post("/keys", map[string]interface{}{"scopes": []string{"users:write"}}, "X-API-Key: sk_live_write")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Post("/keys", map[string]interface{}{"scopes": []string{"keys:read"}}, "X-API-Key: sk_live_write")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Expired key
+	expired := time.Now().Add(-time.Hour)
+	createKey("sk_live_expired", []string{auth.ScopeKeysRead}, &expired)
+	resp = api.Get("/keys", "X-API-Key: sk_live_expired")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), "API key expired")
+}
+
+func TestAPIKeys_CreateRejectsUnknownScope(t *testing.T) {
+	db := setupTestDB(t)
+	_, api := humatest.New(t)
+
+	user := database.User{Email: "scopes@example.com", Name: "Scopes User"}
+	db.Create(&user)
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		ctx = huma.WithValue(ctx, middleware.UserContextKey{}, &user)
+		next(ctx)
+	})
+	handlers.RegisterAPIKeys(api, db)
+
+	resp := api.Post("/keys", map[string]any{"scopes": []string{"everything"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	// Every scope the middleware knows is accepted
+	resp = api.Post("/keys", map[string]any{"scopes": auth.AllScopes})
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/audit"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// Audit actions.
+const (
+	auditLogin          = "auth.login"
+	auditUserRoleUpdate = "user.role_update"
+	auditUserDelete     = "user.delete"
+	auditUserCreate     = "user.create"
+	auditUserUpdate     = "user.update"
+	auditUserDeactivate = "user.deactivate"
+	auditUserReactivate = "user.reactivate"
+	auditAPIKeyCreate   = "api_key.create"
+	auditAPIKeyRevoke   = "api_key.revoke"
+	auditSettingsUpdate = "settings.update"
+	auditLockoutClear   = "lockout.clear"
+
+	auditOrgCreate           = "org.create"
+	auditOrgUpdate           = "org.update"
+	auditOrgDelete           = "org.delete"
+	auditOrgMemberRole       = "org.member_role_update"
+	auditOrgMemberAdd        = "org.member_add"
+	auditOrgMemberRemove     = "org.member_remove"
+	auditOrgInvitationCreate = "org.invitation_create"
+	auditOrgInvitationRevoke = "org.invitation_revoke"
+	auditOrgInvitationAccept = "org.invitation_accept"
+
+	auditRoleCreate = "role.create"
+	auditRoleUpdate = "role.update"
+	auditRoleDelete = "role.delete"
+
+	auditInvitationCreate = "invitation.create"
+	auditInvitationResend = "invitation.resend"
+	auditInvitationRevoke = "invitation.revoke"
+	auditInvitationAccept = "invitation.accept"
+
+	auditImpersonationStart = "impersonation.start"
+
+	auditServiceAccountCreate = "service_account.create"
+	auditServiceAccountUpdate = "service_account.update"
+	auditServiceAccountDelete = "service_account.delete"
+
+	auditSCIMTokenCreate = "scim_token.create"
+	auditSCIMTokenRevoke = "scim_token.revoke"
+
+	auditBackupDownload = "backup.download"
+
+	auditOIDCProviderCreate = "oidc_provider.create"
+	auditOIDCProviderUpdate = "oidc_provider.update"
+	auditOIDCProviderDelete = "oidc_provider.delete"
+)
+
+// Audit outcomes.
+const (
+	auditSuccess     = audit.Success
+	auditFailure     = audit.Failure
+	auditMFARequired = audit.MFARequired
+)
+
+// auditEntry describes an action to record in the audit log.
+type auditEntry = audit.Entry
+
+// recordAudit writes an audit event for the current request. The client,
+// request ID and, unless the entry names one, the actor come from the context.
+func recordAudit(ctx context.Context, db *gorm.DB, entry auditEntry) {
+	if entry.Actor == nil {
+		entry.Actor = middleware.GetUser(ctx)
+	}
+	if impersonator := middleware.GetImpersonator(ctx); impersonator != nil {
+		// Keep the admin behind an impersonated action on record
+		if entry.Details == nil {
+			entry.Details = map[string]any{}
+		}
+		entry.Details["impersonator_id"] = impersonator.ID
+	}
+	if token := middleware.GetSCIMToken(ctx); token != nil {
+		// SCIM requests have no user; name the token that made them
+		if entry.Details == nil {
+			entry.Details = map[string]any{}
+		}
+		entry.Details["scim_token_id"] = token.ID
+	}
+
+	client := middleware.GetClientInfo(ctx)
+	entry.IPAddress = client.IPAddress
+	entry.UserAgent = client.UserAgent
+	entry.RequestID = client.RequestID
+	audit.Record(ctx, db, entry)
+}
+
+// recordLoginAudit records a login attempt. user is nil or unsaved when the
+// account is unknown.
+func recordLoginAudit(ctx context.Context, db *gorm.DB, method, email string, user *database.User, resp *CallbackOutput, err error) {
+	entry := auditEntry{
+		Action:  auditLogin,
+		Actor:   &database.User{}, // Anonymous until the login succeeds
+		Details: map[string]any{"method": method},
+	}
+	if email != "" {
+		entry.Details["email"] = email
+	}
+	if user != nil && user.ID != 0 {
+		entry.TargetType = "user"
+		entry.TargetID = auditID(user.ID)
+	}
+
+	switch {
+	case err != nil:
+		entry.Outcome = auditFailure
+		entry.Details["reason"] = err.Error()
+	case resp != nil && resp.Body.MFARequired:
+		entry.Outcome = auditMFARequired
+	default:
+		entry.Actor = user
+	}
+	recordAudit(ctx, db, entry)
+}
+
+// orgAuditDetails names the organization an action happened in, if any.
+func orgAuditDetails(orgID *uint) map[string]any {
+	if orgID == nil {
+		return nil
+	}
+	return map[string]any{"organization_id": *orgID}
+}
+
+// auditID formats a record ID as an audit target ID.
+func auditID(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// AuditChange is the value of a field before and after an action.
+type AuditChange = audit.Change
+
+// AuditEventInfo represents an audit event.
+type AuditEventInfo struct {
+	ID         uint                   `json:"id"`
+	CreatedAt  time.Time              `json:"created_at"`
+	ActorID    *uint                  `json:"actor_id,omitempty" doc:"User who performed the action; absent for anonymous requests"`
+	ActorEmail string                 `json:"actor_email,omitempty"`
+	Action     string                 `json:"action" doc:"e.g. auth.login, user.role_update, api_key.create"`
+	Outcome    string                 `json:"outcome" enum:"success,failure,mfa_required"`
+	TargetType string                 `json:"target_type,omitempty" doc:"Kind of record acted on, e.g. user, api_key, settings"`
+	TargetID   string                 `json:"target_id,omitempty"`
+	IPAddress  string                 `json:"ip_address,omitempty"`
+	UserAgent  string                 `json:"user_agent,omitempty"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Changes    map[string]AuditChange `json:"changes,omitempty" doc:"Fields changed by the action"`
+	Details    map[string]any         `json:"details,omitempty" doc:"Action-specific context, such as the login method or failure reason"`
+}
+
+func newAuditEventInfo(event *database.AuditEvent) AuditEventInfo {
+	info := AuditEventInfo{
+		ID:         event.ID,
+		CreatedAt:  event.CreatedAt,
+		ActorID:    event.ActorID,
+		ActorEmail: event.ActorEmail,
+		Action:     event.Action,
+		Outcome:    event.Outcome,
+		TargetType: event.TargetType,
+		TargetID:   event.TargetID,
+		IPAddress:  event.IPAddress,
+		UserAgent:  event.UserAgent,
+		RequestID:  event.RequestID,
+	}
+	if event.Changes != "" {
+		json.Unmarshal([]byte(event.Changes), &info.Changes)
+	}
+	if event.Details != "" {
+		json.Unmarshal([]byte(event.Details), &info.Details)
+	}
+	return info
+}
+
+// AuditFilter selects audit events. Empty fields match everything.
+type AuditFilter struct {
+	ActorID    uint      `query:"actor_id" doc:"Only events performed by this user"`
+	Action     string    `query:"action" doc:"Exact action, or a prefix ending in a dot such as 'user.'"`
+	Outcome    string    `query:"outcome" enum:"success,failure,mfa_required"`
+	TargetType string    `query:"target_type"`
+	TargetID   string    `query:"target_id"`
+	Since      time.Time `query:"since" doc:"Only events at or after this time (RFC 3339)"`
+	Until      time.Time `query:"until" doc:"Only events before this time (RFC 3339)"`
+}
+
+func (f *AuditFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.ActorID != 0 {
+		query = query.Where("actor_id = ?", f.ActorID)
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		query = query.Where(database.Like("action"), database.EscapeLike(f.Action)+"%")
+	} else if f.Action != "" {
+		query = query.Where("action = ?", f.Action)
+	}
+	if f.Outcome != "" {
+		query = query.Where("outcome = ?", f.Outcome)
+	}
+	if f.TargetType != "" {
+		query = query.Where("target_type = ?", f.TargetType)
+	}
+	if f.TargetID != "" {
+		query = query.Where("target_id = ?", f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		query = query.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		query = query.Where("created_at < ?", f.Until)
+	}
+	return query
+}
+
+// ListAuditEventsInput represents the request to list audit events.
+type ListAuditEventsInput struct {
+	AuditFilter
+	Limit  int `query:"limit" default:"50" minimum:"1" maximum:"500" doc:"Maximum number of events to return"`
+	Offset int `query:"offset" default:"0" minimum:"0" doc:"Offset for pagination"`
+}
+
+// ListAuditEventsOutput represents the paginated audit event list response.
+type ListAuditEventsOutput struct {
+	Body struct {
+		Events []AuditEventInfo `json:"events"`
+		Total  int64            `json:"total"`
+	}
+}
+
+// auditExportBatchSize is how many events the export reads at a time.
+const auditExportBatchSize = 500
+
+// RegisterAudit registers the admin endpoints for the audit log.
+func RegisterAudit(api huma.API, db *gorm.DB) {
+	// GET /api/admin/audit - List audit events
+	huma.Register(api, huma.Operation{
+		OperationID: "list-audit-events",
+		Method:      http.MethodGet,
+		Path:        "/admin/audit",
+		Summary:     "List audit events",
+		Description: "List audit events, most recent first. Requires the audit:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeAuditRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionAuditRead},
+	}, func(ctx context.Context, input *ListAuditEventsInput) (*ListAuditEventsOutput, error) {
+		query := input.apply(database.Replica(db).Model(&database.AuditEvent{}))
+
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to count audit events", err)
+		}
+
+		var events []database.AuditEvent
+		if err := query.Order("id DESC").Limit(input.Limit).Offset(input.Offset).Find(&events).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch audit events", err)
+		}
+
+		resp := &ListAuditEventsOutput{}
+		resp.Body.Events = make([]AuditEventInfo, len(events))
+		for i := range events {
+			resp.Body.Events[i] = newAuditEventInfo(&events[i])
+		}
+		resp.Body.Total = total
+		return resp, nil
+	})
+
+	// GET /api/admin/audit/export - Export audit events as NDJSON
+	huma.Register(api, huma.Operation{
+		OperationID: "export-audit-events",
+		Method:      http.MethodGet,
+		Path:        "/admin/audit/export",
+		Summary:     "Export audit events",
+		Description: "Download the matching audit events as newline-delimited JSON, oldest first. Requires the audit:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeAuditRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionAuditRead},
+		Responses: map[string]*huma.Response{
+			"200": {
+				Description: "One audit event per line",
+				Content:     map[string]*huma.MediaType{"application/x-ndjson": {}},
+			},
+		},
+	}, func(ctx context.Context, input *AuditFilter) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(hctx huma.Context) {
+				hctx.SetHeader("Content-Type", "application/x-ndjson")
+				hctx.SetHeader("Content-Disposition", `attachment; filename="audit.ndjson"`)
+				enc := json.NewEncoder(hctx.BodyWriter())
+
+				var events []database.AuditEvent
+				err := input.apply(database.Replica(db).WithContext(ctx)).FindInBatches(&events, auditExportBatchSize, func(tx *gorm.DB, batch int) error {
+					for i := range events {
+						if err := enc.Encode(newAuditEventInfo(&events[i])); err != nil {
+							return err
+						}
+					}
+					return nil
+				}).Error
+				if err != nil {
+					logging.FromContext(ctx).Error("audit export failed", logging.Error, err)
+				}
+			},
+		}, nil
+	})
+}
@@ -0,0 +1,154 @@
+package handlers_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+func setupAuditTest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterAdmin(api, db)
+	handlers.RegisterAPIKeys(api, db)
+	handlers.RegisterUsers(api, db)
+	handlers.RegisterAudit(api, db)
+	return db, api
+}
+
+type auditList struct {
+	Events []handlers.AuditEventInfo `json:"events"`
+	Total  int64                     `json:"total"`
+}
+
+func listAudit(t *testing.T, api humatest.TestAPI, token, query string) auditList {
+	t.Helper()
+	resp := api.Get("/admin/audit"+query, "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var list auditList
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	return list
+}
+
+func TestAuditLog(t *testing.T) {
+	db, api := setupAuditTest(t)
+	api.Post("/auth/signup", map[string]any{"email": "admin@example.com", "password": "password123", "name": "Admin"})
+	var admin database.User
+	db.Where("email = ?", "admin@example.com").First(&admin)
+	user := database.User{Email: "user@example.com", Name: "User", Role: database.RoleUser}
+	db.Create(&user)
+
+	// Logins are recorded whether or not they succeed
+	api.Post("/auth/login", map[string]any{"email": "admin@example.com", "password": "wrong-password"},
+		"User-Agent: audit-test", "X-Request-Id: req-123")
+	resp := api.Post("/auth/login", map[string]any{"email": "admin@example.com", "password": "password123"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tokens struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tokens))
+	auth := "Authorization: Bearer " + tokens.Token
+
+	// Admin actions
+	require.Equal(t, http.StatusOK, api.Put(fmt.Sprintf("/admin/users/%d", user.ID), map[string]any{"role": "admin"}, auth).Code)
+	require.Equal(t, http.StatusOK, api.Put("/admin/settings", map[string]any{"registration_enabled": false}, auth).Code)
+	require.Equal(t, http.StatusOK, api.Post("/keys", map[string]any{"name": "ci", "scopes": []string{"keys:read"}}, auth).Code)
+	var key database.APIKey
+	db.First(&key)
+	require.Equal(t, http.StatusNoContent, api.Delete(fmt.Sprintf("/keys/%d", key.ID), auth).Code)
+	require.Equal(t, http.StatusNoContent, api.Delete(fmt.Sprintf("/admin/users/%d", user.ID), auth).Code)
+
+	failed := listAudit(t, api, tokens.Token, "?action=auth.login&outcome=failure")
+	require.Len(t, failed.Events, 1)
+	event := failed.Events[0]
+	assert.Nil(t, event.ActorID)
+	assert.Equal(t, "user", event.TargetType)
+	assert.Equal(t, fmt.Sprint(admin.ID), event.TargetID)
+	assert.Equal(t, "audit-test", event.UserAgent)
+	assert.Equal(t, "req-123", event.RequestID)
+	assert.Equal(t, "password", event.Details["method"])
+	assert.Equal(t, "invalid email or password", event.Details["reason"])
+
+	succeeded := listAudit(t, api, tokens.Token, "?action=auth.login&outcome=success")
+	require.Len(t, succeeded.Events, 1)
+	require.NotNil(t, succeeded.Events[0].ActorID)
+	assert.Equal(t, admin.ID, *succeeded.Events[0].ActorID)
+
+	roles := listAudit(t, api, tokens.Token, "?action=user.role_update")
+	require.Len(t, roles.Events, 1)
+	assert.Equal(t, admin.Email, roles.Events[0].ActorEmail)
+	assert.Equal(t, handlers.AuditChange{Before: "user", After: "admin"}, roles.Events[0].Changes["role"])
+
+	settings := listAudit(t, api, tokens.Token, "?target_type=settings")
+	require.Len(t, settings.Events, 1)
+	assert.Equal(t, map[string]handlers.AuditChange{"registration_enabled": {Before: true, After: false}}, settings.Events[0].Changes)
+
+	keys := listAudit(t, api, tokens.Token, "?action=api_key.")
+	require.Len(t, keys.Events, 2)
+	assert.Equal(t, "api_key.revoke", keys.Events[0].Action)
+	assert.Equal(t, "ci", keys.Events[0].Changes["name"].Before)
+	assert.Equal(t, "api_key.create", keys.Events[1].Action)
+
+	// Every event about the deleted user, newest first
+	target := listAudit(t, api, tokens.Token, fmt.Sprintf("?target_type=user&target_id=%d", user.ID))
+	require.Len(t, target.Events, 2)
+	assert.Equal(t, "user.delete", target.Events[0].Action)
+	assert.Equal(t, "user@example.com", target.Events[0].Changes["email"].Before)
+
+	// Pagination
+	all := listAudit(t, api, tokens.Token, "")
+	assert.EqualValues(t, 7, all.Total)
+	page := listAudit(t, api, tokens.Token, "?limit=3&offset=3")
+	assert.EqualValues(t, 7, page.Total)
+	require.Len(t, page.Events, 3)
+	assert.Equal(t, all.Events[3].ID, page.Events[0].ID)
+}
+
+func TestAuditExport(t *testing.T) {
+	db, api := setupAuditTest(t)
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	user := database.User{Email: "user@example.com", Name: "User", Role: database.RoleUser}
+	db.Create(&user)
+
+	for range 3 {
+		api.Post("/auth/login", map[string]any{"email": "nobody@example.com", "password": "password123"})
+	}
+	adminToken := issueToken(t, db, admin.ID)
+	api.Put("/admin/settings", map[string]any{"registration_enabled": false}, "Authorization: Bearer "+adminToken)
+
+	resp := api.Get("/admin/audit/export?action=auth.login", "Authorization: Bearer "+adminToken)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/x-ndjson", resp.Header().Get("Content-Type"))
+
+	var lines int
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event handlers.AuditEventInfo
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, "auth.login", event.Action)
+		assert.Equal(t, "nobody@example.com", event.Details["email"])
+		lines++
+	}
+	assert.Equal(t, 3, lines)
+
+	// Non-admins cannot read the audit log
+	resp = api.Get("/admin/audit", "Authorization: Bearer "+issueToken(t, db, user.ID))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Get("/admin/audit/export", "Authorization: Bearer "+issueToken(t, db, user.ID))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
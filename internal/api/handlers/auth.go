@@ -2,129 +2,740 @@ package handlers
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/mail"
+	"github.com/techsquidtv/inkling/internal/middleware"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type LoginOutput struct {
-	Status   int    `json:"-"`
-	Location string `header:"Location"`
+	Status    int           `json:"-"`
+	Location  string        `header:"Location"`
+	SetCookie []http.Cookie `header:"Set-Cookie"`
 }
 
 type CallbackOutput struct {
+	SetCookie []http.Cookie `header:"Set-Cookie"`
+	Body      struct {
+		Token                string `json:"token,omitempty" doc:"Short-lived access token"`
+		RefreshToken         string `json:"refresh_token,omitempty" doc:"Single-use token for obtaining a new access token"`
+		ExpiresIn            int    `json:"expires_in,omitempty" doc:"Access token lifetime in seconds"`
+		ReturnTo             string `json:"return_to,omitempty" doc:"Where to send the user after an OIDC login"`
+		MFARequired          bool   `json:"mfa_required,omitempty" doc:"Set instead of the tokens when a second factor is needed"`
+		MFAToken             string `json:"mfa_token,omitempty" doc:"Pass to /auth/mfa/verify with a TOTP or recovery code"`
+		VerificationRequired bool   `json:"verification_required,omitempty" doc:"Set instead of the tokens when the email address must be verified before logging in"`
+	}
+}
+
+// LoginInput represents the request to start an OIDC login.
+type LoginInput struct {
+	ReturnTo   string `query:"return_to" doc:"Relative path or allow-listed URL to return to after login"`
+	Invitation string `query:"invitation" doc:"Invitation token, lets an invited user register while registration is disabled"`
+}
+
+// CallbackInput represents the redirect back from the OIDC provider.
+type CallbackInput struct {
+	Code        string `query:"code"`
+	State       string `query:"state"`
+	StateCookie string `cookie:"inkling_oidc_state"`
+}
+
+// MFAVerifyInput represents the second step of a login for users with MFA.
+type MFAVerifyInput struct {
 	Body struct {
-		Token string `json:"token"`
+		MFAToken string `json:"mfa_token" required:"true" doc:"Token returned by the first login step"`
+		Code     string `json:"code" required:"true" doc:"TOTP code or recovery code"`
 	}
 }
 
-// RegisterAuth registers the login and callback handlers.
-func RegisterAuth(api huma.API, db *gorm.DB, oidc auth.Provider) {
-	// Login endpoint - redirects to OIDC provider
-	huma.Register(api, huma.Operation{
-		OperationID: "login",
-		Method:      http.MethodGet,
-		Path:        "/auth/login",
-		Summary:     "Login with OIDC",
-		Tags:        []string{"Auth", "public"},
-	}, func(ctx context.Context, input *struct{}) (*LoginOutput, error) {
-		if oidc == nil {
-			return nil, huma.Error501NotImplemented("OIDC is not configured")
-		}
-		url := oidc.AuthCodeURL("state") // In production, use a real state
-		return &LoginOutput{
-			Status:   http.StatusFound,
-			Location: url,
-		}, nil
+// SessionCookieInput carries the refresh cookie of a browser session and the
+// CSRF token that must accompany it.
+type SessionCookieInput struct {
+	RefreshCookie string `cookie:"inkling_refresh"`
+	CSRFCookie    string `cookie:"inkling_csrf"`
+	CSRFToken     string `header:"X-CSRF-Token" doc:"Value of the inkling_csrf cookie, required when the refresh token is sent as a cookie"`
+}
+
+// cookieRefreshToken returns the refresh token from the cookie, or an empty
+// string when cookie sessions are off or the cookie is not set.
+func (in *SessionCookieInput) cookieRefreshToken() (string, error) {
+	if !auth.SessionCookiesEnabled() || in.RefreshCookie == "" {
+		return "", nil
+	}
+	if !auth.ValidCSRF(in.CSRFCookie, in.CSRFToken) {
+		return "", huma.Error403Forbidden("missing or invalid CSRF token")
+	}
+	return in.RefreshCookie, nil
+}
+
+// RefreshInput represents the request to rotate a refresh token.
+type RefreshInput struct {
+	SessionCookieInput
+	Body *struct {
+		RefreshToken string `json:"refresh_token" required:"true" doc:"Refresh token from a previous login or refresh"`
+	} `doc:"Optional when the refresh token is sent as a cookie"`
+}
+
+// LogoutInput represents the request to end a session.
+type LogoutInput struct {
+	SessionCookieInput
+	Body *struct {
+		RefreshToken string `json:"refresh_token,omitempty" doc:"Refresh token of the session to end, if not authenticated with an access token"`
+	}
+}
+
+// LogoutOutput clears the session cookies of a browser session.
+type LogoutOutput struct {
+	SetCookie []http.Cookie `header:"Set-Cookie"`
+}
+
+// newSessionOutput starts a session for the user and returns its tokens.
+func newSessionOutput(ctx context.Context, db *gorm.DB, user *database.User) (*CallbackOutput, error) {
+	if err := checkCanSignIn(user); err != nil {
+		return nil, err
+	}
+	client := middleware.GetClientInfo(ctx)
+	pair, err := auth.CreateSession(db, user.ID, auth.SessionMeta{
+		UserAgent: client.UserAgent,
+		IPAddress: client.IPAddress,
 	})
+	if errors.Is(err, auth.ErrAccountDisabled) {
+		return nil, huma.Error403Forbidden(err.Error())
+	}
+	if err != nil {
+		return nil, huma.Error500InternalServerError("failed to generate token", err)
+	}
+	return tokenPairOutput(ctx, pair)
+}
 
-	// Callback endpoint - handles the redirect from OIDC provider
-	huma.Register(api, huma.Operation{
-		OperationID: "callback",
-		Method:      http.MethodGet,
-		Path:        "/auth/callback",
-		Summary:     "OIDC Callback",
-		Tags:        []string{"Auth", "public"},
-	}, func(ctx context.Context, input *struct {
-		Code  string `query:"code"`
-		State string `query:"state"`
-	}) (*CallbackOutput, error) {
-		if oidc == nil {
-			return nil, huma.Error501NotImplemented("OIDC is not configured")
+// checkCanSignIn refuses accounts that cannot start an interactive session.
+func checkCanSignIn(user *database.User) error {
+	if user.ServiceAccount {
+		return huma.Error403Forbidden("service accounts cannot log in interactively")
+	}
+	if user.DisabledAt != nil {
+		return huma.Error403Forbidden("account is deactivated")
+	}
+	return nil
+}
+
+// completeLogin finishes the first login step. Users with MFA get a challenge
+// to answer at /auth/mfa/verify; everyone else gets a session.
+func completeLogin(ctx context.Context, db *gorm.DB, user *database.User, returnTo string) (*CallbackOutput, error) {
+	if err := checkCanSignIn(user); err != nil {
+		return nil, err
+	}
+	if auth.HasMFA(db, user.ID) {
+		token, err := auth.CreateMFAChallenge(db, user.ID, returnTo)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to start MFA challenge", err)
 		}
-		// 1. Exchange code for token
-		oauth2Token, err := oidc.Exchange(ctx, input.Code)
+		resp := &CallbackOutput{}
+		resp.Body.MFARequired = true
+		resp.Body.MFAToken = token
+		return resp, nil
+	}
+
+	resp, err := newSessionOutput(ctx, db, user)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.ReturnTo = returnTo
+	return resp, nil
+}
+
+// checkLoginThrottle refuses the attempt with 429 and Retry-After while the
+// client IP or account is locked out.
+func checkLoginThrottle(ctx context.Context, db *gorm.DB, account string) error {
+	wait, err := auth.CheckLoginThrottle(ctx, db, middleware.GetClientInfo(ctx).IPAddress, account)
+	if err != nil {
+		return huma.Error500InternalServerError("database error", err)
+	}
+	if wait <= 0 {
+		return nil
+	}
+	return tooManyRequests("too many failed login attempts, try again later", wait)
+}
+
+// tooManyRequests returns a 429 error telling the client to retry after wait.
+func tooManyRequests(msg string, wait time.Duration) error {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	return huma.ErrorWithHeaders(
+		huma.Error429TooManyRequests(msg),
+		http.Header{"Retry-After": {strconv.Itoa(retryAfter)}},
+	)
+}
+
+// recordLoginFailure counts a failed attempt towards the lockouts.
+func recordLoginFailure(ctx context.Context, db *gorm.DB, account string) {
+	if err := auth.RecordLoginFailure(ctx, db, middleware.GetClientInfo(ctx).IPAddress, account); err != nil {
+		logging.FromContext(ctx).Error("failed to record login failure", logging.Error, err)
+	}
+}
+
+// loginStateCookie builds the cookie binding an OIDC login to the browser. A
+// negative maxAge clears it.
+func loginStateCookie(ctx context.Context, state string, maxAge int) http.Cookie {
+	return http.Cookie{
+		Name:     auth.LoginStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   middleware.GetClientInfo(ctx).Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// tokenPairOutput returns the tokens in the body and, when cookie sessions
+// are on, in the session cookies as well.
+func tokenPairOutput(ctx context.Context, pair *auth.TokenPair) (*CallbackOutput, error) {
+	resp := &CallbackOutput{}
+	resp.Body.Token = pair.AccessToken
+	resp.Body.RefreshToken = pair.RefreshToken
+	resp.Body.ExpiresIn = pair.ExpiresIn
+	if auth.SessionCookiesEnabled() {
+		csrfToken, err := auth.NewCSRFToken()
 		if err != nil {
-			return nil, huma.Error401Unauthorized("failed to exchange token", err)
+			return nil, huma.Error500InternalServerError("failed to generate CSRF token", err)
 		}
+		refreshMaxAge := int(auth.RefreshTokenTTL.Seconds())
+		resp.SetCookie = []http.Cookie{
+			sessionCookie(ctx, auth.SessionCookie, pair.AccessToken, pair.ExpiresIn, true),
+			sessionCookie(ctx, auth.RefreshCookie, pair.RefreshToken, refreshMaxAge, true),
+			sessionCookie(ctx, auth.CSRFCookie, csrfToken, refreshMaxAge, false),
+		}
+	}
+	return resp, nil
+}
 
-		// 2. Extract and verify ID Token
-		rawIDToken, ok := oauth2Token.Extra("id_token").(string)
-		if !ok {
-			return nil, huma.Error401Unauthorized("no id_token in response")
+// sessionCookie builds a cookie of a browser session. Only the CSRF cookie is
+// readable by scripts. A negative maxAge clears it.
+func sessionCookie(ctx context.Context, name, value string, maxAge int, httpOnly bool) http.Cookie {
+	return http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   middleware.GetClientInfo(ctx).Secure,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// ProviderLoginInput represents the request to start a login with a named provider.
+type ProviderLoginInput struct {
+	Provider string `path:"provider" doc:"Slug of the OIDC provider"`
+	LoginInput
+}
+
+// ProviderCallbackInput represents the redirect back from a named provider.
+type ProviderCallbackInput struct {
+	Provider string `path:"provider" doc:"Slug of the OIDC provider"`
+	CallbackInput
+}
+
+// AuthProvider is an OIDC provider users can sign in with.
+type AuthProvider struct {
+	Slug        string `json:"slug" doc:"Identifier used in /auth/{slug}/login"`
+	DisplayName string `json:"display_name" doc:"Name to show on the login button"`
+}
+
+// ListAuthProvidersOutput represents the response listing sign-in providers.
+type ListAuthProvidersOutput struct {
+	Body struct {
+		Providers []AuthProvider `json:"providers"`
+	}
+}
+
+// oidcLogin redirects the browser to the provider's authorization endpoint.
+func oidcLogin(ctx context.Context, db *gorm.DB, slug string, provider auth.Provider, input *LoginInput) (*LoginOutput, error) {
+	returnTo, err := auth.ValidateReturnTo(input.ReturnTo)
+	if err != nil {
+		return nil, huma.Error400BadRequest("return_to is not allowed")
+	}
+
+	var login *database.PendingLogin
+	if input.Invitation != "" {
+		login, err = auth.StartInvitedLogin(db, slug, returnTo, input.Invitation)
+	} else {
+		login, err = auth.StartLogin(db, slug, returnTo)
+	}
+	if err != nil {
+		return nil, huma.Error500InternalServerError("failed to start login", err)
+	}
+
+	return &LoginOutput{
+		Status:    http.StatusFound,
+		Location:  provider.AuthCodeURL(login.State, login.Nonce, login.CodeVerifier),
+		SetCookie: []http.Cookie{loginStateCookie(ctx, login.State, int(auth.PendingLoginTTL.Seconds()))},
+	}, nil
+}
+
+// oidcCallback completes a login with the provider and starts a session for
+// the user the (provider, sub) identity belongs to.
+func oidcCallback(ctx context.Context, db *gorm.DB, slug string, provider auth.Provider, input *CallbackInput) (resp *CallbackOutput, err error) {
+	var claims oidcClaims
+	var user *database.User
+	defer func() { recordLoginAudit(ctx, db, "oidc", claims.Email, user, resp, err) }()
+
+	// 1. Match the callback to the login attempt this browser started
+	login, err := auth.ConsumeLogin(db, slug, input.State, input.StateCookie)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidLoginState) {
+			return nil, huma.Error400BadRequest("invalid or expired login state")
 		}
+		return nil, huma.Error500InternalServerError("database error", err)
+	}
 
-		idToken, err := oidc.VerifyToken(ctx, rawIDToken)
+	// 2. Exchange code for token
+	oauth2Token, err := provider.Exchange(ctx, input.Code, login.CodeVerifier)
+	if err != nil {
+		return nil, huma.Error401Unauthorized("failed to exchange token", err)
+	}
+
+	// 3. Extract and verify ID Token
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return nil, huma.Error401Unauthorized("no id_token in response")
+	}
+
+	idToken, err := provider.VerifyToken(ctx, rawIDToken)
+	if err != nil {
+		return nil, huma.Error401Unauthorized("failed to verify id_token", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce()), []byte(login.Nonce)) != 1 {
+		return nil, huma.Error401Unauthorized("id_token nonce mismatch")
+	}
+
+	// 4. Get user info from claims
+	var rawClaims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, huma.Error401Unauthorized("failed to parse claims", err)
+	}
+	if err := idToken.Claims(&rawClaims); err != nil {
+		return nil, huma.Error401Unauthorized("failed to parse claims", err)
+	}
+
+	// 5. Find, link or provision the user the identity belongs to
+	user, err = resolveIdentityUser(ctx, db, slug, &claims, login)
+	if err != nil {
+		return nil, err
+	}
+
+	// The provider vouches for the address, so it counts as verified
+	if user.EmailVerifiedAt == nil && claims.emailVerified() && strings.EqualFold(user.Email, claims.Email) {
+		now := time.Now()
+		if err := db.Model(user).Update("email_verified_at", now).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to update user", err)
+		}
+		user.EmailVerifiedAt = &now
+	}
+
+	// Otherwise the same rule as for password logins applies
+	if user.EmailVerifiedAt == nil {
+		required, err := database.RequireEmailVerification.Get(db)
 		if err != nil {
-			return nil, huma.Error401Unauthorized("failed to verify id_token", err)
+			return nil, huma.Error500InternalServerError("failed to load settings", err)
 		}
+		if required {
+			return nil, huma.Error403Forbidden("email address is not verified")
+		}
+	}
 
-		// 3. Get user info from claims
-		var claims struct {
-			Email string `json:"email"`
-			Name  string `json:"name"`
-			Sub   string `json:"sub"`
+	// 6. Apply profile and role changes made at the provider. Linking an
+	// identity to an existing account leaves the account as it is.
+	if login.LinkUserID == nil {
+		if err := syncIdentityProfile(ctx, db, user, &claims, slug); err != nil {
+			return nil, err
 		}
-		if err := idToken.Claims(&claims); err != nil {
-			return nil, huma.Error401Unauthorized("failed to parse claims", err)
+		mappings, defaultRole, err := auth.ProviderRoleMappings(db, slug)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to load role mappings", err)
+		}
+		if role, ok := auth.ClaimsRole(mappings, defaultRole, rawClaims); ok {
+			if err := syncIdentityRole(ctx, db, user, role, slug); err != nil {
+				return nil, err
+			}
 		}
+	}
+
+	// 7. Start a session, or ask for the second factor
+	resp, err = completeLogin(ctx, db, user, login.ReturnTo)
+	if err != nil {
+		return nil, err
+	}
+	resp.SetCookie = append(resp.SetCookie, loginStateCookie(ctx, "", -1))
+	return resp, nil
+}
 
-		// 4. Provision or get user
+// oidcClaims are the ID token claims used to identify and provision users.
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"`
+	Name          string `json:"name"`
+	Sub           string `json:"sub"`
+}
+
+// emailVerified reports whether the provider vouches for the email. Some
+// providers send the claim as a string.
+func (c *oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// syncIdentityProfile copies the name and verified email the identity provider
+// reports onto the user, so changes made there apply on the next login. Only
+// the identity the account was created with may change its email, so linking
+// another provider cannot take over the account's address. An email that
+// belongs to another user is left alone.
+func syncIdentityProfile(ctx context.Context, db *gorm.DB, user *database.User, claims *oidcClaims, source string) error {
+	before := map[string]any{"name": user.Name, "email": user.Email}
+	changed := false
+	if claims.Name != "" && claims.Name != user.Name {
+		user.Name = claims.Name
+		changed = true
+	}
+	primary := user.Provider == source && user.InternalID != nil && *user.InternalID == claims.Sub
+	if primary && claims.Email != "" && claims.emailVerified() && !strings.EqualFold(claims.Email, user.Email) {
+		var taken int64
+		db.Model(&database.User{}).Where("email = ? AND id <> ?", claims.Email, user.ID).Count(&taken)
+		if taken > 0 {
+			logging.FromContext(ctx).Warn("not updating email that belongs to another user", logging.UserID, user.ID, "provider", source)
+		} else {
+			now := time.Now()
+			user.Email = claims.Email
+			user.EmailVerifiedAt = &now
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := db.Save(user).Error; err != nil {
+		return huma.Error500InternalServerError("failed to update user", err)
+	}
+	recordAudit(ctx, db, auditEntry{
+		Action:     auditUserUpdate,
+		Actor:      &database.User{}, // Changed by the identity provider, not an admin
+		TargetType: "user",
+		TargetID:   auditID(user.ID),
+		Before:     before,
+		After:      map[string]any{"name": user.Name, "email": user.Email},
+		Details:    map[string]any{"source": source},
+	})
+	return nil
+}
+
+// syncIdentityRole gives the user the role their identity provider maps them
+// to, unless an admin locked their role. The last active admin is never
+// demoted.
+func syncIdentityRole(ctx context.Context, db *gorm.DB, user *database.User, role, source string) error {
+	if user.RoleLocked || role == user.Role {
+		return nil
+	}
+	if err := requireExistingRole(db, role); err != nil {
+		logging.FromContext(ctx).Warn("identity provider is mapped to an unknown role", logging.UserID, user.ID, "provider", source, "role", role)
+		return nil
+	}
+	if user.DisabledAt == nil && isAdminRole(db, user.Role) && !isAdminRole(db, role) && countActiveAdmins(db) <= 1 {
+		logging.FromContext(ctx).Warn("not demoting the last admin", logging.UserID, user.ID, "provider", source, "role", role)
+		return nil
+	}
+
+	previousRole := user.Role
+	user.Role = role
+	if err := db.Save(user).Error; err != nil {
+		return huma.Error500InternalServerError("failed to update user", err)
+	}
+	recordAudit(ctx, db, auditEntry{
+		Action:     auditUserRoleUpdate,
+		Actor:      &database.User{}, // Changed by the identity provider, not an admin
+		TargetType: "user",
+		TargetID:   auditID(user.ID),
+		Before:     map[string]any{"role": previousRole},
+		After:      map[string]any{"role": role},
+		Details:    map[string]any{"source": source},
+	})
+
+	// Permissions are looked up on every request, so the new role applies
+	// straight away; like a role change by an admin, it also signs the user
+	// out everywhere else
+	if err := auth.RevokeUserSessions(db, user.ID); err != nil {
+		return huma.Error500InternalServerError("failed to revoke user sessions", err)
+	}
+	logging.FromContext(ctx).Info("role updated by identity provider", logging.UserID, user.ID, "provider", source, "role", role)
+	return nil
+}
+
+// requireEmailLink refuses to link a new identity to the existing account with
+// the same email unless the admin allowed it. Directory accounts cannot be
+// linked from the profile, so the LDAP settings decide for them.
+func requireEmailLink(db *gorm.DB, slug string, claims *oidcClaims) error {
+	if slug == database.LDAPProvider {
+		cfg, err := auth.LDAPSettings(db)
+		if err != nil {
+			return huma.Error500InternalServerError("failed to load LDAP settings", err)
+		}
+		if !cfg.LinkExistingAccounts {
+			return huma.Error409Conflict("an account with this email already exists, an admin must turn on link_existing_accounts in the LDAP settings to sign in to it with the directory")
+		}
+		return nil
+	}
+
+	autoLink, err := database.AutoLinkVerifiedEmail.Get(db)
+	if err != nil {
+		return huma.Error500InternalServerError("failed to load settings", err)
+	}
+	if !claims.emailVerified() || !autoLink {
+		return huma.Error409Conflict("an account with this email already exists, sign in and link this provider from your profile")
+	}
+	return nil
+}
+
+// resolveIdentityUser returns the user for a (provider, sub) identity. Unknown
+// identities are linked to the user the login was started by when linking, to
+// the user with the same verified email when auto-linking is enabled, or to a
+// newly registered user.
+func resolveIdentityUser(ctx context.Context, db *gorm.DB, slug string, claims *oidcClaims, login *database.PendingLogin) (*database.User, error) {
+	now := time.Now()
+	linkUserID := login.LinkUserID
+
+	var identity database.Identity
+	err := db.Where("provider = ? AND subject = ?", slug, claims.Sub).First(&identity).Error
+	if err == nil {
+		if linkUserID != nil && identity.UserID != *linkUserID {
+			return nil, huma.Error409Conflict("this identity is already linked to another account")
+		}
 		var user database.User
-		result := db.Where("internal_id = ?", claims.Sub).First(&user)
-		if result.Error == gorm.ErrRecordNotFound {
-			// Check if registration is enabled (skip for first user)
-			var userCount int64
-			db.Model(&database.User{}).Count(&userCount)
-			if userCount > 0 && !database.IsRegistrationEnabled(db) {
-				return nil, huma.Error403Forbidden("user registration is disabled")
-			}
+		if err := db.First(&user, identity.UserID).Error; err != nil {
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+		identity.Email = claims.Email
+		identity.LastLoginAt = &now
+		if err := db.Save(&identity).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to update identity", err)
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, huma.Error500InternalServerError("database error", err)
+	}
 
-			// Determine role: first user is admin
-			role := database.RoleUser
-			if userCount == 0 {
-				role = database.RoleAdmin
-			}
+	identity = database.Identity{Provider: slug, Subject: claims.Sub, Email: claims.Email, LastLoginAt: &now}
+
+	// Linking from an authenticated session
+	if linkUserID != nil {
+		var user database.User
+		if err := db.First(&user, *linkUserID).Error; err != nil {
+			return nil, huma.Error401Unauthorized("user not found")
+		}
+		identity.UserID = user.ID
+		if err := db.Create(&identity).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to link identity", err)
+		}
+		logging.FromContext(ctx).Info("identity linked", logging.UserID, user.ID, "provider", slug)
+		return &user, nil
+	}
 
-			user = database.User{
-				Email:      claims.Email,
-				Name:       claims.Name,
-				InternalID: &claims.Sub,
-				Role:       role,
+	// An account with the same email may already exist, e.g. from /auth/signup
+	if claims.Email != "" {
+		var existing database.User
+		if err := db.Where("email = ?", claims.Email).First(&existing).Error; err == nil {
+			if err := requireEmailLink(db, slug, claims); err != nil {
+				return nil, err
 			}
-			if err := db.Create(&user).Error; err != nil {
-				return nil, huma.Error500InternalServerError("failed to create user", err)
+			identity.UserID = existing.ID
+			if err := db.Create(&identity).Error; err != nil {
+				return nil, huma.Error500InternalServerError("failed to link identity", err)
 			}
-		} else if result.Error != nil {
-			return nil, huma.Error500InternalServerError("database error", result.Error)
+			logging.FromContext(ctx).Info("identity linked by verified email", logging.UserID, existing.ID, "provider", slug)
+			return &existing, nil
 		}
+	}
+
+	// Check if registration is enabled or the user was invited (skip for first user)
+	var userCount int64
+	db.Model(&database.User{}).Count(&userCount)
+	invitation, err := registrationInvitation(db, userCount, claims.Email, login.Invitation)
+	if err != nil {
+		return nil, err
+	}
 
-		// 5. Issue internal JWT
-		token, err := auth.GenerateJWT(user.ID)
+	user := database.User{
+		Email:      claims.Email,
+		Name:       claims.Name,
+		Provider:   slug,
+		InternalID: &claims.Sub,
+		Role:       newUserRole(userCount, invitation),
+	}
+	if claims.emailVerified() || invitation != nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if invitation != nil {
+			if err := auth.RedeemInvitation(tx, invitation, user.ID); err != nil {
+				return err
+			}
+		}
+		identity.UserID = user.ID
+		return tx.Create(&identity).Error
+	})
+	if errors.Is(err, auth.ErrInvalidInvitation) {
+		return nil, huma.Error400BadRequest("invalid or expired invitation")
+	}
+	if err != nil {
+		return nil, huma.Error500InternalServerError("failed to create user", err)
+	}
+	recordInvitationAccept(ctx, db, invitation, &user)
+	return &user, nil
+}
+
+// registrationInvitation checks a new account for email may be created, and
+// returns the invitation it redeems, if any. Invitations work while
+// registration is disabled; the first user can always register.
+func registrationInvitation(db *gorm.DB, userCount int64, email, invitationHash string) (*database.Invitation, error) {
+	if invitationHash != "" {
+		invitation, err := auth.FindInvitationByHash(db, invitationHash, email)
+		switch {
+		case errors.Is(err, auth.ErrInvalidInvitation):
+			return nil, huma.Error400BadRequest(err.Error())
+		case errors.Is(err, auth.ErrInvitationEmailMismatch):
+			return nil, huma.Error403Forbidden(err.Error())
+		case err != nil:
+			return nil, huma.Error500InternalServerError("failed to fetch invitation", err)
+		}
+		return invitation, nil
+	}
+	if userCount > 0 {
+		enabled, err := database.RegistrationEnabled.Get(db)
 		if err != nil {
-			return nil, huma.Error500InternalServerError("failed to generate token", err)
+			return nil, huma.Error500InternalServerError("failed to load settings", err)
 		}
+		if !enabled {
+			return nil, huma.Error403Forbidden("user registration is disabled")
+		}
+	}
+	return nil, nil
+}
 
-		resp := &CallbackOutput{}
-		resp.Body.Token = token
+// newUserRole returns the role for a newly registered user: admin for the
+// first user, otherwise the invitation's role or user.
+func newUserRole(userCount int64, invitation *database.Invitation) string {
+	switch {
+	case userCount == 0:
+		return database.RoleAdmin
+	case invitation != nil:
+		return invitation.Role
+	}
+	return database.RoleUser
+}
+
+// RegisterAuth registers the login and callback handlers.
+func RegisterAuth(api huma.API, db *gorm.DB, providers *auth.Registry, mailer *mail.Mailer) {
+	// Provider list - lets the login page render a button per provider
+	huma.Register(api, huma.Operation{
+		OperationID: "list-auth-providers",
+		Method:      http.MethodGet,
+		Path:        "/auth/providers",
+		Summary:     "List sign-in providers",
+		Description: "List the OIDC providers users can sign in with. Start a login at /auth/{slug}/login.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *struct{}) (*ListAuthProvidersOutput, error) {
+		resp := &ListAuthProvidersOutput{}
+		resp.Body.Providers = []AuthProvider{}
+		for _, info := range providers.List() {
+			resp.Body.Providers = append(resp.Body.Providers, AuthProvider{
+				Slug:        info.Slug,
+				DisplayName: info.DisplayName,
+			})
+		}
 		return resp, nil
 	})
 
+	// Login endpoint - redirects to the default OIDC provider
+	huma.Register(api, huma.Operation{
+		OperationID: "login",
+		Method:      http.MethodGet,
+		Path:        "/auth/login",
+		Summary:     "Login with OIDC",
+		Description: "Start a login with the default provider. Use /auth/{provider}/login to pick one.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *LoginInput) (*LoginOutput, error) {
+		slug, provider, ok := providers.Default()
+		if !ok {
+			return nil, huma.Error501NotImplemented("OIDC is not configured")
+		}
+		return oidcLogin(ctx, db, slug, provider, input)
+	})
+
+	// Callback endpoint - handles the redirect from the default OIDC provider
+	huma.Register(api, huma.Operation{
+		OperationID: "callback",
+		Method:      http.MethodGet,
+		Path:        "/auth/callback",
+		Summary:     "OIDC Callback",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *CallbackInput) (*CallbackOutput, error) {
+		slug, provider, ok := providers.Default()
+		if !ok {
+			return nil, huma.Error501NotImplemented("OIDC is not configured")
+		}
+		return oidcCallback(ctx, db, slug, provider, input)
+	})
+
+	// Login endpoint - redirects to a named OIDC provider
+	huma.Register(api, huma.Operation{
+		OperationID: "login-provider",
+		Method:      http.MethodGet,
+		Path:        "/auth/{provider}/login",
+		Summary:     "Login with a named OIDC provider",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *ProviderLoginInput) (*LoginOutput, error) {
+		provider, ok := providers.Get(ctx, input.Provider)
+		if !ok {
+			return nil, huma.Error404NotFound("provider not found")
+		}
+		return oidcLogin(ctx, db, input.Provider, provider, &input.LoginInput)
+	})
+
+	// Callback endpoint - handles the redirect from a named OIDC provider
+	huma.Register(api, huma.Operation{
+		OperationID: "callback-provider",
+		Method:      http.MethodGet,
+		Path:        "/auth/{provider}/callback",
+		Summary:     "OIDC Callback for a named provider",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *ProviderCallbackInput) (*CallbackOutput, error) {
+		provider, ok := providers.Get(ctx, input.Provider)
+		if !ok {
+			return nil, huma.Error404NotFound("provider not found")
+		}
+		return oidcCallback(ctx, db, input.Provider, provider, &input.CallbackInput)
+	})
+
 	// Signup endpoint - handles email/password registration
 	huma.Register(api, huma.Operation{
 		OperationID: "signup",
@@ -134,16 +745,22 @@ func RegisterAuth(api huma.API, db *gorm.DB, oidc auth.Provider) {
 		Tags:        []string{"Auth", "public"},
 	}, func(ctx context.Context, input *struct {
 		Body struct {
-			Email    string `json:"email" format:"email" required:"true"`
-			Password string `json:"password" minLength:"8" required:"true"`
-			Name     string `json:"name" minLength:"2" required:"true"`
+			Email           string `json:"email" format:"email" required:"true"`
+			Password        string `json:"password" minLength:"8" required:"true"`
+			Name            string `json:"name" minLength:"2" required:"true"`
+			InvitationToken string `json:"invitation_token,omitempty" doc:"Invitation token, lets an invited user register while registration is disabled"`
 		}
 	}) (*CallbackOutput, error) {
-		// 1. Check if registration is enabled (skip for first user)
+		// 1. Check if registration is enabled or the user was invited (skip for first user)
 		var userCount int64
 		db.Model(&database.User{}).Count(&userCount)
-		if userCount > 0 && !database.IsRegistrationEnabled(db) {
-			return nil, huma.Error403Forbidden("user registration is disabled")
+		var invitationHash string
+		if input.Body.InvitationToken != "" {
+			invitationHash = auth.HashKey(input.Body.InvitationToken)
+		}
+		invitation, err := registrationInvitation(db, userCount, input.Body.Email, invitationHash)
+		if err != nil {
+			return nil, err
 		}
 
 		// 2. Check if user already exists
@@ -158,35 +775,58 @@ func RegisterAuth(api huma.API, db *gorm.DB, oidc auth.Provider) {
 			return nil, huma.Error500InternalServerError("failed to hash password", err)
 		}
 
-		// 4. Determine role: first user is admin
-		role := database.RoleUser
-		if userCount == 0 {
-			role = database.RoleAdmin
-		}
-
-		// 5. Create user
+		// 4. Create user. The first user is admin, invited users get the role
+		// they were invited with and count as verified, since the invitation
+		// was sent to their address.
 		user := database.User{
 			Email:        input.Body.Email,
 			PasswordHash: string(hash),
 			Name:         input.Body.Name,
-			Role:         role,
+			Role:         newUserRole(userCount, invitation),
+		}
+		if invitation != nil {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if invitation != nil {
+				return auth.RedeemInvitation(tx, invitation, user.ID)
+			}
+			return nil
+		})
+		if errors.Is(err, auth.ErrInvalidInvitation) {
+			return nil, huma.Error400BadRequest("invalid or expired invitation")
 		}
-		if err := db.Create(&user).Error; err != nil {
+		if err != nil {
 			logging.FromContext(ctx).Error("failed to create user", logging.Email, user.Email, logging.Error, err)
 			return nil, huma.Error500InternalServerError("failed to create user", err)
 		}
 
 		logging.FromContext(ctx).Info("new user signed up", logging.Email, user.Email)
+		recordInvitationAccept(ctx, db, invitation, &user)
 
-		// 4. Issue internal JWT
-		token, err := auth.GenerateJWT(user.ID)
-		if err != nil {
-			return nil, huma.Error500InternalServerError("failed to generate token", err)
+		// 5. Send the verification email. Signup still succeeds if it fails;
+		// the user can ask for another one.
+		if mailer != nil && user.EmailVerifiedAt == nil {
+			if err := sendVerificationEmail(ctx, mailer, &user); err != nil {
+				logging.FromContext(ctx).Error("failed to send verification email", logging.UserID, user.ID, logging.Error, err)
+			}
 		}
 
-		resp := &CallbackOutput{}
-		resp.Body.Token = token
-		return resp, nil
+		// 6. Start a session, unless the email must be verified first
+		verificationRequired, err := database.RequireEmailVerification.Get(db)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to load settings", err)
+		}
+		if userCount > 0 && user.EmailVerifiedAt == nil && verificationRequired {
+			resp := &CallbackOutput{}
+			resp.Body.VerificationRequired = true
+			return resp, nil
+		}
+		return newSessionOutput(ctx, db, &user)
 	})
 
 	// Login endpoint - handles email/password authentication
@@ -201,32 +841,208 @@ func RegisterAuth(api huma.API, db *gorm.DB, oidc auth.Provider) {
 			Email    string `json:"email" format:"email" required:"true"`
 			Password string `json:"password" required:"true"`
 		}
-	}) (*CallbackOutput, error) {
-		// 1. Find user by email
+	}) (resp *CallbackOutput, err error) {
 		var user database.User
-		if err := db.Where("email = ?", input.Body.Email).First(&user).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
+		method := "password"
+		defer func() { recordLoginAudit(ctx, db, method, input.Body.Email, &user, resp, err) }()
+
+		// 1. Refuse locked out clients before doing any work
+		if err := checkLoginThrottle(ctx, db, input.Body.Email); err != nil {
+			return nil, err
+		}
+
+		// 2. Sign in against the directory when LDAP is configured. Emails it
+		// does not know fall through to local accounts.
+		directoryUser, err := ldapLogin(ctx, db, input.Body.Email, input.Body.Password)
+		if err != nil {
+			method = database.LDAPProvider
+			return nil, err
+		}
+		if directoryUser != nil {
+			method = database.LDAPProvider
+			user = *directoryUser
+		} else {
+			// 3. Find user by email. Unknown emails count as failures too, so
+			// lockouts do not reveal which accounts exist.
+			if err := db.Where("email = ?", input.Body.Email).First(&user).Error; err != nil {
+				if err == gorm.ErrRecordNotFound {
+					recordLoginFailure(ctx, db, input.Body.Email)
+					return nil, huma.Error401Unauthorized("invalid email or password")
+				}
+				return nil, huma.Error500InternalServerError("database error", err)
+			}
+
+			// 4. Verify password
+			if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(input.Body.Password)); err != nil {
+				logging.FromContext(ctx).Warn("failed login attempt", logging.Email, input.Body.Email, "reason", "invalid password")
+				recordLoginFailure(ctx, db, input.Body.Email)
 				return nil, huma.Error401Unauthorized("invalid email or password")
 			}
-			return nil, huma.Error500InternalServerError("database error", err)
 		}
 
-		// 2. Verify password
-		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(input.Body.Password)); err != nil {
-			logging.FromContext(ctx).Warn("failed login attempt", logging.Email, input.Body.Email, "reason", "invalid password")
-			return nil, huma.Error401Unauthorized("invalid email or password")
+		// 5. Check the email is verified, if required
+		if user.EmailVerifiedAt == nil {
+			required, err := database.RequireEmailVerification.Get(db)
+			if err != nil {
+				return nil, huma.Error500InternalServerError("failed to load settings", err)
+			}
+			if required {
+				return nil, huma.Error403Forbidden("email address is not verified")
+			}
 		}
 
 		logging.FromContext(ctx).Info("user logged in", logging.Email, user.Email, logging.UserID, user.ID)
 
-		// 3. Issue internal JWT
-		token, err := auth.GenerateJWT(user.ID)
+		// 6. Start a session, or ask for the second factor. The failure count
+		// is only reset once the login is complete, so knowing the password
+		// does not allow unlimited MFA guesses.
+		resp, err = completeLogin(ctx, db, &user, "")
 		if err != nil {
-			return nil, huma.Error500InternalServerError("failed to generate token", err)
+			return nil, err
+		}
+		if !resp.Body.MFARequired {
+			auth.RecordLoginSuccess(db, user.Email)
 		}
+		return resp, nil
+	})
 
-		resp := &CallbackOutput{}
-		resp.Body.Token = token
+	// MFA endpoint - second login step for users with MFA enabled
+	huma.Register(api, huma.Operation{
+		OperationID: "verify-mfa",
+		Method:      http.MethodPost,
+		Path:        "/auth/mfa/verify",
+		Summary:     "Complete an MFA login",
+		Description: "Exchange the mfa_token from the first login step and a TOTP or recovery code for a session. A challenge is discarded after 5 wrong codes.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *MFAVerifyInput) (resp *CallbackOutput, err error) {
+		// Wrong codes count against the account, across challenges
+		var account string
+		var user database.User
+		if pending, err := auth.FindMFAChallenge(db, input.Body.MFAToken); err == nil {
+			if db.First(&user, pending.UserID).Error == nil {
+				account = user.Email
+			}
+		}
+		defer func() { recordLoginAudit(ctx, db, "mfa", account, &user, resp, err) }()
+
+		if err := checkLoginThrottle(ctx, db, account); err != nil {
+			return nil, err
+		}
+
+		challenge, err := auth.CompleteMFAChallenge(db, input.Body.MFAToken, input.Body.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidMFACode):
+				logging.FromContext(ctx).Warn("failed MFA attempt", "reason", "invalid code")
+				recordLoginFailure(ctx, db, account)
+				return nil, huma.Error401Unauthorized("invalid MFA code")
+			case errors.Is(err, auth.ErrInvalidMFAChallenge), errors.Is(err, auth.ErrMFANotEnrolled):
+				return nil, huma.Error401Unauthorized("invalid or expired MFA challenge")
+			}
+			return nil, huma.Error500InternalServerError("failed to verify MFA code", err)
+		}
+
+		if err := db.First(&user, challenge.UserID).Error; err != nil {
+			return nil, huma.Error401Unauthorized("invalid or expired MFA challenge")
+		}
+
+		logging.FromContext(ctx).Info("user completed MFA", logging.Email, user.Email, logging.UserID, user.ID)
+		auth.RecordLoginSuccess(db, user.Email)
+
+		resp, err = newSessionOutput(ctx, db, &user)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.ReturnTo = challenge.ReturnTo
+		return resp, nil
+	})
+
+	// Refresh endpoint - rotates a refresh token into a new token pair
+	huma.Register(api, huma.Operation{
+		OperationID: "refresh-token",
+		Method:      http.MethodPost,
+		Path:        "/auth/refresh",
+		Summary:     "Refresh access token",
+		Description: "Exchange a refresh token for a new access token. Refresh tokens are single-use; presenting one twice revokes its session. Browser sessions may send the refresh token as a cookie instead, along with the CSRF token.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *RefreshInput) (*CallbackOutput, error) {
+		var refreshToken string
+		if input.Body != nil {
+			refreshToken = input.Body.RefreshToken
+		} else {
+			token, err := input.cookieRefreshToken()
+			if err != nil {
+				return nil, err
+			}
+			if token == "" {
+				return nil, huma.Error400BadRequest("refresh token required")
+			}
+			refreshToken = token
+		}
+
+		client := middleware.GetClientInfo(ctx)
+		pair, err := auth.RefreshSession(db, refreshToken, auth.SessionMeta{
+			UserAgent: client.UserAgent,
+			IPAddress: client.IPAddress,
+		})
+		if err != nil {
+			if errors.Is(err, auth.ErrRefreshTokenReused) {
+				logging.FromContext(ctx).Warn("refresh token reuse detected, session revoked")
+				return nil, huma.Error401Unauthorized("invalid refresh token")
+			}
+			if errors.Is(err, auth.ErrInvalidRefreshToken) {
+				return nil, huma.Error401Unauthorized("invalid refresh token")
+			}
+			if errors.Is(err, auth.ErrAccountDisabled) {
+				return nil, huma.Error403Forbidden(err.Error())
+			}
+			return nil, huma.Error500InternalServerError("failed to refresh token", err)
+		}
+		return tokenPairOutput(ctx, pair)
+	})
+
+	// Logout endpoint - revokes the current session
+	huma.Register(api, huma.Operation{
+		OperationID: "logout",
+		Method:      http.MethodPost,
+		Path:        "/auth/logout",
+		Summary:     "Logout",
+		Description: "End the current session. Authenticate with the session's access token or pass its refresh token. Browser sessions also have their session cookies cleared.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *LogoutInput) (*LogoutOutput, error) {
+		sessionID := middleware.GetSessionID(ctx)
+		if sessionID == 0 {
+			var refreshToken string
+			if input.Body != nil && input.Body.RefreshToken != "" {
+				refreshToken = input.Body.RefreshToken
+			} else {
+				token, err := input.cookieRefreshToken()
+				if err != nil {
+					return nil, err
+				}
+				refreshToken = token
+			}
+			var token database.RefreshToken
+			if refreshToken != "" && db.Where("token_hash = ?", auth.HashKey(refreshToken)).First(&token).Error == nil {
+				sessionID = token.SessionID
+			}
+		}
+		if sessionID == 0 {
+			return nil, huma.Error401Unauthorized("unauthorized")
+		}
+
+		if err := auth.RevokeSession(db, sessionID); err != nil {
+			return nil, huma.Error500InternalServerError("failed to revoke session", err)
+		}
+
+		resp := &LogoutOutput{}
+		if auth.SessionCookiesEnabled() {
+			resp.SetCookie = []http.Cookie{
+				sessionCookie(ctx, auth.SessionCookie, "", -1, true),
+				sessionCookie(ctx, auth.RefreshCookie, "", -1, true),
+				sessionCookie(ctx, auth.CSRFCookie, "", -1, false),
+			}
+		}
 		return resp, nil
 	})
 }
@@ -2,7 +2,9 @@ package handlers_test
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"testing"
 
 	"github.com/danielgtaylor/huma/v2/humatest"
@@ -12,49 +14,87 @@ import (
 	"github.com/techsquidtv/inkling/internal/database"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 // MockIDToken implements auth.IDToken
 type MockIDToken struct {
 	ClaimsFunc func(v interface{}) error
+	NonceFunc  func() string
 }
 
 func (m *MockIDToken) Claims(v interface{}) error {
 	return m.ClaimsFunc(v)
 }
 
+func (m *MockIDToken) Nonce() string {
+	return m.NonceFunc()
+}
+
 // MockProvider implements auth.Provider
 type MockProvider struct {
-	AuthCodeURLFunc func(state string) string
-	ExchangeFunc    func(ctx context.Context, code string) (*oauth2.Token, error)
+	AuthCodeURLFunc func(state, nonce, codeVerifier string) string
+	ExchangeFunc    func(ctx context.Context, code, codeVerifier string) (*oauth2.Token, error)
 	VerifyTokenFunc func(ctx context.Context, rawIDToken string) (auth.IDToken, error)
 }
 
-func (m *MockProvider) AuthCodeURL(state string) string {
-	return m.AuthCodeURLFunc(state)
+func (m *MockProvider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	return m.AuthCodeURLFunc(state, nonce, codeVerifier)
 }
 
-func (m *MockProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	return m.ExchangeFunc(ctx, code)
+func (m *MockProvider) Exchange(ctx context.Context, code, codeVerifier string) (*oauth2.Token, error) {
+	return m.ExchangeFunc(ctx, code, codeVerifier)
 }
 
 func (m *MockProvider) VerifyToken(ctx context.Context, rawIDToken string) (auth.IDToken, error) {
 	return m.VerifyTokenFunc(ctx, rawIDToken)
 }
 
-func TestRegisterAuth_Callback(t *testing.T) {
-	// Setup DB
-	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db.AutoMigrate(&database.User{}, &database.APIKey{})
+// testProviders returns a registry with p as the default provider.
+func testProviders(p auth.Provider) *auth.Registry {
+	providers := auth.NewRegistry(nil, auth.RegistryConfig{})
+	providers.Register(database.DefaultOIDCProvider, "Test SSO", p)
+	return providers
+}
 
-	// Setup Huma API
-	_, api := humatest.New(t)
+// issueToken starts a session for the user and returns its access token.
+func issueToken(t *testing.T, db *gorm.DB, userID uint) string {
+	t.Helper()
+	pair, err := auth.CreateSession(db, userID, auth.SessionMeta{})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	return pair.AccessToken
+}
 
-	// Mock OIDC Provider
-	mockOIDC := &MockProvider{
-		ExchangeFunc: func(ctx context.Context, code string) (*oauth2.Token, error) {
+// fakeLoginFlow records what the login handler passed to the provider.
+type fakeLoginFlow struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Exchanged    string // Code verifier passed to Exchange
+}
+
+// newMockOIDC returns a provider that completes the flow for the given claims,
+// echoing back the nonce it was started with. The email is reported as verified.
+func newMockOIDC(flow *fakeLoginFlow, email, name, sub string) *MockProvider {
+	return newMockOIDCClaims(flow, map[string]any{
+		"email":          email,
+		"name":           name,
+		"sub":            sub,
+		"email_verified": true,
+	})
+}
+
+// newMockOIDCClaims is like newMockOIDC but returns arbitrary ID token claims.
+func newMockOIDCClaims(flow *fakeLoginFlow, claims map[string]any) *MockProvider {
+	return &MockProvider{
+		AuthCodeURLFunc: func(state, nonce, codeVerifier string) string {
+			flow.State, flow.Nonce, flow.CodeVerifier = state, nonce, codeVerifier
+			return "https://idp.example.com/authorize?state=" + state
+		},
+		ExchangeFunc: func(ctx context.Context, code, codeVerifier string) (*oauth2.Token, error) {
+			flow.Exchanged = codeVerifier
 			return (&oauth2.Token{
 				AccessToken: "fake-access-token",
 			}).WithExtra(map[string]interface{}{
@@ -63,28 +103,54 @@ func TestRegisterAuth_Callback(t *testing.T) {
 		},
 		VerifyTokenFunc: func(ctx context.Context, rawIDToken string) (auth.IDToken, error) {
 			return &MockIDToken{
+				NonceFunc: func() string { return flow.Nonce },
 				ClaimsFunc: func(v interface{}) error {
-					claims := v.(*struct {
-						Email string `json:"email"`
-						Name  string `json:"name"`
-						Sub   string `json:"sub"`
-					})
-					claims.Email = "test@example.com"
-					claims.Name = "Test User"
-					claims.Sub = "test-sub-123"
-					return nil
+					data, err := json.Marshal(claims)
+					if err != nil {
+						return err
+					}
+					return json.Unmarshal(data, v)
 				},
 			}, nil
 		},
 	}
+}
+
+// startLogin begins an OIDC login and returns the state cookie header.
+func startLogin(t *testing.T, api humatest.TestAPI, flow *fakeLoginFlow, query string) string {
+	t.Helper()
+	resp := api.Get("/auth/login" + query)
+	assert.Equal(t, http.StatusFound, resp.Code)
+	assert.Contains(t, resp.Header().Get("Location"), "state="+flow.State)
+	assert.Contains(t, resp.Header().Get("Set-Cookie"), auth.LoginStateCookie+"="+flow.State)
+	assert.Contains(t, resp.Header().Get("Set-Cookie"), "HttpOnly")
+	return "Cookie: " + auth.LoginStateCookie + "=" + flow.State
+}
+
+func TestRegisterAuth_Callback(t *testing.T) {
+	// Setup DB
+	db := openTestDB(t)
+
+	// Setup Huma API
+	_, api := humatest.New(t)
+
+	// Mock OIDC Provider
+	flow := &fakeLoginFlow{}
+	mockOIDC := newMockOIDC(flow, "test@example.com", "Test User", "test-sub-123")
 
 	// Register Auth Handlers
-	handlers.RegisterAuth(api, db, mockOIDC)
+	handlers.RegisterAuth(api, db, testProviders(mockOIDC), nil)
+
+	// Start the login, then complete the callback from the same browser
+	cookie := startLogin(t, api, flow, "?return_to=/dashboard")
+	assert.NotEmpty(t, flow.Nonce)
+	assert.NotEmpty(t, flow.CodeVerifier)
 
-	// Test Callback
-	resp := api.Get("/auth/callback?code=test-code&state=test-state")
+	resp := api.Get("/auth/callback?code=test-code&state="+flow.State, cookie)
 
 	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"return_to":"/dashboard"`)
+	assert.Equal(t, flow.CodeVerifier, flow.Exchanged)
 
 	// Verify User was created in DB
 	var user database.User
@@ -92,12 +158,59 @@ func TestRegisterAuth_Callback(t *testing.T) {
 	assert.NoError(t, result.Error)
 	assert.Equal(t, "test@example.com", user.Email)
 	assert.Equal(t, "Test User", user.Name)
+
+	// The state is single-use
+	resp = api.Get("/auth/callback?code=test-code&state="+flow.State, cookie)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestRegisterAuth_CallbackRejectsForgedState(t *testing.T) {
+	db := openTestDB(t)
+	_, api := humatest.New(t)
+
+	flow := &fakeLoginFlow{}
+	handlers.RegisterAuth(api, db, testProviders(newMockOIDC(flow, "csrf@example.com", "CSRF", "csrf-sub")), nil)
+
+	// Constant or unknown state
+	resp := api.Get("/auth/callback?code=test-code&state=state", "Cookie: "+auth.LoginStateCookie+"=state")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Valid state, but the callback arrives in a browser that did not start the login
+	startLogin(t, api, flow, "")
+	resp = api.Get("/auth/callback?code=test-code&state=" + flow.State)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Nonce mismatch
+	cookie := startLogin(t, api, flow, "")
+	state := flow.State
+	flow.Nonce = "replayed-nonce"
+	resp = api.Get("/auth/callback?code=test-code&state="+state, cookie)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	var count int64
+	db.Model(&database.User{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestRegisterAuth_LoginReturnToAllowList(t *testing.T) {
+	db := openTestDB(t)
+	_, api := humatest.New(t)
+
+	flow := &fakeLoginFlow{}
+	handlers.RegisterAuth(api, db, testProviders(newMockOIDC(flow, "rt@example.com", "RT", "rt-sub")), nil)
+	t.Setenv("AUTH_RETURN_TO_ALLOWLIST", "https://app.example.com")
+
+	for _, target := range []string{"https://evil.example.com/", "//evil.example.com", "javascript:alert(1)", "dashboard"} {
+		resp := api.Get("/auth/login?return_to=" + url.QueryEscape(target))
+		assert.Equal(t, http.StatusBadRequest, resp.Code, target)
+	}
+
+	startLogin(t, api, flow, "?return_to="+url.QueryEscape("https://app.example.com/settings"))
 }
 
 func TestRegisterAuth_Signup(t *testing.T) {
 	// Setup DB
-	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db.AutoMigrate(&database.User{}, &database.APIKey{})
+	db := openTestDB(t)
 
 	// Setup Huma API
 	_, api := humatest.New(t)
@@ -106,7 +219,7 @@ func TestRegisterAuth_Signup(t *testing.T) {
 	mockOIDC := &MockProvider{}
 
 	// Register Auth Handlers
-	handlers.RegisterAuth(api, db, mockOIDC)
+	handlers.RegisterAuth(api, db, testProviders(mockOIDC), nil)
 
 	// Test Signup
 	signupData := map[string]interface{}{
@@ -131,8 +244,7 @@ func TestRegisterAuth_Signup(t *testing.T) {
 
 func TestRegisterAuth_Login(t *testing.T) {
 	// Setup DB
-	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db.AutoMigrate(&database.User{}, &database.APIKey{})
+	db := openTestDB(t)
 
 	// Setup Huma API
 	_, api := humatest.New(t)
@@ -141,7 +253,7 @@ func TestRegisterAuth_Login(t *testing.T) {
 	mockOIDC := &MockProvider{}
 
 	// Register Auth Handlers
-	handlers.RegisterAuth(api, db, mockOIDC)
+	handlers.RegisterAuth(api, db, testProviders(mockOIDC), nil)
 
 	// Create a user first
 	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// DownloadBackupInput is the input for downloading a database backup.
+type DownloadBackupInput struct {
+	Compress bool `query:"compress" doc:"Compress the backup with gzip"`
+}
+
+// RegisterBackup registers the admin endpoint for downloading database backups.
+func RegisterBackup(api huma.API, db *gorm.DB) {
+	huma.Register(api, huma.Operation{
+		OperationID: "download-backup",
+		Method:      http.MethodGet,
+		Path:        "/admin/backup",
+		Summary:     "Download database backup",
+		Description: "Download a consistent snapshot of the SQLite database, taken while the server keeps running. The X-Checksum-SHA256 header holds the checksum of the file. The backup contains every secret the server stores, so only callers whose role grants every permission (*) can download one.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{
+			middleware.PermissionExtension: database.PermissionAll,
+			middleware.SensitiveExtension:  true,
+		},
+		Responses: map[string]*huma.Response{
+			"200": {
+				Description: "The SQLite database file, gzip-compressed when requested",
+				Content: map[string]*huma.MediaType{
+					"application/vnd.sqlite3": {},
+					"application/gzip":        {},
+				},
+			},
+		},
+	}, func(ctx context.Context, input *DownloadBackupInput) (*huma.StreamResponse, error) {
+		dir, err := os.MkdirTemp("", "inkling-backup-")
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to create backup", err)
+		}
+		name := "inkling-" + time.Now().UTC().Format("20060102T150405Z") + database.BackupExtension
+		contentType := "application/vnd.sqlite3"
+		if input.Compress {
+			name += ".gz"
+			contentType = "application/gzip"
+		}
+
+		info, err := database.Backup(db.WithContext(ctx), filepath.Join(dir, name), input.Compress)
+		if err != nil {
+			os.RemoveAll(dir)
+			if errors.Is(err, database.ErrBackupUnsupported) {
+				return nil, huma.Error501NotImplemented(err.Error())
+			}
+			return nil, huma.Error500InternalServerError("failed to create backup", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditBackupDownload,
+			TargetType: "database",
+			Details: map[string]any{
+				"schema_version": info.SchemaVersion,
+				"size":           info.Size,
+				"sha256":         info.Checksum,
+			},
+		})
+
+		return &huma.StreamResponse{
+			Body: func(hctx huma.Context) {
+				defer os.RemoveAll(dir)
+
+				f, err := os.Open(info.Path)
+				if err != nil {
+					logging.FromContext(ctx).Error("backup download failed", logging.Error, err)
+					hctx.SetStatus(http.StatusInternalServerError)
+					return
+				}
+				defer f.Close()
+
+				hctx.SetHeader("Content-Type", contentType)
+				hctx.SetHeader("Content-Disposition", `attachment; filename="`+name+`"`)
+				hctx.SetHeader("Content-Length", strconv.FormatInt(info.Size, 10))
+				hctx.SetHeader("X-Checksum-SHA256", info.Checksum)
+				if _, err := io.Copy(hctx.BodyWriter(), f); err != nil {
+					logging.FromContext(ctx).Error("backup download failed", logging.Error, err)
+				}
+			},
+		}, nil
+	})
+}
@@ -0,0 +1,85 @@
+package handlers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupBackupTest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+	if db.Dialector.Name() != "sqlite" {
+		t.Skip("backups are only supported for SQLite")
+	}
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterBackup(api, db)
+	return db, api
+}
+
+func TestBackupDownload(t *testing.T) {
+	db, api := setupBackupTest(t)
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	user := database.User{Email: "user@example.com", Name: "User", Role: database.RoleUser}
+	db.Create(&user)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+
+	resp := api.Get("/admin/backup", adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, "application/vnd.sqlite3", resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.Header().Get("Content-Disposition"), `.db"`)
+	body := resp.Body.Bytes()
+	assert.True(t, bytes.HasPrefix(body, []byte("SQLite format 3\x00")))
+	sum := sha256.Sum256(body)
+	assert.Equal(t, hex.EncodeToString(sum[:]), resp.Header().Get("X-Checksum-SHA256"))
+
+	resp = api.Get("/admin/backup?compress=true", adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, "application/gzip", resp.Header().Get("Content-Type"))
+	zr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	snapshot, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(snapshot, []byte("SQLite format 3\x00")))
+
+	// The snapshot holds the data
+	path := filepath.Join(t.TempDir(), "backup.db")
+	require.NoError(t, os.WriteFile(path, snapshot, 0o600))
+	restored, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	require.NoError(t, err)
+	var count int64
+	restored.Model(&database.User{}).Count(&count)
+	assert.Equal(t, int64(2), count)
+	if sqlDB, err := restored.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	var event database.AuditEvent
+	require.NoError(t, db.Where("action = ?", "backup.download").First(&event).Error)
+	assert.Equal(t, admin.ID, *event.ActorID)
+	assert.Contains(t, event.Details, `"schema_version":`)
+
+	// Only roles granting every permission may download the database
+	resp = api.Get("/admin/backup", "Authorization: Bearer "+issueToken(t, db, user.ID))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Get("/admin/backup")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// IdentityInfo represents a linked OIDC identity in API responses.
+type IdentityInfo struct {
+	ID                  uint       `json:"id"`
+	Provider            string     `json:"provider" doc:"Provider slug"`
+	ProviderDisplayName string     `json:"provider_display_name,omitempty"`
+	Email               string     `json:"email" doc:"Email reported by the provider at the last login"`
+	CreatedAt           time.Time  `json:"created_at"`
+	LastLoginAt         *time.Time `json:"last_login_at"`
+}
+
+// ListIdentitiesOutput represents the response for listing identities.
+type ListIdentitiesOutput struct {
+	Body struct {
+		Identities  []IdentityInfo `json:"identities"`
+		HasPassword bool           `json:"has_password" doc:"Whether the user can also sign in with a password"`
+	}
+}
+
+// LinkIdentityInput represents the request to link a provider.
+type LinkIdentityInput struct {
+	Provider string `path:"provider" doc:"Slug of the OIDC provider to link"`
+	Body     *struct {
+		ReturnTo string `json:"return_to,omitempty" doc:"Relative path or allow-listed URL to return to after linking"`
+	}
+}
+
+// LinkIdentityOutput represents the response for starting a link.
+type LinkIdentityOutput struct {
+	SetCookie []http.Cookie `header:"Set-Cookie"`
+	Body      struct {
+		AuthorizationURL string `json:"authorization_url" doc:"Send the browser here to sign in with the provider"`
+	}
+}
+
+// UnlinkIdentityInput represents the request to unlink an identity.
+type UnlinkIdentityInput struct {
+	ID uint `path:"id" doc:"Identity ID"`
+}
+
+// RegisterIdentities registers the endpoints for managing linked identities.
+func RegisterIdentities(api huma.API, db *gorm.DB, providers *auth.Registry) {
+	// GET /api/me/identities - List linked identities
+	huma.Register(api, huma.Operation{
+		OperationID: "list-identities",
+		Method:      http.MethodGet,
+		Path:        "/me/identities",
+		Summary:     "List linked identities",
+		Description: "List the OIDC identities the current user can sign in with.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeProfileRead}},
+		},
+	}, func(ctx context.Context, input *struct{}) (*ListIdentitiesOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var identities []database.Identity
+		if err := db.Where("user_id = ?", user.ID).Order("created_at ASC").Find(&identities).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to list identities", err)
+		}
+
+		names := map[string]string{}
+		for _, info := range providers.List() {
+			names[info.Slug] = info.DisplayName
+		}
+
+		resp := &ListIdentitiesOutput{}
+		resp.Body.Identities = make([]IdentityInfo, len(identities))
+		for i, identity := range identities {
+			resp.Body.Identities[i] = IdentityInfo{
+				ID:                  identity.ID,
+				Provider:            identity.Provider,
+				ProviderDisplayName: names[identity.Provider],
+				Email:               identity.Email,
+				CreatedAt:           identity.CreatedAt,
+				LastLoginAt:         identity.LastLoginAt,
+			}
+		}
+		resp.Body.HasPassword = user.PasswordHash != ""
+		return resp, nil
+	})
+
+	// POST /api/me/identities/{provider} - Start linking a provider
+	huma.Register(api, huma.Operation{
+		OperationID: "link-identity",
+		Method:      http.MethodPost,
+		Path:        "/me/identities/{provider}",
+		Summary:     "Link an OIDC provider",
+		Description: "Start an OIDC login that links the provider's identity to the current user. Send the browser to the returned URL; the provider's callback completes the link.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *LinkIdentityInput) (*LinkIdentityOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		provider, ok := providers.Get(ctx, input.Provider)
+		if !ok {
+			return nil, huma.Error404NotFound("provider not found")
+		}
+
+		var returnTo string
+		if input.Body != nil {
+			if returnTo, err = auth.ValidateReturnTo(input.Body.ReturnTo); err != nil {
+				return nil, huma.Error400BadRequest("return_to is not allowed")
+			}
+		}
+
+		login, err := auth.StartLink(db, input.Provider, user.ID, returnTo)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to start login", err)
+		}
+
+		resp := &LinkIdentityOutput{
+			SetCookie: []http.Cookie{loginStateCookie(ctx, login.State, int(auth.PendingLoginTTL.Seconds()))},
+		}
+		resp.Body.AuthorizationURL = provider.AuthCodeURL(login.State, login.Nonce, login.CodeVerifier)
+		return resp, nil
+	})
+
+	// DELETE /api/me/identities/{id} - Unlink an identity
+	huma.Register(api, huma.Operation{
+		OperationID: "unlink-identity",
+		Method:      http.MethodDelete,
+		Path:        "/me/identities/{id}",
+		Summary:     "Unlink an identity",
+		Description: "Remove a linked identity. The last way to sign in cannot be removed.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *UnlinkIdentityInput) (*struct{}, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var identity database.Identity
+		if err := db.Where("id = ? AND user_id = ?", input.ID, user.ID).First(&identity).Error; err != nil {
+			return nil, huma.Error404NotFound("identity not found")
+		}
+
+		var count, passkeys int64
+		db.Model(&database.Identity{}).Where("user_id = ?", user.ID).Count(&count)
+		db.Model(&database.Passkey{}).Where("user_id = ?", user.ID).Count(&passkeys)
+		if count <= 1 && user.PasswordHash == "" && passkeys == 0 {
+			return nil, huma.Error400BadRequest("cannot unlink the only way to sign in")
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// Hard delete so the identity can be linked again later
+			if err := tx.Unscoped().Delete(&identity).Error; err != nil {
+				return err
+			}
+			// Forget the identity the account was created with, so it can sign up anew
+			if user.InternalID != nil && *user.InternalID == identity.Subject && user.Provider == identity.Provider {
+				return tx.Model(user).Updates(map[string]any{"provider": "", "internal_id": nil}).Error
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to unlink identity", err)
+		}
+
+		logging.FromContext(ctx).Info("identity unlinked", logging.UserID, user.ID, "provider", identity.Provider)
+		return nil, nil
+	})
+}
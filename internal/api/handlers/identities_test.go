@@ -0,0 +1,303 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// identityTest wires the auth and identity handlers to a provider whose ID
+// token claims can be changed between logins.
+type identityTest struct {
+	db     *gorm.DB
+	api    humatest.TestAPI
+	flow   *fakeLoginFlow
+	claims map[string]any
+}
+
+func setupIdentityTest(t *testing.T) *identityTest {
+	db := openTestDB(t)
+
+	it := &identityTest{db: db, flow: &fakeLoginFlow{}, claims: map[string]any{}}
+	providers := testProviders(newMockOIDCClaims(it.flow, it.claims))
+
+	_, it.api = humatest.New(t)
+	it.api.UseMiddleware(middleware.NewAuthMiddleware(it.api, db))
+	handlers.RegisterAuth(it.api, db, providers, nil)
+	handlers.RegisterIdentities(it.api, db, providers)
+	return it
+}
+
+func (it *identityTest) setClaims(sub, email string, verified bool) {
+	it.claims["sub"] = sub
+	it.claims["email"] = email
+	it.claims["name"] = "OIDC User"
+	it.claims["email_verified"] = verified
+}
+
+func (it *identityTest) oidcLogin(t *testing.T) int {
+	t.Helper()
+	cookie := startLogin(t, it.api, it.flow, "")
+	return it.api.Get("/auth/callback?code=c&state="+it.flow.State, cookie).Code
+}
+
+func (it *identityTest) signup(t *testing.T, email string) (database.User, string) {
+	t.Helper()
+	resp := it.api.Post("/auth/signup", map[string]any{"email": email, "password": "password123", "name": "Password User"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var user database.User
+	require.NoError(t, it.db.Where("email = ?", email).First(&user).Error)
+	return user, issueToken(t, it.db, user.ID)
+}
+
+func TestOIDCLoginWithExistingEmail(t *testing.T) {
+	it := setupIdentityTest(t)
+	user, _ := it.signup(t, "pat@example.com")
+
+	// Without auto-linking the login is refused instead of creating a duplicate
+	it.setClaims("pat-sub", "pat@example.com", true)
+	assert.Equal(t, http.StatusConflict, it.oidcLogin(t))
+
+	// With auto-linking, unverified emails are still refused
+	require.NoError(t, database.AutoLinkVerifiedEmail.Set(it.db, true))
+	it.setClaims("pat-sub", "pat@example.com", false)
+	assert.Equal(t, http.StatusConflict, it.oidcLogin(t))
+
+	// A verified email is linked to the existing user
+	it.setClaims("pat-sub", "pat@example.com", true)
+	assert.Equal(t, http.StatusOK, it.oidcLogin(t))
+	var identity database.Identity
+	require.NoError(t, it.db.Where("provider = ? AND subject = ?", database.DefaultOIDCProvider, "pat-sub").First(&identity).Error)
+	assert.Equal(t, user.ID, identity.UserID)
+
+	var count int64
+	it.db.Model(&database.User{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// Later logins find the user through the identity, even if the email changes
+	it.setClaims("pat-sub", "pat@other.example.com", false)
+	assert.Equal(t, http.StatusOK, it.oidcLogin(t))
+	it.db.Model(&database.User{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestLinkAndUnlinkIdentity(t *testing.T) {
+	it := setupIdentityTest(t)
+	user, token := it.signup(t, "sam@example.com")
+
+	// Start the link from an authenticated session
+	resp := it.api.Post("/me/identities/default", map[string]any{"return_to": "/settings"}, "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var link struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &link))
+	assert.Contains(t, link.AuthorizationURL, "state="+it.flow.State)
+	assert.Contains(t, resp.Header().Get("Set-Cookie"), auth.LoginStateCookie+"="+it.flow.State)
+
+	// The callback links the identity even though the emails differ
+	it.setClaims("sam-sub", "sam@work.example.com", false)
+	resp = it.api.Get("/auth/callback?code=c&state="+it.flow.State, "Cookie: "+auth.LoginStateCookie+"="+it.flow.State)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"return_to":"/settings"`)
+
+	resp = it.api.Get("/me/identities", "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var list struct {
+		Identities  []handlers.IdentityInfo `json:"identities"`
+		HasPassword bool                    `json:"has_password"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	require.Len(t, list.Identities, 1)
+	assert.Equal(t, database.DefaultOIDCProvider, list.Identities[0].Provider)
+	assert.Equal(t, "Test SSO", list.Identities[0].ProviderDisplayName)
+	assert.Equal(t, "sam@work.example.com", list.Identities[0].Email)
+	assert.True(t, list.HasPassword)
+
+	// Signing in with the identity now reaches the same user
+	assert.Equal(t, http.StatusOK, it.oidcLogin(t))
+	var count int64
+	it.db.Model(&database.User{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// Another user cannot link the same identity
+	_, otherToken := it.signup(t, "other@example.com")
+	resp = it.api.Post("/me/identities/default", "Authorization: Bearer "+otherToken)
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = it.api.Get("/auth/callback?code=c&state="+it.flow.State, "Cookie: "+auth.LoginStateCookie+"="+it.flow.State)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	// The password user can unlink it
+	resp = it.api.Delete(fmt.Sprintf("/me/identities/%d", list.Identities[0].ID), "Authorization: Bearer "+otherToken)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = it.api.Delete(fmt.Sprintf("/me/identities/%d", list.Identities[0].ID), "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	it.db.Model(&database.Identity{}).Where("user_id = ?", user.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestLinkedIdentityKeepsEmail(t *testing.T) {
+	it := setupIdentityTest(t)
+	user, token := it.signup(t, "kim@example.com")
+
+	resp := it.api.Post("/me/identities/default", "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code)
+	it.setClaims("kim-sub", "kim@work.example.com", true)
+	resp = it.api.Get("/auth/callback?code=c&state="+it.flow.State, "Cookie: "+auth.LoginStateCookie+"="+it.flow.State)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	// Only the identity the account was created with may change its email
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	require.NoError(t, it.db.First(&user, user.ID).Error)
+	assert.Equal(t, "kim@example.com", user.Email)
+	assert.Equal(t, "OIDC User", user.Name)
+}
+
+func TestUnlinkLastIdentityRefused(t *testing.T) {
+	it := setupIdentityTest(t)
+
+	it.setClaims("only-sub", "only@example.com", true)
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+
+	var identity database.Identity
+	require.NoError(t, it.db.Where("subject = ?", "only-sub").First(&identity).Error)
+	token := issueToken(t, it.db, identity.UserID)
+
+	resp := it.api.Delete(fmt.Sprintf("/me/identities/%d", identity.ID), "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+// oidcUser returns the user the identity with the subject belongs to.
+func (it *identityTest) oidcUser(t *testing.T, sub string) database.User {
+	t.Helper()
+	var identity database.Identity
+	require.NoError(t, it.db.Where("subject = ?", sub).First(&identity).Error)
+	var user database.User
+	require.NoError(t, it.db.First(&user, identity.UserID).Error)
+	return user
+}
+
+func TestOIDCProfileSync(t *testing.T) {
+	it := setupIdentityTest(t)
+	it.setClaims("pat-sub", "pat@example.com", true)
+	it.claims["name"] = "Pat"
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+
+	// Name and verified email changes at the provider flow back
+	it.setClaims("pat-sub", "pat.smith@example.com", true)
+	it.claims["name"] = "Pat Smith"
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	user := it.oidcUser(t, "pat-sub")
+	assert.Equal(t, "Pat Smith", user.Name)
+	assert.Equal(t, "pat.smith@example.com", user.Email)
+	assert.NotNil(t, user.EmailVerifiedAt)
+
+	// Unverified emails, and emails of other users, are not taken over
+	it.setClaims("pat-sub", "pat@unverified.example.com", false)
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	assert.Equal(t, "pat.smith@example.com", it.oidcUser(t, "pat-sub").Email)
+
+	it.db.Create(&database.User{Email: "taken@example.com", Role: database.RoleUser})
+	it.setClaims("pat-sub", "taken@example.com", true)
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	assert.Equal(t, "pat.smith@example.com", it.oidcUser(t, "pat-sub").Email)
+
+	var updates int64
+	it.db.Model(&database.AuditEvent{}).Where("action = ? AND target_id = ?", "user.update", fmt.Sprint(user.ID)).Count(&updates)
+	assert.Equal(t, int64(2), updates, "the rename and the name reset by setClaims")
+}
+
+func TestOIDCUnverifiedEmailRequiresVerification(t *testing.T) {
+	it := setupIdentityTest(t)
+	it.db.Create(&database.User{Email: "first@example.com", Role: database.RoleAdmin})
+	require.NoError(t, database.RequireEmailVerification.Set(it.db, true))
+
+	// The provider does not vouch for the address, so no session is started
+	it.setClaims("unverified-sub", "unverified@example.com", false)
+	assert.Equal(t, http.StatusForbidden, it.oidcLogin(t))
+	assert.Nil(t, it.oidcUser(t, "unverified-sub").EmailVerifiedAt)
+
+	// Until it does
+	it.setClaims("unverified-sub", "unverified@example.com", true)
+	assert.Equal(t, http.StatusOK, it.oidcLogin(t))
+	assert.NotNil(t, it.oidcUser(t, "unverified-sub").EmailVerifiedAt)
+}
+
+func TestOIDCClaimRoleMapping(t *testing.T) {
+	it := setupIdentityTest(t)
+	handlers.RegisterAdmin(it.api, it.db)
+	handlers.RegisterUsers(it.api, it.db)
+
+	admin := database.User{Email: "admin@example.com", Role: database.RoleAdmin}
+	it.db.Create(&admin)
+	adminAuth := "Authorization: Bearer " + issueToken(t, it.db, admin.ID)
+
+	resp := it.api.Put("/admin/settings", adminAuth, map[string]any{
+		"oidc_role_mappings": []map[string]string{
+			{"claim": "groups", "value": "inkling-admins", "role": database.RoleAdmin},
+			{"claim": "realm_access.roles", "value": "inkling-admin", "role": database.RoleAdmin},
+		},
+	})
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(t, resp.Body.String(), `"value":"inkling-admins"`)
+
+	resp = it.api.Put("/admin/settings", adminAuth, map[string]any{
+		"oidc_role_mappings": []map[string]string{{"claim": "groups", "value": "x", "role": "missing"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// A list claim containing the value gives the role
+	it.setClaims("kim-sub", "kim@example.com", true)
+	it.claims["groups"] = []string{"staff", "inkling-admins"}
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	kim := it.oidcUser(t, "kim-sub")
+	assert.Equal(t, database.RoleAdmin, kim.Role)
+
+	// Matching no mapping keeps the role, e.g. when the provider stops
+	// sending the claim
+	it.claims["groups"] = []string{"staff"}
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	assert.Equal(t, database.RoleAdmin, it.oidcUser(t, "kim-sub").Role)
+
+	// With a default role, leaving the group at the provider takes the role
+	// away on the next login
+	resp = it.api.Put("/admin/settings", adminAuth, map[string]any{"oidc_default_role": "missing"})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = it.api.Put("/admin/settings", adminAuth, map[string]any{"oidc_default_role": database.RoleUser})
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	assert.Equal(t, database.RoleUser, it.oidcUser(t, "kim-sub").Role)
+
+	// Nested claims are matched too
+	delete(it.claims, "groups")
+	it.claims["realm_access"] = map[string]any{"roles": []string{"inkling-admin"}}
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	assert.Equal(t, database.RoleAdmin, it.oidcUser(t, "kim-sub").Role)
+
+	// A locked role is kept
+	resp = it.api.Put(fmt.Sprintf("/admin/users/%d", kim.ID), adminAuth, map[string]any{"role": database.RoleUser, "role_locked": true})
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	kim = it.oidcUser(t, "kim-sub")
+	assert.Equal(t, database.RoleUser, kim.Role)
+	assert.True(t, kim.RoleLocked)
+
+	resp = it.api.Get("/admin/users", adminAuth)
+	assert.Contains(t, resp.Body.String(), `"role_locked":true`)
+
+	// The role can still be changed by an admin, and the lock lifted
+	resp = it.api.Put(fmt.Sprintf("/admin/users/%d", kim.ID), adminAuth, map[string]any{"role": database.RoleUser, "role_locked": false})
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, http.StatusOK, it.oidcLogin(t))
+	assert.Equal(t, database.RoleAdmin, it.oidcUser(t, "kim-sub").Role)
+}
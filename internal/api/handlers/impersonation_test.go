@@ -0,0 +1,134 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+func setupImpersonationTest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAPIKeys(api, db)
+	handlers.RegisterUser(api, db)
+	handlers.RegisterUsers(api, db)
+	handlers.RegisterRoles(api, db)
+	handlers.RegisterSessions(api, db)
+	return db, api
+}
+
+func impersonate(t *testing.T, api humatest.TestAPI, adminAuth string, userID uint) handlers.ImpersonateUserOutput {
+	t.Helper()
+	resp := api.Post(fmt.Sprintf("/admin/users/%d/impersonate", userID), adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var out handlers.ImpersonateUserOutput
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out.Body))
+	return out
+}
+
+func TestImpersonation(t *testing.T) {
+	db, api := setupImpersonationTest(t)
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	user := database.User{Email: "user@example.com", Name: "User", Role: database.RoleUser, PasswordHash: "x"}
+	db.Create(&admin)
+	db.Create(&user)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+
+	out := impersonate(t, api, adminAuth, user.ID)
+	assert.Equal(t, user.ID, out.Body.User.ID)
+	assert.Equal(t, int(auth.ImpersonationTTL.Seconds()), out.Body.ExpiresIn)
+
+	// The token records both identities and cannot be refreshed
+	claims, err := auth.ValidateJWT(out.Body.Token)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, claims.UserID)
+	require.NotNil(t, claims.Act)
+	assert.Equal(t, admin.ID, claims.Act.UserID)
+	var refreshTokens int64
+	db.Model(&database.RefreshToken{}).Where("session_id = ?", claims.SessionID).Count(&refreshTokens)
+	assert.Zero(t, refreshTokens)
+
+	// Requests act as the user and name the admin
+	userAuth := "Authorization: Bearer " + out.Body.Token
+	resp := api.Get("/me", userAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var me handlers.UserOutput
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &me.Body))
+	assert.Equal(t, user.ID, me.Body.ID)
+	require.NotNil(t, me.Body.Impersonator)
+	assert.Equal(t, admin.Email, me.Body.Impersonator.Email)
+	assert.Equal(t, http.StatusForbidden, api.Get("/admin/users", userAuth).Code)
+
+	// Credential changes are refused
+	resp = api.Put("/me/password", map[string]any{"current_password": "x", "new_password": "password123"}, userAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "impersonating")
+	resp = api.Post("/keys", map[string]any{"name": "k", "scopes": []string{auth.ScopeProfileRead}}, userAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	var keys int64
+	db.Model(&database.APIKey{}).Count(&keys)
+	assert.Zero(t, keys)
+
+	// Every request is audited against the admin, refused ones as failures
+	var events []database.AuditEvent
+	db.Where("action = ?", "impersonation.request").Order("id").Find(&events)
+	require.Len(t, events, 4)
+	for _, event := range events {
+		require.NotNil(t, event.ActorID)
+		assert.Equal(t, admin.ID, *event.ActorID)
+		assert.Equal(t, fmt.Sprint(user.ID), event.TargetID)
+	}
+	assert.Equal(t, "success", events[0].Outcome)
+	assert.Contains(t, events[0].Details, `"operation":"get-current-user"`)
+	assert.Equal(t, "failure", events[2].Outcome)
+	var started int64
+	db.Model(&database.AuditEvent{}).Where("action = ? AND actor_id = ?", "impersonation.start", admin.ID).Count(&started)
+	assert.Equal(t, int64(1), started)
+
+	// Ending the session ends the impersonation
+	require.NoError(t, auth.RevokeSession(db, claims.SessionID))
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/me", userAuth).Code)
+}
+
+func TestImpersonationRefused(t *testing.T) {
+	db, api := setupImpersonationTest(t)
+	admin := database.User{Email: "admin@example.com", Role: database.RoleAdmin}
+	other := database.User{Email: "other@example.com", Role: database.RoleAdmin}
+	user := database.User{Email: "user@example.com", Role: database.RoleUser}
+	db.Create(&admin)
+	db.Create(&other)
+	db.Create(&user)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+	userAuth := "Authorization: Bearer " + issueToken(t, db, user.ID)
+
+	// Admins, yourself and unknown users cannot be impersonated
+	assert.Equal(t, http.StatusForbidden, api.Post(fmt.Sprintf("/admin/users/%d/impersonate", other.ID), adminAuth).Code)
+	assert.Equal(t, http.StatusBadRequest, api.Post(fmt.Sprintf("/admin/users/%d/impersonate", admin.ID), adminAuth).Code)
+	assert.Equal(t, http.StatusNotFound, api.Post("/admin/users/999/impersonate", adminAuth).Code)
+
+	// Users need the permission
+	assert.Equal(t, http.StatusForbidden, api.Post(fmt.Sprintf("/admin/users/%d/impersonate", other.ID), userAuth).Code)
+
+	// Impersonation cannot be chained
+	out := impersonate(t, api, adminAuth, user.ID)
+	impersonatedAuth := "Authorization: Bearer " + out.Body.Token
+	assert.Equal(t, http.StatusForbidden, api.Post(fmt.Sprintf("/admin/users/%d/impersonate", admin.ID), impersonatedAuth).Code)
+
+	// The token stops working once the admin loses the permission
+	require.Equal(t, http.StatusOK, api.Get("/me", impersonatedAuth).Code)
+	db.Model(&admin).Update("role", database.RoleUser)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/me", impersonatedAuth).Code)
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/mail"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// InvitationInfo represents a pending invitation to register.
+type InvitationInfo struct {
+	ID          uint      `json:"id"`
+	Email       string    `json:"email"`
+	Role        string    `json:"role"`
+	InvitedByID uint      `json:"invited_by_id"`
+	Expired     bool      `json:"expired"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ListInvitationsOutput represents the response for listing invitations.
+type ListInvitationsOutput struct {
+	Body struct {
+		Invitations []InvitationInfo `json:"invitations"`
+	}
+}
+
+// CreateInvitationInput represents the request to invite someone to register.
+type CreateInvitationInput struct {
+	Body struct {
+		Email          string `json:"email" format:"email" required:"true"`
+		Role           string `json:"role,omitempty" default:"user" doc:"Role the user registers with"`
+		ExpiresInHours int    `json:"expires_in_hours,omitempty" minimum:"1" maximum:"720" default:"168" doc:"Hours until the invitation expires"`
+	}
+}
+
+// InvitationPathInput identifies an invitation.
+type InvitationPathInput struct {
+	ID uint `path:"id" doc:"Invitation ID"`
+}
+
+// InvitationOutput represents a newly created or resent invitation.
+type InvitationOutput struct {
+	Body struct {
+		Invitation InvitationInfo `json:"invitation"`
+		Token      string         `json:"token" doc:"Invitation token, also emailed to the invitee when email is configured. Earlier tokens for the invitation stop working."`
+		EmailSent  bool           `json:"email_sent"`
+	}
+}
+
+func newInvitationInfo(invitation *database.Invitation) InvitationInfo {
+	return InvitationInfo{
+		ID:          invitation.ID,
+		Email:       invitation.Email,
+		Role:        invitation.Role,
+		InvitedByID: invitation.InvitedByID,
+		Expired:     time.Now().After(invitation.ExpiresAt),
+		ExpiresAt:   invitation.ExpiresAt,
+		CreatedAt:   invitation.CreatedAt,
+	}
+}
+
+// sendInvitationEmail emails the invitation, if email is configured. Failures
+// are logged, the admin still gets the token to pass on.
+func sendInvitationEmail(ctx context.Context, mailer *mail.Mailer, invitation *database.Invitation, token string) bool {
+	if mailer == nil {
+		return false
+	}
+	inviter := middleware.GetUser(ctx)
+	ttl := time.Until(invitation.ExpiresAt).Round(time.Hour)
+	if err := mailer.SendInvitation(ctx, invitation.Email, inviter.Name, token, ttl); err != nil {
+		logging.FromContext(ctx).Error("failed to send invitation email", logging.Email, invitation.Email, logging.Error, err)
+		return false
+	}
+	return true
+}
+
+// recordInvitationAccept audits the registration of an invited user.
+func recordInvitationAccept(ctx context.Context, db *gorm.DB, invitation *database.Invitation, user *database.User) {
+	if invitation == nil {
+		return
+	}
+	recordAudit(ctx, db, auditEntry{
+		Action:     auditInvitationAccept,
+		Actor:      user,
+		TargetType: "invitation",
+		TargetID:   auditID(invitation.ID),
+		Details:    map[string]any{"email": invitation.Email, "role": invitation.Role},
+	})
+}
+
+func findInvitation(db *gorm.DB, id uint) (*database.Invitation, error) {
+	var invitation database.Invitation
+	if err := db.Where("id = ? AND accepted_at IS NULL", id).First(&invitation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("invitation not found")
+		}
+		return nil, huma.Error500InternalServerError("failed to fetch invitation", err)
+	}
+	return &invitation, nil
+}
+
+// RegisterInvitations registers the admin endpoints for inviting users.
+func RegisterInvitations(api huma.API, db *gorm.DB, mailer *mail.Mailer) {
+	huma.Register(api, huma.Operation{
+		OperationID: "list-invitations",
+		Method:      http.MethodGet,
+		Path:        "/admin/invitations",
+		Summary:     "List invitations",
+		Description: "List invitations that have not been redeemed, including expired ones. Requires the users:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersRead},
+	}, func(ctx context.Context, input *struct{}) (*ListInvitationsOutput, error) {
+		var invitations []database.Invitation
+		if err := db.Where("accepted_at IS NULL").Order("created_at DESC").Find(&invitations).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch invitations", err)
+		}
+
+		resp := &ListInvitationsOutput{}
+		resp.Body.Invitations = make([]InvitationInfo, len(invitations))
+		for i := range invitations {
+			resp.Body.Invitations[i] = newInvitationInfo(&invitations[i])
+		}
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "create-invitation",
+		Method:      http.MethodPost,
+		Path:        "/admin/invitations",
+		Summary:     "Invite user",
+		Description: "Invite an email address to register with the given role, even while registration is disabled. The invitation is emailed when email is configured. You can only invite with roles whose permissions you have. Requires the users:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *CreateInvitationInput) (*InvitationOutput, error) {
+		admin, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var role database.Role
+		if err := db.Where("name = ?", input.Body.Role).First(&role).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, huma.Error400BadRequest("unknown role")
+			}
+			return nil, huma.Error500InternalServerError("failed to fetch role", err)
+		}
+		if err := requireRoleWithin(ctx, db, role.Name); err != nil {
+			return nil, err
+		}
+
+		var existing int64
+		db.Model(&database.User{}).Where("LOWER(email) = LOWER(?)", input.Body.Email).Count(&existing)
+		if existing > 0 {
+			return nil, huma.Error409Conflict("a user with this email already exists")
+		}
+
+		ttl := time.Duration(input.Body.ExpiresInHours) * time.Hour
+		invitation, token, err := auth.CreateInvitation(db, admin.ID, input.Body.Email, role.Name, ttl)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to create invitation", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditInvitationCreate,
+			TargetType: "invitation",
+			TargetID:   auditID(invitation.ID),
+			After:      map[string]any{"email": invitation.Email, "role": invitation.Role},
+		})
+
+		resp := &InvitationOutput{}
+		resp.Body.EmailSent = sendInvitationEmail(ctx, mailer, invitation, token)
+		resp.Body.Invitation = newInvitationInfo(invitation)
+		resp.Body.Token = token
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "resend-invitation",
+		Method:      http.MethodPost,
+		Path:        "/admin/invitations/{id}/resend",
+		Summary:     "Resend invitation",
+		Description: "Email the invitation again with a new link, restarting its expiry. The previous link stops working. Requires the users:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *InvitationPathInput) (*InvitationOutput, error) {
+		if mailer == nil {
+			return nil, errMailDisabled
+		}
+		invitation, err := findInvitation(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := auth.RenewInvitation(db, invitation)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to renew invitation", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditInvitationResend,
+			TargetType: "invitation",
+			TargetID:   auditID(invitation.ID),
+			Details:    map[string]any{"email": invitation.Email},
+		})
+
+		resp := &InvitationOutput{}
+		resp.Body.EmailSent = sendInvitationEmail(ctx, mailer, invitation, token)
+		resp.Body.Invitation = newInvitationInfo(invitation)
+		resp.Body.Token = token
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "revoke-invitation",
+		Method:      http.MethodDelete,
+		Path:        "/admin/invitations/{id}",
+		Summary:     "Revoke invitation",
+		Description: "Revoke an invitation so it can no longer be redeemed. Requires the users:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *InvitationPathInput) (*struct{}, error) {
+		invitation, err := findInvitation(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Unscoped().Delete(invitation).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to revoke invitation", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditInvitationRevoke,
+			TargetType: "invitation",
+			TargetID:   auditID(invitation.ID),
+			Before:     map[string]any{"email": invitation.Email, "role": invitation.Role},
+		})
+		return nil, nil
+	})
+}
@@ -0,0 +1,159 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+)
+
+type invitationResponse struct {
+	Invitation handlers.InvitationInfo `json:"invitation"`
+	Token      string                  `json:"token"`
+	EmailSent  bool                    `json:"email_sent"`
+}
+
+func createInvitation(t *testing.T, api humatest.TestAPI, adminAuth string, body map[string]any) invitationResponse {
+	t.Helper()
+	resp := api.Post("/admin/invitations", body, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var out invitationResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+	return out
+}
+
+func signupInvited(api humatest.TestAPI, email, token string) *httptest.ResponseRecorder {
+	return api.Post("/auth/signup", map[string]any{
+		"email":            email,
+		"password":         "password123",
+		"name":             "Invited",
+		"invitation_token": token,
+	})
+}
+
+func TestInvitationSignup(t *testing.T) {
+	db, api, smtp := setupPasswordTest(t)
+	handlers.RegisterInvitations(api, db, smtp.mailer())
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+	require.NoError(t, database.RegistrationEnabled.Set(db, false))
+	require.NoError(t, database.RequireEmailVerification.Set(db, true))
+
+	invitation := createInvitation(t, api, adminAuth, map[string]any{"email": "New@example.com", "role": "admin"})
+	assert.True(t, invitation.EmailSent)
+	assert.Equal(t, "new@example.com", invitation.Invitation.Email)
+	token := linkToken(t, smtp.last(t, "new@example.com"))
+	assert.Equal(t, invitation.Token, token)
+
+	// Registration stays closed to everyone else
+	assert.Equal(t, http.StatusForbidden, signupInvited(api, "new@example.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, signupInvited(api, "other@example.com", token).Code)
+
+	// The invitee registers with the invited role and is already verified
+	resp := signupInvited(api, "new@example.com", token)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(t, resp.Body.String(), `"token"`)
+	var user database.User
+	require.NoError(t, db.Where("email = ?", "new@example.com").First(&user).Error)
+	assert.Equal(t, database.RoleAdmin, user.Role)
+	assert.NotNil(t, user.EmailVerifiedAt)
+
+	// Invitations are single-use and no longer listed
+	db.Unscoped().Delete(&user)
+	assert.Equal(t, http.StatusBadRequest, signupInvited(api, "new@example.com", token).Code)
+	resp = api.Get("/admin/invitations", adminAuth)
+	assert.Contains(t, resp.Body.String(), `"invitations":[]`)
+
+	// Existing users and unknown roles cannot be invited
+	assert.Equal(t, http.StatusConflict, api.Post("/admin/invitations", map[string]any{"email": "ADMIN@example.com"}, adminAuth).Code)
+	assert.Equal(t, http.StatusBadRequest, api.Post("/admin/invitations", map[string]any{"email": "x@example.com", "role": "nope"}, adminAuth).Code)
+}
+
+func TestInvitationResendRevokeExpire(t *testing.T) {
+	db, api, smtp := setupPasswordTest(t)
+	handlers.RegisterInvitations(api, db, smtp.mailer())
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+	require.NoError(t, database.RegistrationEnabled.Set(db, false))
+
+	// Resending replaces the link
+	first := createInvitation(t, api, adminAuth, map[string]any{"email": "resend@example.com"})
+	resp := api.Post(fmt.Sprintf("/admin/invitations/%d/resend", first.Invitation.ID), adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 2, smtp.count())
+	second := linkToken(t, smtp.last(t, "resend@example.com"))
+	assert.NotEqual(t, first.Token, second)
+	assert.Equal(t, http.StatusBadRequest, signupInvited(api, "resend@example.com", first.Token).Code)
+
+	// Revoked invitations cannot be redeemed
+	revoked := createInvitation(t, api, adminAuth, map[string]any{"email": "revoked@example.com"})
+	var list handlers.ListInvitationsOutput
+	resp = api.Get("/admin/invitations", adminAuth)
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list.Body))
+	assert.Len(t, list.Body.Invitations, 2)
+	require.Equal(t, http.StatusNoContent, api.Delete(fmt.Sprintf("/admin/invitations/%d", revoked.Invitation.ID), adminAuth).Code)
+	assert.Equal(t, http.StatusBadRequest, signupInvited(api, "revoked@example.com", revoked.Token).Code)
+	assert.Equal(t, http.StatusNotFound, api.Delete(fmt.Sprintf("/admin/invitations/%d", revoked.Invitation.ID), adminAuth).Code)
+
+	// Expired invitations are listed as such and cannot be redeemed
+	expiring := createInvitation(t, api, adminAuth, map[string]any{"email": "late@example.com", "expires_in_hours": 1})
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiring.Invitation.ExpiresAt, time.Minute)
+	db.Model(&database.Invitation{}).Where("id = ?", expiring.Invitation.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	assert.Equal(t, http.StatusBadRequest, signupInvited(api, "late@example.com", expiring.Token).Code)
+	resp = api.Get("/admin/invitations", adminAuth)
+	assert.Contains(t, resp.Body.String(), `"expired":true`)
+
+	// The resent invitation still works
+	assert.Equal(t, http.StatusOK, signupInvited(api, "resend@example.com", second).Code)
+}
+
+func TestInvitationOIDC(t *testing.T) {
+	pt := setupProviderTest(t)
+	handlers.RegisterInvitations(pt.api, pt.db, nil)
+	adminAuth := "Authorization: Bearer " + pt.adminToken
+	require.NoError(t, database.RegistrationEnabled.Set(pt.db, false))
+
+	// Closed registration turns away uninvited users
+	assert.Equal(t, http.StatusForbidden, pt.loginWith(t, database.DefaultOIDCProvider))
+
+	// The invitation must be for the address the provider reports
+	other := createInvitation(t, pt.api, adminAuth, map[string]any{"email": "other@example.com"})
+	assert.False(t, other.EmailSent)
+	assert.Equal(t, http.StatusForbidden, pt.invitedLogin(t, other.Token))
+
+	invitation := createInvitation(t, pt.api, adminAuth, map[string]any{"email": "env@example.com"})
+	assert.Equal(t, http.StatusOK, pt.invitedLogin(t, invitation.Token))
+	var user database.User
+	require.NoError(t, pt.db.Where("email = ?", "env@example.com").First(&user).Error)
+	assert.Equal(t, database.RoleUser, user.Role)
+
+	var redeemed database.Invitation
+	require.NoError(t, pt.db.First(&redeemed, invitation.Invitation.ID).Error)
+	require.NotNil(t, redeemed.AcceptedUserID)
+	assert.Equal(t, user.ID, *redeemed.AcceptedUserID)
+
+	// Resending needs email
+	resp := pt.api.Post(fmt.Sprintf("/admin/invitations/%d/resend", other.Invitation.ID), adminAuth)
+	assert.Equal(t, http.StatusNotImplemented, resp.Code)
+}
+
+// invitedLogin runs a login through the default provider carrying an invitation.
+func (pt *providerTest) invitedLogin(t *testing.T, token string) int {
+	t.Helper()
+	resp := pt.api.Get("/auth/login?invitation=" + url.QueryEscape(token))
+	require.Equal(t, http.StatusFound, resp.Code)
+	cookie := "Cookie: " + auth.LoginStateCookie + "=" + pt.flow.State
+	return pt.api.Get("/auth/callback?code=c&state="+pt.flow.State, cookie).Code
+}
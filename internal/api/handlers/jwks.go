@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/techsquidtv/inkling/internal/auth"
+)
+
+// ServeJWKS serves the public keys used to verify access tokens so other
+// services can validate Inkling tokens without sharing a secret.
+func ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(auth.Keys().JWKS())
+}
+
+// RegisterJWKS registers the JWKS endpoint directly with the Chi router, since
+// it lives at the well-known path outside of /api.
+func RegisterJWKS(router chi.Router) {
+	router.Get("/.well-known/jwks.json", ServeJWKS)
+}
@@ -0,0 +1,145 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+func setupKeyManager(t *testing.T, cfg auth.KeyConfig) (*auth.KeyManager, *gorm.DB) {
+	db := openTestDB(t)
+
+	keys, err := auth.NewKeyManager(db, cfg)
+	require.NoError(t, err)
+
+	previous := auth.Keys()
+	auth.SetKeyManager(keys)
+	t.Cleanup(func() { auth.SetKeyManager(previous) })
+	return keys, db
+}
+
+func fetchJWKS(t *testing.T) auth.JWKSet {
+	router := chi.NewRouter()
+	handlers.RegisterJWKS(router)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var set auth.JWKSet
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &set))
+	return set
+}
+
+func TestJWKSVerifiesIssuedTokens(t *testing.T) {
+	setupKeyManager(t, auth.KeyConfig{
+		Secret:         strings.Repeat("s", 32),
+		RotationPeriod: time.Hour,
+		GracePeriod:    time.Hour,
+	})
+
+	token, err := auth.GenerateJWT(1, 1)
+	require.NoError(t, err)
+
+	set := fetchJWKS(t)
+	require.Len(t, set.Keys, 1)
+	jwk := set.Keys[0]
+	assert.Equal(t, "OKP", jwk.KeyType)
+	assert.Equal(t, auth.AlgorithmEdDSA, jwk.Algorithm)
+
+	// Verify the token the way a third-party service would: using only the JWKS
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	require.NoError(t, err)
+	parsed, err := jwt.Parse(token, func(tok *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwk.KeyID, tok.Header["kid"])
+		return ed25519.PublicKey(x), nil
+	})
+	require.NoError(t, err)
+	assert.True(t, parsed.Valid)
+}
+
+func TestKeyRotationGraceWindow(t *testing.T) {
+	keys, db := setupKeyManager(t, auth.KeyConfig{
+		Algorithm:      auth.AlgorithmRS256,
+		Secret:         strings.Repeat("s", 32),
+		RotationPeriod: time.Hour,
+		GracePeriod:    time.Hour,
+	})
+
+	oldToken, err := auth.GenerateJWT(1, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, keys.Rotate())
+	newToken, err := auth.GenerateJWT(1, 1)
+	require.NoError(t, err)
+
+	// Both the old and new keys are accepted and published
+	_, err = auth.ValidateJWT(oldToken)
+	assert.NoError(t, err)
+	_, err = auth.ValidateJWT(newToken)
+	assert.NoError(t, err)
+	assert.Len(t, fetchJWKS(t).Keys, 2)
+
+	// Private keys are encrypted at rest
+	var stored []database.SigningKey
+	db.Find(&stored)
+	for _, k := range stored {
+		assert.True(t, k.Encrypted)
+		assert.NotContains(t, k.PrivateKey, "PRIVATE KEY")
+	}
+
+	// Once the grace window has passed the old key is dropped
+	db.Model(&database.SigningKey{}).Where("rotated_at IS NOT NULL").Update("expires_at", time.Now().Add(-time.Minute))
+	reloaded, err := auth.NewKeyManager(db, auth.KeyConfig{
+		Algorithm:      auth.AlgorithmRS256,
+		Secret:         strings.Repeat("s", 32),
+		RotationPeriod: time.Hour,
+		GracePeriod:    time.Hour,
+	})
+	require.NoError(t, err)
+	auth.SetKeyManager(reloaded)
+
+	_, err = auth.ValidateJWT(oldToken)
+	assert.Error(t, err)
+	_, err = auth.ValidateJWT(newToken)
+	assert.NoError(t, err)
+	assert.Len(t, fetchJWKS(t).Keys, 1)
+}
+
+func TestKeyConfigRequiresSecretInProduction(t *testing.T) {
+	cfg := auth.KeyConfig{RotationPeriod: time.Hour, GracePeriod: time.Hour}
+	assert.NoError(t, cfg.Validate(false))
+	assert.Error(t, cfg.Validate(true))
+
+	cfg.Secret = strings.Repeat("s", 32)
+	assert.NoError(t, cfg.Validate(true))
+
+	// Encrypted keys cannot be loaded without the secret
+	_, db := setupKeyManager(t, cfg)
+	_, err := auth.NewKeyManager(db, auth.KeyConfig{RotationPeriod: time.Hour, GracePeriod: time.Hour})
+	assert.Error(t, err)
+}
+
+func TestKeyManagerStartsWithTinyRotationPeriod(t *testing.T) {
+	keys, err := auth.NewKeyManager(nil, auth.KeyConfig{RotationPeriod: time.Nanosecond, GracePeriod: time.Hour})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NotPanics(t, func() { keys.Start(ctx) })
+}
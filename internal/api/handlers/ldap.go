@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// LDAPSettingsInfo represents the directory settings in admin responses.
+type LDAPSettingsInfo struct {
+	URL                  string               `json:"url" doc:"ldap:// or ldaps:// URL of the directory server"`
+	StartTLS             bool                 `json:"start_tls" doc:"Upgrade ldap:// connections with StartTLS"`
+	InsecureSkipVerify   bool                 `json:"insecure_skip_verify" doc:"Skip server certificate verification"`
+	BindDN               string               `json:"bind_dn" doc:"Service account used to search for users, anonymous when empty"`
+	HasBindPassword      bool                 `json:"has_bind_password"`
+	BaseDN               string               `json:"base_dn" doc:"Where to search for users"`
+	UserFilter           string               `json:"user_filter" doc:"Search filter, {email} is replaced by the login email"`
+	EmailAttribute       string               `json:"email_attribute"`
+	NameAttribute        string               `json:"name_attribute"`
+	GroupAttribute       string               `json:"group_attribute" doc:"Attribute listing the distinguished names of the user's groups"`
+	GroupRoles           []auth.LDAPGroupRole `json:"group_roles" doc:"Role given to members of each group on every login, the first match wins"`
+	LinkExistingAccounts bool                 `json:"link_existing_accounts" doc:"Link directory logins to the local account with the same email. Otherwise they are refused."`
+	Enabled              bool                 `json:"enabled"`
+}
+
+// LDAPSettingsOutput represents the directory settings response.
+type LDAPSettingsOutput struct {
+	Body LDAPSettingsInfo
+}
+
+// UpdateLDAPSettingsInput represents the request to change the directory
+// settings.
+type UpdateLDAPSettingsInput struct {
+	Body struct {
+		URL                  *string               `json:"url,omitempty"`
+		StartTLS             *bool                 `json:"start_tls,omitempty"`
+		InsecureSkipVerify   *bool                 `json:"insecure_skip_verify,omitempty"`
+		BindDN               *string               `json:"bind_dn,omitempty"`
+		BindPassword         *string               `json:"bind_password,omitempty"`
+		BaseDN               *string               `json:"base_dn,omitempty"`
+		UserFilter           *string               `json:"user_filter,omitempty"`
+		EmailAttribute       *string               `json:"email_attribute,omitempty" minLength:"1"`
+		NameAttribute        *string               `json:"name_attribute,omitempty" minLength:"1"`
+		GroupAttribute       *string               `json:"group_attribute,omitempty" minLength:"1"`
+		GroupRoles           *[]auth.LDAPGroupRole `json:"group_roles,omitempty"`
+		LinkExistingAccounts *bool                 `json:"link_existing_accounts,omitempty"`
+		Enabled              *bool                 `json:"enabled,omitempty"`
+	}
+}
+
+// TestLDAPInput represents the request to check the directory settings.
+type TestLDAPInput struct {
+	Body struct {
+		Email    string `json:"email,omitempty" format:"email" doc:"Look up this user. Only the service bind is checked when empty."`
+		Password string `json:"password,omitempty" doc:"Also bind as the user with this password"`
+	}
+}
+
+// TestLDAPOutput represents the directory user found by a settings check.
+type TestLDAPOutput struct {
+	Body struct {
+		DN     string   `json:"dn,omitempty"`
+		Email  string   `json:"email,omitempty"`
+		Name   string   `json:"name,omitempty"`
+		Groups []string `json:"groups,omitempty"`
+		Role   string   `json:"role,omitempty" doc:"Role the user would be given by the group mappings"`
+	}
+}
+
+func ldapSettingsInfo(cfg *database.LDAPConfig) LDAPSettingsInfo {
+	groupRoles := auth.ParseLDAPGroupRoles(cfg)
+	if groupRoles == nil {
+		groupRoles = []auth.LDAPGroupRole{}
+	}
+	return LDAPSettingsInfo{
+		URL:                  cfg.URL,
+		StartTLS:             cfg.StartTLS,
+		InsecureSkipVerify:   cfg.InsecureSkipVerify,
+		BindDN:               cfg.BindDN,
+		HasBindPassword:      cfg.BindPassword != "",
+		BaseDN:               cfg.BaseDN,
+		UserFilter:           cfg.UserFilter,
+		EmailAttribute:       cfg.EmailAttribute,
+		NameAttribute:        cfg.NameAttribute,
+		GroupAttribute:       cfg.GroupAttribute,
+		GroupRoles:           groupRoles,
+		LinkExistingAccounts: cfg.LinkExistingAccounts,
+		Enabled:              cfg.Enabled,
+	}
+}
+
+// validateLDAPSettings checks the settings are complete enough to sign in
+// with. Disabled settings may be saved half-finished.
+func validateLDAPSettings(cfg *database.LDAPConfig) error {
+	if cfg.URL != "" {
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return huma.Error400BadRequest("url must be an ldap:// or ldaps:// URL")
+		}
+		if cfg.StartTLS && u.Scheme == "ldaps" {
+			return huma.Error400BadRequest("start_tls cannot be used with ldaps://")
+		}
+	}
+	if cfg.UserFilter != "" && !strings.Contains(cfg.UserFilter, "{email}") {
+		return huma.Error400BadRequest("user_filter must contain {email}")
+	}
+	if cfg.Enabled && (cfg.URL == "" || cfg.BaseDN == "" || cfg.UserFilter == "") {
+		return huma.Error400BadRequest("url, base_dn and user_filter are required to enable LDAP")
+	}
+	return nil
+}
+
+// ldapLogin signs the user in against the directory when LDAP is enabled. It
+// returns no user when the directory does not know the email or cannot be
+// reached, so local accounts can still sign in.
+func ldapLogin(ctx context.Context, db *gorm.DB, email, password string) (*database.User, error) {
+	cfg, err := auth.LDAPSettings(db)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("database error", err)
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	entry, err := auth.AuthenticateLDAP(cfg, email, password)
+	switch {
+	case errors.Is(err, auth.ErrLDAPUserNotFound):
+		return nil, nil
+	case errors.Is(err, auth.ErrLDAPInvalidCredentials):
+		logging.FromContext(ctx).Warn("failed login attempt", logging.Email, email, "reason", "invalid directory password")
+		recordLoginFailure(ctx, db, email)
+		return nil, huma.Error401Unauthorized("invalid email or password")
+	case err != nil:
+		logging.FromContext(ctx).Error("LDAP authentication failed", logging.Email, email, logging.Error, err)
+		return nil, nil
+	}
+
+	// The directory vouches for the address, like a verified email claim
+	claims := &oidcClaims{Email: entry.Email, EmailVerified: true, Name: entry.Name, Sub: entry.DN}
+	user, err := resolveIdentityUser(ctx, db, database.LDAPProvider, claims, &database.PendingLogin{})
+	if err != nil {
+		return nil, err
+	}
+	if err := syncIdentityProfile(ctx, db, user, claims, database.LDAPProvider); err != nil {
+		return nil, err
+	}
+	if role, ok := auth.LDAPRole(cfg, entry); ok {
+		if err := syncIdentityRole(ctx, db, user, role, database.LDAPProvider); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// RegisterLDAP registers the admin endpoints for the LDAP directory settings.
+func RegisterLDAP(api huma.API, db *gorm.DB) {
+	// GET /api/admin/ldap - Get the directory settings
+	huma.Register(api, huma.Operation{
+		OperationID: "get-ldap-settings",
+		Method:      http.MethodGet,
+		Path:        "/admin/ldap",
+		Summary:     "Get LDAP settings",
+		Description: "Get the LDAP directory used to authenticate email logins. Requires the settings:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsRead},
+	}, func(ctx context.Context, input *struct{}) (*LDAPSettingsOutput, error) {
+		cfg, err := auth.LDAPSettings(db)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch LDAP settings", err)
+		}
+		return &LDAPSettingsOutput{Body: ldapSettingsInfo(cfg)}, nil
+	})
+
+	// PUT /api/admin/ldap - Update the directory settings
+	huma.Register(api, huma.Operation{
+		OperationID: "update-ldap-settings",
+		Method:      http.MethodPut,
+		Path:        "/admin/ldap",
+		Summary:     "Update LDAP settings",
+		Description: "Update the LDAP directory settings. Omitted fields are left unchanged. Groups can only be mapped to roles whose permissions the caller has. Requires the settings:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsWrite},
+	}, func(ctx context.Context, input *UpdateLDAPSettingsInput) (*LDAPSettingsOutput, error) {
+		cfg, err := auth.LDAPSettings(db)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch LDAP settings", err)
+		}
+		before := ldapSettingsInfo(cfg)
+
+		body := input.Body
+		if body.URL != nil {
+			cfg.URL = strings.TrimSpace(*body.URL)
+		}
+		if body.StartTLS != nil {
+			cfg.StartTLS = *body.StartTLS
+		}
+		if body.InsecureSkipVerify != nil {
+			cfg.InsecureSkipVerify = *body.InsecureSkipVerify
+		}
+		if body.BindDN != nil {
+			cfg.BindDN = *body.BindDN
+		}
+		if body.BindPassword != nil {
+			sealed, err := auth.Keys().SealSecret(*body.BindPassword)
+			if err != nil {
+				return nil, huma.Error500InternalServerError("failed to encrypt bind password", err)
+			}
+			cfg.BindPassword = sealed
+		}
+		if body.BaseDN != nil {
+			cfg.BaseDN = *body.BaseDN
+		}
+		if body.UserFilter != nil {
+			cfg.UserFilter = *body.UserFilter
+		}
+		if body.EmailAttribute != nil {
+			cfg.EmailAttribute = *body.EmailAttribute
+		}
+		if body.NameAttribute != nil {
+			cfg.NameAttribute = *body.NameAttribute
+		}
+		if body.GroupAttribute != nil {
+			cfg.GroupAttribute = *body.GroupAttribute
+		}
+		if body.GroupRoles != nil {
+			for _, mapping := range *body.GroupRoles {
+				if mapping.Group == "" {
+					return nil, huma.Error400BadRequest("group mappings need a group")
+				}
+				if err := requireExistingRole(db, mapping.Role); err != nil {
+					return nil, err
+				}
+				if err := requireRoleWithin(ctx, db, mapping.Role); err != nil {
+					return nil, err
+				}
+			}
+			cfg.GroupRoles = auth.EncodeLDAPGroupRoles(*body.GroupRoles)
+		}
+		if body.LinkExistingAccounts != nil {
+			cfg.LinkExistingAccounts = *body.LinkExistingAccounts
+		}
+		if body.Enabled != nil {
+			cfg.Enabled = *body.Enabled
+		}
+		if err := validateLDAPSettings(cfg); err != nil {
+			return nil, err
+		}
+		if err := db.Save(cfg).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to save LDAP settings", err)
+		}
+
+		resp := &LDAPSettingsOutput{Body: ldapSettingsInfo(cfg)}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditSettingsUpdate,
+			TargetType: "ldap",
+			Before:     before,
+			After:      resp.Body,
+		})
+		logging.FromContext(ctx).Info("LDAP settings updated", "enabled", cfg.Enabled)
+		return resp, nil
+	})
+
+	// POST /api/admin/ldap/test - Check the directory settings
+	huma.Register(api, huma.Operation{
+		OperationID: "test-ldap-settings",
+		Method:      http.MethodPost,
+		Path:        "/admin/ldap/test",
+		Summary:     "Test LDAP settings",
+		Description: "Connect and bind with the stored settings, whether or not LDAP is enabled, and optionally look up a user or sign them in. Requires the settings:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsWrite},
+	}, func(ctx context.Context, input *TestLDAPInput) (*TestLDAPOutput, error) {
+		cfg, err := auth.LDAPSettings(db)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch LDAP settings", err)
+		}
+		if cfg.URL == "" {
+			return nil, huma.Error400BadRequest("LDAP is not configured")
+		}
+
+		resp := &TestLDAPOutput{}
+		if input.Body.Email == "" {
+			if err := auth.CheckLDAP(cfg); err != nil {
+				return nil, huma.Error400BadRequest("LDAP check failed: " + err.Error())
+			}
+			return resp, nil
+		}
+
+		var entry *auth.LDAPEntry
+		if input.Body.Password != "" {
+			entry, err = auth.AuthenticateLDAP(cfg, input.Body.Email, input.Body.Password)
+		} else {
+			entry, err = auth.LookupLDAP(cfg, input.Body.Email)
+		}
+		switch {
+		case errors.Is(err, auth.ErrLDAPUserNotFound):
+			return nil, huma.Error404NotFound("user not found in directory")
+		case err != nil:
+			return nil, huma.Error400BadRequest("LDAP check failed: " + err.Error())
+		}
+
+		resp.Body.DN = entry.DN
+		resp.Body.Email = entry.Email
+		resp.Body.Name = entry.Name
+		resp.Body.Groups = entry.Groups
+		resp.Body.Role, _ = auth.LDAPRole(cfg, entry)
+		return resp, nil
+	})
+}
@@ -0,0 +1,387 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	ldapBaseDN      = "dc=example,dc=com"
+	ldapServiceDN   = "cn=inkling,ou=services,dc=example,dc=com"
+	ldapAdminsGroup = "cn=Admins,ou=groups,dc=example,dc=com"
+	ldapStaffGroup  = "cn=staff,ou=groups,dc=example,dc=com"
+)
+
+// ldapEntry is a directory entry served by ldapStandIn.
+type ldapEntry struct {
+	DN       string
+	Password string
+	Attrs    map[string][]string
+}
+
+// ldapStandIn is a minimal LDAP server. It answers simple binds and searches
+// with a single equality filter.
+type ldapStandIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	entries  []ldapEntry
+}
+
+func newLDAPStandIn(t *testing.T, entries ...ldapEntry) *ldapStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &ldapStandIn{listener: l, entries: entries}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStandIn) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// setGroups replaces the groups of the entry with the DN.
+func (s *ldapStandIn) setGroups(dn string, groups ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range s.entries {
+		if entry.DN == dn {
+			entry.Attrs["memberOf"] = groups
+		}
+	}
+}
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if s.bind(dn, op.Children[2].Data.String()) {
+				code = ldap.LDAPResultSuccess
+			}
+			ldapReply(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			base, _ := op.Children[0].Value.(string)
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				ldapReply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)
+				continue
+			}
+			for _, entry := range s.search(base, filter) {
+				conn.Write(ldapSearchEntry(id, entry).Bytes())
+			}
+			ldapReply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *ldapStandIn) bind(dn, password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) {
+			return password != "" && entry.Password == password
+		}
+	}
+	return false
+}
+
+// search matches filters of the form (attribute=value) under the base DN.
+func (s *ldapStandIn) search(base, filter string) []ldapEntry {
+	attr, value, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")"), "=")
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []ldapEntry
+	for _, entry := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(entry.DN), strings.ToLower(base)) {
+			continue
+		}
+		for name, values := range entry.Attrs {
+			if strings.EqualFold(name, attr) && len(values) > 0 && strings.EqualFold(values[0], value) {
+				found = append(found, entry)
+			}
+		}
+	}
+	return found
+}
+
+func ldapEnvelope(id int64, op *ber.Packet) *ber.Packet {
+	envelope := ber.NewSequence("LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	envelope.AppendChild(op)
+	return envelope
+}
+
+func ldapReply(conn net.Conn, id int64, tag ber.Tag, code uint16) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	conn.Write(ldapEnvelope(id, op).Bytes())
+}
+
+func ldapSearchEntry(id int64, entry ldapEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+	attrs := ber.NewSequence("Attributes")
+	for name, values := range entry.Attrs {
+		attr := ber.NewSequence("Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return ldapEnvelope(id, op)
+}
+
+func userDN(name string) string {
+	return fmt.Sprintf("uid=%s,ou=people,%s", name, ldapBaseDN)
+}
+
+func setupLDAPTest(t *testing.T) (*gorm.DB, humatest.TestAPI, *ldapStandIn, string) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterLDAP(api, db)
+
+	directory := newLDAPStandIn(t,
+		ldapEntry{DN: ldapServiceDN, Password: "service-secret", Attrs: map[string][]string{}},
+		ldapEntry{DN: userDN("alice"), Password: "alice-pw", Attrs: map[string][]string{
+			"mail":        {"alice@example.com"},
+			"displayName": {"Alice Directory"},
+			"memberOf":    {"cn=admins,ou=groups,dc=example,dc=com", ldapStaffGroup},
+		}},
+		ldapEntry{DN: userDN("bob"), Password: "bob-pw", Attrs: map[string][]string{
+			"mail":     {"bob@example.com"},
+			"memberOf": {ldapStaffGroup},
+		}},
+	)
+
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+	return db, api, directory, adminAuth
+}
+
+func configureLDAP(t *testing.T, api humatest.TestAPI, adminAuth, url string) handlers.LDAPSettingsInfo {
+	t.Helper()
+	resp := api.Put("/admin/ldap", adminAuth, map[string]any{
+		"url":           url,
+		"bind_dn":       ldapServiceDN,
+		"bind_password": "service-secret",
+		"base_dn":       ldapBaseDN,
+		"group_roles": []map[string]string{
+			{"group": ldapAdminsGroup, "role": database.RoleAdmin},
+			{"group": ldapStaffGroup, "role": database.RoleUser},
+		},
+		"enabled": true,
+	})
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var out handlers.LDAPSettingsInfo
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+	return out
+}
+
+func TestLDAPLogin(t *testing.T) {
+	db, api, directory, adminAuth := setupLDAPTest(t)
+
+	// Before LDAP is enabled, directory users cannot sign in
+	assert.Equal(t, http.StatusUnauthorized, attemptLogin(api, "alice@example.com", "alice-pw"))
+
+	settings := configureLDAP(t, api, adminAuth, directory.url())
+	assert.True(t, settings.HasBindPassword)
+	assert.Equal(t, "(mail={email})", settings.UserFilter)
+	assert.NotContains(t, api.Get("/admin/ldap", adminAuth).Body.String(), "service-secret")
+
+	// Search-then-bind provisions the user with the role of their first
+	// mapped group, matching the group DN regardless of case
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "alice@example.com", "alice-pw"))
+	var alice database.User
+	require.NoError(t, db.Where("email = ?", "alice@example.com").First(&alice).Error)
+	assert.Equal(t, database.LDAPProvider, alice.Provider)
+	assert.Equal(t, userDN("alice"), *alice.InternalID)
+	assert.Equal(t, "Alice Directory", alice.Name)
+	assert.Equal(t, database.RoleAdmin, alice.Role)
+	assert.NotNil(t, alice.EmailVerifiedAt)
+	assert.Empty(t, alice.PasswordHash)
+
+	var identities int64
+	db.Model(&database.Identity{}).Where("provider = ? AND user_id = ?", database.LDAPProvider, alice.ID).Count(&identities)
+	assert.Equal(t, int64(1), identities)
+
+	// Wrong directory passwords are refused
+	assert.Equal(t, http.StatusUnauthorized, attemptLogin(api, "alice@example.com", "wrong"))
+
+	// Groups are re-read on every login
+	directory.setGroups(userDN("alice"), ldapStaffGroup)
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "alice@example.com", "alice-pw"))
+	require.NoError(t, db.First(&alice, alice.ID).Error)
+	assert.Equal(t, database.RoleUser, alice.Role)
+	var roleUpdates int64
+	db.Model(&database.AuditEvent{}).Where("action = ? AND target_id = ?", "user.role_update", fmt.Sprint(alice.ID)).Count(&roleUpdates)
+	assert.Equal(t, int64(2), roleUpdates, "promoted on the first login, demoted on the second")
+
+	// Users in no mapped group keep their role
+	require.NoError(t, db.Model(&alice).Update("role", database.RoleAdmin).Error)
+	directory.setGroups(userDN("alice"))
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "alice@example.com", "alice-pw"))
+	require.NoError(t, db.First(&alice, alice.ID).Error)
+	assert.Equal(t, database.RoleAdmin, alice.Role)
+
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "bob@example.com", "bob-pw"))
+	var logins int64
+	db.Model(&database.AuditEvent{}).Where("action = ? AND details LIKE ?", "auth.login", `%"method":"ldap"%`).Count(&logins)
+	assert.Equal(t, int64(5), logins, "including the wrong password")
+
+	// Emails the directory does not know fall back to local accounts
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	db.Create(&database.User{Email: "local@example.com", PasswordHash: string(hash), Role: database.RoleUser})
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "local@example.com", "password123"))
+	assert.Equal(t, http.StatusUnauthorized, attemptLogin(api, "nobody@example.com", "password123"))
+}
+
+func TestLDAPExistingLocalAccount(t *testing.T) {
+	db, api, directory, adminAuth := setupLDAPTest(t)
+	configureLDAP(t, api, adminAuth, directory.url())
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	bob := database.User{Email: "bob@example.com", PasswordHash: string(hash), Role: database.RoleUser}
+	db.Create(&bob)
+
+	// The directory login is refused with a message pointing at the setting,
+	// even though the admin setting for OIDC providers is on
+	require.NoError(t, database.AutoLinkVerifiedEmail.Set(db, true))
+	resp := api.Post("/auth/login", map[string]any{"email": "bob@example.com", "password": "bob-pw"})
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "link_existing_accounts")
+
+	// Once the admin allows it, the directory login is linked to the account
+	resp = api.Put("/admin/ldap", adminAuth, map[string]any{"link_existing_accounts": true})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var settings handlers.LDAPSettingsInfo
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &settings))
+	assert.True(t, settings.LinkExistingAccounts)
+
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "bob@example.com", "bob-pw"))
+	var identity database.Identity
+	require.NoError(t, db.Where("provider = ?", database.LDAPProvider).First(&identity).Error)
+	assert.Equal(t, bob.ID, identity.UserID)
+	assert.Equal(t, userDN("bob"), identity.Subject)
+	var users int64
+	db.Model(&database.User{}).Where("email = ?", "bob@example.com").Count(&users)
+	assert.Equal(t, int64(1), users)
+}
+
+func TestLDAPUnreachableDirectory(t *testing.T) {
+	db, api, _, adminAuth := setupLDAPTest(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := "ldap://" + l.Addr().String()
+	l.Close()
+	configureLDAP(t, api, adminAuth, closed)
+
+	// Local accounts keep working while the directory is down
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	db.Create(&database.User{Email: "local@example.com", PasswordHash: string(hash), Role: database.RoleUser})
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "local@example.com", "password123"))
+	assert.Equal(t, http.StatusUnauthorized, attemptLogin(api, "alice@example.com", "alice-pw"))
+
+	resp := api.Post("/admin/ldap/test", adminAuth, map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestLDAPSettingsTest(t *testing.T) {
+	_, api, directory, adminAuth := setupLDAPTest(t)
+	configureLDAP(t, api, adminAuth, directory.url())
+
+	resp := api.Post("/admin/ldap/test", adminAuth, map[string]any{})
+	assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	resp = api.Post("/admin/ldap/test", adminAuth, map[string]any{"email": "alice@example.com"})
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var found handlers.TestLDAPOutput
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &found.Body))
+	assert.Equal(t, userDN("alice"), found.Body.DN)
+	assert.Equal(t, database.RoleAdmin, found.Body.Role)
+
+	resp = api.Post("/admin/ldap/test", adminAuth, map[string]any{"email": "alice@example.com", "password": "wrong"})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = api.Post("/admin/ldap/test", adminAuth, map[string]any{"email": "nobody@example.com"})
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	// A wrong service password fails the bind
+	resp = api.Put("/admin/ldap", adminAuth, map[string]any{"bind_password": "wrong"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = api.Post("/admin/ldap/test", adminAuth, map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestLDAPSettingsValidation(t *testing.T) {
+	db, api, directory, adminAuth := setupLDAPTest(t)
+
+	cases := []map[string]any{
+		{"url": "http://directory.example.com"},
+		{"url": "ldaps://directory.example.com", "start_tls": true},
+		{"user_filter": "(mail=*)"},
+		{"enabled": true},
+		{"group_roles": []map[string]string{{"group": ldapAdminsGroup, "role": "missing"}}},
+	}
+	for _, body := range cases {
+		resp := api.Put("/admin/ldap", adminAuth, body)
+		assert.Equal(t, http.StatusBadRequest, resp.Code, "%v: %s", body, resp.Body.String())
+	}
+
+	user := database.User{Email: "user@example.com", Role: database.RoleUser}
+	db.Create(&user)
+	userAuth := "Authorization: Bearer " + issueToken(t, db, user.ID)
+	resp := api.Put("/admin/ldap", userAuth, map[string]any{"url": directory.url()})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Get("/admin/ldap", userAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// LockoutInfo represents the failed login counter for an IP or account.
+type LockoutInfo struct {
+	ID            uint       `json:"id"`
+	Scope         string     `json:"scope" enum:"ip,account,mail_ip,mail_recipient" doc:"Login failures of an IP or account, or emails requested by an IP or for a recipient"`
+	Subject       string     `json:"subject" doc:"IP address or email"`
+	Failures      int        `json:"failures" doc:"Failed attempts in the current window"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty" doc:"Set while logins are refused"`
+	Locked        bool       `json:"locked"`
+}
+
+// ListLockoutsOutput represents the response for listing login lockouts.
+type ListLockoutsOutput struct {
+	Body struct {
+		Lockouts []LockoutInfo `json:"lockouts"`
+	}
+}
+
+// ClearLockoutInput represents the request to clear a lockout.
+type ClearLockoutInput struct {
+	ID uint `path:"id" doc:"Lockout ID"`
+}
+
+func newLockoutInfo(record *database.LoginThrottle) LockoutInfo {
+	info := LockoutInfo{
+		ID:            record.ID,
+		Scope:         record.Scope,
+		Subject:       record.Subject,
+		Failures:      record.Failures,
+		LastFailureAt: record.LastFailureAt,
+	}
+	if record.LockedUntil != nil && record.LockedUntil.After(time.Now()) {
+		info.LockedUntil = record.LockedUntil
+		info.Locked = true
+	}
+	return info
+}
+
+// RegisterLockouts registers the admin endpoints for login lockouts.
+func RegisterLockouts(api huma.API, db *gorm.DB) {
+	// GET /api/admin/lockouts - List failed login counters
+	huma.Register(api, huma.Operation{
+		OperationID: "list-lockouts",
+		Method:      http.MethodGet,
+		Path:        "/admin/lockouts",
+		Summary:     "List login lockouts",
+		Description: "List IPs and accounts with recent failed logins, including those currently locked out. Requires the users:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersRead},
+	}, func(ctx context.Context, input *struct {
+		Locked bool `query:"locked" doc:"Only return active lockouts"`
+	}) (*ListLockoutsOutput, error) {
+		records, err := auth.ListLoginThrottles(db)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to list lockouts", err)
+		}
+
+		resp := &ListLockoutsOutput{}
+		resp.Body.Lockouts = make([]LockoutInfo, 0, len(records))
+		for i := range records {
+			info := newLockoutInfo(&records[i])
+			if input.Locked && !info.Locked {
+				continue
+			}
+			resp.Body.Lockouts = append(resp.Body.Lockouts, info)
+		}
+		return resp, nil
+	})
+
+	// DELETE /api/admin/lockouts/{id} - Clear a lockout
+	huma.Register(api, huma.Operation{
+		OperationID: "clear-lockout",
+		Method:      http.MethodDelete,
+		Path:        "/admin/lockouts/{id}",
+		Summary:     "Clear a login lockout",
+		Description: "Reset the failed login counter for an IP or account, lifting any lockout. Requires the users:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *ClearLockoutInput) (*struct{}, error) {
+		admin, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := auth.ClearLoginThrottle(db, input.ID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, huma.Error404NotFound("lockout not found")
+			}
+			return nil, huma.Error500InternalServerError("failed to clear lockout", err)
+		}
+
+		logging.FromContext(ctx).Info("login lockout cleared", logging.UserID, admin.ID, "lockout_id", input.ID)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditLockoutClear,
+			TargetType: "lockout",
+			TargetID:   auditID(input.ID),
+		})
+		return nil, nil
+	})
+}
@@ -0,0 +1,155 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"gorm.io/gorm"
+)
+
+func setupLockoutTest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterLockouts(api, db)
+	return db, api
+}
+
+func attemptLogin(api humatest.TestAPI, email, password string) int {
+	return api.Post("/auth/login", map[string]any{"email": email, "password": password}).Code
+}
+
+// metricSum returns the total of a counter collected by reader.
+func metricSum(t *testing.T, reader *sdkmetric.ManualReader, name string) int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok && m.Name == name {
+				for _, dp := range sum.DataPoints {
+					total += dp.Value
+				}
+			}
+		}
+	}
+	return total
+}
+
+func TestAccountLockout(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	db, api := setupLockoutTest(t)
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	adminToken := issueToken(t, db, admin.ID)
+	api.Post("/auth/signup", map[string]any{"email": "victim@example.com", "password": "password123", "name": "Victim"})
+
+	// Failures below the threshold are reset by a successful login
+	for range 9 {
+		assert.Equal(t, http.StatusUnauthorized, attemptLogin(api, "victim@example.com", "wrong-password"))
+	}
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "victim@example.com", "password123"))
+
+	// Ten failures in a row lock the account, even for the right password
+	for range 10 {
+		assert.Equal(t, http.StatusUnauthorized, attemptLogin(api, "Victim@example.com", "wrong-password"))
+	}
+	resp := api.Post("/auth/login", map[string]any{"email": "victim@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	retryAfter, err := strconv.Atoi(resp.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 30, retryAfter, 1)
+
+	// Other accounts from the same IP are unaffected
+	assert.Equal(t, http.StatusUnauthorized, attemptLogin(api, "other@example.com", "wrong-password"))
+
+	// Admins can see and clear the lockout
+	resp = api.Get("/admin/lockouts?locked=true", "Authorization: Bearer "+adminToken)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var listed struct {
+		Lockouts []handlers.LockoutInfo `json:"lockouts"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &listed))
+	require.Len(t, listed.Lockouts, 1)
+	assert.Equal(t, "account", listed.Lockouts[0].Scope)
+	assert.Equal(t, "victim@example.com", listed.Lockouts[0].Subject)
+	assert.Equal(t, 10, listed.Lockouts[0].Failures)
+
+	resp = api.Delete(fmt.Sprintf("/admin/lockouts/%d", listed.Lockouts[0].ID), "Authorization: Bearer "+adminToken)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, http.StatusOK, attemptLogin(api, "victim@example.com", "password123"))
+
+	assert.Equal(t, int64(20), metricSum(t, reader, "auth.login.failures"))
+	assert.Equal(t, int64(1), metricSum(t, reader, "auth.login.lockouts"))
+	assert.Equal(t, int64(1), metricSum(t, reader, "auth.login.throttled"))
+}
+
+func TestIPLockoutBacksOff(t *testing.T) {
+	db, api := setupLockoutTest(t)
+	user := database.User{Email: "user@example.com", Name: "User", Role: database.RoleUser}
+	db.Create(&user)
+
+	// Spraying many accounts from one IP locks the IP
+	for i := range 30 {
+		attemptLogin(api, fmt.Sprintf("user%d@example.com", i), "guess")
+	}
+	resp := api.Post("/auth/login", map[string]any{"email": "fresh@example.com", "password": "guess"})
+	require.Equal(t, http.StatusTooManyRequests, resp.Code)
+
+	// Each further failure doubles the lockout
+	var record database.LoginThrottle
+	db.Where("scope = ?", "ip").First(&record)
+	first := record.LockedUntil.Sub(record.LastFailureAt)
+	db.Model(&record).Update("locked_until", nil)
+	attemptLogin(api, "fresh@example.com", "guess")
+	db.First(&record, record.ID)
+	assert.Equal(t, 2*first, record.LockedUntil.Sub(record.LastFailureAt))
+
+	// Non-admins cannot see lockouts
+	resp = api.Get("/admin/lockouts", "Authorization: Bearer "+issueToken(t, db, user.ID))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestConcurrentLoginFailuresAreAllCounted(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if db.Name() == "sqlite" {
+		// Every connection to :memory: opens a database of its own
+		sqlDB, err := db.DB()
+		require.NoError(t, err)
+		sqlDB.SetMaxOpenConns(1)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			assert.NoError(t, auth.RecordLoginFailure(ctx, db, "", "racer@example.com"))
+		})
+	}
+	wg.Wait()
+
+	var record database.LoginThrottle
+	require.NoError(t, db.Where("scope = ? AND subject = ?", auth.ThrottleScopeAccount, "racer@example.com").First(&record).Error)
+	assert.Equal(t, 8, record.Failures)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// MFAStatusOutput represents the response for the current user's MFA status.
+type MFAStatusOutput struct {
+	Body struct {
+		Enabled                bool `json:"enabled" doc:"Whether a TOTP authenticator is confirmed"`
+		RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+		Required               bool `json:"required" doc:"Whether MFA is required for this user by policy"`
+	}
+}
+
+// EnrollTOTPOutput represents the response for starting TOTP enrollment.
+type EnrollTOTPOutput struct {
+	Body struct {
+		Secret     string `json:"secret" doc:"Base32 secret, for manual entry"`
+		OTPAuthURI string `json:"otpauth_uri" doc:"otpauth:// URI to show as a QR code"`
+	}
+}
+
+// MFACodeInput represents a request that must be confirmed with an MFA code.
+type MFACodeInput struct {
+	Body struct {
+		Code string `json:"code" required:"true" doc:"TOTP code, or a recovery code where accepted"`
+	}
+}
+
+// RecoveryCodesOutput represents a freshly issued set of recovery codes.
+type RecoveryCodesOutput struct {
+	Body struct {
+		RecoveryCodes []string `json:"recovery_codes" doc:"Single-use codes. They are only shown once."`
+	}
+}
+
+// mfaRequired reports whether policy requires the user to keep MFA enabled:
+// their role is an admin role and admins must have MFA.
+func mfaRequired(db *gorm.DB, user *database.User) (bool, error) {
+	required, err := database.RequireAdminMFA.Get(db)
+	if err != nil {
+		return false, huma.Error500InternalServerError("failed to load settings", err)
+	}
+	return required && auth.IsAdmin(auth.RolePermissions(db, user.Role)), nil
+}
+
+// verifyMFACode checks a code confirming a change to the user's MFA. Wrong
+// codes count towards the login lockouts, like at login.
+func verifyMFACode(ctx context.Context, db *gorm.DB, user *database.User, code string) error {
+	if err := checkLoginThrottle(ctx, db, user.Email); err != nil {
+		return err
+	}
+	err := auth.VerifyMFACode(db, user.ID, code)
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		recordLoginFailure(ctx, db, user.Email)
+	}
+	if err != nil {
+		return mfaCodeError(err)
+	}
+	return nil
+}
+
+// mfaCodeError maps MFA errors to API errors.
+func mfaCodeError(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrInvalidMFACode):
+		return huma.Error400BadRequest("invalid MFA code")
+	case errors.Is(err, auth.ErrMFANotEnrolled):
+		return huma.Error400BadRequest("MFA is not enrolled")
+	case errors.Is(err, auth.ErrMFAAlreadyEnabled):
+		return huma.Error409Conflict("MFA is already enabled")
+	}
+	return huma.Error500InternalServerError("failed to verify MFA code", err)
+}
+
+// RegisterMFA registers the endpoints for managing the current user's MFA.
+func RegisterMFA(api huma.API, db *gorm.DB) {
+	// GET /api/me/mfa - MFA status
+	huma.Register(api, huma.Operation{
+		OperationID: "get-mfa-status",
+		Method:      http.MethodGet,
+		Path:        "/me/mfa",
+		Summary:     "Get MFA status",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeProfileRead}},
+		},
+	}, func(ctx context.Context, input *struct{}) (*MFAStatusOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &MFAStatusOutput{}
+		resp.Body.Enabled = auth.HasMFA(db, user.ID)
+		resp.Body.RecoveryCodesRemaining = auth.RemainingRecoveryCodes(db, user.ID)
+		if resp.Body.Required, err = mfaRequired(db, user); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+
+	// POST /api/me/mfa/totp - Start TOTP enrollment
+	huma.Register(api, huma.Operation{
+		OperationID: "enroll-totp",
+		Method:      http.MethodPost,
+		Path:        "/me/mfa/totp",
+		Summary:     "Start TOTP enrollment",
+		Description: "Generate a new TOTP secret. MFA is not enabled until the secret is confirmed with a code.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *struct{}) (*EnrollTOTPOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := auth.BeginTOTPEnrollment(db, user.ID)
+		if err != nil {
+			return nil, mfaCodeError(err)
+		}
+
+		resp := &EnrollTOTPOutput{}
+		resp.Body.Secret = secret
+		resp.Body.OTPAuthURI = auth.TOTPURI(user.Email, secret)
+		return resp, nil
+	})
+
+	// POST /api/me/mfa/totp/confirm - Confirm TOTP enrollment
+	huma.Register(api, huma.Operation{
+		OperationID: "confirm-totp",
+		Method:      http.MethodPost,
+		Path:        "/me/mfa/totp/confirm",
+		Summary:     "Confirm TOTP enrollment",
+		Description: "Enable MFA by entering a code from the authenticator. Returns the recovery codes.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *MFACodeInput) (*RecoveryCodesOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		codes, err := auth.ConfirmTOTPEnrollment(db, user.ID, input.Body.Code)
+		if err != nil {
+			return nil, mfaCodeError(err)
+		}
+
+		logging.FromContext(ctx).Info("MFA enabled", logging.UserID, user.ID)
+
+		resp := &RecoveryCodesOutput{}
+		resp.Body.RecoveryCodes = codes
+		return resp, nil
+	})
+
+	// POST /api/me/mfa/recovery-codes - Regenerate recovery codes
+	huma.Register(api, huma.Operation{
+		OperationID: "regenerate-recovery-codes",
+		Method:      http.MethodPost,
+		Path:        "/me/mfa/recovery-codes",
+		Summary:     "Regenerate recovery codes",
+		Description: "Replace all recovery codes. Requires a TOTP or recovery code.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *MFACodeInput) (*RecoveryCodesOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := verifyMFACode(ctx, db, user, input.Body.Code); err != nil {
+			return nil, err
+		}
+		codes, err := auth.RegenerateRecoveryCodes(db, user.ID)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to generate recovery codes", err)
+		}
+
+		resp := &RecoveryCodesOutput{}
+		resp.Body.RecoveryCodes = codes
+		return resp, nil
+	})
+
+	// DELETE /api/me/mfa - Disable MFA
+	huma.Register(api, huma.Operation{
+		OperationID: "disable-mfa",
+		Method:      http.MethodDelete,
+		Path:        "/me/mfa",
+		Summary:     "Disable MFA",
+		Description: "Remove the authenticator and recovery codes. Requires a TOTP or recovery code.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *MFACodeInput) (*struct{}, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if required, err := mfaRequired(db, user); err != nil {
+			return nil, err
+		} else if required {
+			return nil, huma.Error400BadRequest("MFA is required for admins")
+		}
+		if err := verifyMFACode(ctx, db, user, input.Body.Code); err != nil {
+			return nil, err
+		}
+		if err := auth.DisableMFA(db, user.ID); err != nil {
+			return nil, huma.Error500InternalServerError("failed to disable MFA", err)
+		}
+
+		logging.FromContext(ctx).Info("MFA disabled", logging.UserID, user.ID)
+		return nil, nil
+	})
+}
@@ -0,0 +1,242 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+type mfaLoginResponse struct {
+	Token       string `json:"token"`
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+func setupMFATest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterAdmin(api, db)
+	handlers.RegisterMFA(api, db)
+	return db, api
+}
+
+// enrollMFA enables TOTP for the token's user and returns the secret and recovery codes.
+func enrollMFA(t *testing.T, api humatest.TestAPI, token string) (string, []string) {
+	t.Helper()
+	resp := api.Post("/me/mfa/totp", "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var enroll struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &enroll))
+	assert.Contains(t, enroll.OTPAuthURI, "otpauth://totp/")
+	assert.Contains(t, enroll.OTPAuthURI, "secret="+enroll.Secret)
+
+	code, err := auth.TOTPCode(enroll.Secret, time.Now())
+	require.NoError(t, err)
+	resp = api.Post("/me/mfa/totp/confirm", map[string]any{"code": code}, "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var confirm struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &confirm))
+	return enroll.Secret, confirm.RecoveryCodes
+}
+
+func passwordLogin(t *testing.T, api humatest.TestAPI, email string) mfaLoginResponse {
+	t.Helper()
+	resp := api.Post("/auth/login", map[string]any{"email": email, "password": "password123"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var out mfaLoginResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+	return out
+}
+
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 secret "12345678901234567890", truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	code, err := auth.TOTPCode(secret, time.Unix(59, 0))
+	require.NoError(t, err)
+	assert.Equal(t, "287082", code)
+
+	step, ok := auth.ValidateTOTP(secret, "287082", time.Unix(59+30, 0))
+	assert.True(t, ok, "previous step is accepted for clock drift")
+	assert.Equal(t, int64(1), step)
+	_, ok = auth.ValidateTOTP(secret, "287082", time.Unix(59+90, 0))
+	assert.False(t, ok)
+}
+
+func TestMFATwoStepLogin(t *testing.T) {
+	db, api := setupMFATest(t)
+	resp := api.Post("/auth/signup", map[string]any{"email": "mfa@example.com", "password": "password123", "name": "MFA User"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var user database.User
+	db.Where("email = ?", "mfa@example.com").First(&user)
+	token := issueToken(t, db, user.ID)
+
+	// Confirming with a wrong code does not enable MFA
+	api.Post("/me/mfa/totp", "Authorization: Bearer "+token)
+	resp = api.Post("/me/mfa/totp/confirm", map[string]any{"code": "000000"}, "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.False(t, auth.HasMFA(db, user.ID))
+
+	secret, recovery := enrollMFA(t, api, token)
+	require.Len(t, recovery, auth.RecoveryCodeCount)
+	resp = api.Get("/me/mfa", "Authorization: Bearer "+token)
+	assert.Contains(t, resp.Body.String(), `"enabled":true`)
+	assert.Contains(t, resp.Body.String(), `"recovery_codes_remaining":10`)
+
+	// Recovery codes are only stored hashed
+	var stored database.RecoveryCode
+	db.Where("user_id = ?", user.ID).First(&stored)
+	assert.NotEqual(t, recovery[0], stored.CodeHash)
+
+	// The password step no longer returns tokens
+	first := passwordLogin(t, api, "mfa@example.com")
+	assert.True(t, first.MFARequired)
+	assert.NotEmpty(t, first.MFAToken)
+	assert.Empty(t, first.Token)
+
+	// The code used to confirm enrollment cannot be replayed
+	code, _ := auth.TOTPCode(secret, time.Now())
+	resp = api.Post("/auth/mfa/verify", map[string]any{"mfa_token": first.MFAToken, "code": code})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// A code for the next time step is accepted
+	code, _ = auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+	resp = api.Post("/auth/mfa/verify", map[string]any{"mfa_token": first.MFAToken, "code": code})
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"token"`)
+	assert.Contains(t, resp.Body.String(), `"refresh_token"`)
+
+	// The challenge is single-use
+	resp = api.Post("/auth/mfa/verify", map[string]any{"mfa_token": first.MFAToken, "code": recovery[0]})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Recovery codes work once
+	second := passwordLogin(t, api, "mfa@example.com")
+	resp = api.Post("/auth/mfa/verify", map[string]any{"mfa_token": second.MFAToken, "code": recovery[0]})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	third := passwordLogin(t, api, "mfa@example.com")
+	resp = api.Post("/auth/mfa/verify", map[string]any{"mfa_token": third.MFAToken, "code": recovery[0]})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, auth.RecoveryCodeCount-1, auth.RemainingRecoveryCodes(db, user.ID))
+
+	// Disabling MFA requires a code, then logins return tokens directly
+	resp = api.Delete("/me/mfa", map[string]any{"code": "000000"}, "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = api.Delete("/me/mfa", map[string]any{"code": recovery[1]}, "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NotEmpty(t, passwordLogin(t, api, "mfa@example.com").Token)
+}
+
+func TestMFAChallengeAttemptLimit(t *testing.T) {
+	db, api := setupMFATest(t)
+	api.Post("/auth/signup", map[string]any{"email": "limit@example.com", "password": "password123", "name": "Limit"})
+	var user database.User
+	db.Where("email = ?", "limit@example.com").First(&user)
+	secret, _ := enrollMFA(t, api, issueToken(t, db, user.ID))
+
+	challenge := passwordLogin(t, api, "limit@example.com")
+	for range 5 {
+		resp := api.Post("/auth/mfa/verify", map[string]any{"mfa_token": challenge.MFAToken, "code": "000000"})
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	}
+
+	// Even the right code is refused once the challenge is exhausted
+	code, _ := auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+	resp := api.Post("/auth/mfa/verify", map[string]any{"mfa_token": challenge.MFAToken, "code": code})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestRequireAdminMFA(t *testing.T) {
+	db, api := setupMFATest(t)
+	first := database.User{Email: "first@example.com", Name: "First", Role: database.RoleAdmin}
+	second := database.User{Email: "second@example.com", Name: "Second", Role: database.RoleAdmin}
+	db.Create(&first)
+	db.Create(&second)
+	firstToken := issueToken(t, db, first.ID)
+	secondToken := issueToken(t, db, second.ID)
+
+	// Admins cannot require MFA before enabling it themselves
+	resp := api.Put("/admin/settings", map[string]any{"require_admin_mfa": true}, "Authorization: Bearer "+firstToken)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	enrollMFA(t, api, firstToken)
+	resp = api.Put("/admin/settings", map[string]any{"require_admin_mfa": true}, "Authorization: Bearer "+firstToken)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"require_admin_mfa":true`)
+
+	// Admins without MFA are locked out of admin endpoints until they enroll
+	resp = api.Get("/admin/settings", "Authorization: Bearer "+secondToken)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Get("/me/mfa", "Authorization: Bearer "+secondToken)
+	assert.Contains(t, resp.Body.String(), `"required":true`)
+	enrollMFA(t, api, secondToken)
+	resp = api.Get("/admin/settings", "Authorization: Bearer "+secondToken)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// And cannot disable it while the policy is on
+	resp = api.Delete("/me/mfa", map[string]any{"code": "000000"}, "Authorization: Bearer "+secondToken)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.True(t, auth.HasMFA(db, second.ID))
+}
+
+func TestRequireAdminMFAAppliesToCustomAdminRoles(t *testing.T) {
+	db, api := setupMFATest(t)
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	adminToken := issueToken(t, db, admin.ID)
+	enrollMFA(t, api, adminToken)
+	require.NoError(t, database.RequireAdminMFA.Set(db, true))
+
+	// A custom role that can manage users is an admin role
+	require.NoError(t, db.Create(&database.Role{Name: "user-manager", Permissions: `["users:write","settings:read"]`}).Error)
+	manager := database.User{Email: "manager@example.com", Name: "Manager", Role: "user-manager"}
+	db.Create(&manager)
+	managerToken := issueToken(t, db, manager.ID)
+	resp := api.Get("/admin/settings", "Authorization: Bearer "+managerToken)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, api.Get("/me/mfa", "Authorization: Bearer "+managerToken).Body.String(), `"required":true`)
+
+	// One that can only read settings is not
+	require.NoError(t, db.Create(&database.Role{Name: "auditor", Permissions: `["settings:read"]`}).Error)
+	auditor := database.User{Email: "auditor@example.com", Name: "Auditor", Role: "auditor"}
+	db.Create(&auditor)
+	resp = api.Get("/admin/settings", "Authorization: Bearer "+issueToken(t, db, auditor.ID))
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestMFAChangesThrottleWrongCodes(t *testing.T) {
+	db, api := setupMFATest(t)
+	user := database.User{Email: "guess@example.com", Name: "Guess"}
+	db.Create(&user)
+	token := issueToken(t, db, user.ID)
+	secret, _ := enrollMFA(t, api, token)
+
+	for range 10 {
+		resp := api.Post("/me/mfa/recovery-codes", map[string]any{"code": "000000"}, "Authorization: Bearer "+token)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+
+	// Locked out, even with the right code
+	code, err := auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+	require.NoError(t, err)
+	resp := api.Delete("/me/mfa", map[string]any{"code": code}, "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.True(t, auth.HasMFA(db, user.ID))
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// Provider sources
+const (
+	ProviderSourceEnv      = "env"
+	ProviderSourceDatabase = "database"
+)
+
+// OIDCProviderInfo represents an OIDC provider in admin responses.
+type OIDCProviderInfo struct {
+	Slug            string                 `json:"slug"`
+	DisplayName     string                 `json:"display_name"`
+	Issuer          string                 `json:"issuer,omitempty"`
+	ClientID        string                 `json:"client_id,omitempty"`
+	RedirectURL     string                 `json:"redirect_url,omitempty" doc:"Callback URL to register with the identity provider"`
+	HasClientSecret bool                   `json:"has_client_secret"`
+	RoleMappings    []auth.OIDCRoleMapping `json:"role_mappings" doc:"Roles given to the provider's users by ID token claims on every login, the first match wins"`
+	DefaultRole     string                 `json:"default_role,omitempty" doc:"Role given to users matching none of the mappings; without one they keep their role"`
+	Enabled         bool                   `json:"enabled"`
+	Loaded          bool                   `json:"loaded" doc:"Whether discovery succeeded and users can sign in"`
+	Source          string                 `json:"source" enum:"env,database" doc:"Where the provider is configured; env providers are read-only"`
+}
+
+// ListOIDCProvidersOutput represents the response for listing providers.
+type ListOIDCProvidersOutput struct {
+	Body struct {
+		Providers []OIDCProviderInfo `json:"providers"`
+	}
+}
+
+// OIDCProviderOutput represents a single provider response.
+type OIDCProviderOutput struct {
+	Body OIDCProviderInfo
+}
+
+// CreateOIDCProviderInput represents the request to add a provider.
+type CreateOIDCProviderInput struct {
+	Body struct {
+		Slug         string                 `json:"slug" required:"true" pattern:"^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$" doc:"URL-safe identifier used in /auth/{slug}/login"`
+		DisplayName  string                 `json:"display_name" required:"true" minLength:"1" maxLength:"64"`
+		Issuer       string                 `json:"issuer" required:"true" format:"uri" doc:"Issuer URL used for OIDC discovery"`
+		ClientID     string                 `json:"client_id" required:"true" minLength:"1"`
+		ClientSecret string                 `json:"client_secret,omitempty"`
+		RedirectURL  string                 `json:"redirect_url,omitempty" format:"uri" doc:"Defaults to PUBLIC_URL/api/auth/{slug}/callback"`
+		RoleMappings []auth.OIDCRoleMapping `json:"role_mappings,omitempty" doc:"Claims can only be mapped to roles whose permissions you have. Without mappings, logins leave roles alone."`
+		DefaultRole  string                 `json:"default_role,omitempty" doc:"Role given to users matching none of the mappings; without one they keep their role"`
+		Enabled      *bool                  `json:"enabled,omitempty" doc:"Defaults to true"`
+	}
+}
+
+// UpdateOIDCProviderInput represents the request to change a provider.
+type UpdateOIDCProviderInput struct {
+	Slug string `path:"slug"`
+	Body struct {
+		DisplayName  *string                 `json:"display_name,omitempty" minLength:"1" maxLength:"64"`
+		Issuer       *string                 `json:"issuer,omitempty" format:"uri"`
+		ClientID     *string                 `json:"client_id,omitempty" minLength:"1"`
+		ClientSecret *string                 `json:"client_secret,omitempty"`
+		RedirectURL  *string                 `json:"redirect_url,omitempty" doc:"Empty to derive from PUBLIC_URL"`
+		RoleMappings *[]auth.OIDCRoleMapping `json:"role_mappings,omitempty" doc:"Replace the claim to role mappings; an empty list stops logins from changing roles"`
+		DefaultRole  *string                 `json:"default_role,omitempty" doc:"Empty to let users matching no mapping keep their role"`
+		Enabled      *bool                   `json:"enabled,omitempty"`
+	}
+}
+
+// DeleteOIDCProviderInput represents the request to remove a provider.
+type DeleteOIDCProviderInput struct {
+	Slug string `path:"slug"`
+}
+
+func oidcProviderInfo(providers *auth.Registry, record *database.OIDCProviderConfig, loaded bool) OIDCProviderInfo {
+	redirectURL, _ := providers.CallbackURL(record)
+	roleMappings := auth.ParseOIDCRoleMappings(record)
+	if roleMappings == nil {
+		roleMappings = []auth.OIDCRoleMapping{}
+	}
+	return OIDCProviderInfo{
+		Slug:            record.Slug,
+		DisplayName:     record.DisplayName,
+		Issuer:          record.Issuer,
+		ClientID:        record.ClientID,
+		RedirectURL:     redirectURL,
+		HasClientSecret: record.ClientSecret != "",
+		RoleMappings:    roleMappings,
+		DefaultRole:     record.DefaultRole,
+		Enabled:         record.Enabled,
+		Loaded:          loaded,
+		Source:          ProviderSourceDatabase,
+	}
+}
+
+// saveOIDCProvider runs discovery for the provider, then stores it and loads
+// it into the registry. Nothing is saved when discovery fails. Discovery runs
+// before the write, as it may take as long as the issuer takes to answer.
+func saveOIDCProvider(ctx context.Context, db *gorm.DB, providers *auth.Registry, record *database.OIDCProviderConfig) error {
+	load, err := providers.Prepare(ctx, record)
+	if err != nil {
+		return huma.Error400BadRequest("failed to load provider: "+err.Error(), err)
+	}
+	if err := db.Save(record).Error; err != nil {
+		return huma.Error500InternalServerError("failed to save provider", err)
+	}
+	load()
+	return nil
+}
+
+// RegisterOIDCProviders registers the admin endpoints for managing OIDC providers.
+func RegisterOIDCProviders(api huma.API, db *gorm.DB, providers *auth.Registry) {
+	// GET /api/admin/oidc-providers - List providers
+	huma.Register(api, huma.Operation{
+		OperationID: "list-oidc-providers",
+		Method:      http.MethodGet,
+		Path:        "/admin/oidc-providers",
+		Summary:     "List OIDC providers",
+		Description: "List the env-configured and stored OIDC providers. Requires the settings:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsRead},
+	}, func(ctx context.Context, input *struct{}) (*ListOIDCProvidersOutput, error) {
+		loaded := map[string]bool{}
+		resp := &ListOIDCProvidersOutput{}
+		resp.Body.Providers = []OIDCProviderInfo{}
+		for _, info := range providers.List() {
+			loaded[info.Slug] = true
+			if info.Static {
+				// Their role mappings are the oidc_role_mappings settings
+				roleMappings, defaultRole, err := auth.ProviderRoleMappings(db, info.Slug)
+				if err != nil {
+					return nil, huma.Error500InternalServerError("failed to load role mappings", err)
+				}
+				resp.Body.Providers = append(resp.Body.Providers, OIDCProviderInfo{
+					Slug:         info.Slug,
+					DisplayName:  info.DisplayName,
+					RoleMappings: roleMappings,
+					DefaultRole:  defaultRole,
+					Enabled:      true,
+					Loaded:       true,
+					Source:       ProviderSourceEnv,
+				})
+			}
+		}
+
+		var records []database.OIDCProviderConfig
+		if err := db.Order("slug ASC").Find(&records).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to list providers", err)
+		}
+		for i := range records {
+			resp.Body.Providers = append(resp.Body.Providers, oidcProviderInfo(providers, &records[i], loaded[records[i].Slug]))
+		}
+		return resp, nil
+	})
+
+	// POST /api/admin/oidc-providers - Add a provider
+	huma.Register(api, huma.Operation{
+		OperationID: "create-oidc-provider",
+		Method:      http.MethodPost,
+		Path:        "/admin/oidc-providers",
+		Summary:     "Add an OIDC provider",
+		Description: "Add an OIDC provider. Discovery is run against the issuer before it is saved. Requires the settings:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsWrite},
+	}, func(ctx context.Context, input *CreateOIDCProviderInput) (*OIDCProviderOutput, error) {
+		if err := auth.ValidateProviderSlug(input.Body.Slug); err != nil || providers.IsStatic(input.Body.Slug) {
+			return nil, huma.Error400BadRequest("slug is reserved or invalid")
+		}
+		var count int64
+		db.Model(&database.OIDCProviderConfig{}).Where("slug = ?", input.Body.Slug).Count(&count)
+		if count > 0 {
+			return nil, huma.Error409Conflict("provider with this slug already exists")
+		}
+		if err := requireMappableRoles(ctx, db, input.Body.RoleMappings, input.Body.DefaultRole); err != nil {
+			return nil, err
+		}
+
+		secret, err := providers.SealClientSecret(input.Body.ClientSecret)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to encrypt client secret", err)
+		}
+		record := database.OIDCProviderConfig{
+			Slug:         input.Body.Slug,
+			DisplayName:  input.Body.DisplayName,
+			Issuer:       input.Body.Issuer,
+			ClientID:     input.Body.ClientID,
+			ClientSecret: secret,
+			RedirectURL:  input.Body.RedirectURL,
+			RoleMappings: auth.EncodeOIDCRoleMappings(input.Body.RoleMappings),
+			DefaultRole:  input.Body.DefaultRole,
+			Enabled:      input.Body.Enabled == nil || *input.Body.Enabled,
+		}
+		if err := saveOIDCProvider(ctx, db, providers, &record); err != nil {
+			return nil, err
+		}
+
+		info := oidcProviderInfo(providers, &record, record.Enabled)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOIDCProviderCreate,
+			TargetType: "oidc_provider",
+			TargetID:   record.Slug,
+			After:      info,
+		})
+
+		logging.FromContext(ctx).Info("OIDC provider added", "provider", record.Slug)
+		return &OIDCProviderOutput{Body: info}, nil
+	})
+
+	// PUT /api/admin/oidc-providers/{slug} - Update a provider
+	huma.Register(api, huma.Operation{
+		OperationID: "update-oidc-provider",
+		Method:      http.MethodPut,
+		Path:        "/admin/oidc-providers/{slug}",
+		Summary:     "Update an OIDC provider",
+		Description: "Update a stored OIDC provider. Omitted fields are left unchanged. Requires the settings:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsWrite},
+	}, func(ctx context.Context, input *UpdateOIDCProviderInput) (*OIDCProviderOutput, error) {
+		if providers.IsStatic(input.Slug) {
+			return nil, huma.Error400BadRequest("provider is configured through environment variables")
+		}
+		var record database.OIDCProviderConfig
+		if err := db.Where("slug = ?", input.Slug).First(&record).Error; err != nil {
+			return nil, huma.Error404NotFound("provider not found")
+		}
+		before := oidcProviderInfo(providers, &record, record.Enabled)
+
+		if input.Body.DisplayName != nil {
+			record.DisplayName = *input.Body.DisplayName
+		}
+		if input.Body.Issuer != nil {
+			record.Issuer = *input.Body.Issuer
+		}
+		if input.Body.ClientID != nil {
+			record.ClientID = *input.Body.ClientID
+		}
+		if input.Body.ClientSecret != nil {
+			secret, err := providers.SealClientSecret(*input.Body.ClientSecret)
+			if err != nil {
+				return nil, huma.Error500InternalServerError("failed to encrypt client secret", err)
+			}
+			record.ClientSecret = secret
+		}
+		if input.Body.RedirectURL != nil {
+			record.RedirectURL = *input.Body.RedirectURL
+		}
+		if input.Body.RoleMappings != nil {
+			if err := requireMappableRoles(ctx, db, *input.Body.RoleMappings, ""); err != nil {
+				return nil, err
+			}
+			record.RoleMappings = auth.EncodeOIDCRoleMappings(*input.Body.RoleMappings)
+		}
+		if input.Body.DefaultRole != nil {
+			if err := requireMappableRoles(ctx, db, nil, *input.Body.DefaultRole); err != nil {
+				return nil, err
+			}
+			record.DefaultRole = *input.Body.DefaultRole
+		}
+		if input.Body.Enabled != nil {
+			record.Enabled = *input.Body.Enabled
+		}
+		if err := saveOIDCProvider(ctx, db, providers, &record); err != nil {
+			return nil, err
+		}
+
+		info := oidcProviderInfo(providers, &record, record.Enabled)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOIDCProviderUpdate,
+			TargetType: "oidc_provider",
+			TargetID:   record.Slug,
+			Before:     before,
+			After:      info,
+		})
+
+		logging.FromContext(ctx).Info("OIDC provider updated", "provider", record.Slug)
+		return &OIDCProviderOutput{Body: info}, nil
+	})
+
+	// DELETE /api/admin/oidc-providers/{slug} - Remove a provider
+	huma.Register(api, huma.Operation{
+		OperationID: "delete-oidc-provider",
+		Method:      http.MethodDelete,
+		Path:        "/admin/oidc-providers/{slug}",
+		Summary:     "Delete an OIDC provider",
+		Description: "Remove a stored OIDC provider and the identities linked through it. Users who signed in with it keep their accounts, but must sign in another way. Requires the settings:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeSettingsWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionSettingsWrite},
+	}, func(ctx context.Context, input *DeleteOIDCProviderInput) (*struct{}, error) {
+		if providers.IsStatic(input.Slug) {
+			return nil, huma.Error400BadRequest("provider is configured through environment variables")
+		}
+		var record database.OIDCProviderConfig
+		if err := db.Where("slug = ?", input.Slug).First(&record).Error; err != nil {
+			return nil, huma.Error404NotFound("provider not found")
+		}
+		before := oidcProviderInfo(providers, &record, record.Enabled)
+
+		// Hard delete so the slug can be reused. A provider added later under
+		// the same slug may be a different IdP, so the identities keyed by it
+		// go too; otherwise its users could sign in as the accounts linked here.
+		var identities int64
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Unscoped().Where("provider = ?", record.Slug).Delete(&database.Identity{})
+			if result.Error != nil {
+				return result.Error
+			}
+			identities = result.RowsAffected
+			if err := tx.Model(&database.User{}).Where("provider = ?", record.Slug).
+				Updates(map[string]any{"provider": "", "internal_id": nil}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&record).Error
+		})
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to delete provider", err)
+		}
+		providers.Remove(input.Slug)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOIDCProviderDelete,
+			TargetType: "oidc_provider",
+			TargetID:   record.Slug,
+			Before:     before,
+			Details:    map[string]any{"identities_removed": identities},
+		})
+
+		logging.FromContext(ctx).Info("OIDC provider deleted", "provider", input.Slug)
+		return nil, nil
+	})
+}
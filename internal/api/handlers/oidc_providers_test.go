@@ -0,0 +1,263 @@
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// providerTest wires a registry whose stored providers are built by a fake
+// discovery step that completes logins as the given sub.
+type providerTest struct {
+	db         *gorm.DB
+	api        humatest.TestAPI
+	providers  *auth.Registry
+	flow       *fakeLoginFlow
+	adminToken string
+	built      []auth.ProviderConfig
+}
+
+func setupProviderTest(t *testing.T) *providerTest {
+	db := openTestDB(t)
+
+	pt := &providerTest{db: db, flow: &fakeLoginFlow{}}
+	pt.providers = auth.NewRegistry(db, auth.RegistryConfig{
+		Secret:    strings.Repeat("s", 32),
+		PublicURL: "https://app.example.com/",
+		Factory: func(ctx context.Context, cfg auth.ProviderConfig) (auth.Provider, error) {
+			if strings.Contains(cfg.Issuer, "unreachable") {
+				return nil, errors.New("discovery failed")
+			}
+			pt.built = append(pt.built, cfg)
+			return newMockOIDC(pt.flow, "stored@example.com", "Stored User", "shared-sub"), nil
+		},
+	})
+	pt.providers.Register(database.DefaultOIDCProvider, "Company SSO", newMockOIDC(pt.flow, "env@example.com", "Env User", "shared-sub"))
+
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	pt.adminToken = issueToken(t, db, admin.ID)
+
+	_, pt.api = humatest.New(t)
+	pt.api.UseMiddleware(middleware.NewAuthMiddleware(pt.api, db))
+	handlers.RegisterAuth(pt.api, db, pt.providers, nil)
+	handlers.RegisterOIDCProviders(pt.api, db, pt.providers)
+	return pt
+}
+
+func (pt *providerTest) createProvider(t *testing.T, slug, issuer string) int {
+	t.Helper()
+	resp := pt.api.Post("/admin/oidc-providers", map[string]any{
+		"slug":          slug,
+		"display_name":  "Acme",
+		"issuer":        issuer,
+		"client_id":     "acme-client",
+		"client_secret": "acme-secret",
+	}, "Authorization: Bearer "+pt.adminToken)
+	return resp.Code
+}
+
+// loginWith runs a full login through the named provider's routes.
+func (pt *providerTest) loginWith(t *testing.T, slug string) int {
+	t.Helper()
+	resp := pt.api.Get("/auth/" + slug + "/login")
+	require.Equal(t, http.StatusFound, resp.Code)
+	cookie := "Cookie: " + auth.LoginStateCookie + "=" + pt.flow.State
+	return pt.api.Get("/auth/"+slug+"/callback?code=c&state="+pt.flow.State, cookie).Code
+}
+
+func TestOIDCProvidersAdminCRUD(t *testing.T) {
+	pt := setupProviderTest(t)
+
+	// Failed discovery is rejected and nothing is stored
+	assert.Equal(t, http.StatusBadRequest, pt.createProvider(t, "broken", "https://unreachable.example.com"))
+	var count int64
+	pt.db.Model(&database.OIDCProviderConfig{}).Count(&count)
+	assert.Zero(t, count)
+
+	// Reserved slugs and duplicates are rejected
+	assert.Equal(t, http.StatusBadRequest, pt.createProvider(t, database.DefaultOIDCProvider, "https://idp.acme.test"))
+	assert.Equal(t, http.StatusBadRequest, pt.createProvider(t, "callback", "https://idp.acme.test"))
+	assert.Equal(t, http.StatusOK, pt.createProvider(t, "acme", "https://idp.acme.test"))
+	assert.Equal(t, http.StatusConflict, pt.createProvider(t, "acme", "https://idp.acme.test"))
+
+	// The callback URL is derived from PUBLIC_URL and the secret is encrypted at rest
+	require.Len(t, pt.built, 1)
+	assert.Equal(t, "https://app.example.com/api/auth/acme/callback", pt.built[0].RedirectURL)
+	assert.Equal(t, "acme-secret", pt.built[0].ClientSecret)
+	var stored database.OIDCProviderConfig
+	require.NoError(t, pt.db.Where("slug = ?", "acme").First(&stored).Error)
+	assert.NotContains(t, stored.ClientSecret, "acme-secret")
+
+	// Both providers are listed publicly
+	resp := pt.api.Get("/auth/providers")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"slug":"acme"`)
+	assert.Contains(t, resp.Body.String(), `"slug":"default"`)
+
+	// Disabling hides the provider; env providers are read-only
+	resp = pt.api.Put("/admin/oidc-providers/acme", map[string]any{"enabled": false}, "Authorization: Bearer "+pt.adminToken)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, pt.api.Get("/auth/providers").Body.String(), `"slug":"acme"`)
+	resp = pt.api.Put("/admin/oidc-providers/default", map[string]any{"enabled": false}, "Authorization: Bearer "+pt.adminToken)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = pt.api.Get("/admin/oidc-providers", "Authorization: Bearer "+pt.adminToken)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"source":"env"`)
+	assert.Contains(t, resp.Body.String(), `"has_client_secret":true`)
+
+	// Deleting frees the slug
+	resp = pt.api.Delete("/admin/oidc-providers/acme", "Authorization: Bearer "+pt.adminToken)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, http.StatusOK, pt.createProvider(t, "acme", "https://idp.acme.test"))
+}
+
+func TestOIDCProviderDeleteUnlinksIdentities(t *testing.T) {
+	pt := setupProviderTest(t)
+	require.Equal(t, http.StatusOK, pt.createProvider(t, "acme", "https://idp.acme.test"))
+	require.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	var user database.User
+	require.NoError(t, pt.db.Where("provider = ?", "acme").First(&user).Error)
+
+	resp := pt.api.Delete("/admin/oidc-providers/acme", "Authorization: Bearer "+pt.adminToken)
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	// The account stays, but nothing ties it to the slug any more
+	var identities int64
+	pt.db.Model(&database.Identity{}).Where("provider = ?", "acme").Count(&identities)
+	assert.Zero(t, identities)
+	require.NoError(t, pt.db.First(&user, user.ID).Error)
+	assert.Empty(t, user.Provider)
+	assert.Nil(t, user.InternalID)
+
+	// A new provider under the same slug cannot sign in as the old user
+	require.Equal(t, http.StatusOK, pt.createProvider(t, "acme", "https://other-idp.test"))
+	assert.Equal(t, http.StatusConflict, pt.loginWith(t, "acme"))
+
+	var created, deleted int64
+	pt.db.Model(&database.AuditEvent{}).Where("action = ? AND target_id = ?", "oidc_provider.create", "acme").Count(&created)
+	pt.db.Model(&database.AuditEvent{}).Where("action = ? AND target_id = ?", "oidc_provider.delete", "acme").Count(&deleted)
+	assert.Equal(t, int64(2), created)
+	assert.Equal(t, int64(1), deleted)
+}
+
+func TestOIDCProvidersRequireAdmin(t *testing.T) {
+	pt := setupProviderTest(t)
+
+	user := database.User{Email: "user@example.com", Name: "User", Role: database.RoleUser}
+	pt.db.Create(&user)
+	token := issueToken(t, pt.db, user.ID)
+
+	resp := pt.api.Get("/admin/oidc-providers", "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = pt.api.Delete("/admin/oidc-providers/acme", "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestNamedProviderLoginKeysUsersByProviderAndSub(t *testing.T) {
+	pt := setupProviderTest(t)
+	require.Equal(t, http.StatusOK, pt.createProvider(t, "acme", "https://idp.acme.test"))
+
+	// The same sub at two providers is two different users
+	assert.Equal(t, http.StatusOK, pt.loginWith(t, database.DefaultOIDCProvider))
+	assert.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+
+	var users []database.User
+	pt.db.Where("internal_id = ?", "shared-sub").Order("provider").Find(&users)
+	require.Len(t, users, 2)
+	assert.Equal(t, "acme", users[0].Provider)
+	assert.Equal(t, "stored@example.com", users[0].Email)
+	assert.Equal(t, database.DefaultOIDCProvider, users[1].Provider)
+
+	// Logging in again finds the existing user
+	assert.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	var count int64
+	pt.db.Model(&database.User{}).Where("internal_id = ?", "shared-sub").Count(&count)
+	assert.Equal(t, int64(2), count)
+
+	// Unknown providers are not found
+	assert.Equal(t, http.StatusNotFound, pt.api.Get("/auth/unknown/login").Code)
+}
+
+func TestNamedProviderCallbackRejectsOtherProvidersState(t *testing.T) {
+	pt := setupProviderTest(t)
+	require.Equal(t, http.StatusOK, pt.createProvider(t, "acme", "https://idp.acme.test"))
+
+	// A login started with one provider cannot be completed at another
+	resp := pt.api.Get("/auth/acme/login")
+	require.Equal(t, http.StatusFound, resp.Code)
+	cookie := "Cookie: " + auth.LoginStateCookie + "=" + pt.flow.State
+	resp = pt.api.Get("/auth/default/callback?code=c&state="+pt.flow.State, cookie)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestNamedProviderRoleMappings(t *testing.T) {
+	pt := setupProviderTest(t)
+	adminAuth := "Authorization: Bearer " + pt.adminToken
+	require.Equal(t, http.StatusOK, pt.createProvider(t, "acme", "https://idp.acme.test"))
+	storedRole := func() string {
+		t.Helper()
+		var user database.User
+		require.NoError(t, pt.db.Where("provider = ?", "acme").First(&user).Error)
+		return user.Role
+	}
+	updateProvider := func(body map[string]any) int {
+		t.Helper()
+		return pt.api.Put("/admin/oidc-providers/acme", body, adminAuth).Code
+	}
+
+	// The env-configured provider's mappings do not apply to other providers
+	require.NoError(t, auth.OIDCRoleMappings.Set(pt.db, []auth.OIDCRoleMapping{{Claim: "groups", Value: "admins", Role: database.RoleAdmin}}))
+	require.NoError(t, auth.OIDCDefaultRole.Set(pt.db, database.RoleUser))
+	require.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	require.NoError(t, pt.db.Model(&database.User{}).Where("provider = ?", "acme").Update("role", database.RoleAdmin).Error)
+	require.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	assert.Equal(t, database.RoleAdmin, storedRole())
+
+	resp := pt.api.Get("/admin/oidc-providers", adminAuth)
+	assert.Contains(t, resp.Body.String(), `"value":"admins"`)
+
+	// Its own mappings do
+	assert.Equal(t, http.StatusOK, updateProvider(map[string]any{
+		"role_mappings": []map[string]string{{"claim": "email", "value": "stored@example.com", "role": database.RoleUser}},
+	}))
+	require.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	assert.Equal(t, database.RoleUser, storedRole())
+
+	// Users matching no mapping keep their role, unless there is a default role
+	assert.Equal(t, http.StatusOK, updateProvider(map[string]any{
+		"role_mappings": []map[string]string{{"claim": "email", "value": "other@example.com", "role": database.RoleAdmin}},
+	}))
+	require.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	assert.Equal(t, database.RoleUser, storedRole())
+
+	require.NoError(t, pt.db.Model(&database.User{}).Where("provider = ?", "acme").Update("role", database.RoleAdmin).Error)
+	require.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	assert.Equal(t, database.RoleAdmin, storedRole())
+
+	assert.Equal(t, http.StatusOK, updateProvider(map[string]any{"default_role": database.RoleUser}))
+	require.Equal(t, http.StatusOK, pt.loginWith(t, "acme"))
+	assert.Equal(t, database.RoleUser, storedRole())
+
+	// Only existing roles can be mapped to
+	assert.Equal(t, http.StatusBadRequest, updateProvider(map[string]any{"default_role": "missing"}))
+	assert.Equal(t, http.StatusBadRequest, updateProvider(map[string]any{
+		"role_mappings": []map[string]string{{"claim": "email", "value": "x", "role": "missing"}},
+	}))
+
+	resp = pt.api.Get("/admin/oidc-providers", adminAuth)
+	assert.Contains(t, resp.Body.String(), `"value":"other@example.com"`)
+	assert.Contains(t, resp.Body.String(), `"default_role":"user"`)
+}
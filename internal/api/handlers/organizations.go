@@ -0,0 +1,653 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/mail"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// OrgPathInput names the organization in the path. The auth middleware
+// resolves it and checks the caller's membership.
+type OrgPathInput struct {
+	Org string `path:"org" doc:"Organization slug"`
+}
+
+// OrganizationInfo represents an organization.
+type OrganizationInfo struct {
+	ID        uint      `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty" enum:"owner,admin,member" doc:"The caller's role in the organization"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListOrganizationsOutput represents the organizations the user belongs to.
+type ListOrganizationsOutput struct {
+	Body struct {
+		Organizations []OrganizationInfo `json:"organizations"`
+	}
+}
+
+// OrganizationOutput represents a single organization response.
+type OrganizationOutput struct {
+	Body OrganizationInfo
+}
+
+// CreateOrganizationInput represents the request to create an organization.
+type CreateOrganizationInput struct {
+	Body struct {
+		Slug string `json:"slug" required:"true" pattern:"^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$" doc:"URL-safe identifier used in /orgs/{slug} and the X-Organization header"`
+		Name string `json:"name" required:"true" minLength:"1" maxLength:"64"`
+	}
+}
+
+// UpdateOrganizationInput represents the request to rename an organization.
+type UpdateOrganizationInput struct {
+	OrgPathInput
+	Body struct {
+		Name string `json:"name" required:"true" minLength:"1" maxLength:"64"`
+	}
+}
+
+// MemberInfo represents a member of an organization.
+type MemberInfo struct {
+	UserID   uint      `json:"user_id"`
+	Email    string    `json:"email"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role" enum:"owner,admin,member"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// ListMembersOutput represents the members of an organization.
+type ListMembersOutput struct {
+	Body struct {
+		Members []MemberInfo `json:"members"`
+	}
+}
+
+// MemberInput names a member of an organization.
+type MemberInput struct {
+	OrgPathInput
+	UserID uint `path:"user_id" doc:"User ID of the member"`
+}
+
+// UpdateMemberInput represents the request to change a member's role.
+type UpdateMemberInput struct {
+	MemberInput
+	Body struct {
+		Role string `json:"role" required:"true" enum:"owner,admin,member"`
+	}
+}
+
+// OrgInvitationInfo represents a pending invitation to an organization.
+type OrgInvitationInfo struct {
+	ID        uint      `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role" enum:"owner,admin,member"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListOrgInvitationsOutput represents the pending invitations to an organization.
+type ListOrgInvitationsOutput struct {
+	Body struct {
+		Invitations []OrgInvitationInfo `json:"invitations"`
+	}
+}
+
+// CreateOrgInvitationInput represents the request to invite someone.
+type CreateOrgInvitationInput struct {
+	OrgPathInput
+	Body struct {
+		Email string `json:"email" format:"email" required:"true"`
+		Role  string `json:"role,omitempty" enum:"owner,admin,member" default:"member"`
+	}
+}
+
+// CreateOrgInvitationOutput represents a new invitation.
+type CreateOrgInvitationOutput struct {
+	Body struct {
+		Invitation OrgInvitationInfo `json:"invitation"`
+		Token      string            `json:"token" doc:"Invitation token, also emailed to the invitee when email is configured. Only returned once."`
+	}
+}
+
+// AcceptOrgInvitationInput represents the request to join an organization.
+type AcceptOrgInvitationInput struct {
+	Body struct {
+		Token string `json:"token" required:"true" doc:"Token from the invitation email"`
+	}
+}
+
+func newOrganizationInfo(org *database.Organization, role string) OrganizationInfo {
+	return OrganizationInfo{
+		ID:        org.ID,
+		Slug:      org.Slug,
+		Name:      org.Name,
+		Role:      role,
+		CreatedAt: org.CreatedAt,
+	}
+}
+
+func newOrgInvitationInfo(invitation *database.OrgInvitation) OrgInvitationInfo {
+	return OrgInvitationInfo{
+		ID:        invitation.ID,
+		Email:     invitation.Email,
+		Role:      invitation.Role,
+		ExpiresAt: invitation.ExpiresAt,
+		CreatedAt: invitation.CreatedAt,
+	}
+}
+
+// callerOrgRole returns the caller's role in the active organization.
+func callerOrgRole(ctx context.Context) string {
+	if membership := middleware.GetMembership(ctx); membership != nil {
+		return membership.Role
+	}
+	return database.OrgRoleMember
+}
+
+// countOwners returns how many owners the organization has.
+func countOwners(db *gorm.DB, orgID uint) int64 {
+	var owners int64
+	db.Model(&database.Membership{}).Where("organization_id = ? AND role = ?", orgID, database.OrgRoleOwner).Count(&owners)
+	return owners
+}
+
+// RegisterOrganizations registers the organization, membership and invitation
+// endpoints. mailer may be nil, in which case invitations are not emailed.
+func RegisterOrganizations(api huma.API, db *gorm.DB, mailer *mail.Mailer) {
+	// GET /api/orgs - List the caller's organizations
+	huma.Register(api, huma.Operation{
+		OperationID: "list-organizations",
+		Method:      http.MethodGet,
+		Path:        "/orgs",
+		Summary:     "List organizations",
+		Description: "List the organizations the current user is a member of, with their role in each.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsRead}},
+		},
+	}, func(ctx context.Context, input *struct{}) (*ListOrganizationsOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var memberships []database.Membership
+		if err := db.Where("user_id = ?", user.ID).Order("created_at").Find(&memberships).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to list organizations", err)
+		}
+
+		resp := &ListOrganizationsOutput{}
+		resp.Body.Organizations = make([]OrganizationInfo, 0, len(memberships))
+		for _, membership := range memberships {
+			var org database.Organization
+			if err := db.First(&org, membership.OrganizationID).Error; err != nil {
+				continue
+			}
+			resp.Body.Organizations = append(resp.Body.Organizations, newOrganizationInfo(&org, membership.Role))
+		}
+		return resp, nil
+	})
+
+	// POST /api/orgs - Create an organization
+	huma.Register(api, huma.Operation{
+		OperationID: "create-organization",
+		Method:      http.MethodPost,
+		Path:        "/orgs",
+		Summary:     "Create organization",
+		Description: "Create an organization with the current user as its owner.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsWrite}},
+		},
+	}, func(ctx context.Context, input *CreateOrganizationInput) (*OrganizationOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var count int64
+		db.Unscoped().Model(&database.Organization{}).Where("slug = ?", input.Body.Slug).Count(&count)
+		if count > 0 {
+			return nil, huma.Error409Conflict("organization with this slug already exists")
+		}
+
+		org := database.Organization{Slug: input.Body.Slug, Name: input.Body.Name}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&org).Error; err != nil {
+				return err
+			}
+			return tx.Create(&database.Membership{OrganizationID: org.ID, UserID: user.ID, Role: database.OrgRoleOwner}).Error
+		})
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to create organization", err)
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgCreate,
+			TargetType: "organization",
+			TargetID:   auditID(org.ID),
+			After:      map[string]any{"slug": org.Slug, "name": org.Name},
+		})
+		return &OrganizationOutput{Body: newOrganizationInfo(&org, database.OrgRoleOwner)}, nil
+	})
+
+	// GET /api/orgs/{org} - Get an organization
+	huma.Register(api, huma.Operation{
+		OperationID: "get-organization",
+		Method:      http.MethodGet,
+		Path:        "/orgs/{org}",
+		Summary:     "Get organization",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsRead}},
+		},
+	}, func(ctx context.Context, input *OrgPathInput) (*OrganizationOutput, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleMember)
+		if err != nil {
+			return nil, err
+		}
+		return &OrganizationOutput{Body: newOrganizationInfo(org, callerOrgRole(ctx))}, nil
+	})
+
+	// PUT /api/orgs/{org} - Rename an organization
+	huma.Register(api, huma.Operation{
+		OperationID: "update-organization",
+		Method:      http.MethodPut,
+		Path:        "/orgs/{org}",
+		Summary:     "Update organization",
+		Description: "Rename the organization. Requires the organization admin role.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsWrite}},
+		},
+	}, func(ctx context.Context, input *UpdateOrganizationInput) (*OrganizationOutput, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+
+		before := map[string]any{"name": org.Name}
+		org.Name = input.Body.Name
+		if err := db.Save(org).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to update organization", err)
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgUpdate,
+			TargetType: "organization",
+			TargetID:   auditID(org.ID),
+			Before:     before,
+			After:      map[string]any{"name": org.Name},
+		})
+		return &OrganizationOutput{Body: newOrganizationInfo(org, callerOrgRole(ctx))}, nil
+	})
+
+	// DELETE /api/orgs/{org} - Delete an organization
+	huma.Register(api, huma.Operation{
+		OperationID: "delete-organization",
+		Method:      http.MethodDelete,
+		Path:        "/orgs/{org}",
+		Summary:     "Delete organization",
+		Description: "Delete the organization with its memberships, invitations and API keys. Requires the organization owner role.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsWrite}},
+		},
+	}, func(ctx context.Context, input *OrgPathInput) (*struct{}, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleOwner)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&database.APIKey{}, "organization_id = ?", org.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&database.OrgInvitation{}, "organization_id = ?", org.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&database.Membership{}, "organization_id = ?", org.ID).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(org).Error
+		})
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to delete organization", err)
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgDelete,
+			TargetType: "organization",
+			TargetID:   auditID(org.ID),
+			Before:     map[string]any{"slug": org.Slug, "name": org.Name},
+		})
+		return nil, nil
+	})
+
+	// GET /api/orgs/{org}/members - List members
+	huma.Register(api, huma.Operation{
+		OperationID: "list-org-members",
+		Method:      http.MethodGet,
+		Path:        "/orgs/{org}/members",
+		Summary:     "List organization members",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsRead}},
+		},
+	}, func(ctx context.Context, input *OrgPathInput) (*ListMembersOutput, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleMember)
+		if err != nil {
+			return nil, err
+		}
+
+		var memberships []database.Membership
+		if err := db.Where("organization_id = ?", org.ID).Order("created_at").Find(&memberships).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to list members", err)
+		}
+
+		resp := &ListMembersOutput{}
+		resp.Body.Members = make([]MemberInfo, 0, len(memberships))
+		for _, membership := range memberships {
+			var user database.User
+			if err := db.First(&user, membership.UserID).Error; err != nil {
+				continue
+			}
+			resp.Body.Members = append(resp.Body.Members, MemberInfo{
+				UserID:   user.ID,
+				Email:    user.Email,
+				Name:     user.Name,
+				Role:     membership.Role,
+				JoinedAt: membership.CreatedAt,
+			})
+		}
+		return resp, nil
+	})
+
+	// PUT /api/orgs/{org}/members/{user_id} - Change a member's role
+	huma.Register(api, huma.Operation{
+		OperationID: "update-org-member",
+		Method:      http.MethodPut,
+		Path:        "/orgs/{org}/members/{user_id}",
+		Summary:     "Change member role",
+		Description: "Requires the organization admin role; only owners can grant or take away the owner role. The last owner cannot be demoted.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsWrite}},
+		},
+	}, func(ctx context.Context, input *UpdateMemberInput) (*struct{}, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+
+		var membership database.Membership
+		if err := db.Where("organization_id = ? AND user_id = ?", org.ID, input.UserID).First(&membership).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, huma.Error404NotFound("member not found")
+			}
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+
+		touchesOwner := membership.Role == database.OrgRoleOwner || input.Body.Role == database.OrgRoleOwner
+		if touchesOwner && callerOrgRole(ctx) != database.OrgRoleOwner {
+			return nil, huma.Error403Forbidden("organization owner role required")
+		}
+		if membership.Role == database.OrgRoleOwner && input.Body.Role != database.OrgRoleOwner && countOwners(db, org.ID) <= 1 {
+			return nil, huma.Error400BadRequest("cannot demote the last owner")
+		}
+
+		previousRole := membership.Role
+		membership.Role = input.Body.Role
+		if err := db.Save(&membership).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to update member", err)
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgMemberRole,
+			TargetType: "user",
+			TargetID:   auditID(membership.UserID),
+			Before:     map[string]any{"role": previousRole},
+			After:      map[string]any{"role": membership.Role},
+			Details:    orgAuditDetails(&org.ID),
+		})
+		return nil, nil
+	})
+
+	// DELETE /api/orgs/{org}/members/{user_id} - Remove a member
+	huma.Register(api, huma.Operation{
+		OperationID: "remove-org-member",
+		Method:      http.MethodDelete,
+		Path:        "/orgs/{org}/members/{user_id}",
+		Summary:     "Remove member",
+		Description: "Remove a member, or leave the organization by passing your own user ID. Removing others requires the organization admin role, and only owners can remove owners. The last owner cannot leave.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsWrite}},
+		},
+	}, func(ctx context.Context, input *MemberInput) (*struct{}, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleMember)
+		if err != nil {
+			return nil, err
+		}
+
+		self := false
+		if user := middleware.GetUser(ctx); user != nil {
+			self = user.ID == input.UserID
+		}
+		if !self {
+			if _, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin); err != nil {
+				return nil, err
+			}
+		}
+
+		var membership database.Membership
+		if err := db.Where("organization_id = ? AND user_id = ?", org.ID, input.UserID).First(&membership).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, huma.Error404NotFound("member not found")
+			}
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+
+		if membership.Role == database.OrgRoleOwner {
+			if !self && callerOrgRole(ctx) != database.OrgRoleOwner {
+				return nil, huma.Error403Forbidden("organization owner role required")
+			}
+			if countOwners(db, org.ID) <= 1 {
+				return nil, huma.Error400BadRequest("cannot remove the last owner")
+			}
+		}
+
+		if err := db.Unscoped().Delete(&membership).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to remove member", err)
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgMemberRemove,
+			TargetType: "user",
+			TargetID:   auditID(membership.UserID),
+			Before:     map[string]any{"role": membership.Role},
+			Details:    orgAuditDetails(&org.ID),
+		})
+		return nil, nil
+	})
+
+	// GET /api/orgs/{org}/invitations - List pending invitations
+	huma.Register(api, huma.Operation{
+		OperationID: "list-org-invitations",
+		Method:      http.MethodGet,
+		Path:        "/orgs/{org}/invitations",
+		Summary:     "List organization invitations",
+		Description: "List invitations that have not been accepted or expired. Requires the organization admin role.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsRead}},
+		},
+	}, func(ctx context.Context, input *OrgPathInput) (*ListOrgInvitationsOutput, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+
+		var invitations []database.OrgInvitation
+		if err := db.Where("organization_id = ? AND accepted_at IS NULL AND expires_at > ?", org.ID, time.Now()).
+			Order("created_at DESC").Find(&invitations).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to list invitations", err)
+		}
+
+		resp := &ListOrgInvitationsOutput{}
+		resp.Body.Invitations = make([]OrgInvitationInfo, len(invitations))
+		for i := range invitations {
+			resp.Body.Invitations[i] = newOrgInvitationInfo(&invitations[i])
+		}
+		return resp, nil
+	})
+
+	// POST /api/orgs/{org}/invitations - Invite someone
+	huma.Register(api, huma.Operation{
+		OperationID: "create-org-invitation",
+		Method:      http.MethodPost,
+		Path:        "/orgs/{org}/invitations",
+		Summary:     "Invite to organization",
+		Description: "Invite an email address to join the organization. The invitation is emailed when email is configured, and expires after 7 days. Requires the organization admin role; only owners can invite owners.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsWrite}},
+		},
+	}, func(ctx context.Context, input *CreateOrgInvitationInput) (*CreateOrgInvitationOutput, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+		if input.Body.Role == database.OrgRoleOwner && callerOrgRole(ctx) != database.OrgRoleOwner {
+			return nil, huma.Error403Forbidden("organization owner role required")
+		}
+
+		inviter := middleware.GetUser(ctx)
+		invitation, token, err := auth.CreateOrgInvitation(db, org.ID, inviter.ID, input.Body.Email, input.Body.Role)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to create invitation", err)
+		}
+
+		if mailer != nil {
+			if err := mailer.SendOrgInvitation(ctx, invitation.Email, org.Name, inviter.Name, token, auth.OrgInvitationTTL); err != nil {
+				logging.FromContext(ctx).Error("failed to send invitation email", logging.Email, invitation.Email, logging.Error, err)
+			}
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgInvitationCreate,
+			TargetType: "org_invitation",
+			TargetID:   auditID(invitation.ID),
+			After:      map[string]any{"email": invitation.Email, "role": invitation.Role},
+			Details:    orgAuditDetails(&org.ID),
+		})
+
+		resp := &CreateOrgInvitationOutput{}
+		resp.Body.Invitation = newOrgInvitationInfo(invitation)
+		resp.Body.Token = token
+		return resp, nil
+	})
+
+	// DELETE /api/orgs/{org}/invitations/{id} - Revoke an invitation
+	huma.Register(api, huma.Operation{
+		OperationID: "revoke-org-invitation",
+		Method:      http.MethodDelete,
+		Path:        "/orgs/{org}/invitations/{id}",
+		Summary:     "Revoke organization invitation",
+		Description: "Requires the organization admin role.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeOrgsWrite}},
+		},
+	}, func(ctx context.Context, input *struct {
+		OrgPathInput
+		ID uint `path:"id" doc:"Invitation ID"`
+	}) (*struct{}, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+
+		result := db.Unscoped().Where("id = ? AND organization_id = ? AND accepted_at IS NULL", input.ID, org.ID).
+			Delete(&database.OrgInvitation{})
+		if result.Error != nil {
+			return nil, huma.Error500InternalServerError("failed to revoke invitation", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return nil, huma.Error404NotFound("invitation not found")
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgInvitationRevoke,
+			TargetType: "org_invitation",
+			TargetID:   auditID(input.ID),
+			Details:    orgAuditDetails(&org.ID),
+		})
+		return nil, nil
+	})
+
+	// POST /api/invitations/accept - Join an organization
+	huma.Register(api, huma.Operation{
+		OperationID: "accept-org-invitation",
+		Method:      http.MethodPost,
+		Path:        "/invitations/accept",
+		Summary:     "Accept organization invitation",
+		Description: "Join the organization an invitation is for. The invitation must have been sent to the current user's email address.",
+		Tags:        []string{"Organizations"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+	}, func(ctx context.Context, input *AcceptOrgInvitationInput) (*OrganizationOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		membership, err := auth.AcceptOrgInvitation(db, input.Body.Token, user)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidInvitation):
+				return nil, huma.Error400BadRequest("invalid or expired invitation")
+			case errors.Is(err, auth.ErrInvitationEmailMismatch):
+				return nil, huma.Error403Forbidden("this invitation was sent to a different email address")
+			}
+			return nil, huma.Error500InternalServerError("failed to accept invitation", err)
+		}
+
+		var org database.Organization
+		if err := db.First(&org, membership.OrganizationID).Error; err != nil {
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgInvitationAccept,
+			TargetType: "organization",
+			TargetID:   auditID(org.ID),
+			After:      map[string]any{"role": membership.Role},
+		})
+		return &OrganizationOutput{Body: newOrganizationInfo(&org, membership.Role)}, nil
+	})
+}
@@ -0,0 +1,246 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+func setupOrgTest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterOrganizations(api, db, nil)
+	handlers.RegisterAPIKeys(api, db)
+	handlers.RegisterUser(api, db)
+	handlers.RegisterProducts(api, db)
+	return db, api
+}
+
+// orgUser creates a user and returns them with an Authorization header.
+func orgUser(t *testing.T, db *gorm.DB, email, role string) (database.User, string) {
+	user := database.User{Email: email, Name: email, Role: role}
+	require.NoError(t, db.Create(&user).Error)
+	return user, "Authorization: Bearer " + issueToken(t, db, user.ID)
+}
+
+// invite invites email to the org and returns the invitation token.
+func invite(t *testing.T, api humatest.TestAPI, auth, org, email, role string) string {
+	t.Helper()
+	resp := api.Post("/orgs/"+org+"/invitations", map[string]any{"email": email, "role": role}, auth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var out struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+	return out.Token
+}
+
+func TestOrganizationMembership(t *testing.T) {
+	db, api := setupOrgTest(t)
+	_, owner := orgUser(t, db, "owner@example.com", database.RoleUser)
+	member, memberAuth := orgUser(t, db, "member@example.com", database.RoleUser)
+	_, outsider := orgUser(t, db, "outsider@example.com", database.RoleUser)
+
+	resp := api.Post("/orgs", map[string]any{"slug": "acme", "name": "Acme"}, owner)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"role":"owner"`)
+	resp = api.Post("/orgs", map[string]any{"slug": "acme", "name": "Other"}, outsider)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	// Invitations can only be accepted by the invited address, once
+	token := invite(t, api, owner, "acme", "Member@example.com", "member")
+	resp = api.Post("/invitations/accept", map[string]any{"token": token}, outsider)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Post("/invitations/accept", map[string]any{"token": token}, memberAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = api.Post("/invitations/accept", map[string]any{"token": token}, memberAuth)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = api.Get("/orgs", memberAuth)
+	assert.Contains(t, resp.Body.String(), `"slug":"acme"`)
+	resp = api.Get("/orgs/acme/members", memberAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var members struct {
+		Members []handlers.MemberInfo `json:"members"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &members))
+	assert.Len(t, members.Members, 2)
+
+	// Non-members cannot see the organization
+	resp = api.Get("/orgs/acme/members", outsider)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Get("/orgs/nope", outsider)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	// Members cannot manage the organization
+	resp = api.Post("/orgs/acme/invitations", map[string]any{"email": "x@example.com"}, memberAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Put("/orgs/acme", map[string]any{"name": "Renamed"}, memberAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Admins can manage members, but not owners
+	memberPath := fmt.Sprintf("/orgs/acme/members/%d", member.ID)
+	require.Equal(t, http.StatusNoContent, api.Put(memberPath, map[string]any{"role": "admin"}, owner).Code)
+	resp = api.Put("/orgs/acme", map[string]any{"name": "Renamed"}, memberAuth)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = api.Post("/orgs/acme/invitations", map[string]any{"email": "x@example.com", "role": "owner"}, memberAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Put(memberPath, map[string]any{"role": "owner"}, memberAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// The last owner cannot leave, other members can
+	var ownerUser database.User
+	db.Where("email = ?", "owner@example.com").First(&ownerUser)
+	resp = api.Delete(fmt.Sprintf("/orgs/acme/members/%d", ownerUser.ID), owner)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = api.Delete(memberPath, memberAuth)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Get("/orgs/acme", memberAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Revoked invitations cannot be accepted
+	token = invite(t, api, owner, "acme", "outsider@example.com", "member")
+	resp = api.Get("/orgs/acme/invitations", owner)
+	var invitations struct {
+		Invitations []handlers.OrgInvitationInfo `json:"invitations"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &invitations))
+	require.Len(t, invitations.Invitations, 1)
+	resp = api.Delete(fmt.Sprintf("/orgs/acme/invitations/%d", invitations.Invitations[0].ID), owner)
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Post("/invitations/accept", map[string]any{"token": token}, outsider)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestOrganizationAPIKeys(t *testing.T) {
+	db, api := setupOrgTest(t)
+	owner, ownerAuth := orgUser(t, db, "owner@example.com", database.RoleUser)
+	_, otherAuth := orgUser(t, db, "other@example.com", database.RoleUser)
+	require.Equal(t, http.StatusOK, api.Post("/orgs", map[string]any{"slug": "acme", "name": "Acme"}, ownerAuth).Code)
+	require.Equal(t, http.StatusOK, api.Post("/orgs", map[string]any{"slug": "globex", "name": "Globex"}, otherAuth).Code)
+
+	resp := api.Post("/orgs/acme/keys", map[string]any{"name": "ci", "scopes": []string{"orgs:read"}}, ownerAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var created struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	keyHeader := "X-API-Key: " + created.Key
+
+	// The key belongs to the organization, not to the person who created it
+	resp = api.Get("/keys", ownerAuth)
+	assert.Contains(t, resp.Body.String(), `"keys":[]`)
+	resp = api.Get("/orgs/acme/keys", ownerAuth)
+	assert.Contains(t, resp.Body.String(), `"name":"ci"`)
+
+	resp = api.Get("/orgs/acme/members", keyHeader)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = api.Get("/orgs/globex/members", keyHeader)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Get("/me", keyHeader)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// It keeps working after its creator is gone
+	db.Delete(&owner)
+	resp = api.Get("/orgs/acme/members", keyHeader)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestOrganizationProducts(t *testing.T) {
+	db, api := setupOrgTest(t)
+	_, acme := orgUser(t, db, "acme@example.com", database.RoleUser)
+	_, globex := orgUser(t, db, "globex@example.com", database.RoleUser)
+	require.Equal(t, http.StatusOK, api.Post("/orgs", map[string]any{"slug": "acme", "name": "Acme"}, acme).Code)
+	require.Equal(t, http.StatusOK, api.Post("/orgs", map[string]any{"slug": "globex", "name": "Globex"}, globex).Code)
+
+	// Products belong to the active organization, and codes are unique within it
+	assert.JSONEq(t, "[]", api.Get("/products", acme).Body.String(), "no default organization yet")
+	resp := api.Post("/products", map[string]any{"code": "D42", "price": 100}, acme)
+	assert.Equal(t, http.StatusForbidden, resp.Code, "the permission comes with the organization")
+	resp = api.Post("/products", map[string]any{"code": "D42", "price": 100}, acme, "X-Organization: acme")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var product database.Product
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &product))
+	resp = api.Post("/products", map[string]any{"code": "D42", "price": 200}, globex, "X-Organization: globex")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	resp = api.Get("/products", globex, "X-Organization: globex")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"price":200`)
+	assert.NotContains(t, resp.Body.String(), `"price":100`)
+	path := fmt.Sprintf("/products/%d", product.ID)
+	assert.Equal(t, http.StatusNotFound, api.Get(path, globex, "X-Organization: globex").Code)
+	assert.Equal(t, http.StatusNotFound, api.Delete(path, globex, "X-Organization: globex").Code)
+	assert.Equal(t, http.StatusForbidden, api.Get(path, globex, "X-Organization: acme").Code)
+	assert.Equal(t, http.StatusOK, api.Get(path, acme, "X-Organization: acme").Code)
+
+	// Reading is public: anonymous callers see the organization they name,
+	// or the default one
+	assert.Equal(t, http.StatusOK, api.Get(path, "X-Organization: acme").Code)
+	assert.Contains(t, api.Get("/products", "X-Organization: acme").Body.String(), `"code":"D42"`)
+	assert.Equal(t, http.StatusNotFound, api.Get("/products", "X-Organization: initech").Code)
+	assert.Equal(t, http.StatusNotFound, api.Get(path).Code)
+	require.NoError(t, db.Create(&database.Organization{Slug: database.DefaultOrganization, Name: "Default"}).Error)
+	assert.JSONEq(t, "[]", api.Get("/products").Body.String())
+
+	// Organization keys are authorized by what the organization grants its members
+	resp = api.Post("/orgs/acme/keys", map[string]any{"name": "ci", "scopes": []string{"products:write"}}, acme)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var created struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	keyHeader := "X-API-Key: " + created.Key
+	resp = api.Post("/products", map[string]any{"code": "K1", "price": 1}, keyHeader)
+	assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	resp = api.Get("/products", keyHeader)
+	assert.Contains(t, resp.Body.String(), `"code":"K1"`)
+	assert.Equal(t, http.StatusNoContent, api.Delete(path, keyHeader).Code)
+	assert.Equal(t, http.StatusForbidden, api.Get("/products", keyHeader, "X-Organization: globex").Code)
+}
+
+func TestOrganizationHeader(t *testing.T) {
+	db, api := setupOrgTest(t)
+	_, ownerAuth := orgUser(t, db, "owner@example.com", database.RoleUser)
+	_, otherAuth := orgUser(t, db, "other@example.com", database.RoleUser)
+	_, adminAuth := orgUser(t, db, "admin@example.com", database.RoleAdmin)
+	require.Equal(t, http.StatusOK, api.Post("/orgs", map[string]any{"slug": "acme", "name": "Acme"}, ownerAuth).Code)
+
+	huma.Get(api, "/active-org", func(ctx context.Context, input *struct{}) (*struct{ Body string }, error) {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleOwner)
+		if err != nil {
+			return nil, err
+		}
+		return &struct{ Body string }{Body: org.Slug}, nil
+	})
+
+	resp := api.Get("/active-org", ownerAuth, "X-Organization: acme")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "acme")
+	resp = api.Get("/active-org", ownerAuth)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = api.Get("/active-org", otherAuth, "X-Organization: acme")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Site admins act as owners of every organization
+	resp = api.Get("/active-org", adminAuth, "X-Organization: acme")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// By the permissions of their role, not its name
+	require.NoError(t, db.Create(&database.Role{Name: "superuser", Permissions: `["*"]`}).Error)
+	_, superAuth := orgUser(t, db, "super@example.com", "superuser")
+	assert.Equal(t, http.StatusOK, api.Get("/active-org", superAuth, "X-Organization: acme").Code)
+}
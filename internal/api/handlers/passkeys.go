@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// PasskeyInfo describes a registered passkey.
+type PasskeyInfo struct {
+	ID             uint       `json:"id"`
+	Name           string     `json:"name"`
+	BackupEligible bool       `json:"backup_eligible" doc:"Whether the passkey can be synced between devices"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+}
+
+func newPasskeyInfo(p *database.Passkey) PasskeyInfo {
+	return PasskeyInfo{
+		ID:             p.ID,
+		Name:           p.Name,
+		BackupEligible: p.BackupEligible,
+		CreatedAt:      p.CreatedAt,
+		LastUsedAt:     p.LastUsedAt,
+	}
+}
+
+// WebAuthnBeginOutput represents the options for a WebAuthn ceremony.
+type WebAuthnBeginOutput struct {
+	Body struct {
+		Options      any    `json:"options" doc:"Pass to navigator.credentials.create() or .get()"`
+		SessionToken string `json:"session_token" doc:"Send back with the authenticator's response"`
+	}
+}
+
+// FinishPasskeyRegistrationInput represents the authenticator's response to a registration.
+type FinishPasskeyRegistrationInput struct {
+	Body struct {
+		SessionToken string         `json:"session_token" required:"true"`
+		Name         string         `json:"name,omitempty" maxLength:"100" doc:"Label for the passkey"`
+		Credential   map[string]any `json:"credential" required:"true" doc:"PublicKeyCredential from navigator.credentials.create()"`
+	}
+}
+
+// FinishPasskeyLoginInput represents the authenticator's response to a login.
+type FinishPasskeyLoginInput struct {
+	Body struct {
+		SessionToken string         `json:"session_token" required:"true"`
+		Credential   map[string]any `json:"credential" required:"true" doc:"PublicKeyCredential from navigator.credentials.get()"`
+	}
+}
+
+// PasskeyOutput represents the response for a single passkey.
+type PasskeyOutput struct {
+	Body PasskeyInfo
+}
+
+// ListPasskeysOutput represents the response for listing the current user's passkeys.
+type ListPasskeysOutput struct {
+	Body []PasskeyInfo
+}
+
+// PasskeyIDInput represents a request for a specific passkey.
+type PasskeyIDInput struct {
+	ID uint `path:"id"`
+}
+
+// RenamePasskeyInput represents the request to rename a passkey.
+type RenamePasskeyInput struct {
+	ID   uint `path:"id"`
+	Body struct {
+		Name string `json:"name" required:"true" minLength:"1" maxLength:"100"`
+	}
+}
+
+// passkeyError maps WebAuthn errors to API errors.
+func passkeyError(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrInvalidWebAuthnSession):
+		return huma.Error400BadRequest("invalid or expired passkey session")
+	case errors.Is(err, auth.ErrPasskeyCloned):
+		return huma.Error401Unauthorized("passkey signature counter did not increase")
+	case errors.Is(err, auth.ErrPasskeyRejected):
+		return huma.Error401Unauthorized("passkey verification failed")
+	}
+	return huma.Error500InternalServerError("failed to verify passkey", err)
+}
+
+// errPasskeysDisabled is returned by the ceremony endpoints when no relying
+// party is configured.
+var errPasskeysDisabled = huma.Error501NotImplemented("passkeys are not configured")
+
+// RegisterPasskeys registers the WebAuthn ceremony endpoints and the endpoints
+// for managing the current user's passkeys. passkeys may be nil when no
+// relying party is configured.
+func RegisterPasskeys(api huma.API, db *gorm.DB, passkeys *auth.Passkeys) {
+	// POST /api/auth/webauthn/register/begin - Start passkey registration
+	huma.Register(api, huma.Operation{
+		OperationID: "begin-passkey-registration",
+		Method:      http.MethodPost,
+		Path:        "/auth/webauthn/register/begin",
+		Summary:     "Start passkey registration",
+		Tags:        []string{"Auth"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *struct{}) (*WebAuthnBeginOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if passkeys == nil {
+			return nil, errPasskeysDisabled
+		}
+
+		creation, token, err := passkeys.BeginRegistration(user)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to start passkey registration", err)
+		}
+
+		resp := &WebAuthnBeginOutput{}
+		resp.Body.Options = creation
+		resp.Body.SessionToken = token
+		return resp, nil
+	})
+
+	// POST /api/auth/webauthn/register/finish - Finish passkey registration
+	huma.Register(api, huma.Operation{
+		OperationID: "finish-passkey-registration",
+		Method:      http.MethodPost,
+		Path:        "/auth/webauthn/register/finish",
+		Summary:     "Finish passkey registration",
+		Tags:        []string{"Auth"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *FinishPasskeyRegistrationInput) (*PasskeyOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if passkeys == nil {
+			return nil, errPasskeysDisabled
+		}
+
+		response, err := json.Marshal(input.Body.Credential)
+		if err != nil {
+			return nil, huma.Error400BadRequest("invalid credential", err)
+		}
+		passkey, err := passkeys.FinishRegistration(user, input.Body.SessionToken, input.Body.Name, response)
+		if err != nil {
+			return nil, passkeyError(err)
+		}
+
+		logging.FromContext(ctx).Info("passkey registered", logging.UserID, user.ID)
+		return &PasskeyOutput{Body: newPasskeyInfo(passkey)}, nil
+	})
+
+	// POST /api/auth/webauthn/login/begin - Start passkey login
+	huma.Register(api, huma.Operation{
+		OperationID: "begin-passkey-login",
+		Method:      http.MethodPost,
+		Path:        "/auth/webauthn/login/begin",
+		Summary:     "Start passkey login",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *struct{}) (*WebAuthnBeginOutput, error) {
+		if passkeys == nil {
+			return nil, errPasskeysDisabled
+		}
+
+		assertion, token, err := passkeys.BeginLogin()
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to start passkey login", err)
+		}
+
+		resp := &WebAuthnBeginOutput{}
+		resp.Body.Options = assertion
+		resp.Body.SessionToken = token
+		return resp, nil
+	})
+
+	// POST /api/auth/webauthn/login/finish - Finish passkey login
+	huma.Register(api, huma.Operation{
+		OperationID: "finish-passkey-login",
+		Method:      http.MethodPost,
+		Path:        "/auth/webauthn/login/finish",
+		Summary:     "Finish passkey login",
+		Description: "Verify the passkey and issue a session. Passkeys require user verification, so no further MFA step is needed.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *FinishPasskeyLoginInput) (resp *CallbackOutput, err error) {
+		if passkeys == nil {
+			return nil, errPasskeysDisabled
+		}
+
+		var user *database.User
+		defer func() { recordLoginAudit(ctx, db, "passkey", "", user, resp, err) }()
+
+		// The account is not known until the assertion is verified, so
+		// failures count against the client IP only
+		if err := checkLoginThrottle(ctx, db, ""); err != nil {
+			return nil, err
+		}
+
+		response, err := json.Marshal(input.Body.Credential)
+		if err != nil {
+			return nil, huma.Error400BadRequest("invalid credential", err)
+		}
+		user, err = passkeys.FinishLogin(input.Body.SessionToken, response)
+		if err != nil {
+			if errors.Is(err, auth.ErrPasskeyCloned) {
+				logging.FromContext(ctx).Warn("passkey counter regression", logging.Error, err)
+			}
+			if errors.Is(err, auth.ErrPasskeyRejected) || errors.Is(err, auth.ErrPasskeyCloned) {
+				recordLoginFailure(ctx, db, "")
+			}
+			return nil, passkeyError(err)
+		}
+
+		logging.FromContext(ctx).Info("passkey login", logging.UserID, user.ID)
+		return newSessionOutput(ctx, db, user)
+	})
+
+	// GET /api/me/passkeys - List passkeys
+	huma.Register(api, huma.Operation{
+		OperationID: "list-passkeys",
+		Method:      http.MethodGet,
+		Path:        "/me/passkeys",
+		Summary:     "List passkeys",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeProfileRead}},
+		},
+	}, func(ctx context.Context, input *struct{}) (*ListPasskeysOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var records []database.Passkey
+		if err := db.Where("user_id = ?", user.ID).Order("created_at").Find(&records).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to list passkeys", err)
+		}
+
+		resp := &ListPasskeysOutput{Body: make([]PasskeyInfo, 0, len(records))}
+		for i := range records {
+			resp.Body = append(resp.Body, newPasskeyInfo(&records[i]))
+		}
+		return resp, nil
+	})
+
+	// PUT /api/me/passkeys/{id} - Rename a passkey
+	huma.Register(api, huma.Operation{
+		OperationID: "rename-passkey",
+		Method:      http.MethodPut,
+		Path:        "/me/passkeys/{id}",
+		Summary:     "Rename a passkey",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+	}, func(ctx context.Context, input *RenamePasskeyInput) (*PasskeyOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var passkey database.Passkey
+		if err := db.Where("id = ? AND user_id = ?", input.ID, user.ID).First(&passkey).Error; err != nil {
+			return nil, huma.Error404NotFound("passkey not found")
+		}
+		if err := db.Model(&passkey).Update("name", input.Body.Name).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to rename passkey", err)
+		}
+		return &PasskeyOutput{Body: newPasskeyInfo(&passkey)}, nil
+	})
+
+	// DELETE /api/me/passkeys/{id} - Delete a passkey
+	huma.Register(api, huma.Operation{
+		OperationID: "delete-passkey",
+		Method:      http.MethodDelete,
+		Path:        "/me/passkeys/{id}",
+		Summary:     "Delete a passkey",
+		Description: "Remove a passkey. The last way to sign in cannot be removed.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *PasskeyIDInput) (*struct{}, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var passkey database.Passkey
+		if err := db.Where("id = ? AND user_id = ?", input.ID, user.ID).First(&passkey).Error; err != nil {
+			return nil, huma.Error404NotFound("passkey not found")
+		}
+
+		var identities, others int64
+		db.Model(&database.Identity{}).Where("user_id = ?", user.ID).Count(&identities)
+		db.Model(&database.Passkey{}).Where("user_id = ? AND id <> ?", user.ID, passkey.ID).Count(&others)
+		if identities == 0 && others == 0 && user.PasswordHash == "" {
+			return nil, huma.Error400BadRequest("cannot delete the only way to sign in")
+		}
+
+		// Hard delete so the credential ID can be registered again
+		if err := db.Unscoped().Delete(&passkey).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to delete passkey", err)
+		}
+
+		logging.FromContext(ctx).Info("passkey deleted", logging.UserID, user.ID)
+		return nil, nil
+	})
+}
@@ -0,0 +1,297 @@
+package handlers_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://app.example.com"
+)
+
+var b64 = base64.RawURLEncoding
+
+// softAuthenticator is a minimal platform authenticator: one P-256 credential,
+// "none" attestation and a signature counter.
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	counter    uint32
+	origin     string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{key: key, credID: credID, origin: testOrigin}
+}
+
+// ceremony holds the parts of the begin response the authenticator needs.
+type ceremony struct {
+	Options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	} `json:"options"`
+	SessionToken string `json:"session_token"`
+}
+
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+// create answers navigator.credentials.create().
+func (a *softAuthenticator) create(t *testing.T, c ceremony) map[string]any {
+	handle, err := b64.DecodeString(c.Options.PublicKey.User.ID)
+	require.NoError(t, err)
+	a.userHandle = handle
+
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(t, err)
+
+	attested := make([]byte, 16) // Zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credID)))
+	attested = append(attested, a.credID...)
+	attested = append(attested, coseKey...)
+
+	// UP | UV | AT
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(0x01|0x04|0x40, attested),
+	})
+	require.NoError(t, err)
+
+	return map[string]any{
+		"id":    b64.EncodeToString(a.credID),
+		"rawId": b64.EncodeToString(a.credID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", c.Options.PublicKey.Challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	}
+}
+
+// get answers navigator.credentials.get(), incrementing the counter.
+func (a *softAuthenticator) get(t *testing.T, c ceremony) map[string]any {
+	a.counter++
+	authData := a.authData(0x01|0x04, nil)
+	clientData := a.clientData("webauthn.get", c.Options.PublicKey.Challenge)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	return map[string]any{
+		"id":    b64.EncodeToString(a.credID),
+		"rawId": b64.EncodeToString(a.credID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(sig),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+func setupPasskeyTest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+
+	passkeys, err := auth.NewPasskeys(db, auth.WebAuthnConfig{
+		RPID:          testRPID,
+		RPDisplayName: "Inkling",
+		RPOrigins:     []string{testOrigin},
+	})
+	require.NoError(t, err)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterMFA(api, db)
+	handlers.RegisterPasskeys(api, db, passkeys)
+	return db, api
+}
+
+func beginCeremony(t *testing.T, api humatest.TestAPI, path string, headers ...any) ceremony {
+	t.Helper()
+	resp := api.Post(path, headers...)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var c ceremony
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &c))
+	require.NotEmpty(t, c.Options.PublicKey.Challenge)
+	return c
+}
+
+// registerPasskey runs a full registration ceremony for the token's user.
+func registerPasskey(t *testing.T, api humatest.TestAPI, token string, a *softAuthenticator) {
+	t.Helper()
+	c := beginCeremony(t, api, "/auth/webauthn/register/begin", "Authorization: Bearer "+token)
+	resp := api.Post("/auth/webauthn/register/finish", map[string]any{
+		"session_token": c.SessionToken,
+		"name":          "Laptop",
+		"credential":    a.create(t, c),
+	}, "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+}
+
+func passkeyLogin(t *testing.T, api humatest.TestAPI, a *softAuthenticator) *httptest.ResponseRecorder {
+	t.Helper()
+	c := beginCeremony(t, api, "/auth/webauthn/login/begin")
+	return api.Post("/auth/webauthn/login/finish", map[string]any{
+		"session_token": c.SessionToken,
+		"credential":    a.get(t, c),
+	})
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	db, api := setupPasskeyTest(t)
+	api.Post("/auth/signup", map[string]any{"email": "passkey@example.com", "password": "password123", "name": "Passkey User"})
+	var user database.User
+	db.Where("email = ?", "passkey@example.com").First(&user)
+	token := issueToken(t, db, user.ID)
+
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, api, token, a)
+
+	resp := api.Get("/me/passkeys", "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var listed []handlers.PasskeyInfo
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, "Laptop", listed[0].Name)
+	assert.Nil(t, listed[0].LastUsedAt)
+
+	// The user handle is random, not the user ID
+	db.First(&user, user.ID)
+	assert.Equal(t, user.WebAuthnID, string(a.userHandle))
+	assert.NotEqual(t, fmt.Sprint(user.ID), user.WebAuthnID)
+
+	// Passkey login issues the same token pair as a password login, even with MFA enabled
+	enrollMFA(t, api, token)
+	login := passkeyLogin(t, api, a)
+	require.Equal(t, http.StatusOK, login.Code, login.Body.String())
+	assert.Contains(t, login.Body.String(), `"token"`)
+	assert.Contains(t, login.Body.String(), `"refresh_token"`)
+	assert.NotContains(t, login.Body.String(), `"mfa_required"`)
+
+	var stored database.Passkey
+	db.Where("user_id = ?", user.ID).First(&stored)
+	assert.Equal(t, uint32(1), stored.SignCount)
+	assert.NotNil(t, stored.LastUsedAt)
+
+	// Ceremony sessions are single-use
+	c := beginCeremony(t, api, "/auth/webauthn/login/begin")
+	credential := a.get(t, c)
+	resp = api.Post("/auth/webauthn/login/finish", map[string]any{"session_token": c.SessionToken, "credential": credential})
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = api.Post("/auth/webauthn/login/finish", map[string]any{"session_token": c.SessionToken, "credential": credential})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Rename
+	resp = api.Put(fmt.Sprintf("/me/passkeys/%d", stored.ID), map[string]any{"name": "Phone"}, "Authorization: Bearer "+token)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"name":"Phone"`)
+
+	// Delete, after which the passkey no longer signs in
+	resp = api.Delete(fmt.Sprintf("/me/passkeys/%d", stored.ID), "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, http.StatusUnauthorized, passkeyLogin(t, api, a).Code)
+}
+
+func TestPasskeyLoginRejectsCounterRegression(t *testing.T) {
+	db, api := setupPasskeyTest(t)
+	user := database.User{Email: "clone@example.com", Name: "Clone", Role: database.RoleUser}
+	db.Create(&user)
+	token := issueToken(t, db, user.ID)
+
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, api, token, a)
+	a.counter = 5
+	require.Equal(t, http.StatusOK, passkeyLogin(t, api, a).Code)
+
+	// A copy of the key with an older counter is refused
+	a.counter = 2
+	assert.Equal(t, http.StatusUnauthorized, passkeyLogin(t, api, a).Code)
+
+	// As is a response for a different origin
+	a.counter = 10
+	a.origin = "https://evil.example.net"
+	assert.Equal(t, http.StatusUnauthorized, passkeyLogin(t, api, a).Code)
+
+	// The only passkey of a user without a password cannot be deleted
+	var stored database.Passkey
+	db.Where("user_id = ?", user.ID).First(&stored)
+	resp := api.Delete(fmt.Sprintf("/me/passkeys/%d", stored.ID), "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestPasskeyLoginFailuresLockOutTheClient(t *testing.T) {
+	db, api := setupPasskeyTest(t)
+	user := database.User{Email: "throttle@example.com", Name: "Throttle", Role: database.RoleUser}
+	db.Create(&user)
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, api, issueToken(t, db, user.ID), a)
+
+	// Thirty rejected assertions lock out the IP, even for a valid passkey
+	a.origin = "https://evil.example.net"
+	for range 30 {
+		require.Equal(t, http.StatusUnauthorized, passkeyLogin(t, api, a).Code)
+	}
+	a.origin = testOrigin
+	assert.Equal(t, http.StatusTooManyRequests, passkeyLogin(t, api, a).Code)
+}
+
+func TestPasskeysNotConfigured(t *testing.T) {
+	db := openTestDB(t)
+	_, api := humatest.New(t)
+	handlers.RegisterPasskeys(api, db, nil)
+
+	resp := api.Post("/auth/webauthn/login/begin")
+	assert.Equal(t, http.StatusNotImplemented, resp.Code)
+}
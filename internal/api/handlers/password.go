@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"github.com/techsquidtv/inkling/internal/mail"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// EmailRequestInput represents a request that sends an email to an address.
+type EmailRequestInput struct {
+	Body struct {
+		Email string `json:"email" format:"email" required:"true"`
+	}
+}
+
+// EmailSentOutput represents the response to a request that may send an
+// email. It is the same whether or not the address belongs to a user.
+type EmailSentOutput struct {
+	Body struct {
+		Message string `json:"message"`
+	}
+}
+
+// ResetPasswordInput represents the request to choose a new password.
+type ResetPasswordInput struct {
+	Body struct {
+		Token    string `json:"token" required:"true" doc:"Token from the reset email"`
+		Password string `json:"password" minLength:"8" required:"true"`
+	}
+}
+
+// VerifyEmailInput represents the request to verify an email address.
+type VerifyEmailInput struct {
+	Body struct {
+		Token string `json:"token" required:"true" doc:"Token from the verification email"`
+	}
+}
+
+// errMailDisabled is returned by endpoints that send email when no mailer is configured.
+var errMailDisabled = huma.Error501NotImplemented("email is not configured")
+
+// sendVerificationEmail emails the user a link to verify their address.
+func sendVerificationEmail(ctx context.Context, mailer *mail.Mailer, user *database.User) error {
+	token, err := auth.NewEmailVerificationToken(user)
+	if err != nil {
+		return err
+	}
+	return mailer.SendVerification(ctx, user.Email, token, auth.EmailVerificationTTL)
+}
+
+// throttleMail refuses with 429 and Retry-After while the client IP or the
+// recipient has asked for too many emails, and otherwise counts the request.
+// Requests count whether or not the address belongs to a user, so the
+// responses do not reveal it either.
+func throttleMail(ctx context.Context, db *gorm.DB, recipient string) error {
+	ip := middleware.GetClientInfo(ctx).IPAddress
+	wait, err := auth.CheckMailThrottle(ctx, db, ip, recipient)
+	if err != nil {
+		return huma.Error500InternalServerError("database error", err)
+	}
+	if wait > 0 {
+		return tooManyRequests("too many emails requested, try again later", wait)
+	}
+	if err := auth.RecordMailRequest(ctx, db, ip, recipient); err != nil {
+		return huma.Error500InternalServerError("database error", err)
+	}
+	return nil
+}
+
+// RegisterPasswordReset registers the forgot-password and email verification
+// endpoints. mailer may be nil, in which case endpoints that send email
+// return 501.
+func RegisterPasswordReset(api huma.API, db *gorm.DB, mailer *mail.Mailer) {
+	// POST /api/auth/password/forgot - Request a password reset email
+	huma.Register(api, huma.Operation{
+		OperationID: "forgot-password",
+		Method:      http.MethodPost,
+		Path:        "/auth/password/forgot",
+		Summary:     "Request a password reset email",
+		Description: "Email a reset link to the address if it belongs to a user. The response does not reveal whether it does.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *EmailRequestInput) (*EmailSentOutput, error) {
+		if mailer == nil {
+			return nil, errMailDisabled
+		}
+		if err := throttleMail(ctx, db, input.Body.Email); err != nil {
+			return nil, err
+		}
+
+		resp := &EmailSentOutput{}
+		resp.Body.Message = "If an account exists for that email, a reset link has been sent."
+
+		var user database.User
+		if err := db.Where("email = ?", input.Body.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return resp, nil
+			}
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+
+		token, err := auth.NewPasswordResetToken(&user)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to create reset token", err)
+		}
+		if err := mailer.SendPasswordReset(ctx, user.Email, token, auth.PasswordResetTTL); err != nil {
+			return nil, huma.Error500InternalServerError("failed to send email", err)
+		}
+
+		logging.FromContext(ctx).Info("password reset requested", logging.UserID, user.ID)
+		return resp, nil
+	})
+
+	// POST /api/auth/password/reset - Choose a new password
+	huma.Register(api, huma.Operation{
+		OperationID: "reset-password",
+		Method:      http.MethodPost,
+		Path:        "/auth/password/reset",
+		Summary:     "Reset password",
+		Description: "Set a new password with the token from a reset email. The token works once, and all sessions are signed out.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *ResetPasswordInput) (*struct{}, error) {
+		hash, err := bcrypt.GenerateFromPassword([]byte(input.Body.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to hash password", err)
+		}
+
+		user, err := auth.ResetPassword(db, input.Body.Token, string(hash))
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidEmailToken) {
+				return nil, huma.Error400BadRequest("invalid or expired token")
+			}
+			return nil, huma.Error500InternalServerError("failed to reset password", err)
+		}
+
+		logging.FromContext(ctx).Info("password reset", logging.UserID, user.ID)
+		return nil, nil
+	})
+
+	// POST /api/auth/verify - Verify an email address
+	huma.Register(api, huma.Operation{
+		OperationID: "verify-email",
+		Method:      http.MethodPost,
+		Path:        "/auth/verify",
+		Summary:     "Verify email address",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *VerifyEmailInput) (*struct{}, error) {
+		user, err := auth.VerifyEmail(db, input.Body.Token)
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidEmailToken) {
+				return nil, huma.Error400BadRequest("invalid or expired token")
+			}
+			return nil, huma.Error500InternalServerError("failed to verify email", err)
+		}
+
+		logging.FromContext(ctx).Info("email verified", logging.UserID, user.ID)
+		return nil, nil
+	})
+
+	// POST /api/auth/verify/resend - Send a new verification email
+	huma.Register(api, huma.Operation{
+		OperationID: "resend-verification",
+		Method:      http.MethodPost,
+		Path:        "/auth/verify/resend",
+		Summary:     "Resend verification email",
+		Description: "Email a new verification link if the address belongs to an unverified user. The response does not reveal whether it does.",
+		Tags:        []string{"Auth", "public"},
+	}, func(ctx context.Context, input *EmailRequestInput) (*EmailSentOutput, error) {
+		if mailer == nil {
+			return nil, errMailDisabled
+		}
+		if err := throttleMail(ctx, db, input.Body.Email); err != nil {
+			return nil, err
+		}
+
+		resp := &EmailSentOutput{}
+		resp.Body.Message = "If an unverified account exists for that email, a verification link has been sent."
+
+		var user database.User
+		if err := db.Where("email = ? AND email_verified_at IS NULL", input.Body.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return resp, nil
+			}
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+		if err := sendVerificationEmail(ctx, mailer, &user); err != nil {
+			return nil, huma.Error500InternalServerError("failed to send email", err)
+		}
+		return resp, nil
+	})
+}
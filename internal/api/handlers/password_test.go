@@ -0,0 +1,319 @@
+package handlers_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/mail"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// smtpMessage is a message received by the SMTP stand-in.
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// smtpStandIn is a minimal SMTP server that accepts every message.
+type smtpStandIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &smtpStandIn{listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP stand-in")
+	var msg smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = smtpMessage{From: strings.Trim(strings.TrimSpace(line)[10:], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.To = append(msg.To, strings.Trim(strings.TrimSpace(line)[8:], "<>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg.Data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *smtpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// last returns the most recent message, which must be addressed to to.
+func (s *smtpStandIn) last(t *testing.T, to string) smtpMessage {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.NotEmpty(t, s.messages, "no email was sent")
+	msg := s.messages[len(s.messages)-1]
+	assert.Equal(t, []string{to}, msg.To)
+	return msg
+}
+
+// mailer returns a mailer that delivers to the stand-in.
+func (s *smtpStandIn) mailer() *mail.Mailer {
+	return mail.NewMailer(mail.NewSMTPSender(mail.SMTPConfig{
+		Host: "127.0.0.1",
+		Port: s.port(),
+		From: "Inkling <no-reply@example.com>",
+	}), "https://app.example.com/")
+}
+
+func (s *smtpStandIn) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+var tokenLink = regexp.MustCompile(`https://app\.example\.com/[a-z-]+\?token=(\S+)`)
+
+// linkToken extracts the token from the link in an email.
+func linkToken(t *testing.T, msg smtpMessage) string {
+	t.Helper()
+	m := tokenLink.FindStringSubmatch(msg.Data)
+	require.NotNil(t, m, "no link in email:\n%s", msg.Data)
+	token, err := url.QueryUnescape(m[1])
+	require.NoError(t, err)
+	return token
+}
+
+func setupPasswordTest(t *testing.T) (*gorm.DB, humatest.TestAPI, *smtpStandIn) {
+	db := openTestDB(t)
+
+	smtp := newSMTPStandIn(t)
+	mailer := smtp.mailer()
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), mailer)
+	handlers.RegisterPasswordReset(api, db, mailer)
+	handlers.RegisterAdmin(api, db)
+	return db, api, smtp
+}
+
+func TestPasswordReset(t *testing.T) {
+	db, api, smtp := setupPasswordTest(t)
+	resp := api.Post("/auth/signup", map[string]any{"email": "reset@example.com", "password": "password123", "name": "Reset"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var user database.User
+	db.Where("email = ?", "reset@example.com").First(&user)
+	session := issueToken(t, db, user.ID)
+
+	// Unknown addresses get the same answer and no email
+	sent := smtp.count()
+	resp = api.Post("/auth/password/forgot", map[string]any{"email": "nobody@example.com"})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, sent, smtp.count())
+
+	resp = api.Post("/auth/password/forgot", map[string]any{"email": "reset@example.com"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	msg := smtp.last(t, "reset@example.com")
+	assert.Equal(t, "no-reply@example.com", msg.From)
+	assert.Contains(t, msg.Data, "Subject: Reset your Inkling password")
+	token := linkToken(t, msg)
+
+	// A reset token is not an access token
+	resp = api.Get("/admin/settings", "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	resp = api.Post("/auth/password/reset", map[string]any{"token": token, "password": "new-password"})
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	// The new password works, the old one and existing sessions do not
+	resp = api.Post("/auth/login", map[string]any{"email": "reset@example.com", "password": "new-password"})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = api.Post("/auth/login", map[string]any{"email": "reset@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = api.Get("/admin/settings", "Authorization: Bearer "+session)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// The token is single-use
+	resp = api.Post("/auth/password/reset", map[string]any{"token": token, "password": "another-password"})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Tampered tokens are rejected
+	api.Post("/auth/password/forgot", map[string]any{"email": "reset@example.com"})
+	token = linkToken(t, smtp.last(t, "reset@example.com"))
+	resp = api.Post("/auth/password/reset", map[string]any{"token": token[:len(token)-2] + "xx", "password": "another-password"})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestEmailVerification(t *testing.T) {
+	db, api, smtp := setupPasswordTest(t)
+
+	// The first user is an admin and verifies their own address
+	resp := api.Post("/auth/signup", map[string]any{"email": "admin@example.com", "password": "password123", "name": "Admin"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var admin database.User
+	db.Where("email = ?", "admin@example.com").First(&admin)
+	adminToken := issueToken(t, db, admin.ID)
+
+	resp = api.Put("/admin/settings", map[string]any{"require_email_verification": true}, "Authorization: Bearer "+adminToken)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	msg := smtp.last(t, "admin@example.com")
+	assert.Contains(t, msg.Data, "Subject: Verify your Inkling email address")
+	resp = api.Post("/auth/verify", map[string]any{"token": linkToken(t, msg)})
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Put("/admin/settings", map[string]any{"require_email_verification": true}, "Authorization: Bearer "+adminToken)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"require_email_verification":true`)
+
+	// New users do not get a session until they verify
+	resp = api.Post("/auth/signup", map[string]any{"email": "new@example.com", "password": "password123", "name": "New"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"verification_required":true`)
+	assert.NotContains(t, resp.Body.String(), `"token"`)
+	first := linkToken(t, smtp.last(t, "new@example.com"))
+
+	resp = api.Post("/auth/login", map[string]any{"email": "new@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// A resent link works too; the first one is then used up
+	resp = api.Post("/auth/verify/resend", map[string]any{"email": "new@example.com"})
+	require.Equal(t, http.StatusOK, resp.Code)
+	second := linkToken(t, smtp.last(t, "new@example.com"))
+	resp = api.Post("/auth/verify", map[string]any{"token": second})
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Post("/auth/verify", map[string]any{"token": first})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = api.Post("/auth/login", map[string]any{"email": "new@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Verified users are not sent another link
+	sent := smtp.count()
+	api.Post("/auth/verify/resend", map[string]any{"email": "new@example.com"})
+	assert.Equal(t, sent, smtp.count())
+}
+
+func TestVerificationTokenBoundToEmail(t *testing.T) {
+	db, api, _ := setupPasswordTest(t)
+	user := database.User{Email: "old@example.com", Name: "Mover", Role: database.RoleUser}
+	db.Create(&user)
+	token, err := auth.NewEmailVerificationToken(&user)
+	require.NoError(t, err)
+
+	// A link sent to the old address cannot verify a new one
+	db.Model(&user).Update("email", "new@example.com")
+	resp := api.Post("/auth/verify", map[string]any{"token": token})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	db.First(&user, user.ID)
+	token, err = auth.NewEmailVerificationToken(&user)
+	require.NoError(t, err)
+	resp = api.Post("/auth/verify", map[string]any{"token": token})
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+}
+
+func TestEmailRequestsAreThrottled(t *testing.T) {
+	db, api, smtp := setupPasswordTest(t)
+	db.Create(&database.User{Email: "spammed@example.com", Name: "Spammed", Role: database.RoleUser})
+
+	// Three emails to an address, then it is locked out for a while
+	for range 3 {
+		require.Equal(t, http.StatusOK, api.Post("/auth/password/forgot", map[string]any{"email": "Spammed@example.com"}).Code)
+	}
+	sent := smtp.count()
+	resp := api.Post("/auth/password/forgot", map[string]any{"email": "spammed@example.com"})
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusTooManyRequests, api.Post("/auth/verify/resend", map[string]any{"email": "spammed@example.com"}).Code)
+	assert.Equal(t, sent, smtp.count())
+
+	// Unknown addresses are counted alike, so the answer does not tell them apart
+	for range 3 {
+		require.Equal(t, http.StatusOK, api.Post("/auth/password/forgot", map[string]any{"email": "nobody@example.com"}).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, api.Post("/auth/password/forgot", map[string]any{"email": "nobody@example.com"}).Code)
+
+	// Asking for mail does not lock the account out of logging in
+	wait, err := auth.CheckLoginThrottle(context.Background(), db, "", "spammed@example.com")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestMailSenderFromEnv(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("MAIL_DIR", "")
+
+	// Emails are only logged in development
+	sender, err := mail.NewSenderFromEnv("development")
+	require.NoError(t, err)
+	assert.IsType(t, &mail.LogSender{}, sender)
+	sender, err = mail.NewSenderFromEnv("production")
+	require.NoError(t, err)
+	assert.Nil(t, sender)
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	sender, err = mail.NewSenderFromEnv("production")
+	require.NoError(t, err)
+	assert.IsType(t, &mail.SMTPSender{}, sender)
+}
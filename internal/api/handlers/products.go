@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
 	"gorm.io/gorm"
@@ -12,7 +14,7 @@ import (
 
 type ProductInput struct {
 	Body struct {
-		Code  string `json:"code" doc:"Unique product code" example:"D42"`
+		Code  string `json:"code" doc:"Product code, unique within the organization" example:"D42"`
 		Price uint   `json:"price" doc:"Product price" example:"100"`
 	}
 }
@@ -25,26 +27,59 @@ type ProductsOutput struct {
 	Body []database.Product
 }
 
+// CatalogueInput names the organization whose products a public read returns.
+type CatalogueInput struct {
+	Organization string `header:"X-Organization" doc:"Slug of the organization; the default organization when omitted"`
+}
+
+// catalogueOrganization returns the organization a public product read is
+// for: the active organization of a member or organization API key, the one
+// named by the header for anonymous callers, or else the default one. It
+// returns nil if that organization does not exist.
+func catalogueOrganization(ctx context.Context, db *gorm.DB, slug string) (*database.Organization, error) {
+	if org := middleware.GetOrganization(ctx); org != nil {
+		return org, nil
+	}
+	if slug == "" {
+		slug = database.DefaultOrganization
+	}
+	var org database.Organization
+	if err := db.Where("slug = ?", slug).First(&org).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, huma.Error500InternalServerError("Failed to fetch organization", err)
+	}
+	return &org, nil
+}
+
+// Products belong to an organization. Anyone can read them; creating and
+// deleting them takes membership of the active organization, named by the
+// X-Organization header or implied by an organization API key.
 func RegisterProducts(api huma.API, db *gorm.DB) {
-	// Create product (admin-only)
+	// Create product (products:write)
 	huma.Register(api, huma.Operation{
 		OperationID: "create-product",
 		Method:      http.MethodPost,
 		Path:        "/products",
 		Summary:     "Create product",
-		Description: "Create a new product. Requires admin role.",
+		Description: "Create a new product in the active organization. Requires the products:write permission, which every organization role grants.",
 		Tags:        []string{"Products"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeProductsWrite}},
 		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionProductsWrite},
 	}, func(ctx context.Context, input *ProductInput) (*ProductOutput, error) {
-		if _, err := middleware.RequireAdmin(ctx); err != nil {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleMember)
+		if err != nil {
 			return nil, err
 		}
 
 		product := database.Product{
-			Code:  input.Body.Code,
-			Price: input.Body.Price,
+			OrganizationID: org.ID,
+			Code:           input.Body.Code,
+			Price:          input.Body.Price,
 		}
 
 		if err := db.Create(&product).Error; err != nil {
@@ -57,23 +92,55 @@ func RegisterProducts(api huma.API, db *gorm.DB) {
 	})
 
 	// List products
-	huma.Get(api, "/products", func(ctx context.Context, input *struct{}) (*ProductsOutput, error) {
-		var products []database.Product
-		if err := db.Find(&products).Error; err != nil {
-			return nil, huma.Error500InternalServerError("Failed to fetch products", err)
+	huma.Register(api, huma.Operation{
+		OperationID: "list-products",
+		Method:      http.MethodGet,
+		Path:        "/products",
+		Summary:     "List products",
+		Description: "List the products of an organization: the one named by the X-Organization header, or the default organization. No authentication required.",
+		Tags:        []string{"Products", "public"},
+	}, func(ctx context.Context, input *CatalogueInput) (*ProductsOutput, error) {
+		org, err := catalogueOrganization(ctx, db, input.Organization)
+		if err != nil {
+			return nil, err
 		}
 
 		resp := &ProductsOutput{}
-		resp.Body = products
+		resp.Body = []database.Product{}
+		if org == nil {
+			if input.Organization != "" {
+				return nil, huma.Error404NotFound("organization not found")
+			}
+			return resp, nil
+		}
+		if err := database.Replica(db).Where("organization_id = ?", org.ID).Find(&resp.Body).Error; err != nil {
+			return nil, huma.Error500InternalServerError("Failed to fetch products", err)
+		}
 		return resp, nil
 	})
 
 	// Get product by ID
-	huma.Get(api, "/products/{id}", func(ctx context.Context, input *struct {
+	huma.Register(api, huma.Operation{
+		OperationID: "get-product",
+		Method:      http.MethodGet,
+		Path:        "/products/{id}",
+		Summary:     "Get product",
+		Description: "Get a product of an organization: the one named by the X-Organization header, or the default organization. No authentication required.",
+		Tags:        []string{"Products", "public"},
+	}, func(ctx context.Context, input *struct {
+		CatalogueInput
 		ID uint `path:"id" doc:"Product ID"`
 	}) (*ProductOutput, error) {
+		org, err := catalogueOrganization(ctx, db, input.Organization)
+		if err != nil {
+			return nil, err
+		}
+		if org == nil {
+			return nil, huma.Error404NotFound("Product not found")
+		}
+
 		var product database.Product
-		if err := db.First(&product, input.ID).Error; err != nil {
+		if err := db.Where("organization_id = ?", org.ID).First(&product, input.ID).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				return nil, huma.Error404NotFound("Product not found")
 			}
@@ -85,26 +152,33 @@ func RegisterProducts(api huma.API, db *gorm.DB) {
 		return resp, nil
 	})
 
-	// Delete product (admin-only)
+	// Delete product (products:write)
 	huma.Register(api, huma.Operation{
 		OperationID: "delete-product",
 		Method:      http.MethodDelete,
 		Path:        "/products/{id}",
 		Summary:     "Delete product",
-		Description: "Delete a product. Requires admin role.",
+		Description: "Delete a product of the active organization. Requires the products:write permission, which every organization role grants.",
 		Tags:        []string{"Products"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeProductsWrite}},
 		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionProductsWrite},
 	}, func(ctx context.Context, input *struct {
 		ID uint `path:"id" doc:"Product ID"`
 	}) (*struct{}, error) {
-		if _, err := middleware.RequireAdmin(ctx); err != nil {
+		org, err := middleware.RequireOrgRole(ctx, database.OrgRoleMember)
+		if err != nil {
 			return nil, err
 		}
 
-		if err := db.Delete(&database.Product{}, input.ID).Error; err != nil {
-			return nil, huma.Error500InternalServerError("Failed to delete product", err)
+		result := db.Where("organization_id = ?", org.ID).Delete(&database.Product{}, input.ID)
+		if result.Error != nil {
+			return nil, huma.Error500InternalServerError("Failed to delete product", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return nil, huma.Error404NotFound("Product not found")
 		}
 		return nil, nil
 	})
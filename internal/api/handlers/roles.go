@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// RoleInfo represents a role in admin responses.
+type RoleInfo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions" doc:"Permissions the role grants; \"*\" grants all"`
+	BuiltIn     bool      `json:"built_in" doc:"Built-in roles cannot be deleted, and admin cannot be changed"`
+	Users       int64     `json:"users" doc:"Number of users with the role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ListRolesOutput represents the response for listing roles.
+type ListRolesOutput struct {
+	Body struct {
+		Roles []RoleInfo `json:"roles"`
+	}
+}
+
+// ListPermissionsOutput represents the response for listing permissions.
+type ListPermissionsOutput struct {
+	Body struct {
+		Permissions []auth.Permission `json:"permissions"`
+	}
+}
+
+// RoleOutput represents a single role response.
+type RoleOutput struct {
+	Body RoleInfo
+}
+
+// CreateRoleInput represents the request to create a role.
+type CreateRoleInput struct {
+	Body struct {
+		Name        string   `json:"name" required:"true" pattern:"^[a-z0-9][a-z0-9_-]{0,31}$" doc:"Unique role name, assigned to users"`
+		Description string   `json:"description,omitempty" maxLength:"256"`
+		Permissions []string `json:"permissions" required:"true" uniqueItems:"true" enum:"products:write,users:read,users:write,users:impersonate,settings:read,settings:write,audit:read,roles:read,roles:write" doc:"Permissions the role grants"`
+	}
+}
+
+// UpdateRoleInput represents the request to change a role.
+type UpdateRoleInput struct {
+	Name string `path:"name"`
+	Body struct {
+		Description *string  `json:"description,omitempty" maxLength:"256"`
+		Permissions []string `json:"permissions,omitempty" uniqueItems:"true" enum:"products:write,users:read,users:write,users:impersonate,settings:read,settings:write,audit:read,roles:read,roles:write" doc:"Replaces the permissions the role grants"`
+	}
+}
+
+// DeleteRoleInput represents the request to delete a role.
+type DeleteRoleInput struct {
+	Name string `path:"name"`
+}
+
+func roleInfo(db *gorm.DB, role *database.Role) RoleInfo {
+	var users int64
+	db.Model(&database.User{}).Where("role = ?", role.Name).Count(&users)
+	return RoleInfo{
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: auth.ParseScopes(role.Permissions),
+		BuiltIn:     role.BuiltIn,
+		Users:       users,
+		CreatedAt:   role.CreatedAt,
+	}
+}
+
+// roleReferrer returns what would hand out the named role to users later:
+// pending invitations, OIDC role mappings or LDAP group mappings. It returns
+// an empty string when nothing does.
+func roleReferrer(db *gorm.DB, name string) (string, error) {
+	// Expired invitations can still be resent
+	var invitations int64
+	if err := db.Model(&database.Invitation{}).Where("role = ? AND accepted_at IS NULL", name).Count(&invitations).Error; err != nil {
+		return "", err
+	}
+	if invitations > 0 {
+		return "pending invitations", nil
+	}
+
+	oidcMappings, oidcDefaultRole, err := auth.ProviderRoleMappings(db, database.DefaultOIDCProvider)
+	if err != nil {
+		return "", err
+	}
+	if oidcDefaultRole == name || slices.ContainsFunc(oidcMappings, func(m auth.OIDCRoleMapping) bool { return m.Role == name }) {
+		return "OIDC role mappings", nil
+	}
+	var providers []database.OIDCProviderConfig
+	if err := db.Find(&providers).Error; err != nil {
+		return "", err
+	}
+	for i := range providers {
+		mappings := auth.ParseOIDCRoleMappings(&providers[i])
+		if providers[i].DefaultRole == name || slices.ContainsFunc(mappings, func(m auth.OIDCRoleMapping) bool { return m.Role == name }) {
+			return "the role mappings of OIDC provider " + providers[i].Slug, nil
+		}
+	}
+
+	ldap, err := auth.LDAPSettings(db)
+	if err != nil {
+		return "", err
+	}
+	if slices.ContainsFunc(auth.ParseLDAPGroupRoles(ldap), func(m auth.LDAPGroupRole) bool { return m.Role == name }) {
+		return "LDAP group mappings", nil
+	}
+	return "", nil
+}
+
+// requireMappableRoles checks that identity provider claims can be mapped to
+// the roles: they must exist and be within the caller's own permissions. An
+// empty default role is allowed, as it keeps users' roles.
+func requireMappableRoles(ctx context.Context, db *gorm.DB, mappings []auth.OIDCRoleMapping, defaultRole string) error {
+	roles := make([]string, 0, len(mappings)+1)
+	for _, mapping := range mappings {
+		roles = append(roles, mapping.Role)
+	}
+	if defaultRole != "" {
+		roles = append(roles, defaultRole)
+	}
+	for _, role := range roles {
+		if err := requireExistingRole(db, role); err != nil {
+			return err
+		}
+		if err := requireRoleWithin(ctx, db, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireRoleWithin refuses callers whose own role lacks any permission the
+// named role grants, so users cannot hand out more access than they hold.
+func requireRoleWithin(ctx context.Context, db *gorm.DB, name string) error {
+	if !auth.HasPermissions(middleware.GetPermissions(ctx), auth.RolePermissions(db, name)) {
+		return huma.Error403Forbidden("the " + name + " role grants permissions you do not have")
+	}
+	return nil
+}
+
+// requirePermissionsWithin refuses callers whose own role lacks any of the
+// given permissions.
+func requirePermissionsWithin(ctx context.Context, permissions []string) error {
+	if !auth.HasPermissions(middleware.GetPermissions(ctx), permissions) {
+		return huma.Error403Forbidden("cannot grant permissions you do not have")
+	}
+	return nil
+}
+
+func findRole(db *gorm.DB, name string) (*database.Role, error) {
+	var role database.Role
+	if err := db.Where("name = ?", name).First(&role).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("role not found")
+		}
+		return nil, huma.Error500InternalServerError("failed to fetch role", err)
+	}
+	return &role, nil
+}
+
+// RegisterRoles registers the role and permission management endpoints.
+func RegisterRoles(api huma.API, db *gorm.DB) {
+	huma.Register(api, huma.Operation{
+		OperationID: "list-permissions",
+		Method:      http.MethodGet,
+		Path:        "/admin/permissions",
+		Summary:     "List permissions",
+		Description: "List every permission a role can grant. Requires the roles:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeRolesRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionRolesRead},
+	}, func(ctx context.Context, input *struct{}) (*ListPermissionsOutput, error) {
+		resp := &ListPermissionsOutput{}
+		resp.Body.Permissions = auth.AllPermissions
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "list-roles",
+		Method:      http.MethodGet,
+		Path:        "/admin/roles",
+		Summary:     "List roles",
+		Description: "List the built-in and custom roles. Requires the roles:read permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeRolesRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionRolesRead},
+	}, func(ctx context.Context, input *struct{}) (*ListRolesOutput, error) {
+		var roles []database.Role
+		if err := db.Order("built_in DESC, name").Find(&roles).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch roles", err)
+		}
+
+		resp := &ListRolesOutput{}
+		resp.Body.Roles = make([]RoleInfo, len(roles))
+		for i := range roles {
+			resp.Body.Roles[i] = roleInfo(db, &roles[i])
+		}
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "create-role",
+		Method:      http.MethodPost,
+		Path:        "/admin/roles",
+		Summary:     "Create role",
+		Description: "Create a custom role from a set of permissions. You can only grant permissions you have. Requires the roles:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeRolesWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionRolesWrite},
+	}, func(ctx context.Context, input *CreateRoleInput) (*RoleOutput, error) {
+		if err := requirePermissionsWithin(ctx, input.Body.Permissions); err != nil {
+			return nil, err
+		}
+
+		var count int64
+		db.Model(&database.Role{}).Where("name = ?", input.Body.Name).Count(&count)
+		if count > 0 {
+			return nil, huma.Error409Conflict("a role with this name already exists")
+		}
+
+		role := database.Role{
+			Name:        input.Body.Name,
+			Description: input.Body.Description,
+			Permissions: auth.EncodeScopes(input.Body.Permissions),
+		}
+		if err := db.Create(&role).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to create role", err)
+		}
+		info := roleInfo(db, &role)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditRoleCreate,
+			TargetType: "role",
+			TargetID:   role.Name,
+			After:      info,
+		})
+
+		return &RoleOutput{Body: info}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "update-role",
+		Method:      http.MethodPut,
+		Path:        "/admin/roles/{name}",
+		Summary:     "Update role",
+		Description: "Change a role's description or permissions. Omitted fields are left unchanged. The admin role cannot be changed. Requires the roles:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeRolesWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionRolesWrite},
+	}, func(ctx context.Context, input *UpdateRoleInput) (*RoleOutput, error) {
+		role, err := findRole(db, input.Name)
+		if err != nil {
+			return nil, err
+		}
+		if role.Name == database.RoleAdmin {
+			return nil, huma.Error400BadRequest("the admin role cannot be changed")
+		}
+		if err := requireRoleWithin(ctx, db, role.Name); err != nil {
+			return nil, err
+		}
+
+		before := roleInfo(db, role)
+		if input.Body.Description != nil {
+			role.Description = *input.Body.Description
+		}
+		if input.Body.Permissions != nil {
+			if err := requirePermissionsWithin(ctx, input.Body.Permissions); err != nil {
+				return nil, err
+			}
+			role.Permissions = auth.EncodeScopes(input.Body.Permissions)
+		}
+		if err := db.Save(role).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to update role", err)
+		}
+		info := roleInfo(db, role)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditRoleUpdate,
+			TargetType: "role",
+			TargetID:   role.Name,
+			Before:     before,
+			After:      info,
+		})
+
+		return &RoleOutput{Body: info}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "delete-role",
+		Method:      http.MethodDelete,
+		Path:        "/admin/roles/{name}",
+		Summary:     "Delete role",
+		Description: "Delete a custom role. Roles still assigned to users, or referenced by pending invitations, OIDC role mappings or LDAP group mappings, cannot be deleted. Requires the roles:write permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeRolesWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionRolesWrite},
+	}, func(ctx context.Context, input *DeleteRoleInput) (*struct{}, error) {
+		role, err := findRole(db, input.Name)
+		if err != nil {
+			return nil, err
+		}
+		if role.BuiltIn {
+			return nil, huma.Error400BadRequest("built-in roles cannot be deleted")
+		}
+		if err := requireRoleWithin(ctx, db, role.Name); err != nil {
+			return nil, err
+		}
+
+		info := roleInfo(db, role)
+		if info.Users > 0 {
+			return nil, huma.Error409Conflict("role is still assigned to users")
+		}
+		referrer, err := roleReferrer(db, role.Name)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to check role references", err)
+		}
+		if referrer != "" {
+			return nil, huma.Error409Conflict("role is still referenced by " + referrer)
+		}
+		if err := db.Unscoped().Delete(role).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to delete role", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditRoleDelete,
+			TargetType: "role",
+			TargetID:   role.Name,
+			Before:     info,
+		})
+		return nil, nil
+	})
+}
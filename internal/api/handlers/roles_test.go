@@ -0,0 +1,190 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+func setupRolesTest(t *testing.T) (*gorm.DB, humatest.TestAPI) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAdmin(api, db)
+	handlers.RegisterAPIKeys(api, db)
+	handlers.RegisterUser(api, db)
+	handlers.RegisterUsers(api, db)
+	handlers.RegisterRoles(api, db)
+	return db, api
+}
+
+func TestBuiltInRoles(t *testing.T) {
+	db, api := setupRolesTest(t)
+	admin := database.User{Email: "admin@example.com", Role: database.RoleAdmin}
+	user := database.User{Email: "user@example.com", Role: database.RoleUser}
+	db.Create(&admin)
+	db.Create(&user)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+	userAuth := "Authorization: Bearer " + issueToken(t, db, user.ID)
+
+	resp := api.Get("/admin/roles", adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var list struct {
+		Roles []handlers.RoleInfo `json:"roles"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	require.Len(t, list.Roles, 2)
+	assert.Equal(t, "admin", list.Roles[0].Name)
+	assert.Equal(t, []string{"*"}, list.Roles[0].Permissions)
+	assert.Equal(t, "user", list.Roles[1].Name)
+	assert.Empty(t, list.Roles[1].Permissions)
+
+	// Built-in roles are protected
+	assert.Equal(t, http.StatusBadRequest, api.Put("/admin/roles/admin", map[string]any{"permissions": []string{}}, adminAuth).Code)
+	assert.Equal(t, http.StatusBadRequest, api.Delete("/admin/roles/user", adminAuth).Code)
+
+	// Admins hold every permission, users none
+	resp = api.Get("/me", adminAuth)
+	assert.Contains(t, resp.Body.String(), `"roles:write"`)
+	assert.Equal(t, http.StatusForbidden, api.Get("/admin/users", userAuth).Code)
+	assert.Equal(t, http.StatusForbidden, api.Get("/admin/roles", userAuth).Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/admin/users").Code)
+
+	// Seeding again, as when upgrading a database from before versioned
+	// migrations, keeps changes to the user role
+	require.Equal(t, http.StatusOK, api.Put("/admin/roles/user", map[string]any{"permissions": []string{"users:read"}}, adminAuth).Code)
+	require.NoError(t, db.Where("1 = 1").Delete(&database.SchemaMigration{}).Error)
+	_, err := database.Migrate(db)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, api.Get("/admin/users", userAuth).Code)
+}
+
+func TestCustomRoles(t *testing.T) {
+	db, api := setupRolesTest(t)
+	admin := database.User{Email: "admin@example.com", Role: database.RoleAdmin}
+	manager := database.User{Email: "manager@example.com", Role: database.RoleUser}
+	user := database.User{Email: "user@example.com", Role: database.RoleUser}
+	db.Create(&admin)
+	db.Create(&manager)
+	db.Create(&user)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+
+	resp := api.Post("/admin/roles", map[string]any{
+		"name":        "manager",
+		"description": "Manages users",
+		"permissions": []string{"users:read", "users:write", "roles:write"},
+	}, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, http.StatusConflict, api.Post("/admin/roles", map[string]any{"name": "manager", "permissions": []string{}}, adminAuth).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, api.Post("/admin/roles", map[string]any{"name": "bad", "permissions": []string{"*"}}, adminAuth).Code)
+
+	// Only existing roles can be assigned
+	resp = api.Put(fmt.Sprintf("/admin/users/%d", manager.ID), map[string]any{"role": "nope"}, adminAuth)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = api.Put(fmt.Sprintf("/admin/users/%d", manager.ID), map[string]any{"role": "manager"}, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	managerAuth := "Authorization: Bearer " + issueToken(t, db, manager.ID)
+
+	// The role grants exactly its permissions
+	assert.Equal(t, http.StatusOK, api.Get("/admin/users", managerAuth).Code)
+	assert.Equal(t, http.StatusForbidden, api.Get("/admin/settings", managerAuth).Code)
+	resp = api.Get("/me", managerAuth)
+	assert.Contains(t, resp.Body.String(), `"permissions":["users:read","users:write","roles:write"]`)
+
+	// Managers cannot hand out more than they hold
+	resp = api.Put(fmt.Sprintf("/admin/users/%d", user.ID), map[string]any{"role": "admin"}, managerAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Delete(fmt.Sprintf("/admin/users/%d", admin.ID), managerAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Post("/admin/roles", map[string]any{"name": "ops", "permissions": []string{"settings:write"}}, managerAuth)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Post("/admin/roles", map[string]any{"name": "viewer", "permissions": []string{"users:read"}}, managerAuth)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = api.Put(fmt.Sprintf("/admin/users/%d", user.ID), map[string]any{"role": "viewer"}, managerAuth)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// API keys are limited by both their scopes and the owner's role
+	resp = api.Post("/keys", map[string]any{"name": "ci", "scopes": []string{"settings:read"}}, managerAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var key struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &key))
+	assert.Equal(t, http.StatusForbidden, api.Get("/admin/settings", "X-API-Key: "+key.Key).Code)
+
+	// Changes to a role apply to its users straight away
+	resp = api.Put("/admin/roles/manager", map[string]any{"permissions": []string{"users:write", "roles:write"}}, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusForbidden, api.Get("/admin/users", managerAuth).Code)
+
+	// Roles in use cannot be deleted
+	assert.Equal(t, http.StatusConflict, api.Delete("/admin/roles/manager", adminAuth).Code)
+	require.Equal(t, http.StatusOK, api.Put(fmt.Sprintf("/admin/users/%d", manager.ID), map[string]any{"role": "user"}, adminAuth).Code)
+	assert.Equal(t, http.StatusNoContent, api.Delete("/admin/roles/manager", adminAuth).Code)
+	assert.Equal(t, http.StatusNotFound, api.Delete("/admin/roles/manager", adminAuth).Code)
+}
+
+func TestDeleteRoleStillReferenced(t *testing.T) {
+	db, api := setupRolesTest(t)
+	admin := database.User{Email: "admin@example.com", Role: database.RoleAdmin}
+	db.Create(&admin)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+	require.Equal(t, http.StatusOK, api.Post("/admin/roles", map[string]any{"name": "auditor", "permissions": []string{"audit:read"}}, adminAuth).Code)
+
+	// A pending invitation would hand out the role, even once expired
+	invitation := database.Invitation{Email: "new@example.com", Role: "auditor", TokenHash: "pending", ExpiresAt: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create(&invitation).Error)
+	resp := api.Delete("/admin/roles/auditor", adminAuth)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "pending invitations")
+	require.NoError(t, db.Unscoped().Delete(&invitation).Error)
+
+	// So would OIDC logins and LDAP logins
+	require.NoError(t, auth.OIDCRoleMappings.Set(db, []auth.OIDCRoleMapping{{Claim: "groups", Value: "audit", Role: "auditor"}}))
+	resp = api.Delete("/admin/roles/auditor", adminAuth)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "OIDC role mappings")
+	require.NoError(t, auth.OIDCRoleMappings.Set(db, []auth.OIDCRoleMapping{}))
+
+	provider := database.OIDCProviderConfig{Slug: "acme", DefaultRole: "auditor"}
+	require.NoError(t, db.Create(&provider).Error)
+	resp = api.Delete("/admin/roles/auditor", adminAuth)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "OIDC provider acme")
+	require.NoError(t, db.Unscoped().Delete(&provider).Error)
+
+	ldap := database.LDAPConfig{GroupRoles: auth.EncodeLDAPGroupRoles([]auth.LDAPGroupRole{{Group: "cn=audit,dc=example,dc=com", Role: "auditor"}})}
+	require.NoError(t, db.Create(&ldap).Error)
+	resp = api.Delete("/admin/roles/auditor", adminAuth)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "LDAP group mappings")
+	require.NoError(t, db.Model(&ldap).Update("group_roles", "[]").Error)
+
+	assert.Equal(t, http.StatusNoContent, api.Delete("/admin/roles/auditor", adminAuth).Code)
+}
+
+func TestPermissionsInOpenAPI(t *testing.T) {
+	_, api := setupRolesTest(t)
+
+	spec, err := json.Marshal(api.OpenAPI())
+	require.NoError(t, err)
+	var doc struct {
+		Paths map[string]map[string]map[string]any `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(spec, &doc))
+	assert.Equal(t, "users:read", doc.Paths["/admin/users"]["get"]["x-permission"])
+	assert.Equal(t, "roles:write", doc.Paths["/admin/roles"]["post"]["x-permission"])
+	assert.NotContains(t, doc.Paths["/me"]["get"], "x-permission")
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// SCIM schema URNs (RFC 7643 and RFC 7644).
+const (
+	scimSchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimSchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// scimContentType is the media type of SCIM requests and responses.
+const scimContentType = "application/scim+json"
+
+// scimBasePath is where the SCIM endpoints are served, relative to the site.
+const scimBasePath = "/api/scim/v2"
+
+// scimMaxCount is the largest page a SCIM list request returns.
+const scimMaxCount = 200
+
+var scimSecurity = []map[string][]string{{middleware.SCIMSecurityScheme: {}}}
+
+// scimError is a SCIM error response (RFC 7644 section 3.12), which
+// provisioning clients expect in place of the usual problem details.
+type scimError struct {
+	status   int
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func (e *scimError) Error() string             { return e.Detail }
+func (e *scimError) GetStatus() int            { return e.status }
+func (e *scimError) ContentType(string) string { return scimContentType }
+func newSCIMError(status int, scimType, detail string) *scimError {
+	return &scimError{
+		status:   status,
+		Schemas:  []string{scimSchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+// SCIMMeta is the meta attribute of a SCIM resource.
+type SCIMMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// scimNoSchemaLink keeps huma from adding a $schema link to SCIM responses,
+// which are defined by their schemas attribute instead.
+type scimNoSchemaLink struct {
+	SchemaLink string `json:"$schema,omitempty" readOnly:"true" doc:"Not used by SCIM responses"`
+}
+
+// SCIMListResponse is a page of SCIM resources.
+type SCIMListResponse[T any] struct {
+	scimNoSchemaLink
+	Schemas      []string `json:"schemas"`
+	TotalResults int64    `json:"totalResults"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	StartIndex   int      `json:"startIndex"`
+	Resources    []T      `json:"Resources"`
+}
+
+func (SCIMListResponse[T]) ContentType(string) string { return scimContentType }
+
+// SCIMListInput holds the query parameters of a SCIM list request.
+type SCIMListInput struct {
+	Filter             string `query:"filter" doc:"SCIM filter, e.g. userName eq \"bjensen@example.com\""`
+	StartIndex         int    `query:"startIndex" default:"1" doc:"1-based index of the first result"`
+	Count              int    `query:"count" default:"100" doc:"Maximum number of results, at most 200"`
+	ExcludedAttributes string `query:"excludedAttributes" doc:"Comma-separated attributes to leave out"`
+}
+
+// page returns the offset and limit for the requested page. Out of range
+// values are clamped rather than refused, as RFC 7644 section 3.4.2.4 asks.
+func (in *SCIMListInput) page() (offset, limit int) {
+	return max(in.StartIndex, 1) - 1, min(max(in.Count, 0), scimMaxCount)
+}
+
+// SCIMPathInput identifies a SCIM resource.
+type SCIMPathInput struct {
+	ID string `path:"id" doc:"Resource ID"`
+}
+
+// SCIMBodyInput carries a SCIM request body. SCIM clients send attributes
+// this server does not store, so the body is decoded leniently rather than
+// validated against a schema.
+type SCIMBodyInput struct {
+	RawBody []byte `contentType:"application/scim+json"`
+}
+
+// scimPatchRequest is a SCIM PATCH request (RFC 7644 section 3.5.2).
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// decodeSCIM decodes a SCIM request body.
+func decodeSCIM(body []byte, v any) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return newSCIMError(http.StatusBadRequest, "invalidSyntax", "malformed request body: "+err.Error())
+	}
+	return nil
+}
+
+// decodeSCIMPatch decodes a PATCH request and normalizes its operations.
+func decodeSCIMPatch(body []byte) ([]scimPatchOperation, error) {
+	var req scimPatchRequest
+	if err := decodeSCIM(body, &req); err != nil {
+		return nil, err
+	}
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		// Some clients capitalize the operation, e.g. "Replace"
+		switch op.Op = strings.ToLower(op.Op); op.Op {
+		case "add", "replace", "remove":
+		default:
+			return nil, newSCIMError(http.StatusBadRequest, "invalidSyntax", "unsupported operation "+strconv.Quote(op.Op))
+		}
+	}
+	return req.Operations, nil
+}
+
+// scimID parses a resource ID. Unknown IDs are reported as not found.
+func scimID(id string) (uint, error) {
+	n, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		return 0, newSCIMError(http.StatusNotFound, "", "resource "+id+" not found")
+	}
+	return uint(n), nil
+}
+
+// scimBool reads a boolean attribute. Some clients send booleans as strings,
+// e.g. "False".
+func scimBool(raw json.RawMessage) (bool, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err == nil {
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+	}
+	return false, newSCIMError(http.StatusBadRequest, "invalidValue", "expected a boolean, got "+string(raw))
+}
+
+// scimString reads a string attribute.
+func scimString(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", newSCIMError(http.StatusBadRequest, "invalidValue", "expected a string, got "+string(raw))
+	}
+	return s, nil
+}
+
+// applySCIMFilter applies the list request's filter to the query.
+func applySCIMFilter(query *gorm.DB, filter string, columns map[string]scimColumn) (*gorm.DB, error) {
+	if filter == "" {
+		return query, nil
+	}
+	parsed, err := parseSCIMFilter(filter)
+	if err == nil {
+		query, err = parsed.apply(query, columns)
+	}
+	if err != nil {
+		return nil, newSCIMError(http.StatusBadRequest, "invalidFilter", err.Error())
+	}
+	return query, nil
+}
+
+// SCIMServiceProviderConfig describes the SCIM features this server supports.
+type SCIMServiceProviderConfig struct {
+	scimNoSchemaLink
+	Schemas        []string          `json:"schemas"`
+	Patch          scimSupported     `json:"patch"`
+	Bulk           scimBulk          `json:"bulk"`
+	Filter         scimFilterSupport `json:"filter"`
+	ChangePassword scimSupported     `json:"changePassword"`
+	Sort           scimSupported     `json:"sort"`
+	ETag           scimSupported     `json:"etag"`
+	AuthSchemes    []scimAuthScheme  `json:"authenticationSchemes"`
+}
+
+func (SCIMServiceProviderConfig) ContentType(string) string { return scimContentType }
+
+type scimSupported struct {
+	Supported bool `json:"supported"`
+}
+
+type scimBulk struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type scimFilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type scimAuthScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary"`
+}
+
+// SCIMTokenInfo represents a SCIM token in admin responses.
+type SCIMTokenInfo struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	CreatedByID uint       `json:"created_by_id"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func newSCIMTokenInfo(token *database.SCIMToken) SCIMTokenInfo {
+	return SCIMTokenInfo{
+		ID:          token.ID,
+		Name:        token.Name,
+		Prefix:      token.Prefix,
+		CreatedByID: token.CreatedByID,
+		LastUsed:    token.LastUsed,
+		ExpiresAt:   token.ExpiresAt,
+		CreatedAt:   token.CreatedAt,
+	}
+}
+
+// ListSCIMTokensOutput represents the response for listing SCIM tokens.
+type ListSCIMTokensOutput struct {
+	Body struct {
+		Tokens []SCIMTokenInfo `json:"tokens"`
+	}
+}
+
+// CreateSCIMTokenInput represents the request to create a SCIM token.
+type CreateSCIMTokenInput struct {
+	Body struct {
+		Name          string `json:"name" required:"true" minLength:"1" maxLength:"128" doc:"Name of the identity provider the token is for"`
+		ExpiresInDays *int   `json:"expires_in_days,omitempty" minimum:"1" maximum:"3650" doc:"Optional number of days until the token expires"`
+	}
+}
+
+// CreateSCIMTokenOutput represents a newly created SCIM token.
+type CreateSCIMTokenOutput struct {
+	Body struct {
+		SCIMTokenInfo
+		Token string `json:"token" doc:"The raw SCIM token. This is only returned once."`
+	}
+}
+
+// RegisterSCIM registers the SCIM 2.0 provisioning endpoints under /scim/v2
+// and the admin endpoints that manage their tokens.
+func RegisterSCIM(api huma.API, db *gorm.DB) {
+	registerSCIMTokens(api, db)
+	registerSCIMUsers(api, db)
+	registerSCIMGroups(api, db)
+
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-service-provider-config",
+		Method:      http.MethodGet,
+		Path:        "/scim/v2/ServiceProviderConfig",
+		Summary:     "Get SCIM service provider configuration",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *struct{}) (*struct{ Body SCIMServiceProviderConfig }, error) {
+		resp := &struct{ Body SCIMServiceProviderConfig }{}
+		resp.Body = SCIMServiceProviderConfig{
+			Schemas: []string{scimSchemaServiceProviderConfig},
+			Patch:   scimSupported{Supported: true},
+			Filter:  scimFilterSupport{Supported: true, MaxResults: scimMaxCount},
+			AuthSchemes: []scimAuthScheme{{
+				Type:        "oauthbearertoken",
+				Name:        "OAuth Bearer Token",
+				Description: "A SCIM token created at /admin/scim/tokens",
+				Primary:     true,
+			}},
+		}
+		return resp, nil
+	})
+}
+
+func registerSCIMTokens(api huma.API, db *gorm.DB) {
+	huma.Register(api, huma.Operation{
+		OperationID: "list-scim-tokens",
+		Method:      http.MethodGet,
+		Path:        "/admin/scim/tokens",
+		Summary:     "List SCIM tokens",
+		Description: "Requires the users:read permission.",
+		Tags:        []string{"Admin", "SCIM"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersRead},
+	}, func(ctx context.Context, input *struct{}) (*ListSCIMTokensOutput, error) {
+		var tokens []database.SCIMToken
+		if err := db.Order("id").Find(&tokens).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch SCIM tokens", err)
+		}
+
+		resp := &ListSCIMTokensOutput{}
+		resp.Body.Tokens = make([]SCIMTokenInfo, len(tokens))
+		for i := range tokens {
+			resp.Body.Tokens[i] = newSCIMTokenInfo(&tokens[i])
+		}
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "create-scim-token",
+		Method:      http.MethodPost,
+		Path:        "/admin/scim/tokens",
+		Summary:     "Create SCIM token",
+		Description: "Create a bearer token for an identity provider's SCIM client. It is only accepted by the /scim/v2 endpoints, which can create, deactivate and delete any user, so only callers whose role grants every permission can create one. Requires the users:write permission.",
+		Tags:        []string{"Admin", "SCIM"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{
+			middleware.PermissionExtension: auth.PermissionUsersWrite,
+			middleware.SensitiveExtension:  true,
+		},
+	}, func(ctx context.Context, input *CreateSCIMTokenInput) (*CreateSCIMTokenOutput, error) {
+		if err := requirePermissionsWithin(ctx, []string{database.PermissionAll}); err != nil {
+			return nil, err
+		}
+
+		var ttl time.Duration
+		if input.Body.ExpiresInDays != nil {
+			ttl = time.Duration(*input.Body.ExpiresInDays) * 24 * time.Hour
+		}
+		user := middleware.GetUser(ctx)
+		token, raw, err := auth.CreateSCIMToken(db, user.ID, input.Body.Name, ttl)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to create SCIM token", err)
+		}
+		info := newSCIMTokenInfo(token)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditSCIMTokenCreate,
+			TargetType: "scim_token",
+			TargetID:   auditID(token.ID),
+			After:      info,
+		})
+
+		resp := &CreateSCIMTokenOutput{}
+		resp.Body.SCIMTokenInfo = info
+		resp.Body.Token = raw
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "revoke-scim-token",
+		Method:      http.MethodDelete,
+		Path:        "/admin/scim/tokens/{id}",
+		Summary:     "Revoke SCIM token",
+		Description: "Requires the users:write permission.",
+		Tags:        []string{"Admin", "SCIM"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *struct {
+		ID uint `path:"id" doc:"SCIM token ID"`
+	}) (*struct{}, error) {
+		var token database.SCIMToken
+		if err := db.First(&token, input.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, huma.Error404NotFound("SCIM token not found")
+			}
+			return nil, huma.Error500InternalServerError("failed to fetch SCIM token", err)
+		}
+		if err := db.Unscoped().Delete(&token).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to revoke SCIM token", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditSCIMTokenRevoke,
+			TargetType: "scim_token",
+			TargetID:   auditID(token.ID),
+			Before:     newSCIMTokenInfo(&token),
+		})
+		return nil, nil
+	})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// scimComparison is a single "attribute operator value" expression of a SCIM
+// filter (RFC 7644 section 3.4.2.2).
+type scimComparison struct {
+	Attr  string // Lower-cased attribute path without the schema URN
+	Op    string // Lower-cased operator
+	Value any    // string, bool, float64 or nil
+}
+
+// scimFilter is a parsed SCIM filter in disjunctive form: the comparisons in
+// each group are joined by "and", the groups by "or". Grouping with
+// parentheses, "not" and complex attribute filters are not supported.
+type scimFilter [][]scimComparison
+
+// scimColumn maps a filterable attribute to a column.
+type scimColumn struct {
+	Name            string
+	CaseInsensitive bool
+	// Filter builds the condition for attributes that do not map onto a plain
+	// column comparison, such as active.
+	Filter func(op string, value any) (string, error)
+}
+
+var errInvalidSCIMFilter = errors.New("invalid filter")
+
+var scimOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"pr": true, "gt": true, "ge": true, "lt": true, "le": true,
+}
+
+// parseSCIMFilter parses a filter such as `userName eq "bjensen"`.
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := scanSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var result scimFilter
+	var group []scimComparison
+	for i := 0; i < len(tokens); {
+		if tokens[i].quoted || i+1 >= len(tokens) {
+			return nil, fmt.Errorf("%w: expected attribute and operator", errInvalidSCIMFilter)
+		}
+		cmp := scimComparison{
+			Attr: normalizeSCIMAttr(tokens[i].text),
+			Op:   strings.ToLower(tokens[i+1].text),
+		}
+		if tokens[i+1].quoted || !scimOperators[cmp.Op] {
+			return nil, fmt.Errorf("%w: unsupported operator %q", errInvalidSCIMFilter, tokens[i+1].text)
+		}
+		i += 2
+		if cmp.Op != "pr" {
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("%w: missing value for %s", errInvalidSCIMFilter, cmp.Attr)
+			}
+			if cmp.Value, err = tokens[i].value(); err != nil {
+				return nil, err
+			}
+			i++
+		}
+		group = append(group, cmp)
+
+		if i == len(tokens) {
+			break
+		}
+		switch strings.ToLower(tokens[i].text) {
+		case "and":
+		case "or":
+			result = append(result, group)
+			group = nil
+		default:
+			return nil, fmt.Errorf("%w: expected and/or, got %q", errInvalidSCIMFilter, tokens[i].text)
+		}
+		if i++; i == len(tokens) {
+			return nil, fmt.Errorf("%w: dangling logical operator", errInvalidSCIMFilter)
+		}
+	}
+	if len(group) == 0 {
+		return nil, fmt.Errorf("%w: empty filter", errInvalidSCIMFilter)
+	}
+	return append(result, group), nil
+}
+
+// apply adds the filter to the query. Attributes not in columns are refused.
+func (f scimFilter) apply(query *gorm.DB, columns map[string]scimColumn) (*gorm.DB, error) {
+	var ors []string
+	var args []any
+	for _, group := range f {
+		var ands []string
+		for _, cmp := range group {
+			column, ok := columns[cmp.Attr]
+			if !ok {
+				return nil, fmt.Errorf("%w: cannot filter on %s", errInvalidSCIMFilter, cmp.Attr)
+			}
+			cond, arg, err := column.condition(cmp)
+			if err != nil {
+				return nil, err
+			}
+			ands = append(ands, cond)
+			if arg != nil {
+				args = append(args, arg)
+			}
+		}
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return query.Where(strings.Join(ors, " OR "), args...), nil
+}
+
+// condition builds the SQL for one comparison and its argument, if any.
+func (c scimColumn) condition(cmp scimComparison) (string, any, error) {
+	if c.Filter != nil {
+		cond, err := c.Filter(cmp.Op, cmp.Value)
+		return cond, nil, err
+	}
+	if cmp.Op == "pr" {
+		return fmt.Sprintf("(%s IS NOT NULL AND %s <> '')", c.Name, c.Name), nil, nil
+	}
+
+	value := fmt.Sprint(cmp.Value)
+	column := c.Name
+	if c.CaseInsensitive {
+		column = "LOWER(" + column + ")"
+		value = strings.ToLower(value)
+	}
+	like := database.EscapeLike(value)
+	likeCond := database.Like(column)
+	switch cmp.Op {
+	case "eq":
+		return column + " = ?", value, nil
+	case "ne":
+		return column + " <> ?", value, nil
+	case "co":
+		return likeCond, "%" + like + "%", nil
+	case "sw":
+		return likeCond, like + "%", nil
+	case "ew":
+		return likeCond, "%" + like, nil
+	case "gt":
+		return column + " > ?", value, nil
+	case "ge":
+		return column + " >= ?", value, nil
+	case "lt":
+		return column + " < ?", value, nil
+	case "le":
+		return column + " <= ?", value, nil
+	}
+	return "", nil, fmt.Errorf("%w: unsupported operator %q", errInvalidSCIMFilter, cmp.Op)
+}
+
+// normalizeSCIMAttr lower-cases an attribute path and strips the core schema
+// URN, e.g. "urn:ietf:params:scim:schemas:core:2.0:User:userName" becomes
+// "username".
+func normalizeSCIMAttr(attr string) string {
+	attr = strings.ToLower(attr)
+	for _, schema := range []string{scimSchemaUser, scimSchemaGroup} {
+		if rest, ok := strings.CutPrefix(attr, strings.ToLower(schema)+":"); ok {
+			return rest
+		}
+	}
+	return attr
+}
+
+type scimToken struct {
+	text   string
+	quoted bool
+}
+
+// value converts a comparison value token to its JSON type.
+func (t scimToken) value() (any, error) {
+	if t.quoted {
+		return t.text, nil
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	n, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid value %q", errInvalidSCIMFilter, t.text)
+	}
+	return n, nil
+}
+
+// scanSCIMFilter splits a filter into words and quoted strings.
+func scanSCIMFilter(filter string) ([]scimToken, error) {
+	var tokens []scimToken
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			return nil, fmt.Errorf("%w: grouping and complex attribute filters are not supported", errInvalidSCIMFilter)
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(filter) && filter[i] != '"'; i++ {
+				if filter[i] == '\\' && i+1 < len(filter) {
+					i++
+				}
+				b.WriteByte(filter[i])
+			}
+			if i >= len(filter) {
+				return nil, fmt.Errorf("%w: unterminated string", errInvalidSCIMFilter)
+			}
+			i++
+			tokens = append(tokens, scimToken{text: b.String(), quoted: true})
+		default:
+			start := i
+			for i < len(filter) && !strings.ContainsRune(" \t()[]\"", rune(filter[i])) {
+				i++
+			}
+			tokens = append(tokens, scimToken{text: filter[start:i]})
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,615 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// SCIMGroup is an organization as a SCIM Group resource. Members added
+// through SCIM join with the member role.
+type SCIMGroup struct {
+	scimNoSchemaLink
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []SCIMMember `json:"members,omitempty"`
+	Meta        SCIMMeta     `json:"meta"`
+}
+
+func (SCIMGroup) ContentType(string) string { return scimContentType }
+
+// SCIMMember is an entry of a SCIM Group's members attribute.
+type SCIMMember struct {
+	Value   string `json:"value" doc:"User ID"`
+	Display string `json:"display,omitempty"`
+}
+
+// scimGroupPayload is a SCIM Group in a POST or PUT request.
+type scimGroupPayload struct {
+	DisplayName string       `json:"displayName"`
+	ExternalID  string       `json:"externalId"`
+	Members     []SCIMMember `json:"members"`
+}
+
+// scimGroupAttrs are the group attributes SCIM manages.
+type scimGroupAttrs struct {
+	Name       string
+	ExternalID string
+	Members    map[uint]bool
+}
+
+// scimGroupColumns maps the filterable Group attributes to columns.
+var scimGroupColumns = map[string]scimColumn{
+	"id":          {Name: "id"},
+	"displayname": {Name: "name", CaseInsensitive: true},
+	"externalid":  {Name: "external_id"},
+}
+
+func newSCIMGroup(db *gorm.DB, org *database.Organization, withMembers bool) (SCIMGroup, error) {
+	group := SCIMGroup{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          auditID(org.ID),
+		ExternalID:  org.ExternalID,
+		DisplayName: org.Name,
+		Meta: SCIMMeta{
+			ResourceType: "Group",
+			Created:      org.CreatedAt,
+			LastModified: org.UpdatedAt,
+			Location:     scimBasePath + "/Groups/" + auditID(org.ID),
+		},
+	}
+	if !withMembers {
+		return group, nil
+	}
+
+	var users []database.User
+	err := db.Joins("JOIN memberships ON memberships.user_id = users.id").
+		Where("memberships.organization_id = ? AND memberships.deleted_at IS NULL", org.ID).
+		Order("users.id").
+		Find(&users).Error
+	if err != nil {
+		return group, huma.Error500InternalServerError("failed to fetch group members", err)
+	}
+	group.Members = make([]SCIMMember, len(users))
+	for i, user := range users {
+		group.Members[i] = SCIMMember{Value: auditID(user.ID), Display: user.Name}
+	}
+	return group, nil
+}
+
+// findSCIMGroup loads an organization by SCIM ID.
+func findSCIMGroup(db *gorm.DB, id string) (*database.Organization, error) {
+	orgID, err := scimID(id)
+	if err != nil {
+		return nil, err
+	}
+	var org database.Organization
+	if err := db.First(&org, orgID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, newSCIMError(http.StatusNotFound, "", "group "+id+" not found")
+		}
+		return nil, huma.Error500InternalServerError("failed to fetch group", err)
+	}
+	return &org, nil
+}
+
+// scimGroupAttrsOf returns the organization's current attributes.
+func scimGroupAttrsOf(db *gorm.DB, org *database.Organization) (scimGroupAttrs, error) {
+	attrs := scimGroupAttrs{Name: org.Name, ExternalID: org.ExternalID, Members: map[uint]bool{}}
+	var userIDs []uint
+	if err := db.Model(&database.Membership{}).Where("organization_id = ?", org.ID).Pluck("user_id", &userIDs).Error; err != nil {
+		return attrs, huma.Error500InternalServerError("failed to fetch group members", err)
+	}
+	for _, id := range userIDs {
+		attrs.Members[id] = true
+	}
+	return attrs, nil
+}
+
+// attrs returns the attributes a POST or PUT request sets.
+func (p *scimGroupPayload) attrs() (scimGroupAttrs, error) {
+	attrs := scimGroupAttrs{Name: p.DisplayName, ExternalID: p.ExternalID, Members: map[uint]bool{}}
+	if err := attrs.addMembers(p.Members); err != nil {
+		return attrs, err
+	}
+	return attrs, nil
+}
+
+func (a *scimGroupAttrs) addMembers(members []SCIMMember) error {
+	for _, member := range members {
+		id, err := strconv.ParseUint(member.Value, 10, 0)
+		if err != nil {
+			return newSCIMError(http.StatusBadRequest, "invalidValue", "unknown member "+strconv.Quote(member.Value))
+		}
+		a.Members[uint(id)] = true
+	}
+	return nil
+}
+
+func (a *scimGroupAttrs) removeMembers(members []SCIMMember) {
+	for _, member := range members {
+		if id, err := strconv.ParseUint(member.Value, 10, 0); err == nil {
+			delete(a.Members, uint(id))
+		}
+	}
+}
+
+// patch applies PATCH operations. Paths other than displayName, externalId
+// and members are ignored.
+func (a *scimGroupAttrs) patch(ops []scimPatchOperation) error {
+	for _, op := range ops {
+		if op.Path == "" {
+			// Without a path the value is an object of attributes to set
+			if op.Op == "remove" {
+				return newSCIMError(http.StatusBadRequest, "noTarget", "remove requires a path")
+			}
+			var values map[string]json.RawMessage
+			if err := json.Unmarshal(op.Value, &values); err != nil {
+				return newSCIMError(http.StatusBadRequest, "invalidValue", "expected an object of attributes")
+			}
+			for key, value := range values {
+				if err := a.apply(op.Op, key, value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// members[value eq "42"] selects members by ID
+		attr, filter, found := strings.Cut(op.Path, "[")
+		if !found {
+			if err := a.apply(op.Op, attr, op.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		filter, _, _ = strings.Cut(filter, "]")
+		if normalizeSCIMAttr(attr) != "members" || op.Op != "remove" {
+			return newSCIMError(http.StatusBadRequest, "invalidPath", "unsupported path "+strconv.Quote(op.Path))
+		}
+		members, err := scimMemberFilter(filter)
+		if err != nil {
+			return err
+		}
+		a.removeMembers(members)
+	}
+	return nil
+}
+
+func (a *scimGroupAttrs) apply(op, path string, raw json.RawMessage) error {
+	var err error
+	switch normalizeSCIMAttr(path) {
+	case "displayname":
+		if op == "remove" {
+			return newSCIMError(http.StatusBadRequest, "mutability", "displayName cannot be removed")
+		}
+		a.Name, err = scimString(raw)
+	case "externalid":
+		if op == "remove" {
+			a.ExternalID = ""
+			return nil
+		}
+		a.ExternalID, err = scimString(raw)
+	case "members":
+		var members []SCIMMember
+		if len(raw) > 0 && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &members); err != nil {
+				return newSCIMError(http.StatusBadRequest, "invalidValue", "expected an array of members")
+			}
+		}
+		switch op {
+		case "add":
+			err = a.addMembers(members)
+		case "replace":
+			a.Members = map[uint]bool{}
+			err = a.addMembers(members)
+		case "remove":
+			if members == nil {
+				// Removing the attribute removes every member
+				a.Members = map[uint]bool{}
+			}
+			a.removeMembers(members)
+		}
+	}
+	return err
+}
+
+// scimMemberFilter reads the members a value filter such as
+// `value eq "42" or value eq "43"` selects.
+func scimMemberFilter(filter string) ([]SCIMMember, error) {
+	parsed, err := parseSCIMFilter(filter)
+	if err != nil {
+		return nil, newSCIMError(http.StatusBadRequest, "invalidFilter", err.Error())
+	}
+	var members []SCIMMember
+	for _, group := range parsed {
+		for _, cmp := range group {
+			value, ok := cmp.Value.(string)
+			if cmp.Attr != "value" || cmp.Op != "eq" || !ok || len(group) > 1 {
+				return nil, newSCIMError(http.StatusBadRequest, "invalidFilter", "members can only be selected with value eq")
+			}
+			members = append(members, SCIMMember{Value: value})
+		}
+	}
+	return members, nil
+}
+
+// scimGroupSlug derives an unused organization slug from a group name.
+func scimGroupSlug(db *gorm.DB, name string) (string, error) {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	base := b.String()
+	if len(base) > 28 {
+		// Leave room for a numeric suffix within the 32 character limit
+		base = base[:28]
+	}
+	if base = strings.Trim(base, "-"); base == "" {
+		base = "group"
+	}
+
+	for i := 1; i < 1000; i++ {
+		slug := base
+		if i > 1 {
+			slug = fmt.Sprintf("%s-%d", base, i)
+		}
+		var count int64
+		if err := db.Unscoped().Model(&database.Organization{}).Where("slug = ?", slug).Count(&count).Error; err != nil {
+			return "", huma.Error500InternalServerError("failed to check organization slug", err)
+		}
+		if count == 0 {
+			return slug, nil
+		}
+	}
+	return "", newSCIMError(http.StatusConflict, "uniqueness", "too many groups named "+strconv.Quote(name))
+}
+
+// checkSCIMMembers refuses members that are not people with an account.
+func checkSCIMMembers(db *gorm.DB, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var count int64
+	if err := db.Model(&database.User{}).Where("id IN ? AND service_account = ?", ids, false).Count(&count).Error; err != nil {
+		return huma.Error500InternalServerError("failed to fetch members", err)
+	}
+	if count != int64(len(ids)) {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "unknown member")
+	}
+	return nil
+}
+
+// updateSCIMGroup saves new attributes for an organization. Members join
+// with the member role; members who hold other roles keep them. The last
+// owner cannot be removed.
+func updateSCIMGroup(ctx context.Context, db *gorm.DB, org *database.Organization, attrs scimGroupAttrs) error {
+	if attrs.Name == "" {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "displayName is required")
+	}
+
+	var memberships []database.Membership
+	if err := db.Where("organization_id = ?", org.ID).Find(&memberships).Error; err != nil {
+		return huma.Error500InternalServerError("failed to fetch group members", err)
+	}
+	var added []uint
+	for id := range attrs.Members {
+		if !slices.ContainsFunc(memberships, func(m database.Membership) bool { return m.UserID == id }) {
+			added = append(added, id)
+		}
+	}
+	slices.Sort(added)
+	var removed []database.Membership
+	var owners, removedOwners int
+	for _, membership := range memberships {
+		if membership.Role == database.OrgRoleOwner {
+			owners++
+		}
+		if !attrs.Members[membership.UserID] {
+			removed = append(removed, membership)
+			if membership.Role == database.OrgRoleOwner {
+				removedOwners++
+			}
+		}
+	}
+	if owners > 0 && removedOwners == owners {
+		return newSCIMError(http.StatusBadRequest, "mutability", "cannot remove the last owner")
+	}
+	if err := checkSCIMMembers(db, added); err != nil {
+		return err
+	}
+
+	before := map[string]any{"name": org.Name, "external_id": org.ExternalID}
+	changed := org.Name != attrs.Name || org.ExternalID != attrs.ExternalID
+	org.Name = attrs.Name
+	org.ExternalID = attrs.ExternalID
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if changed {
+			if err := tx.Save(org).Error; err != nil {
+				return err
+			}
+		}
+		for _, id := range added {
+			if err := tx.Create(&database.Membership{OrganizationID: org.ID, UserID: id, Role: database.OrgRoleMember}).Error; err != nil {
+				return err
+			}
+		}
+		for i := range removed {
+			if err := tx.Unscoped().Delete(&removed[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return huma.Error500InternalServerError("failed to update group", err)
+	}
+
+	if changed {
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgUpdate,
+			TargetType: "organization",
+			TargetID:   auditID(org.ID),
+			Before:     before,
+			After:      map[string]any{"name": org.Name, "external_id": org.ExternalID},
+		})
+	}
+	for _, id := range added {
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgMemberAdd,
+			TargetType: "user",
+			TargetID:   auditID(id),
+			After:      map[string]any{"role": database.OrgRoleMember},
+			Details:    orgAuditDetails(&org.ID),
+		})
+	}
+	for _, membership := range removed {
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgMemberRemove,
+			TargetType: "user",
+			TargetID:   auditID(membership.UserID),
+			Before:     map[string]any{"role": membership.Role},
+			Details:    orgAuditDetails(&org.ID),
+		})
+	}
+	return nil
+}
+
+func registerSCIMGroups(api huma.API, db *gorm.DB) {
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-list-groups",
+		Method:      http.MethodGet,
+		Path:        "/scim/v2/Groups",
+		Summary:     "List SCIM groups",
+		Description: "Groups are organizations. Filter on displayName, externalId or id; pass excludedAttributes=members to leave out member lists.",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *SCIMListInput) (*struct{ Body SCIMListResponse[SCIMGroup] }, error) {
+		query, err := applySCIMFilter(db.Model(&database.Organization{}), input.Filter, scimGroupColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &struct{ Body SCIMListResponse[SCIMGroup] }{}
+		resp.Body.Schemas = []string{scimSchemaListResponse}
+		resp.Body.StartIndex = max(input.StartIndex, 1)
+		if err := query.Count(&resp.Body.TotalResults).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to count groups", err)
+		}
+
+		var orgs []database.Organization
+		offset, limit := input.page()
+		if limit > 0 {
+			if err := query.Order("id").Offset(offset).Limit(limit).Find(&orgs).Error; err != nil {
+				return nil, huma.Error500InternalServerError("failed to fetch groups", err)
+			}
+		}
+		withMembers := !slices.Contains(strings.Split(strings.ToLower(input.ExcludedAttributes), ","), "members")
+		resp.Body.Resources = make([]SCIMGroup, len(orgs))
+		for i := range orgs {
+			if resp.Body.Resources[i], err = newSCIMGroup(db, &orgs[i], withMembers); err != nil {
+				return nil, err
+			}
+		}
+		resp.Body.ItemsPerPage = len(orgs)
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-get-group",
+		Method:      http.MethodGet,
+		Path:        "/scim/v2/Groups/{id}",
+		Summary:     "Get SCIM group",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *struct {
+		SCIMPathInput
+		ExcludedAttributes string `query:"excludedAttributes" doc:"Comma-separated attributes to leave out"`
+	}) (*struct{ Body SCIMGroup }, error) {
+		org, err := findSCIMGroup(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		withMembers := !slices.Contains(strings.Split(strings.ToLower(input.ExcludedAttributes), ","), "members")
+		group, err := newSCIMGroup(db, org, withMembers)
+		if err != nil {
+			return nil, err
+		}
+		return &struct{ Body SCIMGroup }{Body: group}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "scim-create-group",
+		Method:        http.MethodPost,
+		Path:          "/scim/v2/Groups",
+		Summary:       "Create SCIM group",
+		Description:   "Create an organization. Its slug is derived from displayName.",
+		Tags:          []string{"SCIM"},
+		Security:      scimSecurity,
+		DefaultStatus: http.StatusCreated,
+	}, func(ctx context.Context, input *SCIMBodyInput) (*struct{ Body SCIMGroup }, error) {
+		var payload scimGroupPayload
+		if err := decodeSCIM(input.RawBody, &payload); err != nil {
+			return nil, err
+		}
+		attrs, err := payload.attrs()
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Name == "" {
+			return nil, newSCIMError(http.StatusBadRequest, "invalidValue", "displayName is required")
+		}
+		members := make([]uint, 0, len(attrs.Members))
+		for id := range attrs.Members {
+			members = append(members, id)
+		}
+		if err := checkSCIMMembers(db, members); err != nil {
+			return nil, err
+		}
+
+		slug, err := scimGroupSlug(db, attrs.Name)
+		if err != nil {
+			return nil, err
+		}
+		org := database.Organization{Slug: slug, Name: attrs.Name, ExternalID: attrs.ExternalID}
+		if err := db.Create(&org).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to create group", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgCreate,
+			TargetType: "organization",
+			TargetID:   auditID(org.ID),
+			After:      map[string]any{"slug": org.Slug, "name": org.Name, "external_id": org.ExternalID},
+		})
+		if err := updateSCIMGroup(ctx, db, &org, attrs); err != nil {
+			return nil, err
+		}
+
+		group, err := newSCIMGroup(db, &org, true)
+		if err != nil {
+			return nil, err
+		}
+		return &struct{ Body SCIMGroup }{Body: group}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-replace-group",
+		Method:      http.MethodPut,
+		Path:        "/scim/v2/Groups/{id}",
+		Summary:     "Replace SCIM group",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *struct {
+		SCIMPathInput
+		SCIMBodyInput
+	}) (*struct{ Body SCIMGroup }, error) {
+		org, err := findSCIMGroup(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		var payload scimGroupPayload
+		if err := decodeSCIM(input.RawBody, &payload); err != nil {
+			return nil, err
+		}
+		attrs, err := payload.attrs()
+		if err != nil {
+			return nil, err
+		}
+		if err := updateSCIMGroup(ctx, db, org, attrs); err != nil {
+			return nil, err
+		}
+
+		group, err := newSCIMGroup(db, org, true)
+		if err != nil {
+			return nil, err
+		}
+		return &struct{ Body SCIMGroup }{Body: group}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "scim-patch-group",
+		Method:        http.MethodPatch,
+		Path:          "/scim/v2/Groups/{id}",
+		Summary:       "Update SCIM group",
+		Description:   "Rename the group or add and remove members. Responds with 204 No Content.",
+		Tags:          []string{"SCIM"},
+		Security:      scimSecurity,
+		DefaultStatus: http.StatusNoContent,
+	}, func(ctx context.Context, input *struct {
+		SCIMPathInput
+		SCIMBodyInput
+	}) (*struct{}, error) {
+		org, err := findSCIMGroup(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		ops, err := decodeSCIMPatch(input.RawBody)
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := scimGroupAttrsOf(db, org)
+		if err != nil {
+			return nil, err
+		}
+		if err := attrs.patch(ops); err != nil {
+			return nil, err
+		}
+		return nil, updateSCIMGroup(ctx, db, org, attrs)
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "scim-delete-group",
+		Method:        http.MethodDelete,
+		Path:          "/scim/v2/Groups/{id}",
+		Summary:       "Delete SCIM group",
+		Description:   "Delete the organization with its memberships, invitations and API keys.",
+		Tags:          []string{"SCIM"},
+		Security:      scimSecurity,
+		DefaultStatus: http.StatusNoContent,
+	}, func(ctx context.Context, input *SCIMPathInput) (*struct{}, error) {
+		org, err := findSCIMGroup(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&database.APIKey{}, "organization_id = ?", org.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&database.OrgInvitation{}, "organization_id = ?", org.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&database.Membership{}, "organization_id = ?", org.ID).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(org).Error
+		})
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to delete group", err)
+		}
+
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditOrgDelete,
+			TargetType: "organization",
+			TargetID:   auditID(org.ID),
+			Before:     map[string]any{"slug": org.Slug, "name": org.Name},
+		})
+		return nil, nil
+	})
+}
@@ -0,0 +1,272 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func setupSCIMTest(t *testing.T) (*gorm.DB, humatest.TestAPI, string, string) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterAPIKeys(api, db)
+	handlers.RegisterUser(api, db)
+	handlers.RegisterUsers(api, db)
+	handlers.RegisterAudit(api, db)
+	handlers.RegisterSCIM(api, db)
+
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	adminAuth := "Authorization: Bearer " + issueToken(t, db, admin.ID)
+
+	resp := api.Post("/admin/scim/tokens", map[string]any{"name": "Okta"}, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var out struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+	return db, api, "Authorization: Bearer " + out.Token, adminAuth
+}
+
+// scimPayload reads a recorded identity provider request from testdata,
+// filling in {{name}} placeholders.
+func scimPayload(t *testing.T, name string, vars ...string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "scim", name+".json"))
+	require.NoError(t, err)
+	return strings.NewReplacer(vars...).Replace(string(b))
+}
+
+func scimDo(api humatest.TestAPI, method, path, body, scimAuth string) *httptest.ResponseRecorder {
+	args := []any{scimAuth}
+	if body != "" {
+		args = append(args, "Content-Type: application/scim+json", strings.NewReader(body))
+	}
+	return api.Do(method, path, args...)
+}
+
+func scimDecode[T any](t *testing.T, resp *httptest.ResponseRecorder) T {
+	t.Helper()
+	var out T
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out), resp.Body.String())
+	return out
+}
+
+func TestSCIMUsers(t *testing.T) {
+	_, api, scimAuth, _ := setupSCIMTest(t)
+
+	resp := scimDo(api, http.MethodPost, "/scim/v2/Users", scimPayload(t, "okta_create_user"), scimAuth)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	assert.Equal(t, "application/scim+json", resp.Header().Get("Content-Type"))
+	assert.NotContains(t, resp.Body.String(), "$schema")
+	user := scimDecode[handlers.SCIMUser](t, resp)
+	assert.Equal(t, "isabella.ortiz@example.com", user.UserName)
+	assert.Equal(t, "Isabella Ortiz", user.DisplayName)
+	assert.Equal(t, "00u1esetbeLtnQBbT5d7", user.ExternalID)
+	assert.True(t, user.Active)
+
+	// Okta looks users up before creating them
+	resp = scimDo(api, http.MethodPost, "/scim/v2/Users", scimPayload(t, "okta_create_user"), scimAuth)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"scimType":"uniqueness"`)
+
+	for filter, total := range map[string]int64{
+		`userName eq "Isabella.Ortiz@example.com"`:                          1,
+		`externalId eq "00u1esetbeLtnQBbT5d7"`:                              1,
+		`userName sw "isabella" and active eq true`:                         1,
+		`userName eq "nobody@example.com" or displayName co "Ortiz"`:        1,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName ew "%example"`: 0,
+		`userName eq "admin@example.com"`:                                   1,
+	} {
+		resp = scimDo(api, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(filter), "", scimAuth)
+		require.Equal(t, http.StatusOK, resp.Code, filter)
+		list := scimDecode[handlers.SCIMListResponse[handlers.SCIMUser]](t, resp)
+		assert.Equal(t, total, list.TotalResults, filter)
+	}
+	resp = scimDo(api, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(`userName eq`), "", scimAuth)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"scimType":"invalidFilter"`)
+
+	// Pagination
+	list := scimDecode[handlers.SCIMListResponse[handlers.SCIMUser]](t, scimDo(api, http.MethodGet, "/scim/v2/Users?startIndex=2&count=1", "", scimAuth))
+	assert.Equal(t, int64(2), list.TotalResults)
+	require.Len(t, list.Resources, 1)
+	assert.Equal(t, user.ID, list.Resources[0].ID)
+
+	// Entra sends a formatted name and enterprise extension attributes
+	resp = scimDo(api, http.MethodPost, "/scim/v2/Users", scimPayload(t, "entra_create_user"), scimAuth)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	entra := scimDecode[handlers.SCIMUser](t, resp)
+	assert.Equal(t, "givenName familyName", entra.DisplayName)
+
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Users/"+entra.ID, scimPayload(t, "entra_update_user"), scimAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	entra = scimDecode[handlers.SCIMUser](t, resp)
+	assert.Equal(t, "Contoso Sales Lead", entra.DisplayName)
+	assert.Equal(t, "1a21f0f2-8d2a-4f8e-bf98-7363c4aed4ef", entra.ExternalID)
+	assert.Equal(t, "Test_User_ab6490ee-1e48-479e-a20b-2d77186b5dd1@contoso.com", entra.UserName)
+
+	resp = scimDo(api, http.MethodDelete, "/scim/v2/Users/"+entra.ID, "", scimAuth)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = scimDo(api, http.MethodGet, "/scim/v2/Users/"+entra.ID, "", scimAuth)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Contains(t, resp.Body.String(), "urn:ietf:params:scim:api:messages:2.0:Error")
+}
+
+func TestSCIMDeactivation(t *testing.T) {
+	db, api, scimAuth, adminAuth := setupSCIMTest(t)
+	resp := scimDo(api, http.MethodPost, "/scim/v2/Users", scimPayload(t, "okta_create_user"), scimAuth)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	scimUser := scimDecode[handlers.SCIMUser](t, resp)
+
+	var user database.User
+	require.NoError(t, db.Where("email = ?", scimUser.UserName).First(&user).Error)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	db.Model(&user).Update("password_hash", string(hash))
+	bearer := "Authorization: Bearer " + issueToken(t, db, user.ID)
+	resp = api.Post("/keys", map[string]any{"scopes": []string{auth.ScopeProfileRead}}, bearer)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	key := "X-API-Key: " + scimDecode[struct{ Key string }](t, resp).Key
+	require.Equal(t, http.StatusOK, api.Get("/me", key).Code)
+
+	// Okta deactivates with a path-less replace
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Users/"+scimUser.ID, scimPayload(t, "okta_deactivate_user"), scimAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.False(t, scimDecode[handlers.SCIMUser](t, resp).Active)
+	assert.Equal(t, http.StatusForbidden, attemptLogin(api, user.Email, "password123"))
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/me", bearer).Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/me", key).Code)
+
+	events := listAudit(t, api, strings.TrimPrefix(adminAuth, "Authorization: Bearer "), "?action=user.deactivate").Events
+	require.Len(t, events, 1)
+	assert.Equal(t, scimUser.ID, events[0].TargetID)
+	assert.Contains(t, events[0].Details, "scim_token_id")
+
+	// Reactivating restores keys; the revoked sessions stay revoked
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Users/"+scimUser.ID, `{"Operations":[{"op":"replace","path":"active","value":true}]}`, scimAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, http.StatusOK, attemptLogin(api, user.Email, "password123"))
+	assert.Equal(t, http.StatusOK, api.Get("/me", key).Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/me", bearer).Code)
+
+	// Entra sends booleans as strings
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Users/"+scimUser.ID, scimPayload(t, "entra_disable_user"), scimAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.False(t, scimDecode[handlers.SCIMUser](t, resp).Active)
+	list := scimDecode[handlers.SCIMListResponse[handlers.SCIMUser]](t, scimDo(api, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(`active eq false`), "", scimAuth))
+	assert.Equal(t, int64(1), list.TotalResults)
+
+	// The last active admin cannot be deactivated
+	var admin database.User
+	db.Where("email = ?", "admin@example.com").First(&admin)
+	resp = scimDo(api, http.MethodPatch, fmt.Sprintf("/scim/v2/Users/%d", admin.ID), scimPayload(t, "okta_deactivate_user"), scimAuth)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"scimType":"mutability"`)
+}
+
+func TestSCIMGroups(t *testing.T) {
+	db, api, scimAuth, _ := setupSCIMTest(t)
+	resp := scimDo(api, http.MethodPost, "/scim/v2/Users", scimPayload(t, "okta_create_user"), scimAuth)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	user := scimDecode[handlers.SCIMUser](t, resp)
+
+	resp = scimDo(api, http.MethodPost, "/scim/v2/Groups", scimPayload(t, "okta_create_group"), scimAuth)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	group := scimDecode[handlers.SCIMGroup](t, resp)
+	assert.Equal(t, "Engineering Team", group.DisplayName)
+	var org database.Organization
+	require.NoError(t, db.First(&org, group.ID).Error)
+	assert.Equal(t, "engineering-team", org.Slug)
+
+	vars := []string{"{{user}}", user.ID, "{{group}}", group.ID}
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Groups/"+group.ID, scimPayload(t, "okta_add_members", vars...), scimAuth)
+	require.Equal(t, http.StatusNoContent, resp.Code, resp.Body.String())
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Groups/"+group.ID, scimPayload(t, "okta_rename_group", vars...), scimAuth)
+	require.Equal(t, http.StatusNoContent, resp.Code, resp.Body.String())
+
+	group = scimDecode[handlers.SCIMGroup](t, scimDo(api, http.MethodGet, "/scim/v2/Groups/"+group.ID, "", scimAuth))
+	assert.Equal(t, "Platform Engineering", group.DisplayName)
+	assert.Equal(t, []handlers.SCIMMember{{Value: user.ID, Display: "Isabella Ortiz"}}, group.Members)
+	var membership database.Membership
+	require.NoError(t, db.Where("organization_id = ?", org.ID).First(&membership).Error)
+	assert.Equal(t, database.OrgRoleMember, membership.Role)
+
+	list := scimDecode[handlers.SCIMListResponse[handlers.SCIMGroup]](t, scimDo(api, http.MethodGet, "/scim/v2/Groups?excludedAttributes=members&filter="+url.QueryEscape(`displayName eq "platform engineering"`), "", scimAuth))
+	require.Equal(t, int64(1), list.TotalResults)
+	assert.Empty(t, list.Resources[0].Members)
+
+	// Okta removes members with a value filter, Entra with a value list
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Groups/"+group.ID, scimPayload(t, "okta_remove_member", vars...), scimAuth)
+	require.Equal(t, http.StatusNoContent, resp.Code, resp.Body.String())
+	assert.Empty(t, scimDecode[handlers.SCIMGroup](t, scimDo(api, http.MethodGet, "/scim/v2/Groups/"+group.ID, "", scimAuth)).Members)
+	scimDo(api, http.MethodPatch, "/scim/v2/Groups/"+group.ID, scimPayload(t, "okta_add_members", vars...), scimAuth)
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Groups/"+group.ID, scimPayload(t, "entra_remove_member", vars...), scimAuth)
+	require.Equal(t, http.StatusNoContent, resp.Code, resp.Body.String())
+	assert.Empty(t, scimDecode[handlers.SCIMGroup](t, scimDo(api, http.MethodGet, "/scim/v2/Groups/"+group.ID, "", scimAuth)).Members)
+
+	// Unknown members are refused
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Groups/"+group.ID, scimPayload(t, "okta_add_members", "{{user}}", "999"), scimAuth)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// The last owner of an organization stays
+	owner := database.User{Email: "owner@example.com", Name: "Owner"}
+	db.Create(&owner)
+	db.Create(&database.Membership{OrganizationID: org.ID, UserID: owner.ID, Role: database.OrgRoleOwner})
+	resp = scimDo(api, http.MethodPatch, "/scim/v2/Groups/"+group.ID, `{"Operations":[{"op":"remove","path":"members"}]}`, scimAuth)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = scimDo(api, http.MethodDelete, "/scim/v2/Groups/"+group.ID, "", scimAuth)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	var count int64
+	db.Model(&database.Membership{}).Where("organization_id = ?", org.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestSCIMTokens(t *testing.T) {
+	db, api, scimAuth, adminAuth := setupSCIMTest(t)
+
+	// SCIM tokens only work on SCIM endpoints, and only SCIM tokens do
+	assert.Equal(t, http.StatusForbidden, api.Get("/me", scimAuth).Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/scim/v2/Users", adminAuth).Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/scim/v2/Users").Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/scim/v2/Users", "Authorization: Bearer scim_unknown").Code)
+	assert.Equal(t, http.StatusOK, api.Get("/scim/v2/ServiceProviderConfig", scimAuth).Code)
+
+	// Only callers with every permission can create one
+	db.Create(&database.Role{Name: "support", Permissions: auth.EncodeScopes([]string{auth.PermissionUsersRead, auth.PermissionUsersWrite})})
+	support := database.User{Email: "support@example.com", Role: "support"}
+	db.Create(&support)
+	supportAuth := "Authorization: Bearer " + issueToken(t, db, support.ID)
+	assert.Equal(t, http.StatusForbidden, api.Post("/admin/scim/tokens", map[string]any{"name": "x"}, supportAuth).Code)
+
+	resp := api.Get("/admin/scim/tokens", supportAuth)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var tokens handlers.ListSCIMTokensOutput
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tokens.Body))
+	require.Len(t, tokens.Body.Tokens, 1)
+	assert.NotNil(t, tokens.Body.Tokens[0].LastUsed)
+
+	resp = api.Delete(fmt.Sprintf("/admin/scim/tokens/%d", tokens.Body.Tokens[0].ID), adminAuth)
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/scim/v2/Users", scimAuth).Code)
+}
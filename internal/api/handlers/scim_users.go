@@ -0,0 +1,498 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// SCIMUser is a user as a SCIM User resource. userName is the email address.
+type SCIMUser struct {
+	scimNoSchemaLink
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        SCIMName    `json:"name"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []SCIMEmail `json:"emails"`
+	Active      bool        `json:"active"`
+	Meta        SCIMMeta    `json:"meta"`
+}
+
+func (SCIMUser) ContentType(string) string { return scimContentType }
+
+// SCIMName is the name attribute of a SCIM User.
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// SCIMEmail is an entry of a SCIM User's emails attribute.
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary"`
+}
+
+// scimUserPayload is a SCIM User in a POST or PUT request. Attributes the
+// user model has no place for are ignored.
+type scimUserPayload struct {
+	UserName    string          `json:"userName"`
+	ExternalID  string          `json:"externalId"`
+	DisplayName string          `json:"displayName"`
+	Name        SCIMName        `json:"name"`
+	Emails      []SCIMEmail     `json:"emails"`
+	Active      json.RawMessage `json:"active"`
+}
+
+// scimUserAttrs are the user attributes SCIM manages.
+type scimUserAttrs struct {
+	Email      string `json:"email"`
+	Name       string `json:"name"`
+	ExternalID string `json:"external_id"`
+	Active     bool   `json:"active"`
+}
+
+// scimUserColumns maps the filterable User attributes to columns.
+var scimUserColumns = map[string]scimColumn{
+	"id":             {Name: "id"},
+	"username":       {Name: "email", CaseInsensitive: true},
+	"emails":         {Name: "email", CaseInsensitive: true},
+	"emails.value":   {Name: "email", CaseInsensitive: true},
+	"externalid":     {Name: "external_id"},
+	"displayname":    {Name: "name"},
+	"name.formatted": {Name: "name"},
+	"active": {Filter: func(op string, value any) (string, error) {
+		active, ok := value.(bool)
+		switch {
+		case op == "pr":
+			return "1 = 1", nil
+		case !ok || (op != "eq" && op != "ne"):
+			return "", errors.New("active only supports eq and ne with true or false")
+		case active == (op == "eq"):
+			return "disabled_at IS NULL", nil
+		default:
+			return "disabled_at IS NOT NULL", nil
+		}
+	}},
+}
+
+func newSCIMUser(user *database.User) SCIMUser {
+	return SCIMUser{
+		Schemas:     []string{scimSchemaUser},
+		ID:          auditID(user.ID),
+		ExternalID:  user.ExternalID,
+		UserName:    user.Email,
+		Name:        SCIMName{Formatted: user.Name},
+		DisplayName: user.Name,
+		Emails:      []SCIMEmail{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      user.DisabledAt == nil,
+		Meta: SCIMMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     scimBasePath + "/Users/" + auditID(user.ID),
+		},
+	}
+}
+
+func scimUserAttrsOf(user *database.User) scimUserAttrs {
+	return scimUserAttrs{
+		Email:      user.Email,
+		Name:       user.Name,
+		ExternalID: user.ExternalID,
+		Active:     user.DisabledAt == nil,
+	}
+}
+
+// attrs returns the attributes a POST or PUT request sets. Users are active
+// unless the request says otherwise.
+func (p *scimUserPayload) attrs() (scimUserAttrs, error) {
+	attrs := scimUserAttrs{
+		Email:      strings.TrimSpace(p.UserName),
+		ExternalID: p.ExternalID,
+		Active:     true,
+	}
+	if !strings.Contains(attrs.Email, "@") {
+		// Fall back to the primary email when userName is not an address
+		for _, email := range p.Emails {
+			if email.Primary || len(p.Emails) == 1 {
+				attrs.Email = strings.TrimSpace(email.Value)
+				break
+			}
+		}
+	}
+	switch {
+	case p.DisplayName != "":
+		attrs.Name = p.DisplayName
+	case p.Name.Formatted != "":
+		attrs.Name = p.Name.Formatted
+	default:
+		attrs.Name = strings.TrimSpace(p.Name.GivenName + " " + p.Name.FamilyName)
+	}
+	if len(p.Active) > 0 && string(p.Active) != "null" {
+		active, err := scimBool(p.Active)
+		if err != nil {
+			return attrs, err
+		}
+		attrs.Active = active
+	}
+	return attrs, nil
+}
+
+// patch applies PATCH operations. Paths the user model has no place for,
+// such as enterprise extension attributes, are ignored.
+func (a *scimUserAttrs) patch(ops []scimPatchOperation) error {
+	for _, op := range ops {
+		if op.Path != "" {
+			if op.Op == "remove" {
+				if err := a.remove(op.Path); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := a.set(op.Path, op.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Without a path the value is an object of attributes to set
+		if op.Op == "remove" {
+			return newSCIMError(http.StatusBadRequest, "noTarget", "remove requires a path")
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return newSCIMError(http.StatusBadRequest, "invalidValue", "expected an object of attributes")
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		// Reverse order applies displayName after name, so it wins
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		for _, key := range keys {
+			if err := a.set(key, values[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *scimUserAttrs) set(path string, raw json.RawMessage) error {
+	var err error
+	switch normalizeSCIMAttr(path) {
+	case "active":
+		a.Active, err = scimBool(raw)
+	case "username":
+		a.Email, err = scimString(raw)
+		a.Email = strings.TrimSpace(a.Email)
+	case "displayname", "name.formatted":
+		a.Name, err = scimString(raw)
+	case "name":
+		var name SCIMName
+		if err := json.Unmarshal(raw, &name); err != nil {
+			return newSCIMError(http.StatusBadRequest, "invalidValue", "expected a name object")
+		}
+		if name.Formatted != "" {
+			a.Name = name.Formatted
+		} else if full := strings.TrimSpace(name.GivenName + " " + name.FamilyName); full != "" {
+			a.Name = full
+		}
+	case "externalid":
+		a.ExternalID, err = scimString(raw)
+	}
+	return err
+}
+
+func (a *scimUserAttrs) remove(path string) error {
+	switch normalizeSCIMAttr(path) {
+	case "username", "active":
+		return newSCIMError(http.StatusBadRequest, "mutability", path+" cannot be removed")
+	case "displayname", "name", "name.formatted":
+		a.Name = ""
+	case "externalid":
+		a.ExternalID = ""
+	}
+	return nil
+}
+
+// findSCIMUser loads a user by SCIM ID. Service accounts are not exposed.
+func findSCIMUser(db *gorm.DB, id string) (*database.User, error) {
+	userID, err := scimID(id)
+	if err != nil {
+		return nil, err
+	}
+	var user database.User
+	if err := db.Where("id = ? AND service_account = ?", userID, false).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, newSCIMError(http.StatusNotFound, "", "user "+id+" not found")
+		}
+		return nil, huma.Error500InternalServerError("failed to fetch user", err)
+	}
+	return &user, nil
+}
+
+// checkSCIMEmail refuses missing addresses and ones another user has.
+func checkSCIMEmail(db *gorm.DB, email string, userID uint) error {
+	if !strings.Contains(email, "@") {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "userName must be an email address")
+	}
+	var count int64
+	err := db.Unscoped().Model(&database.User{}).
+		Where("LOWER(email) = ? AND id <> ?", strings.ToLower(email), userID).
+		Count(&count).Error
+	if err != nil {
+		return huma.Error500InternalServerError("failed to check userName", err)
+	}
+	if count > 0 {
+		return newSCIMError(http.StatusConflict, "uniqueness", "a user with this userName already exists")
+	}
+	return nil
+}
+
+// updateSCIMUser saves new attributes for a user. Deactivating revokes the
+// user's sessions; the last active admin cannot be deactivated.
+func updateSCIMUser(ctx context.Context, db *gorm.DB, user *database.User, attrs scimUserAttrs) error {
+	before := scimUserAttrsOf(user)
+	if attrs == before {
+		return nil
+	}
+	if attrs.Email != user.Email {
+		if err := checkSCIMEmail(db, attrs.Email, user.ID); err != nil {
+			return err
+		}
+	}
+
+	action := auditUserUpdate
+	switch {
+	case before.Active && !attrs.Active:
+		if isAdminRole(db, user.Role) && countActiveAdmins(db) <= 1 {
+			return newSCIMError(http.StatusBadRequest, "mutability", "cannot deactivate the last admin")
+		}
+		now := time.Now()
+		user.DisabledAt = &now
+		action = auditUserDeactivate
+	case !before.Active && attrs.Active:
+		user.DisabledAt = nil
+		action = auditUserReactivate
+	}
+	user.Email = attrs.Email
+	user.Name = attrs.Name
+	user.ExternalID = attrs.ExternalID
+	if err := db.Save(user).Error; err != nil {
+		return huma.Error500InternalServerError("failed to update user", err)
+	}
+	if action == auditUserDeactivate {
+		if err := auth.RevokeUserSessions(db, user.ID); err != nil {
+			return huma.Error500InternalServerError("failed to revoke user sessions", err)
+		}
+	}
+
+	recordAudit(ctx, db, auditEntry{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   auditID(user.ID),
+		Before:     before,
+		After:      attrs,
+	})
+	return nil
+}
+
+func registerSCIMUsers(api huma.API, db *gorm.DB) {
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-list-users",
+		Method:      http.MethodGet,
+		Path:        "/scim/v2/Users",
+		Summary:     "List SCIM users",
+		Description: "Filter on userName, emails.value, externalId, displayName, id or active with eq, ne, co, sw, ew, pr, gt, ge, lt and le, joined by and/or.",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *SCIMListInput) (*struct{ Body SCIMListResponse[SCIMUser] }, error) {
+		query, err := applySCIMFilter(db.Model(&database.User{}).Where("service_account = ?", false), input.Filter, scimUserColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &struct{ Body SCIMListResponse[SCIMUser] }{}
+		resp.Body.Schemas = []string{scimSchemaListResponse}
+		resp.Body.StartIndex = max(input.StartIndex, 1)
+		if err := query.Count(&resp.Body.TotalResults).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to count users", err)
+		}
+
+		var users []database.User
+		offset, limit := input.page()
+		if limit > 0 {
+			if err := query.Order("id").Offset(offset).Limit(limit).Find(&users).Error; err != nil {
+				return nil, huma.Error500InternalServerError("failed to fetch users", err)
+			}
+		}
+		resp.Body.Resources = make([]SCIMUser, len(users))
+		for i := range users {
+			resp.Body.Resources[i] = newSCIMUser(&users[i])
+		}
+		resp.Body.ItemsPerPage = len(users)
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-get-user",
+		Method:      http.MethodGet,
+		Path:        "/scim/v2/Users/{id}",
+		Summary:     "Get SCIM user",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *SCIMPathInput) (*struct{ Body SCIMUser }, error) {
+		user, err := findSCIMUser(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &struct{ Body SCIMUser }{Body: newSCIMUser(user)}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "scim-create-user",
+		Method:        http.MethodPost,
+		Path:          "/scim/v2/Users",
+		Summary:       "Create SCIM user",
+		Description:   "Provision a user with the user role. userName must be the email address, and the identity provider is trusted to have verified it.",
+		Tags:          []string{"SCIM"},
+		Security:      scimSecurity,
+		DefaultStatus: http.StatusCreated,
+	}, func(ctx context.Context, input *SCIMBodyInput) (*struct{ Body SCIMUser }, error) {
+		var payload scimUserPayload
+		if err := decodeSCIM(input.RawBody, &payload); err != nil {
+			return nil, err
+		}
+		attrs, err := payload.attrs()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSCIMEmail(db, attrs.Email, 0); err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		user := database.User{
+			Email:           attrs.Email,
+			EmailVerifiedAt: &now,
+			Name:            attrs.Name,
+			Role:            database.RoleUser,
+			ExternalID:      attrs.ExternalID,
+		}
+		if !attrs.Active {
+			user.DisabledAt = &now
+		}
+		if err := db.Create(&user).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to create user", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditUserCreate,
+			TargetType: "user",
+			TargetID:   auditID(user.ID),
+			After:      attrs,
+		})
+
+		return &struct{ Body SCIMUser }{Body: newSCIMUser(&user)}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-replace-user",
+		Method:      http.MethodPut,
+		Path:        "/scim/v2/Users/{id}",
+		Summary:     "Replace SCIM user",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *struct {
+		SCIMPathInput
+		SCIMBodyInput
+	}) (*struct{ Body SCIMUser }, error) {
+		user, err := findSCIMUser(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		var payload scimUserPayload
+		if err := decodeSCIM(input.RawBody, &payload); err != nil {
+			return nil, err
+		}
+		attrs, err := payload.attrs()
+		if err != nil {
+			return nil, err
+		}
+		if err := updateSCIMUser(ctx, db, user, attrs); err != nil {
+			return nil, err
+		}
+		return &struct{ Body SCIMUser }{Body: newSCIMUser(user)}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "scim-patch-user",
+		Method:      http.MethodPatch,
+		Path:        "/scim/v2/Users/{id}",
+		Summary:     "Update SCIM user",
+		Description: "Setting active to false deactivates the user: they cannot sign in, and their sessions and API keys stop working until active is set to true again.",
+		Tags:        []string{"SCIM"},
+		Security:    scimSecurity,
+	}, func(ctx context.Context, input *struct {
+		SCIMPathInput
+		SCIMBodyInput
+	}) (*struct{ Body SCIMUser }, error) {
+		user, err := findSCIMUser(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		ops, err := decodeSCIMPatch(input.RawBody)
+		if err != nil {
+			return nil, err
+		}
+		attrs := scimUserAttrsOf(user)
+		if err := attrs.patch(ops); err != nil {
+			return nil, err
+		}
+		if err := updateSCIMUser(ctx, db, user, attrs); err != nil {
+			return nil, err
+		}
+		return &struct{ Body SCIMUser }{Body: newSCIMUser(user)}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "scim-delete-user",
+		Method:        http.MethodDelete,
+		Path:          "/scim/v2/Users/{id}",
+		Summary:       "Delete SCIM user",
+		Tags:          []string{"SCIM"},
+		Security:      scimSecurity,
+		DefaultStatus: http.StatusNoContent,
+	}, func(ctx context.Context, input *SCIMPathInput) (*struct{}, error) {
+		user, err := findSCIMUser(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		if user.DisabledAt == nil && isAdminRole(db, user.Role) && countActiveAdmins(db) <= 1 {
+			return nil, newSCIMError(http.StatusBadRequest, "mutability", "cannot delete the last admin")
+		}
+		if err := deleteUser(db, user); err != nil {
+			return nil, err
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditUserDelete,
+			TargetType: "user",
+			TargetID:   auditID(user.ID),
+			Before:     UserInfo{ID: user.ID, Email: user.Email, Name: user.Name, Role: user.Role, DisabledAt: user.DisabledAt, CreatedAt: user.CreatedAt},
+		})
+		return nil, nil
+	})
+}
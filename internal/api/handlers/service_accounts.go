@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// ServiceAccountInfo represents a service account in admin responses.
+type ServiceAccountInfo struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	ClientID  string    `json:"client_id" doc:"Client ID for the OAuth2 client credentials grant at /auth/token"`
+	Role      string    `json:"role"`
+	Keys      int64     `json:"keys" doc:"Number of API keys the account owns"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListServiceAccountsOutput represents the response for listing service accounts.
+type ListServiceAccountsOutput struct {
+	Body struct {
+		ServiceAccounts []ServiceAccountInfo `json:"service_accounts"`
+	}
+}
+
+// ServiceAccountOutput represents a single service account response.
+type ServiceAccountOutput struct {
+	Body ServiceAccountInfo
+}
+
+// CreateServiceAccountInput represents the request to create a service account.
+type CreateServiceAccountInput struct {
+	Body struct {
+		Name string `json:"name" required:"true" minLength:"1" maxLength:"128" doc:"Name of the automation the account is for"`
+		Role string `json:"role,omitempty" default:"user" doc:"Role granting the account's permissions"`
+	}
+}
+
+// ServiceAccountPathInput identifies a service account.
+type ServiceAccountPathInput struct {
+	ID uint `path:"id" doc:"Service account ID"`
+}
+
+// UpdateServiceAccountInput represents the request to change a service account.
+type UpdateServiceAccountInput struct {
+	ServiceAccountPathInput
+	Body struct {
+		Name *string `json:"name,omitempty" minLength:"1" maxLength:"128"`
+		Role *string `json:"role,omitempty" doc:"Role granting the account's permissions"`
+	}
+}
+
+// TokenInput represents an OAuth2 token request (RFC 6749 section 4.4).
+type TokenInput struct {
+	Authorization string `header:"Authorization" doc:"HTTP Basic client authentication with the client ID and secret"`
+	RawBody       []byte `contentType:"application/x-www-form-urlencoded"`
+}
+
+// TokenOutput represents an OAuth2 access token response.
+type TokenOutput struct {
+	CacheControl string `header:"Cache-Control"`
+	Body         struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in" doc:"Access token lifetime in seconds"`
+		Scope       string `json:"scope" doc:"Space-separated scopes granted to the token"`
+	}
+}
+
+// oauthError is an OAuth2 error response (RFC 6749 section 5.2), which
+// clients expect in place of the usual problem details.
+type oauthError struct {
+	status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *oauthError) Error() string  { return e.Code + ": " + e.Description }
+func (e *oauthError) GetStatus() int { return e.status }
+
+func newServiceAccountInfo(db *gorm.DB, account *database.User) ServiceAccountInfo {
+	var keys int64
+	db.Model(&database.APIKey{}).Where("user_id = ?", account.ID).Count(&keys)
+	return ServiceAccountInfo{
+		ID:        account.ID,
+		Name:      account.Name,
+		ClientID:  *account.ClientID,
+		Role:      account.Role,
+		Keys:      keys,
+		CreatedAt: account.CreatedAt,
+	}
+}
+
+func findServiceAccount(db *gorm.DB, id uint) (*database.User, error) {
+	var account database.User
+	if err := db.Where("id = ? AND service_account = ?", id, true).First(&account).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, huma.Error404NotFound("service account not found")
+		}
+		return nil, huma.Error500InternalServerError("failed to fetch service account", err)
+	}
+	return &account, nil
+}
+
+// requireExistingRole refuses roles that have not been defined.
+func requireExistingRole(db *gorm.DB, name string) error {
+	var count int64
+	if err := db.Model(&database.Role{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return huma.Error500InternalServerError("failed to fetch role", err)
+	}
+	if count == 0 {
+		return huma.Error400BadRequest("unknown role")
+	}
+	return nil
+}
+
+// clientCredentials reads the client ID and secret from HTTP Basic
+// authentication or, failing that, the form body.
+func clientCredentials(authorization string, form url.Values) (string, string) {
+	if encoded, ok := strings.CutPrefix(authorization, "Basic "); ok {
+		if raw, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			if id, secret, ok := strings.Cut(string(raw), ":"); ok {
+				// RFC 6749 section 2.3.1 form-encodes both parts
+				if unescaped, err := url.QueryUnescape(id); err == nil {
+					id = unescaped
+				}
+				if unescaped, err := url.QueryUnescape(secret); err == nil {
+					secret = unescaped
+				}
+				return id, secret
+			}
+		}
+	}
+	return form.Get("client_id"), form.Get("client_secret")
+}
+
+// RegisterServiceAccounts registers the service account management endpoints
+// and the OAuth2 token endpoint they authenticate with.
+func RegisterServiceAccounts(api huma.API, db *gorm.DB) {
+	huma.Register(api, huma.Operation{
+		OperationID: "list-service-accounts",
+		Method:      http.MethodGet,
+		Path:        "/admin/service-accounts",
+		Summary:     "List service accounts",
+		Description: "List the accounts used by automation. Requires the users:read permission.",
+		Tags:        []string{"Admin", "Service Accounts"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersRead},
+	}, func(ctx context.Context, input *struct{}) (*ListServiceAccountsOutput, error) {
+		var accounts []database.User
+		if err := db.Where("service_account = ?", true).Order("name").Find(&accounts).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch service accounts", err)
+		}
+
+		resp := &ListServiceAccountsOutput{}
+		resp.Body.ServiceAccounts = make([]ServiceAccountInfo, len(accounts))
+		for i := range accounts {
+			resp.Body.ServiceAccounts[i] = newServiceAccountInfo(db, &accounts[i])
+		}
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "create-service-account",
+		Method:      http.MethodPost,
+		Path:        "/admin/service-accounts",
+		Summary:     "Create service account",
+		Description: "Create an account for automation. It cannot log in interactively; it authenticates with its own API keys, either directly or through the client credentials grant. You can only assign roles whose permissions you have. Requires the users:write permission.",
+		Tags:        []string{"Admin", "Service Accounts"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *CreateServiceAccountInput) (*ServiceAccountOutput, error) {
+		if err := requireExistingRole(db, input.Body.Role); err != nil {
+			return nil, err
+		}
+		if err := requireRoleWithin(ctx, db, input.Body.Role); err != nil {
+			return nil, err
+		}
+
+		clientID, err := auth.NewClientID()
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to generate client ID", err)
+		}
+		account := database.User{
+			Email:          auth.ServiceAccountEmail(clientID),
+			ClientID:       &clientID,
+			Name:           input.Body.Name,
+			Role:           input.Body.Role,
+			ServiceAccount: true,
+		}
+		if err := db.Create(&account).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to create service account", err)
+		}
+		info := newServiceAccountInfo(db, &account)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditServiceAccountCreate,
+			TargetType: "service_account",
+			TargetID:   auditID(account.ID),
+			After:      info,
+		})
+
+		return &ServiceAccountOutput{Body: info}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "update-service-account",
+		Method:      http.MethodPut,
+		Path:        "/admin/service-accounts/{id}",
+		Summary:     "Update service account",
+		Description: "Rename a service account or change its role. Omitted fields are left unchanged. Requires the users:write permission.",
+		Tags:        []string{"Admin", "Service Accounts"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *UpdateServiceAccountInput) (*ServiceAccountOutput, error) {
+		account, err := findServiceAccount(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireRoleWithin(ctx, db, account.Role); err != nil {
+			return nil, err
+		}
+
+		before := newServiceAccountInfo(db, account)
+		if input.Body.Name != nil {
+			account.Name = *input.Body.Name
+		}
+		if input.Body.Role != nil {
+			if err := requireExistingRole(db, *input.Body.Role); err != nil {
+				return nil, err
+			}
+			if err := requireRoleWithin(ctx, db, *input.Body.Role); err != nil {
+				return nil, err
+			}
+			account.Role = *input.Body.Role
+		}
+		if err := db.Save(account).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to update service account", err)
+		}
+		info := newServiceAccountInfo(db, account)
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditServiceAccountUpdate,
+			TargetType: "service_account",
+			TargetID:   auditID(account.ID),
+			Before:     before,
+			After:      info,
+		})
+
+		return &ServiceAccountOutput{Body: info}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "delete-service-account",
+		Method:      http.MethodDelete,
+		Path:        "/admin/service-accounts/{id}",
+		Summary:     "Delete service account",
+		Description: "Delete a service account together with its keys and tokens. Requires the users:write permission.",
+		Tags:        []string{"Admin", "Service Accounts"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *ServiceAccountPathInput) (*struct{}, error) {
+		account, err := findServiceAccount(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireRoleWithin(ctx, db, account.Role); err != nil {
+			return nil, err
+		}
+
+		info := newServiceAccountInfo(db, account)
+		if err := db.Delete(&database.APIKey{}, "user_id = ?", account.ID).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to delete service account keys", err)
+		}
+		if err := auth.RevokeUserSessions(db, account.ID); err != nil {
+			return nil, huma.Error500InternalServerError("failed to revoke service account tokens", err)
+		}
+		if err := db.Delete(account).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to delete service account", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditServiceAccountDelete,
+			TargetType: "service_account",
+			TargetID:   auditID(account.ID),
+			Before:     info,
+		})
+		return nil, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "list-service-account-keys",
+		Method:      http.MethodGet,
+		Path:        "/admin/service-accounts/{id}/keys",
+		Summary:     "List service account API keys",
+		Description: "Requires the users:read permission.",
+		Tags:        []string{"Admin", "Service Accounts", "API Keys"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersRead}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersRead},
+	}, func(ctx context.Context, input *ServiceAccountPathInput) (*ListKeysOutput, error) {
+		account, err := findServiceAccount(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []database.APIKey
+		if err := db.Where("user_id = ?", account.ID).Find(&keys).Error; err != nil {
+			return nil, huma.Error500InternalServerError("database error", err)
+		}
+
+		resp := &ListKeysOutput{}
+		resp.Body.Keys = make([]APIKey, len(keys))
+		for i := range keys {
+			resp.Body.Keys[i] = newAPIKey(&keys[i])
+		}
+		return resp, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "create-service-account-key",
+		Method:      http.MethodPost,
+		Path:        "/admin/service-accounts/{id}/keys",
+		Summary:     "Create service account API key",
+		Description: "Create a key owned by the service account. Use it in the X-API-Key header, or as the client secret at /auth/token. The key keeps working when the admin who created it is deleted. Requires the users:write permission.",
+		Tags:        []string{"Admin", "Service Accounts", "API Keys"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{
+			middleware.PermissionExtension: auth.PermissionUsersWrite,
+			middleware.SensitiveExtension:  true,
+		},
+	}, func(ctx context.Context, input *struct {
+		ServiceAccountPathInput
+		CreateKeyInput
+	}) (*CreateKeyOutput, error) {
+		account, err := findServiceAccount(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireRoleWithin(ctx, db, account.Role); err != nil {
+			return nil, err
+		}
+
+		user := middleware.GetUser(ctx)
+		return createAPIKey(ctx, db, database.APIKey{UserID: account.ID, CreatedByID: &user.ID}, &input.CreateKeyInput)
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "revoke-service-account-key",
+		Method:      http.MethodDelete,
+		Path:        "/admin/service-accounts/{id}/keys/{key}",
+		Summary:     "Revoke service account API key",
+		Description: "Revoke a key and every token issued for it. Requires the users:write permission.",
+		Tags:        []string{"Admin", "Service Accounts", "API Keys"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
+		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
+	}, func(ctx context.Context, input *struct {
+		ServiceAccountPathInput
+		Key uint `path:"key" doc:"API key ID"`
+	}) (*struct{}, error) {
+		account, err := findServiceAccount(db, input.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireRoleWithin(ctx, db, account.Role); err != nil {
+			return nil, err
+		}
+
+		return nil, revokeAPIKey(ctx, db, db.Where("id = ? AND user_id = ?", input.Key, account.ID))
+	})
+
+	// OAuth2 token endpoint - client credentials grant for service accounts
+	huma.Register(api, huma.Operation{
+		OperationID: "issue-token",
+		Method:      http.MethodPost,
+		Path:        "/auth/token",
+		Summary:     "Issue access token",
+		Description: "OAuth2 client credentials grant for service accounts. Authenticate with the account's client ID and one of its API keys as the client secret, using HTTP Basic or the client_id and client_secret form fields. The optional scope parameter narrows the token to a space-separated subset of the key's scopes. Tokens cannot be refreshed and stop working when the key is revoked.",
+		Tags:        []string{"Auth", "Service Accounts", "public"},
+	}, func(ctx context.Context, input *TokenInput) (*TokenOutput, error) {
+		form, err := url.ParseQuery(string(input.RawBody))
+		if err != nil {
+			return nil, &oauthError{status: http.StatusBadRequest, Code: "invalid_request", Description: "malformed form body"}
+		}
+		if form.Get("grant_type") != "client_credentials" {
+			return nil, &oauthError{status: http.StatusBadRequest, Code: "unsupported_grant_type", Description: "only client_credentials is supported"}
+		}
+		clientID, secret := clientCredentials(input.Authorization, form)
+		if clientID == "" || secret == "" {
+			return nil, &oauthError{status: http.StatusUnauthorized, Code: "invalid_client", Description: "client authentication required"}
+		}
+
+		client := middleware.GetClientInfo(ctx)
+		grant, err := auth.IssueClientCredentialsToken(db, clientID, secret, form.Get("scope"), auth.SessionMeta{
+			UserAgent: client.UserAgent,
+			IPAddress: client.IPAddress,
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidClient):
+				recordLoginAudit(ctx, db, "client_credentials", clientID, nil, nil, err)
+				return nil, &oauthError{status: http.StatusUnauthorized, Code: "invalid_client", Description: err.Error()}
+			case errors.Is(err, auth.ErrAccountDisabled):
+				recordLoginAudit(ctx, db, "client_credentials", clientID, nil, nil, err)
+				return nil, &oauthError{status: http.StatusUnauthorized, Code: "invalid_client", Description: err.Error()}
+			case errors.Is(err, auth.ErrInvalidScope):
+				recordLoginAudit(ctx, db, "client_credentials", clientID, nil, nil, err)
+				return nil, &oauthError{status: http.StatusBadRequest, Code: "invalid_scope", Description: err.Error()}
+			}
+			return nil, huma.Error500InternalServerError("failed to issue token", err)
+		}
+		recordLoginAudit(ctx, db, "client_credentials", clientID, grant.Account, nil, nil)
+
+		resp := &TokenOutput{CacheControl: "no-store"}
+		resp.Body.AccessToken = grant.AccessToken
+		resp.Body.TokenType = "Bearer"
+		resp.Body.ExpiresIn = grant.ExpiresIn
+		resp.Body.Scope = strings.Join(grant.Scopes, " ")
+		return resp, nil
+	})
+}
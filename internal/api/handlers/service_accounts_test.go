@@ -0,0 +1,218 @@
+package handlers_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+func setupServiceAccountTest(t *testing.T) (*gorm.DB, humatest.TestAPI, string) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewClientInfoMiddleware())
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterAPIKeys(api, db)
+	handlers.RegisterUser(api, db)
+	handlers.RegisterUsers(api, db)
+	handlers.RegisterServiceAccounts(api, db)
+
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	return db, api, "Authorization: Bearer " + issueToken(t, db, admin.ID)
+}
+
+func createServiceAccount(t *testing.T, api humatest.TestAPI, adminAuth string, body map[string]any) handlers.ServiceAccountInfo {
+	t.Helper()
+	resp := api.Post("/admin/service-accounts", body, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var account handlers.ServiceAccountInfo
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &account))
+	return account
+}
+
+func createServiceAccountKey(t *testing.T, api humatest.TestAPI, adminAuth string, id uint, scopes ...string) string {
+	t.Helper()
+	resp := api.Post(fmt.Sprintf("/admin/service-accounts/%d/keys", id), map[string]any{"name": "ci", "scopes": scopes}, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var out struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+	return out.Key
+}
+
+func requestToken(api humatest.TestAPI, form url.Values, headers ...any) (int, map[string]any) {
+	args := append([]any{"Content-Type: application/x-www-form-urlencoded", strings.NewReader(form.Encode())}, headers...)
+	resp := api.Post("/auth/token", args...)
+	var body map[string]any
+	_ = json.Unmarshal(resp.Body.Bytes(), &body)
+	return resp.Code, body
+}
+
+func TestServiceAccounts(t *testing.T) {
+	db, api, adminAuth := setupServiceAccountTest(t)
+	account := createServiceAccount(t, api, adminAuth, map[string]any{"name": "Deploy bot", "role": "admin"})
+	assert.True(t, strings.HasPrefix(account.ClientID, auth.ServiceAccountClientIDPrefix))
+	key := createServiceAccountKey(t, api, adminAuth, account.ID, auth.ScopeUsersRead)
+
+	// Listed separately from people
+	resp := api.Get("/admin/users", adminAuth)
+	assert.NotContains(t, resp.Body.String(), account.ClientID)
+	resp = api.Get("/admin/service-accounts", adminAuth)
+	assert.Contains(t, resp.Body.String(), `"name":"Deploy bot"`)
+	assert.Contains(t, resp.Body.String(), `"keys":1`)
+
+	// The key works as the account, within its scopes
+	assert.Equal(t, http.StatusOK, api.Get("/admin/users", "X-API-Key: "+key).Code)
+	assert.Equal(t, http.StatusForbidden, api.Get("/me", "X-API-Key: "+key).Code)
+
+	// Human user endpoints leave service accounts alone
+	assert.Equal(t, http.StatusNotFound, api.Delete(fmt.Sprintf("/admin/users/%d", account.ID), adminAuth).Code)
+
+	// Keys outlive the admin who created them
+	other := database.User{Email: "other@example.com", Role: database.RoleAdmin}
+	db.Create(&other)
+	otherAuth := "Authorization: Bearer " + issueToken(t, db, other.ID)
+	second := createServiceAccountKey(t, api, otherAuth, account.ID, auth.ScopeUsersRead)
+	require.Equal(t, http.StatusNoContent, api.Delete(fmt.Sprintf("/admin/users/%d", other.ID), adminAuth).Code)
+	assert.Equal(t, http.StatusOK, api.Get("/admin/users", "X-API-Key: "+second).Code)
+
+	// Role changes cannot exceed the caller's permissions
+	db.Create(&database.Role{Name: "support", Permissions: auth.EncodeScopes([]string{auth.PermissionUsersWrite})})
+	support := database.User{Email: "support@example.com", Role: "support"}
+	db.Create(&support)
+	supportAuth := "Authorization: Bearer " + issueToken(t, db, support.ID)
+	assert.Equal(t, http.StatusForbidden, api.Delete(fmt.Sprintf("/admin/service-accounts/%d", account.ID), supportAuth).Code)
+	assert.Equal(t, http.StatusForbidden, api.Post("/admin/service-accounts", map[string]any{"name": "x", "role": "admin"}, supportAuth).Code)
+	assert.Equal(t, http.StatusBadRequest, api.Post("/admin/service-accounts", map[string]any{"name": "x", "role": "nope"}, adminAuth).Code)
+
+	resp = api.Put(fmt.Sprintf("/admin/service-accounts/%d", account.ID), map[string]any{"role": "user"}, adminAuth)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, http.StatusForbidden, api.Get("/admin/users", "X-API-Key: "+key).Code)
+
+	// Deleting the account removes its keys
+	require.Equal(t, http.StatusNoContent, api.Delete(fmt.Sprintf("/admin/service-accounts/%d", account.ID), adminAuth).Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/admin/users", "X-API-Key: "+key).Code)
+}
+
+func TestServiceAccountNoInteractiveLogin(t *testing.T) {
+	db, api, adminAuth := setupServiceAccountTest(t)
+	account := createServiceAccount(t, api, adminAuth, map[string]any{"name": "Bot"})
+
+	// Client IDs are not email addresses, so password login is not possible
+	resp := api.Post("/auth/login", map[string]any{"email": account.ClientID, "password": "password123"})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	// Sessions not issued through the token endpoint are refused
+	token := issueToken(t, db, account.ID)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/admin/service-accounts", "Authorization: Bearer "+token).Code)
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	db, api, adminAuth := setupServiceAccountTest(t)
+	account := createServiceAccount(t, api, adminAuth, map[string]any{"name": "Bot", "role": "admin"})
+	secret := createServiceAccountKey(t, api, adminAuth, account.ID, auth.ScopeUsersRead, auth.ScopeProfileRead)
+
+	// Client authentication through the form body
+	status, body := requestToken(api, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {account.ClientID},
+		"client_secret": {secret},
+		"scope":         {auth.ScopeUsersRead},
+	})
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "Bearer", body["token_type"])
+	assert.Equal(t, auth.ScopeUsersRead, body["scope"])
+	tokenAuth := "Authorization: Bearer " + body["access_token"].(string)
+
+	// The token carries only the requested scopes
+	assert.Equal(t, http.StatusOK, api.Get("/admin/users", tokenAuth).Code)
+	assert.Equal(t, http.StatusForbidden, api.Get("/me", tokenAuth).Code)
+	assert.Equal(t, http.StatusForbidden, api.Post("/admin/service-accounts", map[string]any{"name": "x"}, tokenAuth).Code)
+
+	// Client authentication through HTTP Basic, with every scope of the key
+	basic := base64.StdEncoding.EncodeToString([]byte(account.ClientID + ":" + secret))
+	status, body = requestToken(api, url.Values{"grant_type": {"client_credentials"}}, "Authorization: Basic "+basic)
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, auth.ScopeUsersRead+" "+auth.ScopeProfileRead, body["scope"])
+	assert.Equal(t, http.StatusOK, api.Get("/me", "Authorization: Bearer "+body["access_token"].(string)).Code)
+
+	// OAuth2 errors
+	status, body = requestToken(api, url.Values{"grant_type": {"client_credentials"}, "client_id": {account.ClientID}, "client_secret": {"wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "invalid_client", body["error"])
+	status, body = requestToken(api, url.Values{"grant_type": {"password"}, "client_id": {account.ClientID}, "client_secret": {secret}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "unsupported_grant_type", body["error"])
+	status, body = requestToken(api, url.Values{"grant_type": {"client_credentials"}, "client_id": {account.ClientID}, "client_secret": {secret}, "scope": {auth.ScopeUsersWrite}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_scope", body["error"])
+
+	// Deactivated accounts get no tokens
+	require.NoError(t, db.Model(&database.User{}).Where("id = ?", account.ID).Update("disabled_at", time.Now()).Error)
+	status, body = requestToken(api, url.Values{"grant_type": {"client_credentials"}, "client_id": {account.ClientID}, "client_secret": {secret}})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "invalid_client", body["error"])
+	require.NoError(t, db.Model(&database.User{}).Where("id = ?", account.ID).Update("disabled_at", nil).Error)
+
+	// Revoking the key ends its tokens
+	var keys handlers.ListKeysOutput
+	resp := api.Get(fmt.Sprintf("/admin/service-accounts/%d/keys", account.ID), adminAuth)
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &keys.Body))
+	require.Len(t, keys.Body.Keys, 1)
+	require.Equal(t, http.StatusNoContent, api.Delete(fmt.Sprintf("/admin/service-accounts/%d/keys/%d", account.ID, keys.Body.Keys[0].ID), adminAuth).Code)
+	assert.Equal(t, http.StatusUnauthorized, api.Get("/admin/users", tokenAuth).Code)
+}
+
+func TestClientCredentialsSessions(t *testing.T) {
+	db, api, adminAuth := setupServiceAccountTest(t)
+	account := createServiceAccount(t, api, adminAuth, map[string]any{"name": "Bot", "role": "admin"})
+	secret := createServiceAccountKey(t, api, adminAuth, account.ID, auth.ScopeUsersRead)
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {account.ClientID}, "client_secret": {secret}}
+
+	// The client ID has a column of its own; the email is only a placeholder
+	var user database.User
+	require.NoError(t, db.First(&user, account.ID).Error)
+	require.NotNil(t, user.ClientID)
+	assert.Equal(t, account.ClientID, *user.ClientID)
+	assert.NotEqual(t, account.ClientID, user.Email)
+
+	// Tokens for the same key share a session
+	for range 3 {
+		status, body := requestToken(api, form)
+		require.Equal(t, http.StatusOK, status, body)
+		assert.Equal(t, http.StatusOK, api.Get("/admin/users", "Authorization: Bearer "+body["access_token"].(string)).Code)
+	}
+	var sessions int64
+	db.Model(&database.Session{}).Where("user_id = ?", account.ID).Count(&sessions)
+	assert.Equal(t, int64(1), sessions)
+
+	// Expired sessions and their refresh tokens are deleted when new ones start
+	stale := database.Session{UserID: account.ID, ExpiresAt: time.Now().Add(-time.Minute)}
+	require.NoError(t, db.Create(&stale).Error)
+	require.NoError(t, db.Create(&database.RefreshToken{SessionID: stale.ID, TokenHash: "stale", ExpiresAt: stale.ExpiresAt}).Error)
+	require.NoError(t, db.Model(&database.Session{}).Where("id <> ?", stale.ID).Update("expires_at", time.Now().Add(-time.Second)).Error)
+	status, body := requestToken(api, form)
+	require.Equal(t, http.StatusOK, status, body)
+	db.Unscoped().Model(&database.Session{}).Where("user_id = ?", account.ID).Count(&sessions)
+	assert.Equal(t, int64(1), sessions)
+	var tokens int64
+	db.Unscoped().Model(&database.RefreshToken{}).Where("session_id = ?", stale.ID).Count(&tokens)
+	assert.Zero(t, tokens)
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"gorm.io/gorm"
+)
+
+// SessionInfo represents an active login session.
+type SessionInfo struct {
+	ID         uint      `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current" doc:"Whether this is the session making the request"`
+}
+
+// ListSessionsOutput represents the list of the current user's sessions.
+type ListSessionsOutput struct {
+	Body struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+}
+
+// RevokeAllSessionsInput represents the request to sign out everywhere.
+type RevokeAllSessionsInput struct {
+	KeepCurrent bool `query:"keep_current" default:"false" doc:"Keep the session making the request signed in"`
+}
+
+// RegisterSessions registers the session management endpoints.
+func RegisterSessions(api huma.API, db *gorm.DB) {
+	// GET /api/me/sessions - List active sessions
+	huma.Register(api, huma.Operation{
+		OperationID: "list-sessions",
+		Method:      http.MethodGet,
+		Path:        "/me/sessions",
+		Summary:     "List sessions",
+		Description: "Returns the current user's active login sessions.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+	}, func(ctx context.Context, input *struct{}) (*ListSessionsOutput, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var sessions []database.Session
+		if err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+			Order("last_used_at DESC").Find(&sessions).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to fetch sessions", err)
+		}
+
+		current := middleware.GetSessionID(ctx)
+		resp := &ListSessionsOutput{}
+		resp.Body.Sessions = make([]SessionInfo, len(sessions))
+		for i, s := range sessions {
+			resp.Body.Sessions[i] = SessionInfo{
+				ID:         s.ID,
+				UserAgent:  s.UserAgent,
+				IPAddress:  s.IPAddress,
+				CreatedAt:  s.CreatedAt,
+				LastUsedAt: s.LastUsedAt,
+				ExpiresAt:  s.ExpiresAt,
+				Current:    s.ID == current,
+			}
+		}
+		return resp, nil
+	})
+
+	// DELETE /api/me/sessions/:id - Revoke a single session
+	huma.Register(api, huma.Operation{
+		OperationID: "revoke-session",
+		Method:      http.MethodDelete,
+		Path:        "/me/sessions/{id}",
+		Summary:     "Revoke session",
+		Description: "Sign out a single session belonging to the current user.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+	}, func(ctx context.Context, input *struct {
+		ID uint `path:"id" doc:"Session ID"`
+	}) (*struct{}, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var session database.Session
+		if err := db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", input.ID, user.ID).First(&session).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, huma.Error404NotFound("session not found")
+			}
+			return nil, huma.Error500InternalServerError("failed to fetch session", err)
+		}
+
+		if err := auth.RevokeSession(db, session.ID); err != nil {
+			return nil, huma.Error500InternalServerError("failed to revoke session", err)
+		}
+		return nil, nil
+	})
+
+	// DELETE /api/me/sessions - Sign out everywhere
+	huma.Register(api, huma.Operation{
+		OperationID: "revoke-all-sessions",
+		Method:      http.MethodDelete,
+		Path:        "/me/sessions",
+		Summary:     "Sign out everywhere",
+		Description: "Revoke all of the current user's sessions, optionally keeping the one making the request.",
+		Tags:        []string{"User"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
+	}, func(ctx context.Context, input *RevokeAllSessionsInput) (*struct{}, error) {
+		user, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		query := db.Model(&database.Session{}).Where("user_id = ? AND revoked_at IS NULL", user.ID)
+		if current := middleware.GetSessionID(ctx); input.KeepCurrent && current != 0 {
+			query = query.Where("id != ?", current)
+		}
+		if err := query.Update("revoked_at", time.Now()).Error; err != nil {
+			return nil, huma.Error500InternalServerError("failed to revoke sessions", err)
+		}
+		return nil, nil
+	})
+}
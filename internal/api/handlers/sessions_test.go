@@ -0,0 +1,278 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/api/handlers"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/middleware"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func setupSessionsTest(t *testing.T) (humatest.TestAPI, *gorm.DB) {
+	db := openTestDB(t)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterAuth(api, db, testProviders(&MockProvider{}), nil)
+	handlers.RegisterUser(api, db)
+	handlers.RegisterSessions(api, db)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	db.Create(&database.User{Email: "session@example.com", Name: "Session User", PasswordHash: string(hash)})
+	return api, db
+}
+
+func login(t *testing.T, api humatest.TestAPI) tokenResponse {
+	t.Helper()
+	resp := api.Post("/auth/login", map[string]interface{}{
+		"email":    "session@example.com",
+		"password": "password123",
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var tokens tokenResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tokens))
+	assert.NotEmpty(t, tokens.Token)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	return tokens
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	api, _ := setupSessionsTest(t)
+	tokens := login(t, api)
+
+	resp := api.Post("/auth/refresh", map[string]interface{}{"refresh_token": tokens.RefreshToken})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var rotated tokenResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &rotated))
+	assert.NotEqual(t, tokens.RefreshToken, rotated.RefreshToken)
+	assert.Greater(t, rotated.ExpiresIn, 0)
+
+	// The new access token works
+	resp = api.Get("/me", "Authorization: Bearer "+rotated.Token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Unknown refresh tokens are rejected
+	resp = api.Post("/auth/refresh", map[string]interface{}{"refresh_token": "bogus"})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	api, _ := setupSessionsTest(t)
+	tokens := login(t, api)
+
+	resp := api.Post("/auth/refresh", map[string]interface{}{"refresh_token": tokens.RefreshToken})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var rotated tokenResponse
+	json.Unmarshal(resp.Body.Bytes(), &rotated)
+
+	// Replaying the first refresh token is detected as reuse
+	resp = api.Post("/auth/refresh", map[string]interface{}{"refresh_token": tokens.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// The whole family is gone: neither the rotated refresh token nor its access token work
+	resp = api.Post("/auth/refresh", map[string]interface{}{"refresh_token": rotated.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = api.Get("/me", "Authorization: Bearer "+rotated.Token)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), "session revoked")
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	api, _ := setupSessionsTest(t)
+	tokens := login(t, api)
+
+	resp := api.Post("/auth/logout", "Authorization: Bearer "+tokens.Token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	resp = api.Get("/me", "Authorization: Bearer "+tokens.Token)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = api.Post("/auth/refresh", map[string]interface{}{"refresh_token": tokens.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Logging out with a refresh token works without an access token
+	tokens = login(t, api)
+	resp = api.Post("/auth/logout", map[string]interface{}{"refresh_token": tokens.RefreshToken})
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Get("/me", "Authorization: Bearer "+tokens.Token)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+// sessionCookies returns the cookies a response set, by name.
+func sessionCookies(resp *httptest.ResponseRecorder) map[string]*http.Cookie {
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range resp.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	return cookies
+}
+
+func TestSessionCookies(t *testing.T) {
+	auth.SetSessionCookies(true)
+	t.Cleanup(func() { auth.SetSessionCookies(false) })
+	api, _ := setupSessionsTest(t)
+
+	resp := api.Post("/auth/login", map[string]interface{}{
+		"email":    "session@example.com",
+		"password": "password123",
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// API clients still get the tokens in the body
+	var tokens tokenResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tokens))
+	assert.NotEmpty(t, tokens.Token)
+
+	cookies := sessionCookies(resp)
+	session, refresh, csrf := cookies[auth.SessionCookie], cookies[auth.RefreshCookie], cookies[auth.CSRFCookie]
+	if !assert.NotNil(t, session) || !assert.NotNil(t, refresh) || !assert.NotNil(t, csrf) {
+		return
+	}
+	assert.Equal(t, tokens.Token, session.Value)
+	assert.True(t, session.HttpOnly)
+	assert.True(t, refresh.HttpOnly)
+	assert.False(t, csrf.HttpOnly, "scripts must be able to read the CSRF token")
+	assert.Equal(t, http.SameSiteStrictMode, session.SameSite)
+	assert.False(t, session.Secure, "plain HTTP requests get non-Secure cookies")
+
+	cookieHeader := fmt.Sprintf("Cookie: %s=%s; %s=%s; %s=%s",
+		auth.SessionCookie, session.Value, auth.RefreshCookie, refresh.Value, auth.CSRFCookie, csrf.Value)
+	csrfHeader := auth.CSRFHeader + ": " + csrf.Value
+
+	// The session cookie authenticates safe requests on its own
+	resp = api.Get("/me", cookieHeader)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Unsafe requests must echo the CSRF cookie
+	resp = api.Put("/me", cookieHeader, map[string]interface{}{"name": "Renamed"})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "CSRF")
+	resp = api.Put("/me", cookieHeader, auth.CSRFHeader+": wrong", map[string]interface{}{"name": "Renamed"})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Put("/me", cookieHeader, csrfHeader, map[string]interface{}{"name": "Renamed"})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Bearer tokens need no CSRF token
+	resp = api.Put("/me", "Authorization: Bearer "+tokens.Token, map[string]interface{}{"name": "Bearer"})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// The refresh cookie rotates the session, with the CSRF token
+	resp = api.Post("/auth/refresh", cookieHeader)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Post("/auth/refresh", cookieHeader, csrfHeader)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	rotated := sessionCookies(resp)
+	if !assert.NotNil(t, rotated[auth.RefreshCookie]) || !assert.NotNil(t, rotated[auth.CSRFCookie]) {
+		return
+	}
+	assert.NotEqual(t, refresh.Value, rotated[auth.RefreshCookie].Value)
+
+	cookieHeader = fmt.Sprintf("Cookie: %s=%s; %s=%s; %s=%s",
+		auth.SessionCookie, rotated[auth.SessionCookie].Value, auth.RefreshCookie, rotated[auth.RefreshCookie].Value,
+		auth.CSRFCookie, rotated[auth.CSRFCookie].Value)
+	csrfHeader = auth.CSRFHeader + ": " + rotated[auth.CSRFCookie].Value
+
+	// Logging out ends the session and clears the cookies
+	resp = api.Post("/auth/logout", cookieHeader, csrfHeader)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	for _, name := range []string{auth.SessionCookie, auth.RefreshCookie, auth.CSRFCookie} {
+		if cleared := sessionCookies(resp)[name]; assert.NotNil(t, cleared, name) {
+			assert.Less(t, cleared.MaxAge, 0, name)
+		}
+	}
+	resp = api.Get("/me", cookieHeader)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestSessionCookiesDisabled(t *testing.T) {
+	api, _ := setupSessionsTest(t)
+	tokens := login(t, api)
+
+	resp := api.Post("/auth/login", map[string]interface{}{
+		"email":    "session@example.com",
+		"password": "password123",
+	})
+	assert.Empty(t, resp.Result().Cookies())
+
+	// The cookie is ignored when cookie sessions are off
+	resp = api.Get("/me", fmt.Sprintf("Cookie: %s=%s", auth.SessionCookie, tokens.Token))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = api.Post("/auth/refresh", fmt.Sprintf("Cookie: %s=%s", auth.RefreshCookie, tokens.RefreshToken))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	api, _ := setupSessionsTest(t)
+	first := login(t, api)
+	second := login(t, api)
+
+	resp := api.Get("/me/sessions", "Authorization: Bearer "+first.Token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var list struct {
+		Sessions []handlers.SessionInfo `json:"sessions"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	assert.Len(t, list.Sessions, 2)
+
+	// Revoke the second session from the first
+	var other uint
+	for _, s := range list.Sessions {
+		if !s.Current {
+			other = s.ID
+		}
+	}
+	resp = api.Delete(fmt.Sprintf("/me/sessions/%d", other), "Authorization: Bearer "+first.Token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Get("/me", "Authorization: Bearer "+second.Token)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Sign out everywhere, keeping the current session
+	third := login(t, api)
+	resp = api.Delete("/me/sessions?keep_current=true", "Authorization: Bearer "+first.Token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Get("/me", "Authorization: Bearer "+third.Token)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = api.Get("/me", "Authorization: Bearer "+first.Token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Sign out everywhere
+	resp = api.Delete("/me/sessions", "Authorization: Bearer "+first.Token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = api.Get("/me", "Authorization: Bearer "+first.Token)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestDeactivatedUsersCannotSignInOrRefresh(t *testing.T) {
+	api, db := setupSessionsTest(t)
+	tokens := login(t, api)
+	require.NoError(t, db.Model(&database.User{}).Where("email = ?", "session@example.com").Update("disabled_at", time.Now()).Error)
+
+	resp := api.Post("/auth/login", map[string]interface{}{"email": "session@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = api.Post("/auth/refresh", map[string]interface{}{"refresh_token": tokens.RefreshToken})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Sessions are refused below the handlers too
+	var user database.User
+	require.NoError(t, db.Where("email = ?", "session@example.com").First(&user).Error)
+	_, err := auth.CreateSession(db, user.ID, auth.SessionMeta{})
+	assert.ErrorIs(t, err, auth.ErrAccountDisabled)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
 	"golang.org/x/crypto/bcrypt"
@@ -14,14 +15,23 @@ import (
 // UserOutput represents the response for user info.
 type UserOutput struct {
 	Body struct {
-		ID          uint   `json:"id"`
-		Email       string `json:"email"`
-		Name        string `json:"name"`
-		Role        string `json:"role"`
-		HasPassword bool   `json:"has_password" doc:"Whether user has a password set (false for OIDC-only users)"`
+		ID           uint              `json:"id"`
+		Email        string            `json:"email"`
+		Name         string            `json:"name"`
+		Role         string            `json:"role"`
+		HasPassword  bool              `json:"has_password" doc:"Whether user has a password set (false for OIDC-only users)"`
+		Permissions  []string          `json:"permissions,omitempty" doc:"Permissions granted by the user's role"`
+		Impersonator *ImpersonatorInfo `json:"impersonator,omitempty" doc:"Admin acting as the user, when impersonating"`
 	}
 }
 
+// ImpersonatorInfo identifies the admin behind an impersonated request.
+type ImpersonatorInfo struct {
+	ID    uint   `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
 // UpdateProfileInput represents the request to update profile.
 type UpdateProfileInput struct {
 	Body struct {
@@ -46,10 +56,11 @@ func RegisterUser(api huma.API, db *gorm.DB) {
 		Method:      http.MethodGet,
 		Path:        "/me",
 		Summary:     "Get current user info",
-		Description: "Returns the authenticated user's information including role.",
+		Description: "Returns the authenticated user's information including role and permissions.",
 		Tags:        []string{"User"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeProfileRead}},
 		},
 	}, func(ctx context.Context, input *struct{}) (*UserOutput, error) {
 		user, err := middleware.RequireAuth(ctx)
@@ -63,6 +74,10 @@ func RegisterUser(api huma.API, db *gorm.DB) {
 		resp.Body.Name = user.Name
 		resp.Body.Role = user.Role
 		resp.Body.HasPassword = user.PasswordHash != ""
+		resp.Body.Permissions = auth.ExpandPermissions(middleware.GetPermissions(ctx))
+		if impersonator := middleware.GetImpersonator(ctx); impersonator != nil {
+			resp.Body.Impersonator = &ImpersonatorInfo{ID: impersonator.ID, Email: impersonator.Email, Name: impersonator.Name}
+		}
 		return resp, nil
 	})
 
@@ -76,7 +91,9 @@ func RegisterUser(api huma.API, db *gorm.DB) {
 		Tags:        []string{"User"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeProfileWrite}},
 		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
 	}, func(ctx context.Context, input *UpdateProfileInput) (*UserOutput, error) {
 		user, err := middleware.RequireAuth(ctx)
 		if err != nil {
@@ -119,6 +136,7 @@ func RegisterUser(api huma.API, db *gorm.DB) {
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
 		},
+		Extensions: map[string]any{middleware.SensitiveExtension: true},
 	}, func(ctx context.Context, input *ChangePasswordInput) (*struct{}, error) {
 		user, err := middleware.RequireAuth(ctx)
 		if err != nil {
@@ -3,9 +3,11 @@ package handlers
 import (
 	"context"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
 	"gorm.io/gorm"
@@ -13,11 +15,13 @@ import (
 
 // UserInfo represents user data for admin listing.
 type UserInfo struct {
-	ID        uint      `json:"id"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         uint       `json:"id"`
+	Email      string     `json:"email"`
+	Name       string     `json:"name"`
+	Role       string     `json:"role"`
+	RoleLocked bool       `json:"role_locked" doc:"Whether identity provider claims and groups are kept from changing the role"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty" doc:"Set while the account is deactivated"`
+	CreatedAt  time.Time  `json:"created_at"`
 }
 
 // ListUsersOutput represents the paginated user list response.
@@ -32,7 +36,8 @@ type ListUsersOutput struct {
 type UpdateUserRoleInput struct {
 	ID   uint `path:"id" doc:"User ID"`
 	Body struct {
-		Role string `json:"role" enum:"admin,user" required:"true" doc:"New role for the user"`
+		Role       string `json:"role" required:"true" doc:"Name of the new role for the user, e.g. admin or user"`
+		RoleLocked *bool  `json:"role_locked,omitempty" doc:"Keep identity provider claims and groups from changing the role. Unchanged when omitted."`
 	}
 }
 
@@ -41,37 +46,102 @@ type DeleteUserInput struct {
 	ID uint `path:"id" doc:"User ID"`
 }
 
+// ImpersonateUserInput represents the request to impersonate a user.
+type ImpersonateUserInput struct {
+	ID uint `path:"id" doc:"User ID"`
+}
+
+// ImpersonateUserOutput represents the response to impersonating a user.
+type ImpersonateUserOutput struct {
+	Body struct {
+		Token     string   `json:"token" doc:"Access token acting as the user; it cannot be refreshed"`
+		ExpiresIn int      `json:"expires_in" doc:"Access token lifetime in seconds"`
+		User      UserInfo `json:"user"`
+	}
+}
+
+// isAdminRole reports whether the named role grants admin permissions.
+func isAdminRole(db *gorm.DB, name string) bool {
+	return auth.IsAdmin(auth.RolePermissions(db, name))
+}
+
+// countActiveAdmins returns how many people can still sign in with a role
+// that grants admin permissions.
+func countActiveAdmins(db *gorm.DB) int64 {
+	var roles []database.Role
+	if err := db.Find(&roles).Error; err != nil {
+		return 0
+	}
+	var adminRoles []string
+	for _, role := range roles {
+		if auth.IsAdmin(auth.ParseScopes(role.Permissions)) {
+			adminRoles = append(adminRoles, role.Name)
+		}
+	}
+	if len(adminRoles) == 0 {
+		return 0
+	}
+
+	var admins int64
+	db.Model(&database.User{}).
+		Where("role IN ? AND service_account = ? AND disabled_at IS NULL", adminRoles, false).
+		Count(&admins)
+	return admins
+}
+
+// deleteUser deletes a user with their API keys, identities, passkeys,
+// memberships and sessions.
+func deleteUser(db *gorm.DB, user *database.User) error {
+	if err := db.Delete(&database.APIKey{}, "user_id = ?", user.ID).Error; err != nil {
+		return huma.Error500InternalServerError("failed to delete user API keys", err)
+	}
+	if err := db.Unscoped().Delete(&database.Identity{}, "user_id = ?", user.ID).Error; err != nil {
+		return huma.Error500InternalServerError("failed to delete user identities", err)
+	}
+	if err := db.Unscoped().Delete(&database.Passkey{}, "user_id = ?", user.ID).Error; err != nil {
+		return huma.Error500InternalServerError("failed to delete user passkeys", err)
+	}
+	if err := db.Unscoped().Delete(&database.Membership{}, "user_id = ?", user.ID).Error; err != nil {
+		return huma.Error500InternalServerError("failed to delete user memberships", err)
+	}
+	if err := auth.RevokeUserSessions(db, user.ID); err != nil {
+		return huma.Error500InternalServerError("failed to revoke user sessions", err)
+	}
+	if err := db.Delete(user).Error; err != nil {
+		return huma.Error500InternalServerError("failed to delete user", err)
+	}
+	return nil
+}
+
 // RegisterUsers registers admin user management endpoints.
 func RegisterUsers(api huma.API, db *gorm.DB) {
-	// GET /api/admin/users - List all users (admin-only)
+	// GET /api/admin/users - List all users (users:read)
 	huma.Register(api, huma.Operation{
 		OperationID: "list-users",
 		Method:      http.MethodGet,
 		Path:        "/admin/users",
 		Summary:     "List all users",
-		Description: "Returns a list of all users. Requires admin role.",
+		Description: "Returns a list of all users. Service accounts are listed separately. Requires the users:read permission.",
 		Tags:        []string{"Admin"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersRead}},
 		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersRead},
 	}, func(ctx context.Context, input *struct {
 		Search string `query:"search" doc:"Search by email or name"`
 		Limit  int    `query:"limit" default:"50" doc:"Maximum number of users to return"`
 		Offset int    `query:"offset" default:"0" doc:"Offset for pagination"`
 	}) (*ListUsersOutput, error) {
-		if _, err := middleware.RequireAdmin(ctx); err != nil {
-			return nil, err
-		}
-
 		var users []database.User
 		var total int64
 
-		query := db.Model(&database.User{})
+		query := database.Replica(db).Model(&database.User{}).Where("service_account = ?", false)
 
-		// Apply search filter
+		// Apply search filter, case-insensitive on every database
 		if input.Search != "" {
-			searchPattern := "%" + input.Search + "%"
-			query = query.Where("email LIKE ? OR name LIKE ?", searchPattern, searchPattern)
+			searchPattern := "%" + database.EscapeLike(strings.ToLower(input.Search)) + "%"
+			query = query.Where(database.Like("LOWER(email)")+" OR "+database.Like("LOWER(name)"), searchPattern, searchPattern)
 		}
 
 		// Get total count
@@ -86,11 +156,13 @@ func RegisterUsers(api huma.API, db *gorm.DB) {
 		userInfos := make([]UserInfo, len(users))
 		for i, u := range users {
 			userInfos[i] = UserInfo{
-				ID:        u.ID,
-				Email:     u.Email,
-				Name:      u.Name,
-				Role:      u.Role,
-				CreatedAt: u.CreatedAt,
+				ID:         u.ID,
+				Email:      u.Email,
+				Name:       u.Name,
+				Role:       u.Role,
+				RoleLocked: u.RoleLocked,
+				DisabledAt: u.DisabledAt,
+				CreatedAt:  u.CreatedAt,
 			}
 		}
 
@@ -100,37 +172,54 @@ func RegisterUsers(api huma.API, db *gorm.DB) {
 		return resp, nil
 	})
 
-	// PUT /api/admin/users/:id - Update user role (admin-only)
+	// PUT /api/admin/users/:id - Update user role (users:write)
 	huma.Register(api, huma.Operation{
 		OperationID: "update-user-role",
 		Method:      http.MethodPut,
 		Path:        "/admin/users/{id}",
 		Summary:     "Update user role",
-		Description: "Update a user's role. Requires admin role. Cannot demote the last admin.",
+		Description: "Update a user's role, and optionally lock it against identity provider sync. Requires the users:write permission. Cannot assign a role with permissions you do not have, or demote the last admin.",
 		Tags:        []string{"Admin"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
 		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
 	}, func(ctx context.Context, input *UpdateUserRoleInput) (*UserOutput, error) {
-		admin, err := middleware.RequireAdmin(ctx)
+		admin, err := middleware.RequireAuth(ctx)
 		if err != nil {
 			return nil, err
 		}
 
 		// Find the user to update
 		var user database.User
-		if err := db.First(&user, input.ID).Error; err != nil {
+		if err := db.Where("service_account = ?", false).First(&user, input.ID).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				return nil, huma.Error404NotFound("user not found")
 			}
 			return nil, huma.Error500InternalServerError("failed to fetch user", err)
 		}
 
+		// Only roles that exist can be assigned
+		var role database.Role
+		if err := db.Where("name = ?", input.Body.Role).First(&role).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, huma.Error400BadRequest("unknown role")
+			}
+			return nil, huma.Error500InternalServerError("failed to fetch role", err)
+		}
+
+		// Prevent granting, or taking away, more than the caller holds
+		if err := requireRoleWithin(ctx, db, user.Role); err != nil {
+			return nil, err
+		}
+		if err := requireRoleWithin(ctx, db, role.Name); err != nil {
+			return nil, err
+		}
+
 		// Prevent demoting the last admin
-		if user.Role == database.RoleAdmin && input.Body.Role == database.RoleUser {
-			var adminCount int64
-			db.Model(&database.User{}).Where("role = ?", database.RoleAdmin).Count(&adminCount)
-			if adminCount <= 1 {
+		if user.DisabledAt == nil && isAdminRole(db, user.Role) && !isAdminRole(db, input.Body.Role) {
+			if countActiveAdmins(db) <= 1 {
 				return nil, huma.Error400BadRequest("cannot demote the last admin")
 			}
 		}
@@ -141,10 +230,29 @@ func RegisterUsers(api huma.API, db *gorm.DB) {
 		}
 
 		// Update role
+		before := map[string]any{"role": user.Role, "role_locked": user.RoleLocked}
+		roleChanged := user.Role != input.Body.Role
 		user.Role = input.Body.Role
+		if input.Body.RoleLocked != nil {
+			user.RoleLocked = *input.Body.RoleLocked
+		}
 		if err := db.Save(&user).Error; err != nil {
 			return nil, huma.Error500InternalServerError("failed to update user", err)
 		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditUserRoleUpdate,
+			TargetType: "user",
+			TargetID:   auditID(user.ID),
+			Before:     before,
+			After:      map[string]any{"role": user.Role, "role_locked": user.RoleLocked},
+		})
+
+		// Sign the user out so the new role applies to fresh sessions only
+		if roleChanged {
+			if err := auth.RevokeUserSessions(db, user.ID); err != nil {
+				return nil, huma.Error500InternalServerError("failed to revoke user sessions", err)
+			}
+		}
 
 		resp := &UserOutput{}
 		resp.Body.ID = user.ID
@@ -154,19 +262,21 @@ func RegisterUsers(api huma.API, db *gorm.DB) {
 		return resp, nil
 	})
 
-	// DELETE /api/admin/users/:id - Delete user (admin-only)
+	// DELETE /api/admin/users/:id - Delete user (users:write)
 	huma.Register(api, huma.Operation{
 		OperationID: "delete-user",
 		Method:      http.MethodDelete,
 		Path:        "/admin/users/{id}",
 		Summary:     "Delete user",
-		Description: "Delete a user. Requires admin role. Cannot delete yourself.",
+		Description: "Delete a user. Requires the users:write permission. Cannot delete yourself.",
 		Tags:        []string{"Admin"},
 		Security: []map[string][]string{
 			{"bearerAuth": {}},
+			{"apiKey": {auth.ScopeUsersWrite}},
 		},
+		Extensions: map[string]any{middleware.PermissionExtension: auth.PermissionUsersWrite},
 	}, func(ctx context.Context, input *DeleteUserInput) (*struct{}, error) {
-		admin, err := middleware.RequireAdmin(ctx)
+		admin, err := middleware.RequireAuth(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -178,30 +288,97 @@ func RegisterUsers(api huma.API, db *gorm.DB) {
 
 		// Check if user exists
 		var user database.User
-		if err := db.First(&user, input.ID).Error; err != nil {
+		if err := db.Where("service_account = ?", false).First(&user, input.ID).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				return nil, huma.Error404NotFound("user not found")
 			}
 			return nil, huma.Error500InternalServerError("failed to fetch user", err)
 		}
 
+		// Prevent deleting users who hold more than the caller
+		if err := requireRoleWithin(ctx, db, user.Role); err != nil {
+			return nil, err
+		}
+
 		// Prevent deleting the last admin
-		if user.Role == database.RoleAdmin {
-			var adminCount int64
-			db.Model(&database.User{}).Where("role = ?", database.RoleAdmin).Count(&adminCount)
-			if adminCount <= 1 {
+		if user.DisabledAt == nil && isAdminRole(db, user.Role) {
+			if countActiveAdmins(db) <= 1 {
 				return nil, huma.Error400BadRequest("cannot delete the last admin")
 			}
 		}
 
-		// Delete user and their API keys
-		if err := db.Delete(&database.APIKey{}, "user_id = ?", input.ID).Error; err != nil {
-			return nil, huma.Error500InternalServerError("failed to delete user API keys", err)
-		}
-		if err := db.Delete(&user).Error; err != nil {
-			return nil, huma.Error500InternalServerError("failed to delete user", err)
+		if err := deleteUser(db, &user); err != nil {
+			return nil, err
 		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditUserDelete,
+			TargetType: "user",
+			TargetID:   auditID(user.ID),
+			Before:     UserInfo{ID: user.ID, Email: user.Email, Name: user.Name, Role: user.Role, CreatedAt: user.CreatedAt},
+		})
 
 		return nil, nil
 	})
+
+	// POST /api/admin/users/:id/impersonate - Act as a user (users:impersonate)
+	huma.Register(api, huma.Operation{
+		OperationID: "impersonate-user",
+		Method:      http.MethodPost,
+		Path:        "/admin/users/{id}/impersonate",
+		Summary:     "Impersonate user",
+		Description: "Issue a short-lived access token that acts as the user, to see the app as they do. The token records who is impersonating, every request made with it is audited, and credential changes such as password changes and API key creation are refused. Users who can impersonate others, such as admins, cannot be impersonated. Requires the users:impersonate permission.",
+		Tags:        []string{"Admin"},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Extensions: map[string]any{
+			middleware.PermissionExtension: auth.PermissionUsersImpersonate,
+			middleware.SensitiveExtension:  true,
+		},
+	}, func(ctx context.Context, input *ImpersonateUserInput) (*ImpersonateUserOutput, error) {
+		admin, err := middleware.RequireAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if admin.ID == input.ID {
+			return nil, huma.Error400BadRequest("cannot impersonate yourself")
+		}
+
+		var user database.User
+		if err := db.Where("service_account = ?", false).First(&user, input.ID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, huma.Error404NotFound("user not found")
+			}
+			return nil, huma.Error500InternalServerError("failed to fetch user", err)
+		}
+
+		// Prevent acting as admins, or as anyone holding more than the caller
+		if auth.HasPermission(auth.RolePermissions(db, user.Role), auth.PermissionUsersImpersonate) {
+			return nil, huma.Error403Forbidden("cannot impersonate users who can impersonate others")
+		}
+		if err := requireRoleWithin(ctx, db, user.Role); err != nil {
+			return nil, err
+		}
+
+		client := middleware.GetClientInfo(ctx)
+		pair, err := auth.StartImpersonation(db, admin.ID, user.ID, auth.SessionMeta{
+			UserAgent: client.UserAgent,
+			IPAddress: client.IPAddress,
+		})
+		if err != nil {
+			return nil, huma.Error500InternalServerError("failed to start impersonation", err)
+		}
+		recordAudit(ctx, db, auditEntry{
+			Action:     auditImpersonationStart,
+			TargetType: "user",
+			TargetID:   auditID(user.ID),
+			Details:    map[string]any{"session_id": pair.SessionID},
+		})
+
+		resp := &ImpersonateUserOutput{}
+		resp.Body.Token = pair.AccessToken
+		resp.Body.ExpiresIn = pair.ExpiresIn
+		resp.Body.User = UserInfo{ID: user.ID, Email: user.Email, Name: user.Name, Role: user.Role, CreatedAt: user.CreatedAt}
+		return resp, nil
+	})
 }
@@ -1,7 +1,9 @@
 package handlers_test
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"testing"
 
 	"github.com/danielgtaylor/huma/v2/humatest"
@@ -10,17 +12,11 @@ import (
 	"github.com/techsquidtv/inkling/internal/auth"
 	"github.com/techsquidtv/inkling/internal/database"
 	"github.com/techsquidtv/inkling/internal/middleware"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 func setupUsersTestDB(t *testing.T) *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	if err != nil {
-		t.Fatalf("failed to open database: %v", err)
-	}
-	db.AutoMigrate(&database.User{}, &database.APIKey{}, &database.AppSettings{})
-	return db
+	return openTestDB(t)
 }
 
 func TestListUsers(t *testing.T) {
@@ -40,7 +36,7 @@ func TestListUsers(t *testing.T) {
 	handlers.RegisterUsers(api, db)
 
 	// Generate admin token
-	adminToken, _ := auth.GenerateJWT(admin.ID)
+	adminToken := issueToken(t, db, admin.ID)
 
 	// Test: Admin can list users
 	resp := api.Get("/admin/users", "Authorization: Bearer "+adminToken)
@@ -51,6 +47,40 @@ func TestListUsers(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.Code)
 }
 
+func TestListUsersSearch(t *testing.T) {
+	db := setupUsersTestDB(t)
+	_, api := humatest.New(t)
+
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	db.Create(&database.User{Email: "alice@example.com", Name: "Alice Liddell", Role: database.RoleUser})
+	db.Create(&database.User{Email: "bob_smith@example.com", Name: "Bob", Role: database.RoleUser})
+	db.Create(&database.User{Email: "bobxsmith@example.com", Name: "Bobby", Role: database.RoleUser})
+
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterUsers(api, db)
+	adminToken := issueToken(t, db, admin.ID)
+
+	search := func(term string) []string {
+		t.Helper()
+		resp := api.Get("/admin/users?search="+url.QueryEscape(term), "Authorization: Bearer "+adminToken)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		var out handlers.ListUsersOutput
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out.Body))
+		emails := []string{}
+		for _, user := range out.Body.Users {
+			emails = append(emails, user.Email)
+		}
+		return emails
+	}
+
+	// Case-insensitive on every database
+	assert.Equal(t, []string{"alice@example.com"}, search("LIDDELL"))
+	// Wildcards in the search term are matched literally
+	assert.Equal(t, []string{"bob_smith@example.com"}, search("bob_"))
+	assert.Empty(t, search("%"))
+}
+
 func TestListUsersUnauthorized(t *testing.T) {
 	db := setupUsersTestDB(t)
 	_, api := humatest.New(t)
@@ -64,7 +94,7 @@ func TestListUsersUnauthorized(t *testing.T) {
 	handlers.RegisterUsers(api, db)
 
 	// Generate user token
-	userToken, _ := auth.GenerateJWT(user.ID)
+	userToken := issueToken(t, db, user.ID)
 
 	// Test: Non-admin cannot list users
 	resp := api.Get("/admin/users", "Authorization: Bearer "+userToken)
@@ -86,7 +116,7 @@ func TestUpdateUserRole(t *testing.T) {
 	handlers.RegisterUsers(api, db)
 
 	// Generate admin token
-	adminToken, _ := auth.GenerateJWT(admin.ID)
+	adminToken := issueToken(t, db, admin.ID)
 
 	// Test: Admin can promote user to admin
 	resp := api.Put("/admin/users/"+string(rune(user.ID+'0')), map[string]interface{}{
@@ -121,7 +151,7 @@ func TestCannotDemoteLastAdmin(t *testing.T) {
 	handlers.RegisterUsers(api, db)
 
 	// Generate admin2 token
-	admin2Token, _ := auth.GenerateJWT(admin2.ID)
+	admin2Token := issueToken(t, db, admin2.ID)
 
 	// Demote admin1 (should succeed since there are 2 admins)
 	resp := api.Put("/admin/users/1", map[string]interface{}{
@@ -137,6 +167,43 @@ func TestCannotDemoteLastAdmin(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, resp.Code)
 }
 
+func TestLastAdminCountsCustomAdminRoles(t *testing.T) {
+	db := setupUsersTestDB(t)
+	_, api := humatest.New(t)
+
+	db.Create(&database.Role{Name: "superuser", Permissions: `["*"]`})
+	admin := database.User{Email: "admin@example.com", Name: "Admin", Role: database.RoleAdmin}
+	db.Create(&admin)
+	superuser := database.User{Email: "super@example.com", Name: "Super", Role: "superuser"}
+	db.Create(&superuser)
+	robot := database.User{Email: "robot@example.com", Name: "Robot", Role: database.RoleAdmin, ServiceAccount: true}
+	db.Create(&robot)
+
+	api.UseMiddleware(middleware.NewAuthMiddleware(api, db))
+	handlers.RegisterUsers(api, db)
+	db.Create(&database.APIKey{
+		UserID:  robot.ID,
+		Name:    "robot",
+		Prefix:  "sk_robot",
+		KeyHash: auth.HashKey("sk_robot_key"),
+		Scopes:  auth.EncodeScopes([]string{auth.ScopeUsersWrite}),
+	})
+
+	// The custom role grants admin permissions, so the admin is not the last one
+	resp := api.Put("/admin/users/1", map[string]any{"role": "user"}, "X-API-Key: sk_robot_key")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// The service account does not count, so the custom role holder is the last admin
+	resp = api.Put("/admin/users/2", map[string]any{"role": "user"}, "X-API-Key: sk_robot_key")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = api.Delete("/admin/users/2", "X-API-Key: sk_robot_key")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Moving between admin roles is not a demotion
+	resp = api.Put("/admin/users/2", map[string]any{"role": database.RoleAdmin}, "X-API-Key: sk_robot_key")
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
 func TestDeleteUser(t *testing.T) {
 	db := setupUsersTestDB(t)
 	_, api := humatest.New(t)
@@ -152,7 +219,7 @@ func TestDeleteUser(t *testing.T) {
 	handlers.RegisterUsers(api, db)
 
 	// Generate admin token
-	adminToken, _ := auth.GenerateJWT(admin.ID)
+	adminToken := issueToken(t, db, admin.ID)
 
 	// Test: Admin can delete user
 	resp := api.Delete("/admin/users/2", "Authorization: Bearer "+adminToken)
@@ -177,7 +244,7 @@ func TestCannotDeleteSelf(t *testing.T) {
 	handlers.RegisterUsers(api, db)
 
 	// Generate admin token
-	adminToken, _ := auth.GenerateJWT(admin.ID)
+	adminToken := issueToken(t, db, admin.ID)
 
 	// Test: Admin cannot delete themselves
 	resp := api.Delete("/admin/users/1", "Authorization: Bearer "+adminToken)
@@ -199,14 +266,14 @@ func TestCannotDeleteLastAdmin(t *testing.T) {
 	handlers.RegisterUsers(api, db)
 
 	// Generate admin1 token
-	admin1Token, _ := auth.GenerateJWT(admin1.ID)
+	admin1Token := issueToken(t, db, admin1.ID)
 
 	// Delete admin2 (should succeed since there are 2 admins)
 	resp := api.Delete("/admin/users/2", "Authorization: Bearer "+admin1Token)
 	assert.Equal(t, http.StatusNoContent, resp.Code)
 
 	// Generate new token for admin1 (still works)
-	admin1Token, _ = auth.GenerateJWT(admin1.ID)
+	admin1Token = issueToken(t, db, admin1.ID)
 
 	// Now there's only one admin left, cannot delete
 	// But admin1 is trying to delete themselves which is also blocked
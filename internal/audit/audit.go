@@ -0,0 +1,106 @@
+// Package audit writes security-relevant actions to the audit log. Handlers
+// and middleware share it, so every event is built the same way.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"github.com/techsquidtv/inkling/internal/logging"
+	"gorm.io/gorm"
+)
+
+// Outcomes.
+const (
+	Success     = "success"
+	Failure     = "failure"
+	MFARequired = "mfa_required"
+)
+
+// Entry describes an action to record in the audit log.
+type Entry struct {
+	Action     string
+	Outcome    string         // Defaults to success
+	Actor      *database.User // Nil or unsaved for anonymous requests
+	TargetType string
+	TargetID   string
+	Before     any // State before the action; only fields that differ from After are kept
+	After      any
+	Details    map[string]any
+
+	// The client that made the request
+	IPAddress string
+	UserAgent string
+	RequestID string
+}
+
+// Change is the value of a field before and after an action.
+type Change struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// Record writes an audit event. Failures are logged rather than returned, so
+// a broken audit log never blocks the action itself.
+func Record(ctx context.Context, db *gorm.DB, entry Entry) {
+	event := database.AuditEvent{
+		Action:     entry.Action,
+		Outcome:    entry.Outcome,
+		TargetType: entry.TargetType,
+		TargetID:   entry.TargetID,
+		IPAddress:  entry.IPAddress,
+		UserAgent:  entry.UserAgent,
+		RequestID:  entry.RequestID,
+	}
+	if event.Outcome == "" {
+		event.Outcome = Success
+	}
+	if entry.Actor != nil && entry.Actor.ID != 0 {
+		event.ActorID = &entry.Actor.ID
+		event.ActorEmail = entry.Actor.Email
+	}
+
+	if changes := Diff(entry.Before, entry.After); len(changes) > 0 {
+		b, _ := json.Marshal(changes)
+		event.Changes = string(b)
+	}
+	if len(entry.Details) > 0 {
+		b, _ := json.Marshal(entry.Details)
+		event.Details = string(b)
+	}
+
+	if err := db.Create(&event).Error; err != nil {
+		logging.FromContext(ctx).Error("failed to write audit event", "action", entry.Action, logging.Error, err)
+	}
+}
+
+// Diff returns the top-level fields whose JSON encoding differs between
+// before and after. Either may be nil, e.g. for creations and deletions.
+func Diff(before, after any) map[string]Change {
+	b, a := fields(before), fields(after)
+	changes := map[string]Change{}
+	for key, value := range b {
+		if other, ok := a[key]; !ok || !reflect.DeepEqual(value, other) {
+			changes[key] = Change{Before: value, After: a[key]}
+		}
+	}
+	for key, value := range a {
+		if _, ok := b[key]; !ok {
+			changes[key] = Change{After: value}
+		}
+	}
+	return changes
+}
+
+func fields(v any) map[string]any {
+	fields := map[string]any{}
+	if v == nil {
+		return fields
+	}
+	if b, err := json.Marshal(v); err == nil {
+		json.Unmarshal(b, &fields)
+	}
+	return fields
+}
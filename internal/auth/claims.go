@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// OIDCRoleMapping gives a role to users whose ID token claim has a value.
+type OIDCRoleMapping struct {
+	Claim string `json:"claim" minLength:"1" doc:"Claim name, nested claims are separated by dots, e.g. realm_access.roles"`
+	Value string `json:"value" minLength:"1" doc:"Value the claim must equal or, for list claims, contain"`
+	Role  string `json:"role" minLength:"1"`
+}
+
+// OIDCRoleMappings are the claim to role mappings applied on every login
+// with the env-configured OIDC provider, in order. Stored providers have
+// mappings of their own.
+var OIDCRoleMappings = database.RegisterSetting(database.Setting[[]OIDCRoleMapping]{
+	Key:         "oidc_role_mappings",
+	Description: "Roles given to users of the env-configured OIDC provider by ID token claims on every login, the first match wins. Claims can only be mapped to roles whose permissions you have; an empty list stops its logins from changing roles.",
+	Default:     []OIDCRoleMapping{},
+})
+
+// OIDCDefaultRole is the role given to users of the env-configured OIDC
+// provider who match none of its mappings.
+var OIDCDefaultRole = database.RegisterSetting(database.Setting[string]{
+	Key:         "oidc_default_role",
+	Description: "Role given to users of the env-configured OIDC provider who match none of the oidc_role_mappings. When empty they keep their role.",
+})
+
+// ProviderRoleMappings returns the claim to role mappings of the provider
+// with the slug, and the role for users matching none of them: the settings
+// for the env-configured provider, or the stored provider's own.
+func ProviderRoleMappings(db *gorm.DB, slug string) ([]OIDCRoleMapping, string, error) {
+	if slug == database.DefaultOIDCProvider {
+		mappings, err := OIDCRoleMappings.Get(db)
+		if err != nil {
+			return nil, "", err
+		}
+		defaultRole, err := OIDCDefaultRole.Get(db)
+		return mappings, defaultRole, err
+	}
+
+	var record database.OIDCProviderConfig
+	err := db.Where("slug = ?", slug).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return ParseOIDCRoleMappings(&record), record.DefaultRole, nil
+}
+
+// ParseOIDCRoleMappings decodes the claim to role mappings of a stored
+// provider.
+func ParseOIDCRoleMappings(record *database.OIDCProviderConfig) []OIDCRoleMapping {
+	var mappings []OIDCRoleMapping
+	if record.RoleMappings != "" {
+		_ = json.Unmarshal([]byte(record.RoleMappings), &mappings)
+	}
+	return mappings
+}
+
+// EncodeOIDCRoleMappings encodes claim to role mappings for storage.
+func EncodeOIDCRoleMappings(mappings []OIDCRoleMapping) string {
+	if len(mappings) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(mappings)
+	return string(data)
+}
+
+// ClaimsRole returns the role of the first mapping the claims match, or the
+// default role when none does. It returns false when no mappings are
+// configured, in which case roles are not managed by the provider, and when
+// none matches and there is no default role, in which case the user keeps
+// their role.
+func ClaimsRole(mappings []OIDCRoleMapping, defaultRole string, claims map[string]any) (string, bool) {
+	if len(mappings) == 0 {
+		return "", false
+	}
+	for _, mapping := range mappings {
+		for _, value := range claimValues(claims, mapping.Claim) {
+			if value == mapping.Value {
+				return mapping.Role, true
+			}
+		}
+	}
+	return defaultRole, defaultRole != ""
+}
+
+// claimValues returns the values of a claim as strings. List claims such as
+// groups give one value per element.
+func claimValues(claims map[string]any, path string) []string {
+	var value any = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			values = append(values, fmt.Sprint(element))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidClient is returned when a client ID and secret do not match a
+	// service account key.
+	ErrInvalidClient = errors.New("invalid client credentials")
+	// ErrInvalidScope is returned when a client requests scopes its key lacks.
+	ErrInvalidScope = errors.New("requested scope exceeds the key's scopes")
+)
+
+// ServiceAccountClientIDPrefix starts every service account client ID.
+const ServiceAccountClientIDPrefix = "sa_"
+
+// serviceAccountEmailDomain holds the placeholder email addresses of service
+// accounts. The .invalid TLD is reserved, so no mail is ever delivered there.
+const serviceAccountEmailDomain = "service-accounts.invalid"
+
+// ServiceAccountEmail returns the placeholder email address of the service
+// account with the client ID. Users need a unique email; service accounts
+// are looked up by their client ID instead.
+func ServiceAccountEmail(clientID string) string {
+	return clientID + "@" + serviceAccountEmailDomain
+}
+
+// NewClientID generates a client ID for a new service account.
+func NewClientID() (string, error) {
+	id, err := randomToken(12)
+	if err != nil {
+		return "", err
+	}
+	return ServiceAccountClientIDPrefix + id, nil
+}
+
+// ParseScopeList splits a space-separated OAuth2 scope parameter.
+func ParseScopeList(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// ClientCredentialsGrant is the result of a client credentials exchange.
+type ClientCredentialsGrant struct {
+	AccessToken string
+	ExpiresIn   int // Access token lifetime in seconds
+	Scopes      []string
+	Account     *database.User
+	Key         *database.APIKey
+}
+
+// IssueClientCredentialsToken implements the OAuth2 client credentials grant.
+// The client secret is one of the service account's API keys, and the token
+// carries the requested scopes, or all of the key's scopes when scope is
+// empty. The token's session is tied to the key, so revoking the key ends it,
+// and there is no refresh token. Tokens for the same key share a session.
+func IssueClientCredentialsToken(db *gorm.DB, clientID, secret, scope string, meta SessionMeta) (*ClientCredentialsGrant, error) {
+	var account database.User
+	if err := db.Where("client_id = ? AND service_account = ?", clientID, true).First(&account).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidClient
+		}
+		return nil, err
+	}
+	var key database.APIKey
+	if err := db.Where("key_hash = ? AND user_id = ?", HashKey(secret), account.ID).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidClient
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, ErrInvalidClient
+	}
+	if account.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	scopes := ParseScopes(key.Scopes)
+	if requested := ParseScopeList(scope); len(requested) > 0 {
+		if !HasScopes(scopes, requested) {
+			return nil, ErrInvalidScope
+		}
+		scopes = requested
+	}
+
+	session, err := keySession(db, &account, &key, meta, now)
+	if err != nil {
+		return nil, err
+	}
+	db.Model(&key).Update("last_used", now)
+
+	claims := &Claims{UserID: account.ID, SessionID: session.ID, Scope: strings.Join(scopes, " ")}
+	token, err := signAccessToken(claims, AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientCredentialsGrant{
+		AccessToken: token,
+		ExpiresIn:   int(AccessTokenTTL.Seconds()),
+		Scopes:      scopes,
+		Account:     &account,
+		Key:         &key,
+	}, nil
+}
+
+// keySession returns the key's live session, extended to cover a new access
+// token, or starts one. Reusing it keeps clients that fetch a token per
+// request from piling up sessions.
+func keySession(db *gorm.DB, account *database.User, key *database.APIKey, meta SessionMeta, now time.Time) (*database.Session, error) {
+	var session database.Session
+	err := db.Where("user_id = ? AND api_key_id = ? AND revoked_at IS NULL AND expires_at > ?", account.ID, key.ID, now).
+		Order("id DESC").First(&session).Error
+	if err == nil {
+		err = db.Model(&session).Updates(map[string]any{
+			"user_agent":   meta.UserAgent,
+			"ip_address":   meta.IPAddress,
+			"last_used_at": now,
+			"expires_at":   now.Add(AccessTokenTTL),
+		}).Error
+		return &session, err
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// Clean up expired sessions while we are here
+	if err := pruneSessions(db, now); err != nil {
+		return nil, err
+	}
+	session = database.Session{
+		UserID:     account.ID,
+		APIKeyID:   &key.ID,
+		UserAgent:  meta.UserAgent,
+		IPAddress:  meta.IPAddress,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(AccessTokenTTL),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
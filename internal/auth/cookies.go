@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"sync/atomic"
+)
+
+// Cookies set for browser sessions when session cookies are enabled.
+const (
+	// SessionCookie holds the access token. It is HttpOnly, so scripts cannot
+	// read it.
+	SessionCookie = "inkling_session"
+	// RefreshCookie holds the refresh token, also HttpOnly.
+	RefreshCookie = "inkling_refresh"
+	// CSRFCookie holds the CSRF token. Scripts read it and echo it in the
+	// CSRFHeader of unsafe requests, which a cross-site page cannot do.
+	CSRFCookie = "inkling_csrf"
+)
+
+// CSRFHeader carries the CSRF token on requests authenticated by cookie.
+const CSRFHeader = "X-CSRF-Token"
+
+var sessionCookies atomic.Bool
+
+// SetSessionCookies turns cookie sessions on or off. When on, logins and
+// refreshes also set the session cookies and the auth middleware accepts them.
+func SetSessionCookies(enabled bool) {
+	sessionCookies.Store(enabled)
+}
+
+// SessionCookiesEnabled reports whether cookie sessions are on.
+func SessionCookiesEnabled() bool {
+	return sessionCookies.Load()
+}
+
+// NewCSRFToken returns a random token for the CSRF cookie.
+func NewCSRFToken() (string, error) {
+	return randomToken(32)
+}
+
+// ValidCSRF reports whether the token sent in the CSRF header matches the
+// CSRF cookie.
+func ValidCSRF(cookie, header string) bool {
+	return cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
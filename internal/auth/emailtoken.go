@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/techsquidtv/inkling/internal/config"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+const (
+	// PasswordResetTTL is how long a password reset link is valid.
+	PasswordResetTTL = time.Hour
+	// EmailVerificationTTL is how long an email verification link is valid.
+	EmailVerificationTTL = 24 * time.Hour
+)
+
+// Audiences of emailed tokens. Access tokens have no audience, so an emailed
+// token can never be used as one.
+const (
+	audiencePasswordReset     = "password_reset"
+	audienceEmailVerification = "email_verification"
+)
+
+// ErrInvalidEmailToken is returned for malformed, expired or already used
+// reset and verification tokens.
+var ErrInvalidEmailToken = errors.New("invalid or expired token")
+
+// emailTokenClaims are the claims of a reset or verification token. The
+// fingerprint ties the token to the state it changes, so it stops working
+// once used.
+type emailTokenClaims struct {
+	Fingerprint string `json:"fp"`
+	jwt.RegisteredClaims
+}
+
+// NewPasswordResetToken returns a signed token for resetting the user's
+// password. It is invalidated by any password change.
+func NewPasswordResetToken(user *database.User) (string, error) {
+	return signEmailToken(user, audiencePasswordReset, passwordFingerprint(user), PasswordResetTTL)
+}
+
+// NewEmailVerificationToken returns a signed token confirming the user's
+// current email address.
+func NewEmailVerificationToken(user *database.User) (string, error) {
+	return signEmailToken(user, audienceEmailVerification, emailFingerprint(user), EmailVerificationTTL)
+}
+
+// ResetPassword sets a new password hash for the user a reset token was
+// issued to and revokes their sessions. The token can only be used once.
+func ResetPassword(db *gorm.DB, token, passwordHash string) (*database.User, error) {
+	user, err := parseEmailToken(db, token, audiencePasswordReset)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only update the password the token was issued for, so a token cannot
+	// be replayed, even concurrently
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&database.User{}).
+			Where("id = ? AND password_hash = ?", user.ID, user.PasswordHash).
+			Update("password_hash", passwordHash)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidEmailToken
+		}
+		// The user proved they own the address
+		if user.EmailVerifiedAt == nil {
+			if err := tx.Model(&database.User{}).Where("id = ?", user.ID).Update("email_verified_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+		return RevokeUserSessions(tx, user.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// VerifyEmail marks the email address a verification token was issued for as
+// verified.
+func VerifyEmail(db *gorm.DB, token string) (*database.User, error) {
+	user, err := parseEmailToken(db, token, audienceEmailVerification)
+	if err != nil {
+		return nil, err
+	}
+	if user.EmailVerifiedAt != nil {
+		return nil, ErrInvalidEmailToken
+	}
+
+	now := time.Now()
+	result := db.Model(&database.User{}).
+		Where("id = ? AND email = ? AND email_verified_at IS NULL", user.ID, user.Email).
+		Update("email_verified_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidEmailToken
+	}
+	user.EmailVerifiedAt = &now
+	return user, nil
+}
+
+func signEmailToken(user *database.User, audience, fingerprint string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return Keys().Sign(&emailTokenClaims{
+		Fingerprint: fingerprint,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings{audience},
+			Issuer:    config.ServiceName,
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// parseEmailToken verifies a token's signature and audience and returns its
+// user, provided the user's state still matches the token's fingerprint.
+func parseEmailToken(db *gorm.DB, token, audience string) (*database.User, error) {
+	claims := &emailTokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, Keys().Keyfunc,
+		jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}),
+		jwt.WithIssuer(config.ServiceName),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEmailToken, err)
+	}
+	id, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+
+	var user database.User
+	if err := db.First(&user, uint(id)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidEmailToken
+		}
+		return nil, err
+	}
+
+	expected := emailFingerprint(&user)
+	if audience == audiencePasswordReset {
+		expected = passwordFingerprint(&user)
+	}
+	if claims.Fingerprint != expected {
+		return nil, ErrInvalidEmailToken
+	}
+	return &user, nil
+}
+
+// passwordFingerprint changes whenever the user's password does.
+func passwordFingerprint(user *database.User) string {
+	return HashKey("password:" + user.Email + ":" + user.PasswordHash)[:16]
+}
+
+// emailFingerprint changes whenever the user's email address does.
+func emailFingerprint(user *database.User) string {
+	return HashKey("email:" + user.Email)[:16]
+}
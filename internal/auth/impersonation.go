@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// ImpersonationTTL is the lifetime of an impersonation session. Its token
+// cannot be refreshed; the admin has to start a new one.
+const ImpersonationTTL = 15 * time.Minute
+
+// StartImpersonation starts a session in which impersonatorID acts as userID
+// and returns its access token. No refresh token is issued.
+func StartImpersonation(db *gorm.DB, impersonatorID, userID uint, meta SessionMeta) (*TokenPair, error) {
+	now := time.Now()
+	session := database.Session{
+		UserID:         userID,
+		ImpersonatorID: &impersonatorID,
+		UserAgent:      meta.UserAgent,
+		IPAddress:      meta.IPAddress,
+		LastUsedAt:     now,
+		ExpiresAt:      now.Add(ImpersonationTTL),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{UserID: userID, SessionID: session.ID, Act: &ActorClaim{UserID: impersonatorID}}
+	token, err := signAccessToken(claims, ImpersonationTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken: token,
+		ExpiresIn:   int(ImpersonationTTL.Seconds()),
+		SessionID:   session.ID,
+	}, nil
+}
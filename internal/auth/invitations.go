@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// InvitationTTL is how long an invitation to register can be redeemed, unless
+// the admin chooses otherwise.
+const InvitationTTL = 7 * 24 * time.Hour
+
+// CreateInvitation records an invitation to register with the given role and
+// returns its token. An earlier pending invitation for the same email is
+// replaced.
+func CreateInvitation(db *gorm.DB, invitedByID uint, email, role string, ttl time.Duration) (*database.Invitation, string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	invitation := database.Invitation{
+		Email:       strings.ToLower(strings.TrimSpace(email)),
+		Role:        role,
+		TokenHash:   HashKey(raw),
+		InvitedByID: invitedByID,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("email = ? AND accepted_at IS NULL", invitation.Email).
+			Delete(&database.Invitation{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&invitation).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &invitation, raw, nil
+}
+
+// RenewInvitation replaces the invitation's token, so earlier links stop
+// working, and restarts its expiry with the duration it was created with.
+func RenewInvitation(db *gorm.DB, invitation *database.Invitation) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	ttl := invitation.ExpiresAt.Sub(invitation.CreatedAt)
+	if ttl <= 0 {
+		ttl = InvitationTTL
+	}
+	invitation.TokenHash = HashKey(raw)
+	invitation.ExpiresAt = time.Now().Add(ttl)
+	if err := db.Save(invitation).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// FindInvitation returns the pending invitation for a raw token, checking it
+// was sent to email.
+func FindInvitation(db *gorm.DB, token, email string) (*database.Invitation, error) {
+	return FindInvitationByHash(db, HashKey(token), email)
+}
+
+// FindInvitationByHash is FindInvitation for a token that was already hashed,
+// such as one carried through an OIDC login.
+func FindInvitationByHash(db *gorm.DB, hash, email string) (*database.Invitation, error) {
+	var invitation database.Invitation
+	if err := db.Where("token_hash = ? AND accepted_at IS NULL", hash).First(&invitation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidInvitation
+		}
+		return nil, err
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		return nil, ErrInvalidInvitation
+	}
+	if !strings.EqualFold(invitation.Email, strings.TrimSpace(email)) {
+		return nil, ErrInvitationEmailMismatch
+	}
+	return &invitation, nil
+}
+
+// RedeemInvitation marks the invitation used by the newly registered user.
+// Run it in the transaction that creates the user; it fails if the
+// invitation was redeemed concurrently.
+func RedeemInvitation(tx *gorm.DB, invitation *database.Invitation, userID uint) error {
+	now := time.Now()
+	result := tx.Model(invitation).Where("accepted_at IS NULL").
+		Updates(map[string]any{"accepted_at": now, "accepted_user_id": userID})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidInvitation
+	}
+	return nil
+}
@@ -1,57 +1,110 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/techsquidtv/inkling/internal/config"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
+// AccessTokenTTL is the lifetime of an access token. Clients renew it with a
+// refresh token before it expires.
+const AccessTokenTTL = 15 * time.Minute
+
+var (
+	keyManager   *KeyManager
+	keyManagerMu sync.Mutex
+)
 
 type Claims struct {
-	UserID uint `json:"user_id"`
+	UserID    uint        `json:"user_id"`
+	SessionID uint        `json:"sid"`
+	Act       *ActorClaim `json:"act,omitempty"`
+	Scope     string      `json:"scope,omitempty"` // Space-separated scopes; only set on client credentials tokens
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(userID uint) (string, error) {
-	if len(jwtKey) == 0 {
-		jwtKey = []byte("default-secret-change-me") // Fallback for dev
-	}
+// ActorClaim identifies who is acting as the token's user, like the "act"
+// claim of RFC 8693. It is only set on impersonation tokens.
+type ActorClaim struct {
+	UserID uint `json:"user_id"`
+}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+// SetKeyManager sets the key manager used to sign and verify access tokens.
+func SetKeyManager(m *KeyManager) {
+	keyManagerMu.Lock()
+	defer keyManagerMu.Unlock()
+	keyManager = m
+}
+
+// Keys returns the key manager used to sign and verify access tokens. Until one
+// is set, an ephemeral in-memory key is used, which is only suitable for tests.
+func Keys() *KeyManager {
+	keyManagerMu.Lock()
+	defer keyManagerMu.Unlock()
+	if keyManager == nil {
+		m, err := NewKeyManager(nil, KeyConfig{
+			RotationPeriod: 24 * time.Hour,
+			GracePeriod:    AccessTokenTTL,
+		})
+		if err != nil {
+			panic(fmt.Sprintf("failed to create ephemeral signing key: %v", err))
+		}
+		keyManager = m
 	}
+	return keyManager
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+func GenerateJWT(userID uint, sessionID uint) (string, error) {
+	return signAccessToken(&Claims{UserID: userID, SessionID: sessionID}, AccessTokenTTL)
 }
 
-func ValidateJWT(tokenString string) (*Claims, error) {
-	if len(jwtKey) == 0 {
-		jwtKey = []byte("default-secret-change-me")
+// signAccessToken fills in the registered claims and signs the token.
+func signAccessToken(claims *Claims, ttl time.Duration) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtKey, nil
-	})
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        jti,
+		Issuer:    config.ServiceName,
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+
+	return Keys().Sign(claims)
+}
+
+func ValidateJWT(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, Keys().Keyfunc,
+		jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}),
+		jwt.WithIssuer(config.ServiceName),
+	)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	// Tokens with an audience were issued for something else, such as a
+	// password reset link
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && len(claims.Audience) == 0 {
 		return claims, nil
 	}
 
 	return nil, fmt.Errorf("invalid token")
 }
+
+// randomToken returns n random bytes encoded as hex.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
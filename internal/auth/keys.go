@@ -0,0 +1,529 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// Supported signing algorithms.
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+// encryptedKeyPrefix marks private keys that are encrypted with the master secret.
+const encryptedKeyPrefix = "enc:v1:"
+
+// minSecretLength is the minimum master secret length accepted in production.
+const minSecretLength = 32
+
+// reloadInterval throttles database reloads triggered by unknown key IDs.
+const reloadInterval = 10 * time.Second
+
+// minRotationCheckInterval bounds how often Start checks for a due rotation,
+// however short the rotation period.
+const minRotationCheckInterval = time.Second
+
+// ErrUnknownKey is returned when a token references a key that is not known or has expired.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeyConfig configures the signing keys used for access tokens.
+type KeyConfig struct {
+	// Algorithm used for new keys: EdDSA (default) or RS256.
+	Algorithm string
+	// Secret is the master secret used to encrypt private keys at rest.
+	Secret string
+	// RotationPeriod is how long a key signs new tokens before it is rotated.
+	RotationPeriod time.Duration
+	// GracePeriod is how long a rotated key is still accepted for verification.
+	// It must be longer than the access token lifetime.
+	GracePeriod time.Duration
+}
+
+// KeyConfigFromEnv reads the key configuration from JWT_* environment variables.
+func KeyConfigFromEnv() KeyConfig {
+	cfg := KeyConfig{
+		Algorithm:      os.Getenv("JWT_ALGORITHM"),
+		Secret:         os.Getenv("JWT_SECRET"),
+		RotationPeriod: 30 * 24 * time.Hour,
+		GracePeriod:    24 * time.Hour,
+	}
+	if d, err := time.ParseDuration(os.Getenv("JWT_ROTATION_PERIOD")); err == nil {
+		cfg.RotationPeriod = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("JWT_GRACE_PERIOD")); err == nil {
+		cfg.GracePeriod = d
+	}
+	return cfg
+}
+
+// Validate checks the configuration. In production a master secret is required
+// so that private keys are never stored in the database in plain text.
+func (c KeyConfig) Validate(production bool) error {
+	switch c.Algorithm {
+	case "", AlgorithmEdDSA, AlgorithmRS256:
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", c.Algorithm)
+	}
+	if c.RotationPeriod <= 0 {
+		return fmt.Errorf("JWT rotation period must be positive")
+	}
+	if c.GracePeriod < AccessTokenTTL {
+		return fmt.Errorf("JWT grace period must be at least the access token lifetime (%s)", AccessTokenTTL)
+	}
+	if production && len(c.Secret) < minSecretLength {
+		return fmt.Errorf("JWT_SECRET must be set to at least %d characters in production", minSecretLength)
+	}
+	return nil
+}
+
+type signingKey struct {
+	kid       string
+	alg       string
+	private   crypto.Signer
+	public    crypto.PublicKey
+	createdAt time.Time
+	expiresAt *time.Time
+}
+
+func (k *signingKey) method() jwt.SigningMethod {
+	if k.alg == AlgorithmRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// KeyManager signs and verifies access tokens with keys persisted in the
+// database, rotating the active key on a schedule. Rotated keys keep verifying
+// tokens for the configured grace period and are published in the JWKS until
+// they expire. A KeyManager without a database keeps an ephemeral key in memory.
+type KeyManager struct {
+	db  *gorm.DB
+	cfg KeyConfig
+
+	mu         sync.RWMutex
+	active     *signingKey
+	keys       map[string]*signingKey
+	lastReload time.Time
+}
+
+// NewKeyManager loads the signing keys from the database, creating or rotating
+// the active key if needed.
+func NewKeyManager(db *gorm.DB, cfg KeyConfig) (*KeyManager, error) {
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = AlgorithmEdDSA
+	}
+	if err := cfg.Validate(false); err != nil {
+		return nil, err
+	}
+
+	m := &KeyManager{db: db, cfg: cfg, keys: map[string]*signingKey{}}
+	if db == nil {
+		if err := m.Rotate(); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	if err := m.rotateIfDue(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Start rotates the active key in the background until the context is cancelled.
+func (m *KeyManager) Start(ctx context.Context) {
+	interval := min(max(m.cfg.RotationPeriod/10, minRotationCheckInterval), time.Hour)
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if m.db != nil {
+					if err := m.reload(); err != nil {
+						log.Error("failed to reload signing keys", "err", err)
+						continue
+					}
+				}
+				if err := m.rotateIfDue(); err != nil {
+					log.Error("failed to rotate signing key", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// Encrypted reports whether private keys are encrypted at rest.
+func (m *KeyManager) Encrypted() bool {
+	return m.cfg.Secret != ""
+}
+
+// SealSecret encrypts a value for storage with the master secret. Values are
+// stored as is when no master secret is configured.
+func (m *KeyManager) SealSecret(plaintext string) (string, error) {
+	if m.cfg.Secret == "" {
+		return plaintext, nil
+	}
+	return encryptWithSecret(m.cfg.Secret, plaintext)
+}
+
+// OpenSecret reverses SealSecret.
+func (m *KeyManager) OpenSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedKeyPrefix) {
+		return stored, nil
+	}
+	if m.cfg.Secret == "" {
+		return "", errors.New("value is encrypted but no JWT_SECRET is configured")
+	}
+	return decryptWithSecret(m.cfg.Secret, stored)
+}
+
+// Sign signs the claims with the active key and sets the "kid" header.
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	m.mu.RLock()
+	key := m.active
+	m.mu.RUnlock()
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Keyfunc resolves the verification key for a token from its "kid" header.
+func (m *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, ErrUnknownKey
+	}
+
+	key := m.lookup(kid)
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.method().Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// Rotate creates a new active key. The previous active key keeps verifying
+// tokens until the grace period has passed.
+func (m *KeyManager) Rotate() error {
+	key, err := generateSigningKey(m.cfg.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	if m.db != nil {
+		record, err := m.encode(key)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		expiresAt := now.Add(m.cfg.GracePeriod)
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&database.SigningKey{}).
+				Where("rotated_at IS NULL").
+				Updates(map[string]interface{}{"rotated_at": now, "expires_at": expiresAt}).Error; err != nil {
+				return err
+			}
+			return tx.Create(record).Error
+		})
+		if err != nil {
+			return err
+		}
+		log.Info("rotated JWT signing key", "kid", key.kid, "alg", key.alg)
+		return m.reload()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active != nil {
+		expiresAt := time.Now().Add(m.cfg.GracePeriod)
+		m.active.expiresAt = &expiresAt
+	}
+	m.active = key
+	m.keys[key.kid] = key
+	return nil
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKSet is a set of public keys in JSON Web Key Set format.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that are currently accepted for verification.
+func (m *KeyManager) JWKS() JWKSet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range m.keys {
+		if key.expiresAt != nil && now.After(*key.expiresAt) {
+			continue
+		}
+		jwk := JWK{KeyID: key.kid, Algorithm: key.alg, Use: "sig"}
+		switch pub := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
+
+// lookup returns the key with the given ID, reloading from the database when
+// it is not known yet (another replica may have rotated).
+func (m *KeyManager) lookup(kid string) *signingKey {
+	m.mu.RLock()
+	key := m.keys[kid]
+	canReload := m.db != nil && time.Since(m.lastReload) > reloadInterval
+	m.mu.RUnlock()
+
+	if key == nil && canReload {
+		if err := m.reload(); err != nil {
+			log.Error("failed to reload signing keys", "err", err)
+		}
+		m.mu.RLock()
+		key = m.keys[kid]
+		m.mu.RUnlock()
+	}
+
+	if key == nil || (key.expiresAt != nil && time.Now().After(*key.expiresAt)) {
+		return nil
+	}
+	return key
+}
+
+// reload replaces the in-memory key set with the unexpired keys in the database.
+func (m *KeyManager) reload() error {
+	var records []database.SigningKey
+	if err := m.db.Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("created_at ASC").Find(&records).Error; err != nil {
+		return err
+	}
+
+	keys := make(map[string]*signingKey, len(records))
+	var active *signingKey
+	for _, record := range records {
+		key, err := m.decode(&record)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key %s: %w", record.KID, err)
+		}
+		keys[key.kid] = key
+		if record.RotatedAt == nil {
+			active = key // Newest unrotated key wins
+		}
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.active = active
+	m.lastReload = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// rotateIfDue rotates the active key when there is none or it is too old.
+func (m *KeyManager) rotateIfDue() error {
+	m.mu.RLock()
+	active := m.active
+	m.mu.RUnlock()
+
+	if active != nil && time.Since(active.createdAt) < m.cfg.RotationPeriod {
+		return nil
+	}
+	return m.Rotate()
+}
+
+// encode converts a key into its database representation.
+func (m *KeyManager) encode(key *signingKey) (*database.SigningKey, error) {
+	privDER, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &database.SigningKey{
+		KID:        key.kid,
+		Algorithm:  key.alg,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})),
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})),
+	}
+	if m.cfg.Secret != "" {
+		record.PrivateKey, err = encryptWithSecret(m.cfg.Secret, record.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		record.Encrypted = true
+	} else {
+		log.Warn("JWT_SECRET is not set, storing signing key unencrypted", "kid", key.kid)
+	}
+	return record, nil
+}
+
+// decode converts a database record back into a key.
+func (m *KeyManager) decode(record *database.SigningKey) (*signingKey, error) {
+	privPEM := record.PrivateKey
+	if record.Encrypted {
+		if m.cfg.Secret == "" {
+			return nil, errors.New("key is encrypted but JWT_SECRET is not set")
+		}
+		var err error
+		privPEM, err = decryptWithSecret(m.cfg.Secret, privPEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode([]byte(privPEM))
+	if block == nil {
+		return nil, errors.New("invalid private key PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+
+	return &signingKey{
+		kid:       record.KID,
+		alg:       record.Algorithm,
+		private:   signer,
+		public:    signer.Public(),
+		createdAt: record.CreatedAt,
+		expiresAt: record.ExpiresAt,
+	}, nil
+}
+
+// generateSigningKey creates a new key pair for the algorithm.
+func generateSigningKey(alg string) (*signingKey, error) {
+	kid, err := randomToken(8)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{kid: kid, alg: alg, createdAt: time.Now()}
+	switch alg {
+	case AlgorithmRS256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		key.private = priv
+		key.public = priv.Public()
+	default:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.alg = AlgorithmEdDSA
+		key.private = priv
+		key.public = pub
+	}
+	return key, nil
+}
+
+// encryptWithSecret encrypts plaintext with AES-256-GCM keyed by the secret.
+func encryptWithSecret(secret, plaintext string) (string, error) {
+	gcm, err := secretCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptWithSecret reverses encryptWithSecret.
+func decryptWithSecret(secret, ciphertext string) (string, error) {
+	encoded, ok := strings.CutPrefix(ciphertext, encryptedKeyPrefix)
+	if !ok {
+		return "", errors.New("unknown encryption format")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := secretCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt key, is JWT_SECRET correct?")
+	}
+	return string(plaintext), nil
+}
+
+func secretCipher(secret string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
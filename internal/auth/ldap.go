@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// Defaults for directory settings that have not been configured.
+const (
+	DefaultLDAPUserFilter     = "(mail={email})"
+	DefaultLDAPEmailAttribute = "mail"
+	DefaultLDAPNameAttribute  = "displayName"
+	DefaultLDAPGroupAttribute = "memberOf"
+)
+
+// ldapTimeout bounds dialing and each request to the directory.
+const ldapTimeout = 10 * time.Second
+
+var (
+	// ErrLDAPUserNotFound is returned when the user filter matches no entry.
+	ErrLDAPUserNotFound = errors.New("user not found in directory")
+	// ErrLDAPInvalidCredentials is returned when the directory refuses the
+	// user's password.
+	ErrLDAPInvalidCredentials = errors.New("invalid directory credentials")
+)
+
+// LDAPGroupRole maps the members of a directory group to a role.
+type LDAPGroupRole struct {
+	Group string `json:"group" doc:"Distinguished name of the group"`
+	Role  string `json:"role"`
+}
+
+// LDAPEntry is a directory user.
+type LDAPEntry struct {
+	DN     string
+	Email  string
+	Name   string
+	Groups []string // Distinguished names of the user's groups
+}
+
+// LDAPSettings returns the stored directory settings, or the defaults when
+// none are stored yet.
+func LDAPSettings(db *gorm.DB) (*database.LDAPConfig, error) {
+	var cfg database.LDAPConfig
+	err := db.First(&cfg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &database.LDAPConfig{
+			UserFilter:     DefaultLDAPUserFilter,
+			EmailAttribute: DefaultLDAPEmailAttribute,
+			NameAttribute:  DefaultLDAPNameAttribute,
+			GroupAttribute: DefaultLDAPGroupAttribute,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ParseLDAPGroupRoles decodes the group to role mappings of the settings.
+func ParseLDAPGroupRoles(cfg *database.LDAPConfig) []LDAPGroupRole {
+	var mappings []LDAPGroupRole
+	if cfg.GroupRoles != "" {
+		_ = json.Unmarshal([]byte(cfg.GroupRoles), &mappings)
+	}
+	return mappings
+}
+
+// EncodeLDAPGroupRoles encodes group to role mappings for storage.
+func EncodeLDAPGroupRoles(mappings []LDAPGroupRole) string {
+	if len(mappings) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(mappings)
+	return string(data)
+}
+
+// LDAPRole returns the role of the first mapping whose group the entry is a
+// member of. Group names are compared as distinguished names, ignoring case.
+func LDAPRole(cfg *database.LDAPConfig, entry *LDAPEntry) (string, bool) {
+	for _, mapping := range ParseLDAPGroupRoles(cfg) {
+		for _, group := range entry.Groups {
+			if sameDN(mapping.Group, group) {
+				return mapping.Role, true
+			}
+		}
+	}
+	return "", false
+}
+
+// AuthenticateLDAP finds the user with the email using the service account,
+// then binds as them with the password.
+func AuthenticateLDAP(cfg *database.LDAPConfig, email, password string) (*LDAPEntry, error) {
+	// Most servers treat a bind with an empty password as an anonymous bind,
+	// which succeeds for any DN
+	if password == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := dialLDAP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := searchLDAPUser(conn, cfg, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrLDAPInvalidCredentials
+		}
+		return nil, fmt.Errorf("user bind failed: %w", err)
+	}
+	return entry, nil
+}
+
+// CheckLDAP connects to the directory and binds as the service account.
+func CheckLDAP(cfg *database.LDAPConfig) error {
+	conn, err := dialLDAP(cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// LookupLDAP finds the user with the email using the service account, without
+// binding as them. It is used to check the settings.
+func LookupLDAP(cfg *database.LDAPConfig, email string) (*LDAPEntry, error) {
+	conn, err := dialLDAP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return searchLDAPUser(conn, cfg, email)
+}
+
+// dialLDAP connects to the directory and binds as the service account, or
+// stays anonymous when no bind DN is configured.
+func dialLDAP(cfg *database.LDAPConfig) (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if u, err := url.Parse(cfg.URL); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %w", err)
+		}
+	}
+	if cfg.BindDN != "" {
+		password, err := Keys().OpenSecret(cfg.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to decrypt bind password: %w", err)
+		}
+		if err := conn.Bind(cfg.BindDN, password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("service bind failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// searchLDAPUser finds the single entry matching the user filter.
+func searchLDAPUser(conn *ldap.Conn, cfg *database.LDAPConfig, email string) (*LDAPEntry, error) {
+	filter := strings.ReplaceAll(cfg.UserFilter, "{email}", ldap.EscapeFilter(email))
+	req := ldap.NewSearchRequest(
+		cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, filter,
+		[]string{cfg.EmailAttribute, cfg.NameAttribute, cfg.GroupAttribute}, nil,
+	)
+	res, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || (err == nil && len(res.Entries) > 1) {
+		return nil, errors.New("user filter matched more than one entry")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, ErrLDAPUserNotFound
+	}
+
+	found := res.Entries[0]
+	entry := &LDAPEntry{
+		DN:     found.DN,
+		Email:  found.GetAttributeValue(cfg.EmailAttribute),
+		Name:   found.GetAttributeValue(cfg.NameAttribute),
+		Groups: found.GetAttributeValues(cfg.GroupAttribute),
+	}
+	if entry.Email == "" {
+		entry.Email = email
+	}
+	return entry, nil
+}
+
+// sameDN reports whether two distinguished names are equal, ignoring case
+// and insignificant spaces.
+func sameDN(a, b string) bool {
+	dnA, errA := ldap.ParseDN(a)
+	dnB, errB := ldap.ParseDN(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return dnA.EqualFold(dnB)
+}
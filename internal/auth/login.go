@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// PendingLoginTTL is how long a user has to complete an OIDC login.
+const PendingLoginTTL = 10 * time.Minute
+
+// LoginStateCookie binds an OIDC login attempt to the browser that started it.
+const LoginStateCookie = "inkling_oidc_state"
+
+var (
+	// ErrInvalidLoginState is returned when a callback does not match a pending login
+	// started by the same browser.
+	ErrInvalidLoginState = errors.New("invalid or expired login state")
+	// ErrInvalidReturnTo is returned for return_to targets outside the allow-list.
+	ErrInvalidReturnTo = errors.New("return_to is not allowed")
+)
+
+// StartLogin records a new OIDC login attempt with the named provider, using a
+// random state, nonce and PKCE verifier.
+func StartLogin(db *gorm.DB, provider, returnTo string) (*database.PendingLogin, error) {
+	return startLogin(db, provider, returnTo, nil, "")
+}
+
+// StartInvitedLogin records an OIDC login attempt carrying an invitation
+// token, which lets a new user register while registration is disabled.
+func StartInvitedLogin(db *gorm.DB, provider, returnTo, invitationToken string) (*database.PendingLogin, error) {
+	return startLogin(db, provider, returnTo, nil, HashKey(invitationToken))
+}
+
+// StartLink records an OIDC login attempt that links the resulting identity to
+// an already authenticated user instead of signing in as its owner.
+func StartLink(db *gorm.DB, provider string, userID uint, returnTo string) (*database.PendingLogin, error) {
+	return startLogin(db, provider, returnTo, &userID, "")
+}
+
+func startLogin(db *gorm.DB, provider, returnTo string, linkUserID *uint, invitationHash string) (*database.PendingLogin, error) {
+	state, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	login := database.PendingLogin{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Provider:     provider,
+		LinkUserID:   linkUserID,
+		Invitation:   invitationHash,
+		ReturnTo:     returnTo,
+		ExpiresAt:    now.Add(PendingLoginTTL),
+	}
+
+	// Clean up abandoned attempts while we are here
+	if err := db.Unscoped().Where("expires_at < ?", now).Delete(&database.PendingLogin{}).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Create(&login).Error; err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// ConsumeLogin looks up the pending login for a callback and deletes it so it
+// cannot be replayed. The state must match the one stored in the browser's
+// cookie, and the login must have been started with the same provider.
+func ConsumeLogin(db *gorm.DB, provider, state, cookieState string) (*database.PendingLogin, error) {
+	if state == "" || state != cookieState {
+		return nil, ErrInvalidLoginState
+	}
+
+	var login database.PendingLogin
+	if err := db.Where("state = ?", state).First(&login).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidLoginState
+		}
+		return nil, err
+	}
+
+	result := db.Unscoped().Where("id = ?", login.ID).Delete(&database.PendingLogin{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || time.Now().After(login.ExpiresAt) || login.Provider != provider {
+		return nil, ErrInvalidLoginState
+	}
+	return &login, nil
+}
+
+// ValidateReturnTo checks where a user may be sent after logging in. Relative
+// paths on this site are always allowed; absolute URLs must match one of the
+// origins listed in AUTH_RETURN_TO_ALLOWLIST (comma-separated).
+func ValidateReturnTo(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", ErrInvalidReturnTo
+	}
+
+	// Relative path, but not protocol-relative ("//evil.com") or backslash tricks
+	if u.Scheme == "" && u.Host == "" {
+		if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || strings.Contains(raw, "\\") {
+			return "", ErrInvalidReturnTo
+		}
+		return raw, nil
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", ErrInvalidReturnTo
+	}
+	origin := u.Scheme + "://" + u.Host
+	if !slices.Contains(returnToAllowlist(), origin) {
+		return "", ErrInvalidReturnTo
+	}
+	return raw, nil
+}
+
+func returnToAllowlist() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("AUTH_RETURN_TO_ALLOWLIST"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+const (
+	// MFAChallengeTTL is how long a user has to enter a code after the first login step.
+	MFAChallengeTTL = 5 * time.Minute
+	// RecoveryCodeCount is how many recovery codes are issued at a time.
+	RecoveryCodeCount = 10
+	// maxMFAAttempts is how many wrong codes a challenge accepts before it is discarded.
+	maxMFAAttempts = 5
+)
+
+var (
+	// ErrMFAAlreadyEnabled is returned when enrolling a user who already has MFA.
+	ErrMFAAlreadyEnabled = errors.New("MFA is already enabled")
+	// ErrMFANotEnrolled is returned when there is no enrollment to confirm or use.
+	ErrMFANotEnrolled = errors.New("MFA is not enrolled")
+	// ErrInvalidMFACode is returned for wrong, reused or expired codes.
+	ErrInvalidMFACode = errors.New("invalid MFA code")
+	// ErrInvalidMFAChallenge is returned for unknown, expired or exhausted challenges.
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA challenge")
+)
+
+// HasMFA reports whether the user has a confirmed MFA enrollment.
+func HasMFA(db *gorm.DB, userID uint) bool {
+	var count int64
+	db.Model(&database.MFAEnrollment{}).Where("user_id = ? AND confirmed_at IS NOT NULL", userID).Count(&count)
+	return count > 0
+}
+
+// BeginTOTPEnrollment generates a new TOTP secret for the user, replacing any
+// unconfirmed enrollment. It returns the plaintext secret.
+func BeginTOTPEnrollment(db *gorm.DB, userID uint) (string, error) {
+	if HasMFA(db, userID) {
+		return "", ErrMFAAlreadyEnabled
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := Keys().SealSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&database.MFAEnrollment{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&database.MFAEnrollment{UserID: userID, Secret: sealed}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTPEnrollment enables MFA once the user proves their authenticator
+// works, and returns a fresh set of recovery codes.
+func ConfirmTOTPEnrollment(db *gorm.DB, userID uint, code string) ([]string, error) {
+	var enrollment database.MFAEnrollment
+	if err := db.Where("user_id = ?", userID).First(&enrollment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMFANotEnrolled
+		}
+		return nil, err
+	}
+	if enrollment.ConfirmedAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if err := useTOTPCode(db, &enrollment, code); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := db.Model(&enrollment).Update("confirmed_at", now).Error; err != nil {
+		return nil, err
+	}
+	return RegenerateRecoveryCodes(db, userID)
+}
+
+// VerifyMFACode accepts either a current TOTP code or an unused recovery code.
+// Both are single-use.
+func VerifyMFACode(db *gorm.DB, userID uint, code string) error {
+	var enrollment database.MFAEnrollment
+	if err := db.Where("user_id = ? AND confirmed_at IS NOT NULL", userID).First(&enrollment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrMFANotEnrolled
+		}
+		return err
+	}
+
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) == totpDigits {
+		return useTOTPCode(db, &enrollment, code)
+	}
+
+	// Mark the recovery code used only if nobody else did first
+	result := db.Model(&database.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, HashKey(strings.ToLower(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes and returns the
+// new ones. Only their hashes are stored.
+func RegenerateRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	records := make([]database.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := hex.EncodeToString(b)
+		codes[i] = raw[:5] + "-" + raw[5:]
+		records[i] = database.RecoveryCode{UserID: userID, CodeHash: HashKey(codes[i])}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&database.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes the user has.
+func RemainingRecoveryCodes(db *gorm.DB, userID uint) int {
+	var count int64
+	db.Model(&database.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return int(count)
+}
+
+// DisableMFA removes the user's enrollment and recovery codes.
+func DisableMFA(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&database.MFAEnrollment{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", userID).Delete(&database.RecoveryCode{}).Error
+	})
+}
+
+// CreateMFAChallenge records a pending second login step and returns its token.
+func CreateMFAChallenge(db *gorm.DB, userID uint, returnTo string) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	// Clean up abandoned challenges while we are here
+	if err := db.Unscoped().Where("expires_at < ?", now).Delete(&database.MFAChallenge{}).Error; err != nil {
+		return "", err
+	}
+	challenge := database.MFAChallenge{
+		UserID:    userID,
+		TokenHash: HashKey(raw),
+		ReturnTo:  returnTo,
+		ExpiresAt: now.Add(MFAChallengeTTL),
+	}
+	if err := db.Create(&challenge).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// FindMFAChallenge returns the pending challenge for a token without
+// consuming it, so callers can check who it belongs to first.
+func FindMFAChallenge(db *gorm.DB, token string) (*database.MFAChallenge, error) {
+	var challenge database.MFAChallenge
+	if err := db.Where("token_hash = ?", HashKey(token)).First(&challenge).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidMFAChallenge
+		}
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// CompleteMFAChallenge checks the code for a challenge. On success the
+// challenge is consumed and returned; wrong codes count towards its attempt
+// limit.
+func CompleteMFAChallenge(db *gorm.DB, token, code string) (*database.MFAChallenge, error) {
+	challenge, err := FindMFAChallenge(db, token)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(challenge.ExpiresAt) || challenge.Attempts >= maxMFAAttempts {
+		db.Unscoped().Delete(challenge)
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	if err := VerifyMFACode(db, challenge.UserID, code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			db.Model(challenge).Update("attempts", gorm.Expr("attempts + 1"))
+		}
+		return nil, err
+	}
+
+	result := db.Unscoped().Delete(challenge)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return challenge, nil
+}
+
+// useTOTPCode validates a TOTP code and records its time step so the same
+// code cannot be used twice.
+func useTOTPCode(db *gorm.DB, enrollment *database.MFAEnrollment, code string) error {
+	secret, err := Keys().OpenSecret(enrollment.Secret)
+	if err != nil {
+		return err
+	}
+	step, ok := ValidateTOTP(secret, code, time.Now())
+	if !ok || step <= enrollment.LastUsedStep {
+		return ErrInvalidMFACode
+	}
+
+	result := db.Model(&database.MFAEnrollment{}).
+		Where("id = ? AND last_used_step < ?", enrollment.ID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	enrollment.LastUsedStep = step
+	return nil
+}
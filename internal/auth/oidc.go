@@ -11,11 +11,15 @@ import (
 
 type IDToken interface {
 	Claims(v interface{}) error
+	// Nonce returns the nonce the token was issued for.
+	Nonce() string
 }
 
+// Provider is an OpenID Connect identity provider. AuthCodeURL and Exchange
+// take the per-attempt nonce and PKCE code verifier of the login flow.
 type Provider interface {
-	AuthCodeURL(state string) string
-	Exchange(ctx context.Context, code string) (*oauth2.Token, error)
+	AuthCodeURL(state, nonce, codeVerifier string) string
+	Exchange(ctx context.Context, code, codeVerifier string) (*oauth2.Token, error)
 	VerifyToken(ctx context.Context, rawIDToken string) (IDToken, error)
 }
 
@@ -25,35 +29,53 @@ type OIDCProvider struct {
 	OAuth2Config oauth2.Config
 }
 
+// ProviderConfig holds the client registration for an OIDC provider.
+type ProviderConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// NewOIDCProvider creates the provider configured through the OIDC_*
+// environment variables. It returns nil when OIDC is not configured.
 func NewOIDCProvider(ctx context.Context) (*OIDCProvider, error) {
-	issuer := os.Getenv("OIDC_ISSUER")
-	clientID := os.Getenv("OIDC_CLIENT_ID")
-	clientSecret := os.Getenv("OIDC_CLIENT_SECRET")
-	redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	cfg := ProviderConfig{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+	}
 
-	if issuer == "" && clientID == "" {
+	if cfg.Issuer == "" && cfg.ClientID == "" {
 		return nil, nil
 	}
 
-	if issuer == "" || clientID == "" {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
 		return nil, fmt.Errorf("OIDC_ISSUER and OIDC_CLIENT_ID must be set")
 	}
 
-	provider, err := oidc.NewProvider(ctx, issuer)
+	return NewOIDCProviderFromConfig(ctx, cfg)
+}
+
+// NewOIDCProviderFromConfig runs discovery against the issuer and returns a
+// provider for the given client registration.
+func NewOIDCProviderFromConfig(ctx context.Context, cfg ProviderConfig) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get provider: %v", err)
 	}
 
 	oidcConfig := &oidc.Config{
-		ClientID: clientID,
+		ClientID: cfg.ClientID,
 	}
 	verifier := provider.Verifier(oidcConfig)
 
 	config := oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
 		Endpoint:     provider.Endpoint(),
-		RedirectURL:  redirectURL,
+		RedirectURL:  cfg.RedirectURL,
 		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
 	}
 
@@ -64,14 +86,27 @@ func NewOIDCProvider(ctx context.Context) (*OIDCProvider, error) {
 	}, nil
 }
 
-func (p *OIDCProvider) AuthCodeURL(state string) string {
-	return p.OAuth2Config.AuthCodeURL(state)
+func (p *OIDCProvider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	return p.OAuth2Config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier))
 }
 
-func (p *OIDCProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	return p.OAuth2Config.Exchange(ctx, code)
+func (p *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier string) (*oauth2.Token, error) {
+	return p.OAuth2Config.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
 }
 
 func (p *OIDCProvider) VerifyToken(ctx context.Context, rawIDToken string) (IDToken, error) {
-	return p.Verifier.Verify(ctx, rawIDToken)
+	token, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedIDToken{token}, nil
+}
+
+// verifiedIDToken adapts *oidc.IDToken to the IDToken interface.
+type verifiedIDToken struct {
+	*oidc.IDToken
+}
+
+func (t *verifiedIDToken) Nonce() string {
+	return t.IDToken.Nonce
 }
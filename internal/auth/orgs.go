@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// OrgInvitationTTL is how long an organization invitation can be accepted.
+const OrgInvitationTTL = 7 * 24 * time.Hour
+
+// orgRoles lists organization roles from least to most privileged.
+var orgRoles = []string{database.OrgRoleMember, database.OrgRoleAdmin, database.OrgRoleOwner}
+
+// orgRolePermissions are the permissions each organization role grants for
+// operations acting in that organization, on top of the user's site role.
+// Organization API keys act with the member role.
+var orgRolePermissions = map[string][]string{
+	database.OrgRoleMember: {PermissionProductsWrite},
+	database.OrgRoleAdmin:  {PermissionProductsWrite},
+	database.OrgRoleOwner:  {PermissionProductsWrite},
+}
+
+var (
+	// ErrInvalidInvitation is returned for unknown, expired or used invitations.
+	ErrInvalidInvitation = errors.New("invalid or expired invitation")
+	// ErrInvitationEmailMismatch is returned when an invitation is accepted by
+	// a user with a different email address.
+	ErrInvitationEmailMismatch = errors.New("invitation was sent to a different email address")
+)
+
+// OrgRoleAtLeast reports whether role grants at least the privileges of min.
+func OrgRoleAtLeast(role, min string) bool {
+	have, need := slices.Index(orgRoles, role), slices.Index(orgRoles, min)
+	return have >= 0 && need >= 0 && have >= need
+}
+
+// OrgRolePermissions returns the permissions an organization role grants in
+// its organization. Unknown roles grant none.
+func OrgRolePermissions(role string) []string {
+	return orgRolePermissions[role]
+}
+
+// CreateOrgInvitation records an invitation to join an organization and
+// returns its token. An earlier pending invitation for the same email is
+// replaced.
+func CreateOrgInvitation(db *gorm.DB, orgID, invitedByID uint, email, role string) (*database.OrgInvitation, string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	invitation := database.OrgInvitation{
+		OrganizationID: orgID,
+		Email:          strings.ToLower(strings.TrimSpace(email)),
+		Role:           role,
+		TokenHash:      HashKey(raw),
+		InvitedByID:    invitedByID,
+		ExpiresAt:      time.Now().Add(OrgInvitationTTL),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("organization_id = ? AND email = ? AND accepted_at IS NULL", orgID, invitation.Email).
+			Delete(&database.OrgInvitation{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&invitation).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &invitation, raw, nil
+}
+
+// AcceptOrgInvitation adds the user to the organization the token invites
+// them to. The user's email must match the invitation. Users who are already
+// members keep their role, unless the invitation grants a higher one.
+func AcceptOrgInvitation(db *gorm.DB, token string, user *database.User) (*database.Membership, error) {
+	var membership database.Membership
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var invitation database.OrgInvitation
+		if err := tx.Where("token_hash = ? AND accepted_at IS NULL", HashKey(token)).First(&invitation).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidInvitation
+			}
+			return err
+		}
+		if time.Now().After(invitation.ExpiresAt) {
+			return ErrInvalidInvitation
+		}
+		if !strings.EqualFold(invitation.Email, user.Email) {
+			return ErrInvitationEmailMismatch
+		}
+
+		// Mark it used first, so two concurrent accepts cannot both succeed
+		result := tx.Model(&invitation).Where("accepted_at IS NULL").Update("accepted_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidInvitation
+		}
+
+		err := tx.Where("organization_id = ? AND user_id = ?", invitation.OrganizationID, user.ID).First(&membership).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			membership = database.Membership{OrganizationID: invitation.OrganizationID, UserID: user.ID, Role: invitation.Role}
+			return tx.Create(&membership).Error
+		}
+		if err != nil {
+			return err
+		}
+		if !OrgRoleAtLeast(membership.Role, invitation.Role) {
+			membership.Role = invitation.Role
+			return tx.Save(&membership).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &membership, nil
+}
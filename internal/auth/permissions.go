@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"slices"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// Permissions a role can grant. Operations declare the permission they need
+// in their x-permission extension. Most share names with the API key scopes
+// that guard the same operations.
+const (
+	PermissionProductsWrite    = "products:write"
+	PermissionUsersRead        = "users:read"
+	PermissionUsersWrite       = "users:write"
+	PermissionUsersImpersonate = "users:impersonate"
+	PermissionSettingsRead     = "settings:read"
+	PermissionSettingsWrite    = "settings:write"
+	PermissionAuditRead        = "audit:read"
+	PermissionRolesRead        = "roles:read"
+	PermissionRolesWrite       = "roles:write"
+)
+
+// Permission describes a permission a role can grant.
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// AllPermissions lists every permission a role can grant.
+var AllPermissions = []Permission{
+	{PermissionProductsWrite, "Create and delete products"},
+	{PermissionUsersRead, "List users and login lockouts"},
+	{PermissionUsersWrite, "Change user roles, delete users and clear lockouts"},
+	{PermissionUsersImpersonate, "Act as another user to see what they see"},
+	{PermissionSettingsRead, "Read application settings and OIDC providers"},
+	{PermissionSettingsWrite, "Change application settings and OIDC providers"},
+	{PermissionAuditRead, "Read and export the audit log"},
+	{PermissionRolesRead, "List roles and permissions"},
+	{PermissionRolesWrite, "Create, update and delete roles"},
+}
+
+// IsPermission reports whether name is a known permission.
+func IsPermission(name string) bool {
+	return slices.ContainsFunc(AllPermissions, func(p Permission) bool { return p.Name == name })
+}
+
+// HasPermission reports whether granted includes permission, either by name
+// or through the "*" wildcard.
+func HasPermission(granted []string, permission string) bool {
+	return slices.Contains(granted, database.PermissionAll) || slices.Contains(granted, permission)
+}
+
+// HasPermissions reports whether granted includes every permission in
+// required. Only the wildcard itself covers a required wildcard.
+func HasPermissions(granted []string, required []string) bool {
+	for _, permission := range required {
+		if !HasPermission(granted, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// adminPermissions are the permissions that make a role an admin role: with
+// any of them a user can give themselves every other permission.
+var adminPermissions = []string{PermissionUsersWrite, PermissionRolesWrite}
+
+// IsAdmin reports whether the granted permissions make a role an admin role,
+// for policies such as require_admin_mfa that apply to admins. Custom roles
+// count as well as the built-in admin role.
+func IsAdmin(granted []string) bool {
+	return slices.ContainsFunc(adminPermissions, func(permission string) bool {
+		return HasPermission(granted, permission)
+	})
+}
+
+// ExpandPermissions lists the permissions granted, with the wildcard replaced
+// by every known permission.
+func ExpandPermissions(granted []string) []string {
+	if !slices.Contains(granted, database.PermissionAll) {
+		return granted
+	}
+	expanded := make([]string, len(AllPermissions))
+	for i, p := range AllPermissions {
+		expanded[i] = p.Name
+	}
+	return expanded
+}
+
+// RolePermissions returns the permissions granted by the named role. Unknown
+// roles grant none.
+func RolePermissions(db *gorm.DB, name string) []string {
+	var role database.Role
+	if err := db.Where("name = ?", name).First(&role).Error; err != nil {
+		return nil
+	}
+	return ParseScopes(role.Permissions)
+}
@@ -0,0 +1,315 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// providerRefreshInterval is how often stored providers are re-read in the
+// background so changes made on another replica are picked up.
+const providerRefreshInterval = time.Minute
+
+// reservedProviderSlugs cannot be used for stored providers because they
+// collide with other /auth routes or the env-configured provider.
+var reservedProviderSlugs = []string{
+	database.DefaultOIDCProvider, database.LDAPProvider, "login", "callback", "signup", "refresh", "logout", "providers", "mfa", "webauthn", "password", "verify",
+}
+
+var providerSlugPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$`)
+
+var (
+	// ErrInvalidProviderSlug is returned for slugs that are malformed or reserved.
+	ErrInvalidProviderSlug = errors.New("invalid provider slug")
+	// ErrMissingRedirectURL is returned when a callback URL cannot be derived.
+	ErrMissingRedirectURL = errors.New("redirect_url is required when PUBLIC_URL is not set")
+)
+
+// ProviderFactory builds a Provider from its client registration, typically by
+// running OIDC discovery against the issuer.
+type ProviderFactory func(ctx context.Context, cfg ProviderConfig) (Provider, error)
+
+// RegistryConfig configures a provider Registry.
+type RegistryConfig struct {
+	// Secret encrypts stored client secrets at rest. Usually JWT_SECRET.
+	Secret string
+	// PublicURL is the externally reachable base URL, used to derive each
+	// provider's callback URL.
+	PublicURL string
+	// Factory builds providers from stored configs. Defaults to OIDC discovery.
+	Factory ProviderFactory
+}
+
+// ProviderInfo describes a registered provider.
+type ProviderInfo struct {
+	Slug        string
+	DisplayName string
+	Static      bool // Registered at startup rather than stored in the database
+}
+
+type registeredProvider struct {
+	info      ProviderInfo
+	provider  Provider
+	updatedAt time.Time // UpdatedAt of the stored config the provider was built from
+}
+
+// Registry holds the OIDC providers users can sign in with, keyed by slug.
+// Static providers are registered at startup; the rest are loaded from the
+// oidc_provider_configs table.
+type Registry struct {
+	db  *gorm.DB
+	cfg RegistryConfig
+
+	mu         sync.RWMutex
+	providers  map[string]registeredProvider
+	lastReload time.Time
+}
+
+// NewRegistry creates an empty registry. db may be nil when only static
+// providers are used.
+func NewRegistry(db *gorm.DB, cfg RegistryConfig) *Registry {
+	if cfg.Factory == nil {
+		cfg.Factory = func(ctx context.Context, pc ProviderConfig) (Provider, error) {
+			return NewOIDCProviderFromConfig(ctx, pc)
+		}
+	}
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	return &Registry{db: db, cfg: cfg, providers: map[string]registeredProvider{}}
+}
+
+// Register adds a static provider.
+func (r *Registry) Register(slug, displayName string, p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[slug] = registeredProvider{
+		info:     ProviderInfo{Slug: slug, DisplayName: displayName, Static: true},
+		provider: p,
+	}
+}
+
+// Get returns the provider with the given slug, reloading stored providers
+// when it is not known yet (another replica may have added it).
+func (r *Registry) Get(ctx context.Context, slug string) (Provider, bool) {
+	r.mu.RLock()
+	entry, ok := r.providers[slug]
+	canReload := r.db != nil && time.Since(r.lastReload) > reloadInterval
+	r.mu.RUnlock()
+
+	if !ok && canReload {
+		if err := r.Reload(ctx); err != nil {
+			log.Error("failed to reload OIDC providers", "err", err)
+		}
+		r.mu.RLock()
+		entry, ok = r.providers[slug]
+		r.mu.RUnlock()
+	}
+	if !ok {
+		return nil, false
+	}
+	return entry.provider, true
+}
+
+// Default returns the provider used by the legacy /auth/login and
+// /auth/callback routes: the env-configured one, or the only provider when
+// exactly one is registered.
+func (r *Registry) Default() (string, Provider, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if entry, ok := r.providers[database.DefaultOIDCProvider]; ok {
+		return entry.info.Slug, entry.provider, true
+	}
+	if len(r.providers) == 1 {
+		for slug, entry := range r.providers {
+			return slug, entry.provider, true
+		}
+	}
+	return "", nil, false
+}
+
+// List returns the registered providers sorted by slug.
+func (r *Registry) List() []ProviderInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	infos := make([]ProviderInfo, 0, len(r.providers))
+	for _, entry := range r.providers {
+		infos = append(infos, entry.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Slug < infos[j].Slug })
+	return infos
+}
+
+// IsStatic reports whether slug belongs to a provider registered at startup.
+func (r *Registry) IsStatic(slug string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.providers[slug].info.Static
+}
+
+// Start refreshes the stored providers in the background until the context
+// is cancelled.
+func (r *Registry) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(providerRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Reload(ctx); err != nil {
+					log.Error("failed to reload OIDC providers", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// Reload syncs the registry with the enabled providers in the database.
+// Providers whose config has not changed are kept as is; ones that fail
+// discovery are logged and skipped.
+func (r *Registry) Reload(ctx context.Context) error {
+	if r.db == nil {
+		return nil
+	}
+
+	var records []database.OIDCProviderConfig
+	if err := r.db.Where("enabled = ?", true).Find(&records).Error; err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	current := make(map[string]registeredProvider, len(r.providers))
+	for slug, entry := range r.providers {
+		current[slug] = entry
+	}
+	r.mu.RUnlock()
+
+	loaded := map[string]registeredProvider{}
+	for _, record := range records {
+		if existing, ok := current[record.Slug]; ok && (existing.info.Static || existing.updatedAt.Equal(record.UpdatedAt)) {
+			loaded[record.Slug] = existing
+			continue
+		}
+		entry, err := r.build(ctx, &record)
+		if err != nil {
+			log.Error("failed to load OIDC provider", "provider", record.Slug, "err", err)
+			continue
+		}
+		loaded[record.Slug] = entry
+	}
+
+	r.mu.Lock()
+	for slug, entry := range r.providers {
+		if entry.info.Static {
+			loaded[slug] = entry
+		}
+	}
+	r.providers = loaded
+	r.lastReload = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+// Prepare builds the provider for a stored config without changing the
+// registry, so discovery can run before the config is saved. The returned
+// function adds the provider, replacing any provider with the same slug, or
+// removes it when the config is disabled. The error from discovery is
+// returned so callers can reject bad configs.
+func (r *Registry) Prepare(ctx context.Context, record *database.OIDCProviderConfig) (func(), error) {
+	if !record.Enabled {
+		return func() { r.Remove(record.Slug) }, nil
+	}
+	entry, err := r.build(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// Saving the config changed its update time
+		entry.updatedAt = record.UpdatedAt
+		r.mu.Lock()
+		r.providers[record.Slug] = entry
+		r.mu.Unlock()
+	}, nil
+}
+
+// Remove drops a stored provider from the registry.
+func (r *Registry) Remove(slug string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.providers[slug].info.Static {
+		delete(r.providers, slug)
+	}
+}
+
+// CallbackURL returns the redirect URL registered with the provider's IdP.
+func (r *Registry) CallbackURL(record *database.OIDCProviderConfig) (string, error) {
+	if record.RedirectURL != "" {
+		return record.RedirectURL, nil
+	}
+	if r.cfg.PublicURL == "" {
+		return "", ErrMissingRedirectURL
+	}
+	return r.cfg.PublicURL + "/api/auth/" + record.Slug + "/callback", nil
+}
+
+// SealClientSecret encrypts a client secret for storage when a master secret
+// is configured.
+func (r *Registry) SealClientSecret(plaintext string) (string, error) {
+	if r.cfg.Secret == "" || plaintext == "" {
+		return plaintext, nil
+	}
+	return encryptWithSecret(r.cfg.Secret, plaintext)
+}
+
+func (r *Registry) openClientSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedKeyPrefix) {
+		return stored, nil
+	}
+	if r.cfg.Secret == "" {
+		return "", errors.New("client secret is encrypted but no JWT_SECRET is configured")
+	}
+	return decryptWithSecret(r.cfg.Secret, stored)
+}
+
+func (r *Registry) build(ctx context.Context, record *database.OIDCProviderConfig) (registeredProvider, error) {
+	secret, err := r.openClientSecret(record.ClientSecret)
+	if err != nil {
+		return registeredProvider{}, err
+	}
+	redirectURL, err := r.CallbackURL(record)
+	if err != nil {
+		return registeredProvider{}, err
+	}
+	p, err := r.cfg.Factory(ctx, ProviderConfig{
+		Issuer:       record.Issuer,
+		ClientID:     record.ClientID,
+		ClientSecret: secret,
+		RedirectURL:  redirectURL,
+	})
+	if err != nil {
+		return registeredProvider{}, err
+	}
+	return registeredProvider{
+		info:      ProviderInfo{Slug: record.Slug, DisplayName: record.DisplayName},
+		provider:  p,
+		updatedAt: record.UpdatedAt,
+	}, nil
+}
+
+// ValidateProviderSlug checks that a slug is URL-safe and not reserved.
+func ValidateProviderSlug(slug string) error {
+	if !providerSlugPattern.MatchString(slug) || slices.Contains(reservedProviderSlugs, slug) {
+		return fmt.Errorf("%w: %q", ErrInvalidProviderSlug, slug)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// SCIMTokenPrefix starts every SCIM bearer token, telling it apart from access
+// tokens.
+const SCIMTokenPrefix = "scim_"
+
+// ErrInvalidSCIMToken is returned for unknown or expired SCIM tokens.
+var ErrInvalidSCIMToken = errors.New("invalid or expired SCIM token")
+
+// IsSCIMToken reports whether a bearer token is a SCIM token.
+func IsSCIMToken(raw string) bool {
+	return strings.HasPrefix(raw, SCIMTokenPrefix)
+}
+
+// CreateSCIMToken stores a new SCIM token and returns it with the raw token,
+// which is not stored. A zero ttl creates a token that does not expire.
+func CreateSCIMToken(db *gorm.DB, createdByID uint, name string, ttl time.Duration) (*database.SCIMToken, string, error) {
+	random, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := SCIMTokenPrefix + random
+
+	token := database.SCIMToken{
+		Name:        name,
+		Prefix:      raw[:12],
+		TokenHash:   HashKey(raw),
+		CreatedByID: createdByID,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return nil, "", err
+	}
+	return &token, raw, nil
+}
+
+// ValidateSCIMToken looks up a raw SCIM token and records its use.
+func ValidateSCIMToken(db *gorm.DB, raw string) (*database.SCIMToken, error) {
+	var token database.SCIMToken
+	if err := db.Where("token_hash = ?", HashKey(raw)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidSCIMToken
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+		return nil, ErrInvalidSCIMToken
+	}
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) > time.Minute {
+		db.Model(&token).Update("last_used", now)
+	}
+	return &token, nil
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// API key scopes. Operations declare the scope they need in the scope list of
+// their "apiKey" security requirement; keys are only accepted by operations that
+// declare one.
+const (
+	ScopeProfileRead   = "profile:read"
+	ScopeProfileWrite  = "profile:write"
+	ScopeKeysRead      = "keys:read"
+	ScopeKeysWrite     = "keys:write"
+	ScopeProductsWrite = "products:write"
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopeSettingsRead  = "settings:read"
+	ScopeSettingsWrite = "settings:write"
+	ScopeAuditRead     = "audit:read"
+	ScopeOrgsRead      = "orgs:read"
+	ScopeOrgsWrite     = "orgs:write"
+	ScopeRolesRead     = "roles:read"
+	ScopeRolesWrite    = "roles:write"
+)
+
+// AllScopes lists every scope an API key can be granted.
+var AllScopes = []string{
+	ScopeProfileRead,
+	ScopeProfileWrite,
+	ScopeKeysRead,
+	ScopeKeysWrite,
+	ScopeProductsWrite,
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopeSettingsRead,
+	ScopeSettingsWrite,
+	ScopeAuditRead,
+	ScopeOrgsRead,
+	ScopeOrgsWrite,
+	ScopeRolesRead,
+	ScopeRolesWrite,
+}
+
+// ParseScopes decodes the JSON scope list stored on an API key.
+func ParseScopes(raw string) []string {
+	var scopes []string
+	if raw == "" {
+		return scopes
+	}
+	if err := json.Unmarshal([]byte(raw), &scopes); err != nil {
+		return nil
+	}
+	return scopes
+}
+
+// EncodeScopes encodes a scope list for storage on an API key.
+func EncodeScopes(scopes []string) string {
+	if scopes == nil {
+		scopes = []string{}
+	}
+	b, _ := json.Marshal(scopes)
+	return string(b)
+}
+
+// HasScopes reports whether granted contains every scope in required.
+func HasScopes(granted []string, required []string) bool {
+	for _, scope := range required {
+		if !slices.Contains(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
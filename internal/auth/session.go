@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// RefreshTokenTTL is the absolute lifetime of a session. Rotating the refresh
+// token does not extend it; the user has to log in again afterwards.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is
+	// presented again. The whole session is revoked when this happens.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+	// ErrSessionRevoked is returned when an access token belongs to a session
+	// that has been revoked or has expired.
+	ErrSessionRevoked = errors.New("session revoked")
+	// ErrAccountDisabled is returned when a deactivated user tries to start or
+	// refresh a session.
+	ErrAccountDisabled = errors.New("account is deactivated")
+)
+
+// SessionMeta describes the client a session was created for.
+type SessionMeta struct {
+	UserAgent string
+	IPAddress string
+}
+
+// TokenPair is the set of tokens handed to a client after authenticating.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int // Access token lifetime in seconds
+	SessionID    uint
+}
+
+// CreateSession starts a new session for the user and issues its first token
+// pair. Deactivated users are refused.
+func CreateSession(db *gorm.DB, userID uint, meta SessionMeta) (*TokenPair, error) {
+	if err := checkActive(db, userID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := database.Session{
+		UserID:     userID,
+		UserAgent:  meta.UserAgent,
+		IPAddress:  meta.IPAddress,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+	}
+
+	// Clean up expired sessions while we are here
+	if err := pruneSessions(db, now); err != nil {
+		return nil, err
+	}
+
+	var pair *TokenPair
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		var err error
+		pair, err = issueTokenPair(tx, &session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. The presented
+// token is marked as used; if it is ever presented again the session it belongs
+// to is revoked, logging out both the legitimate client and whoever replayed it.
+func RefreshSession(db *gorm.DB, rawToken string, meta SessionMeta) (*TokenPair, error) {
+	var token database.RefreshToken
+	if err := db.Where("token_hash = ?", HashKey(rawToken)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	var session database.Session
+	if err := db.First(&session, token.SessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.UsedAt != nil {
+		if err := RevokeSession(db, session.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) || now.After(token.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err := checkActive(db, session.UserID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	var pair *TokenPair
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Mark the token as used only if nobody beat us to it, so two concurrent
+		// refreshes with the same token are treated as reuse.
+		result := tx.Model(&database.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+
+		updates := map[string]interface{}{"last_used_at": now}
+		if meta.UserAgent != "" {
+			updates["user_agent"] = meta.UserAgent
+		}
+		if meta.IPAddress != "" {
+			updates["ip_address"] = meta.IPAddress
+		}
+		if err := tx.Model(&session).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		var err error
+		pair, err = issueTokenPair(tx, &session)
+		return err
+	})
+	if errors.Is(err, ErrRefreshTokenReused) {
+		if err := RevokeSession(db, session.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// ValidateSession checks that the session an access token was issued for is
+// still active and returns it.
+func ValidateSession(db *gorm.DB, sessionID uint) (*database.Session, error) {
+	var session database.Session
+	if err := db.First(&session, sessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionRevoked
+		}
+		return nil, err
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionRevoked
+	}
+	return &session, nil
+}
+
+// RevokeSession revokes a session together with all of its refresh tokens.
+func RevokeSession(db *gorm.DB, sessionID uint) error {
+	return db.Model(&database.Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeUserSessions revokes every active session belonging to the user.
+func RevokeUserSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&database.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// checkActive returns ErrAccountDisabled if the user is deactivated.
+func checkActive(db *gorm.DB, userID uint) error {
+	var user database.User
+	if err := db.Select("id", "disabled_at").First(&user, userID).Error; err != nil {
+		return err
+	}
+	if user.DisabledAt != nil {
+		return ErrAccountDisabled
+	}
+	return nil
+}
+
+// pruneSessions deletes sessions that expired before now, together with their
+// refresh tokens, which expire with them.
+func pruneSessions(db *gorm.DB, now time.Time) error {
+	if err := db.Unscoped().Where("expires_at < ?", now).Delete(&database.RefreshToken{}).Error; err != nil {
+		return err
+	}
+	return db.Unscoped().Where("expires_at < ?", now).Delete(&database.Session{}).Error
+}
+
+// issueTokenPair mints an access token and a fresh refresh token for the session.
+func issueTokenPair(db *gorm.DB, session *database.Session) (*TokenPair, error) {
+	accessToken, err := GenerateJWT(session.UserID, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rawRefresh, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	refresh := database.RefreshToken{
+		SessionID: session.ID,
+		TokenHash: HashKey(rawRefresh),
+		ExpiresAt: session.ExpiresAt,
+	}
+	if err := db.Create(&refresh).Error; err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: rawRefresh,
+		ExpiresIn:    int(AccessTokenTTL.Seconds()),
+		SessionID:    session.ID,
+	}, nil
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/config"
+	"github.com/techsquidtv/inkling/internal/database"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Login throttling. Failed password and MFA attempts are counted per client
+// IP and per account. Once a counter reaches its free attempts, each further
+// failure locks that IP or account out for twice as long as the last, up to
+// maxLockout. Counters are forgotten after failureWindow without failures.
+const (
+	accountFreeFailures = 10
+	ipFreeFailures      = 30
+	baseLockout         = 30 * time.Second
+	maxLockout          = 30 * time.Minute
+	failureWindow       = time.Hour
+)
+
+// Mail throttling. Password reset and verification emails requested without
+// signing in are counted per client IP and per recipient the same way, under
+// scopes of their own so that requesting mail cannot lock anyone out of
+// logging in.
+const (
+	recipientFreeMails = 3
+	ipFreeMails        = 10
+)
+
+// Throttle scopes.
+const (
+	ThrottleScopeIP            = "ip"
+	ThrottleScopeAccount       = "account"
+	ThrottleScopeMailIP        = "mail_ip"
+	ThrottleScopeMailRecipient = "mail_recipient"
+)
+
+var (
+	loginFailures  metric.Int64Counter
+	loginLockouts  metric.Int64Counter
+	loginThrottled metric.Int64Counter
+)
+
+func init() {
+	// The global meter forwards to the provider set in telemetry.Init
+	meter := otel.Meter(config.ServiceName)
+	loginFailures, _ = meter.Int64Counter("auth.login.failures",
+		metric.WithDescription("Failed password and MFA login attempts"))
+	loginLockouts, _ = meter.Int64Counter("auth.login.lockouts",
+		metric.WithDescription("Lockouts started by repeated login failures"))
+	loginThrottled, _ = meter.Int64Counter("auth.login.throttled",
+		metric.WithDescription("Login attempts refused because of a lockout"))
+}
+
+// CheckLoginThrottle returns how long the client must wait before trying to
+// log in to the account again, or 0 if it may try now. Empty values are not
+// checked.
+func CheckLoginThrottle(ctx context.Context, db *gorm.DB, ip, account string) (time.Duration, error) {
+	return checkThrottle(ctx, db, throttleKeys(ThrottleScopeIP, ip, ThrottleScopeAccount, account))
+}
+
+// CheckMailThrottle returns how long the client must wait before asking for
+// another email to the recipient, or 0 if it may ask now.
+func CheckMailThrottle(ctx context.Context, db *gorm.DB, ip, recipient string) (time.Duration, error) {
+	return checkThrottle(ctx, db, throttleKeys(ThrottleScopeMailIP, ip, ThrottleScopeMailRecipient, recipient))
+}
+
+// RecordMailRequest counts a request for an email to the recipient against
+// the IP and recipient, whether or not an email was sent.
+func RecordMailRequest(ctx context.Context, db *gorm.DB, ip, recipient string) error {
+	if ip != "" {
+		if err := recordFailure(ctx, db, ThrottleScopeMailIP, ip, ipFreeMails); err != nil {
+			return err
+		}
+	}
+	return recordFailure(ctx, db, ThrottleScopeMailRecipient, normalizeAccount(recipient), recipientFreeMails)
+}
+
+// checkThrottle returns the longest lockout held by any of the keys.
+func checkThrottle(ctx context.Context, db *gorm.DB, keys []string) (time.Duration, error) {
+	var records []database.LoginThrottle
+	if err := db.Where("throttle_key IN ? AND locked_until > ?", keys, time.Now()).Find(&records).Error; err != nil {
+		return 0, err
+	}
+
+	var wait time.Duration
+	for _, record := range records {
+		if d := time.Until(*record.LockedUntil); d > wait {
+			wait = d
+		}
+		loginThrottled.Add(ctx, 1, metric.WithAttributes(attribute.String("scope", record.Scope)))
+	}
+	return wait, nil
+}
+
+// RecordLoginFailure counts a failed attempt against the IP and account,
+// locking them out when they run out of free attempts.
+func RecordLoginFailure(ctx context.Context, db *gorm.DB, ip, account string) error {
+	loginFailures.Add(ctx, 1)
+	if ip != "" {
+		if err := recordFailure(ctx, db, ThrottleScopeIP, ip, ipFreeFailures); err != nil {
+			return err
+		}
+	}
+	if account != "" {
+		return recordFailure(ctx, db, ThrottleScopeAccount, normalizeAccount(account), accountFreeFailures)
+	}
+	return nil
+}
+
+// RecordLoginSuccess resets the account's failure counter. The IP counter is
+// left alone, so one working account cannot be used to reset it.
+func RecordLoginSuccess(db *gorm.DB, account string) error {
+	return db.Unscoped().Where("throttle_key = ?", throttleKey(ThrottleScopeAccount, normalizeAccount(account))).
+		Delete(&database.LoginThrottle{}).Error
+}
+
+// ListLoginThrottles returns the counters with recent failures, most recent first.
+func ListLoginThrottles(db *gorm.DB) ([]database.LoginThrottle, error) {
+	var records []database.LoginThrottle
+	err := db.Where("last_failure_at > ? OR locked_until > ?", time.Now().Add(-failureWindow), time.Now()).
+		Order("last_failure_at DESC").
+		Find(&records).Error
+	return records, err
+}
+
+// ClearLoginThrottle removes a counter and any lockout it holds.
+func ClearLoginThrottle(db *gorm.DB, id uint) error {
+	result := db.Unscoped().Delete(&database.LoginThrottle{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// recordFailure counts a failure in the database rather than in Go, so
+// concurrent failures against the same key are all counted.
+func recordFailure(ctx context.Context, db *gorm.DB, scope, subject string, free int) error {
+	now := time.Now()
+	key := throttleKey(scope, subject)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		counter := database.LoginThrottle{Key: key, Scope: scope, Subject: subject, LastFailureAt: now}
+		if err := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "throttle_key"}}, DoNothing: true}).
+			Create(&counter).Error; err != nil {
+			return err
+		}
+
+		// Counters idle for longer than the window start over
+		err := tx.Model(&database.LoginThrottle{}).Where("throttle_key = ?", key).Updates(map[string]any{
+			"failures":        gorm.Expr("CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END", now.Add(-failureWindow)),
+			"last_failure_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		var record database.LoginThrottle
+		if err := tx.Where("throttle_key = ?", key).First(&record).Error; err != nil {
+			return err
+		}
+		if record.Failures < free {
+			return nil
+		}
+
+		lockout := maxLockout
+		if shift := record.Failures - free; shift < 16 {
+			lockout = min(baseLockout<<shift, maxLockout)
+		}
+		until := now.Add(lockout)
+		loginLockouts.Add(ctx, 1, metric.WithAttributes(attribute.String("scope", scope)))
+		return tx.Model(&record).Update("locked_until", until).Error
+	})
+}
+
+// throttleKeys returns the keys of an IP counter and an account counter
+// under the given scopes. Empty values are left out.
+func throttleKeys(ipScope, ip, accountScope, account string) []string {
+	var keys []string
+	if ip != "" {
+		keys = append(keys, throttleKey(ipScope, ip))
+	}
+	if account != "" {
+		keys = append(keys, throttleKey(accountScope, normalizeAccount(account)))
+	}
+	return keys
+}
+
+func throttleKey(scope, subject string) string {
+	return scope + ":" + subject
+}
+
+// normalizeAccount makes differently cased spellings of an email share a counter.
+func normalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/techsquidtv/inkling/internal/config"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+// WebAuthnSessionTTL is how long a registration or login ceremony may take.
+const WebAuthnSessionTTL = 5 * time.Minute
+
+const (
+	webAuthnRegistration = "registration"
+	webAuthnLogin        = "login"
+)
+
+var (
+	// ErrInvalidWebAuthnSession is returned for unknown, expired or reused ceremonies.
+	ErrInvalidWebAuthnSession = errors.New("invalid or expired passkey session")
+	// ErrPasskeyRejected is returned when the authenticator response does not verify.
+	ErrPasskeyRejected = errors.New("passkey verification failed")
+	// ErrPasskeyCloned is returned when a credential's signature counter goes
+	// backwards, which means the private key may have been copied.
+	ErrPasskeyCloned = errors.New("passkey signature counter did not increase")
+)
+
+// WebAuthnConfig identifies the relying party passkeys are bound to.
+type WebAuthnConfig struct {
+	RPID          string   // Domain the credentials are scoped to, e.g. example.com
+	RPDisplayName string   // Name shown by the browser during registration
+	RPOrigins     []string // Origins allowed to run ceremonies, e.g. https://app.example.com
+}
+
+// WebAuthnConfigFromEnv reads WEBAUTHN_RP_ID and WEBAUTHN_RP_ORIGINS, falling
+// back to PUBLIC_URL for both. It returns false when passkeys cannot be
+// configured.
+func WebAuthnConfigFromEnv() (WebAuthnConfig, bool) {
+	cfg := WebAuthnConfig{
+		RPID:          os.Getenv("WEBAUTHN_RP_ID"),
+		RPDisplayName: config.AppName,
+	}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.RPOrigins = append(cfg.RPOrigins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	if len(cfg.RPOrigins) == 0 {
+		if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+			if u, err := url.Parse(publicURL); err == nil && u.Host != "" {
+				cfg.RPOrigins = []string{u.Scheme + "://" + u.Host}
+			}
+		}
+	}
+	if cfg.RPID == "" && len(cfg.RPOrigins) > 0 {
+		if u, err := url.Parse(cfg.RPOrigins[0]); err == nil {
+			cfg.RPID = u.Hostname()
+		}
+	}
+	return cfg, cfg.RPID != "" && len(cfg.RPOrigins) > 0
+}
+
+// Passkeys runs WebAuthn registration and login ceremonies. Ceremony state is
+// kept in the webauthn_sessions table so any replica can finish it.
+type Passkeys struct {
+	db *gorm.DB
+	wa *webauthn.WebAuthn
+}
+
+// NewPasskeys creates the passkey service for a relying party.
+func NewPasskeys(db *gorm.DB, cfg WebAuthnConfig) (*Passkeys, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     cfg.RPOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Passkeys{db: db, wa: wa}, nil
+}
+
+// webauthnUser adapts a user and their stored passkeys to webauthn.User.
+type webauthnUser struct {
+	user     *database.User
+	passkeys []database.Passkey
+}
+
+func (u *webauthnUser) WebAuthnID() []byte          { return []byte(u.user.WebAuthnID) }
+func (u *webauthnUser) WebAuthnName() string        { return u.user.Email }
+func (u *webauthnUser) WebAuthnDisplayName() string { return u.user.Name }
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, p := range u.passkeys {
+		id, err := base64.RawURLEncoding.DecodeString(p.CredentialID)
+		if err != nil {
+			continue
+		}
+		var transports []protocol.AuthenticatorTransport
+		for _, t := range strings.Split(p.Transports, ",") {
+			if t != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		creds = append(creds, webauthn.Credential{
+			ID:              id,
+			PublicKey:       p.PublicKey,
+			AttestationType: p.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: p.BackupEligible,
+				BackupState:    p.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{AAGUID: p.AAGUID, SignCount: p.SignCount},
+		})
+	}
+	return creds
+}
+
+// loadWebAuthnUser loads a user with their passkeys.
+func (p *Passkeys) loadWebAuthnUser(user *database.User) (*webauthnUser, error) {
+	u := &webauthnUser{user: user}
+	if err := p.db.Where("user_id = ?", user.ID).Find(&u.passkeys).Error; err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// BeginRegistration starts registering a new passkey for the user. It returns
+// the options to pass to navigator.credentials.create() and a session token to
+// send back with the result.
+func (p *Passkeys) BeginRegistration(user *database.User) (*protocol.CredentialCreation, string, error) {
+	// The user handle is random rather than derived from the user ID, so it
+	// reveals nothing about the account to the authenticator
+	if user.WebAuthnID == "" {
+		handle, err := randomToken(32)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := p.db.Model(user).Update("webauthn_id", handle).Error; err != nil {
+			return nil, "", err
+		}
+		user.WebAuthnID = handle
+	}
+
+	u, err := p.loadWebAuthnUser(user)
+	if err != nil {
+		return nil, "", err
+	}
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(u.passkeys))
+	for _, cred := range u.WebAuthnCredentials() {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+
+	creation, session, err := p.wa.BeginRegistration(u,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := p.saveSession(user.ID, webAuthnRegistration, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return creation, token, nil
+}
+
+// FinishRegistration verifies the authenticator's response and stores the new
+// passkey under the given name.
+func (p *Passkeys) FinishRegistration(user *database.User, token, name string, response []byte) (*database.Passkey, error) {
+	session, err := p.consumeSession(token, webAuthnRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != user.ID {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	data, err := decodeSessionData(session)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, errors.Join(ErrPasskeyRejected, err)
+	}
+	u, err := p.loadWebAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := p.wa.CreateCredential(u, *data, parsed)
+	if err != nil {
+		return nil, errors.Join(ErrPasskeyRejected, err)
+	}
+
+	transports := make([]string, 0, len(cred.Transport))
+	for _, t := range cred.Transport {
+		transports = append(transports, string(t))
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey := database.Passkey{
+		UserID:          user.ID,
+		Name:            name,
+		CredentialID:    base64.RawURLEncoding.EncodeToString(cred.ID),
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		Transports:      strings.Join(transports, ","),
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+	}
+	if err := p.db.Create(&passkey).Error; err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+// BeginLogin starts a passwordless login. Any discoverable passkey for this
+// relying party may answer, so no user needs to be known up front.
+func (p *Passkeys) BeginLogin() (*protocol.CredentialAssertion, string, error) {
+	assertion, session, err := p.wa.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := p.saveSession(0, webAuthnLogin, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, token, nil
+}
+
+// FinishLogin verifies a login assertion and returns the user it belongs to.
+// The credential's signature counter must increase, unless the authenticator
+// does not implement one.
+func (p *Passkeys) FinishLogin(token string, response []byte) (*database.User, error) {
+	session, err := p.consumeSession(token, webAuthnLogin)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeSessionData(session)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, errors.Join(ErrPasskeyRejected, err)
+	}
+
+	var u *webauthnUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		var user database.User
+		if err := p.db.Where("webauthn_id = ?", string(userHandle)).First(&user).Error; err != nil {
+			return nil, err
+		}
+		loaded, err := p.loadWebAuthnUser(&user)
+		if err != nil {
+			return nil, err
+		}
+		u = loaded
+		return u, nil
+	}
+	_, cred, err := p.wa.ValidatePasskeyLogin(handler, *data, parsed)
+	if err != nil {
+		return nil, errors.Join(ErrPasskeyRejected, err)
+	}
+	if cred.Authenticator.CloneWarning {
+		return nil, ErrPasskeyCloned
+	}
+
+	// Only move the counter forward from the value we validated against, so
+	// two concurrent logins with the same counter cannot both succeed
+	credentialID := base64.RawURLEncoding.EncodeToString(cred.ID)
+	var stored database.Passkey
+	for _, pk := range u.passkeys {
+		if pk.CredentialID == credentialID {
+			stored = pk
+		}
+	}
+	result := p.db.Model(&database.Passkey{}).
+		Where("id = ? AND sign_count = ?", stored.ID, stored.SignCount).
+		Updates(map[string]any{
+			"sign_count":   cred.Authenticator.SignCount,
+			"backup_state": cred.Flags.BackupState,
+			"last_used_at": time.Now(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrPasskeyCloned
+	}
+	return u.user, nil
+}
+
+// saveSession stores ceremony state and returns the raw token that refers to it.
+func (p *Passkeys) saveSession(userID uint, kind string, data *webauthn.SessionData) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	// Clean up abandoned ceremonies while we are here
+	if err := p.db.Unscoped().Where("expires_at < ?", now).Delete(&database.WebAuthnSession{}).Error; err != nil {
+		return "", err
+	}
+	session := database.WebAuthnSession{
+		TokenHash: HashKey(raw),
+		UserID:    userID,
+		Kind:      kind,
+		Data:      string(encoded),
+		ExpiresAt: now.Add(WebAuthnSessionTTL),
+	}
+	if err := p.db.Create(&session).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeSession deletes and returns the ceremony state for a token. Sessions
+// are single-use whether or not the ceremony succeeds.
+func (p *Passkeys) consumeSession(token, kind string) (*database.WebAuthnSession, error) {
+	var session database.WebAuthnSession
+	if err := p.db.Where("token_hash = ? AND kind = ?", HashKey(token), kind).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidWebAuthnSession
+		}
+		return nil, err
+	}
+	result := p.db.Unscoped().Delete(&session)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || time.Now().After(session.ExpiresAt) {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	return &session, nil
+}
+
+func decodeSessionData(session *database.WebAuthnSession) (*webauthn.SessionData, error) {
+	var data webauthn.SessionData
+	if err := json.Unmarshal([]byte(session.Data), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
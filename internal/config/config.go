@@ -15,4 +15,11 @@ const (
 
 	// DefaultDBName is the default database filename
 	DefaultDBName = "inkling.db"
+
+	// EnvProduction is the environment name that enables production safety checks
+	EnvProduction = "production"
+
+	// EnvDevelopment is the default environment, which allows conveniences
+	// unsafe in production such as logging emails instead of sending them
+	EnvDevelopment = "development"
 )
@@ -0,0 +1,361 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// ErrBackupUnsupported is returned for databases other than SQLite, which
+// come with backup tools of their own (pg_dump, mysqldump).
+var ErrBackupUnsupported = errors.New("backups are only supported for SQLite databases")
+
+// BackupExtension is the file extension of backups, followed by ".gz" when
+// they are compressed.
+const BackupExtension = ".db"
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// BackupInfo describes a backup file.
+type BackupInfo struct {
+	Path          string
+	Size          int64
+	Checksum      string // Hex SHA-256 of the file
+	SchemaVersion string // Newest migration applied to the backed up database
+	Compressed    bool
+}
+
+// Backup writes a consistent snapshot of the SQLite database to path with
+// VACUUM INTO, which is safe while the database is in use. The snapshot is
+// gzip-compressed when compress is set. The path must not exist yet.
+func Backup(db *gorm.DB, path string, compress bool) (*BackupInfo, error) {
+	if db.Dialector.Name() != "sqlite" {
+		return nil, ErrBackupUnsupported
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// VACUUM INTO refuses to overwrite, so snapshot to a fresh name next to
+	// the destination and move it into place once complete
+	snapshot, err := tempPath(filepath.Dir(path), ".inkling-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(snapshot)
+	if err := db.Exec("VACUUM INTO ?", snapshot).Error; err != nil {
+		return nil, fmt.Errorf("snapshot failed: %w", err)
+	}
+
+	if compress {
+		if err := gzipFile(snapshot, path); err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+	} else if err := os.Rename(snapshot, path); err != nil {
+		return nil, err
+	}
+
+	info, err := inspectBackupFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info.SchemaVersion = version
+	return info, nil
+}
+
+// WriteChecksumFile writes the backup's checksum next to it, as
+// <path>.sha256 in the format of sha256sum.
+func WriteChecksumFile(info *BackupInfo) (string, error) {
+	path := info.Path + ".sha256"
+	line := fmt.Sprintf("%s  %s\n", info.Checksum, filepath.Base(info.Path))
+	return path, os.WriteFile(path, []byte(line), 0o644)
+}
+
+// readChecksumFile returns the checksum stored next to a backup, or an empty
+// string when there is none.
+func readChecksumFile(backupPath string) (string, error) {
+	data, err := os.ReadFile(backupPath + ".sha256")
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	checksum, _, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	return strings.ToLower(checksum), nil
+}
+
+// Restore replaces the SQLite database at dbPath with a backup. The backup
+// is checked against its .sha256 file when there is one, decompressed if
+// needed, and must contain a schema this build knows; older schemas are
+// migrated on the next start. The replaced database is kept as
+// <dbPath>.pre-restore-<time>, whose path is returned. The server must be
+// stopped while restoring.
+func Restore(backupPath, dbPath string) (*BackupInfo, string, error) {
+	info, err := inspectBackupFile(backupPath)
+	if err != nil {
+		return nil, "", err
+	}
+	expected, err := readChecksumFile(backupPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if expected != "" && expected != info.Checksum {
+		return nil, "", fmt.Errorf("checksum mismatch: %s.sha256 has %s, file is %s", backupPath, expected, info.Checksum)
+	}
+
+	// Unpack to a fresh file next to the database, so the swap is a rename
+	restored, err := tempPath(filepath.Dir(dbPath), ".inkling-restore-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(restored)
+	if info.Compressed {
+		err = gunzipFile(backupPath, restored)
+	} else {
+		err = copyFile(backupPath, restored)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if info.SchemaVersion, err = checkRestorable(restored); err != nil {
+		return nil, "", err
+	}
+
+	previous := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		previous = fmt.Sprintf("%s.pre-restore-%s", dbPath, time.Now().UTC().Format("20060102150405"))
+		if err := os.Rename(dbPath, previous); err != nil {
+			return nil, "", err
+		}
+		// The write-ahead log belongs to the replaced database
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if _, err := os.Stat(dbPath + suffix); err == nil {
+				if err := os.Rename(dbPath+suffix, previous+suffix); err != nil {
+					return nil, "", err
+				}
+			}
+		}
+	}
+	if err := os.Rename(restored, dbPath); err != nil {
+		return nil, "", err
+	}
+	return info, previous, nil
+}
+
+// checkRestorable opens a restored database and returns its schema version.
+// It refuses damaged files, databases without migrations, and schemas newer
+// than this build.
+func checkRestorable(path string) (string, error) {
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		return "", fmt.Errorf("not a SQLite database: %w", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	var result string
+	if err := db.Raw("PRAGMA quick_check").Scan(&result).Error; err != nil {
+		return "", fmt.Errorf("not a SQLite database: %w", err)
+	}
+	if result != "ok" {
+		return "", fmt.Errorf("backup is damaged: %s", result)
+	}
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return "", err
+	}
+	if version == "" {
+		return "", errors.New("backup has no schema version, it was not made by Inkling")
+	}
+	if _, ok := findMigration(version); !ok {
+		return "", fmt.Errorf("backup has schema version %s, which this build does not know; restore it with a newer build", version)
+	}
+	return version, nil
+}
+
+// inspectBackupFile returns the size and checksum of a backup file and
+// whether it is compressed.
+func inspectBackupFile(path string) (*BackupInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(len(gzipMagic))
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupInfo{
+		Path:       path,
+		Size:       size,
+		Checksum:   hex.EncodeToString(hash.Sum(nil)),
+		Compressed: bytes.Equal(magic, gzipMagic),
+	}, nil
+}
+
+// BackupSchedule configures scheduled backups.
+type BackupSchedule struct {
+	Dir      string        // Directory the backups are written to
+	Interval time.Duration // Time between backups
+	Keep     int           // Number of backups to keep; older ones are deleted. 0 keeps all
+}
+
+// StartBackups writes a compressed, checksummed backup to the schedule's
+// directory at every interval until the context is cancelled.
+func StartBackups(ctx context.Context, db *gorm.DB, schedule BackupSchedule) {
+	go func() {
+		ticker := time.NewTicker(schedule.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				info, err := ScheduledBackup(db, schedule)
+				if err != nil {
+					log.Error("scheduled backup failed", "err", err)
+					continue
+				}
+				log.Info("wrote scheduled backup", "path", info.Path, "size", info.Size)
+			}
+		}
+	}()
+}
+
+// ScheduledBackup writes one backup to the schedule's directory, named after
+// the current time, then deletes the backups beyond the number to keep.
+func ScheduledBackup(db *gorm.DB, schedule BackupSchedule) (*BackupInfo, error) {
+	if err := os.MkdirAll(schedule.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	name := "inkling-" + time.Now().UTC().Format("20060102T150405.000000000Z") + BackupExtension + ".gz"
+	info, err := Backup(db, filepath.Join(schedule.Dir, name), true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := WriteChecksumFile(info); err != nil {
+		return nil, err
+	}
+	return info, pruneBackups(schedule.Dir, schedule.Keep)
+}
+
+// pruneBackups deletes all but the newest keep scheduled backups in dir,
+// with their checksum files.
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, "inkling-*"+BackupExtension+".gz"))
+	if err != nil {
+		return err
+	}
+	// Names sort by the time they were written
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for _, path := range backups[min(keep, len(backups)):] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		os.Remove(path + ".sha256")
+	}
+	return nil
+}
+
+// tempPath returns an unused file name in dir matching the pattern.
+func tempPath(dir, pattern string) (string, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), os.Remove(f.Name())
+}
+
+// gzipFile writes a compressed copy of src to dst.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// gunzipFile writes a decompressed copy of src to dst.
+func gunzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return writeFile(dst, zr)
+}
+
+// copyFile writes a copy of src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFile(dst, in)
+}
+
+// writeFile writes r to a new file at path and syncs it to disk.
+func writeFile(path string, r io.Reader) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,95 @@
+package database_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestBackupRestore(t *testing.T) {
+	db := openTestDB(t)
+	db.Create(&database.User{Email: "kept@example.com", Name: "Kept", Role: database.RoleUser})
+	dir := t.TempDir()
+
+	info, err := database.Backup(db, filepath.Join(dir, "backup.db.gz"), true)
+	require.NoError(t, err)
+	assert.True(t, info.Compressed)
+	assert.NotEmpty(t, info.SchemaVersion)
+	_, err = database.WriteChecksumFile(info)
+	require.NoError(t, err)
+
+	_, err = database.Backup(db, info.Path, true)
+	assert.Error(t, err, "existing backups are not overwritten")
+
+	// Restoring moves the current database aside
+	dbPath := filepath.Join(dir, "app.db")
+	require.NoError(t, os.WriteFile(dbPath, []byte("current"), 0o600))
+	restoredInfo, previous, err := database.Restore(info.Path, dbPath)
+	require.NoError(t, err)
+	assert.Equal(t, info.SchemaVersion, restoredInfo.SchemaVersion)
+	kept, err := os.ReadFile(previous)
+	require.NoError(t, err)
+	assert.Equal(t, "current", string(kept))
+
+	restored, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	require.NoError(t, err)
+	var user database.User
+	assert.NoError(t, restored.Where("email = ?", "kept@example.com").First(&user).Error)
+
+	// Backups from a newer build are refused
+	restored.Create(&database.SchemaMigration{Version: "99991231000000", Name: "future", AppliedAt: time.Now()})
+	if sqlDB, err := restored.DB(); err == nil {
+		sqlDB.Close()
+	}
+	future, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+	futurePath := filepath.Join(dir, "future.db")
+	require.NoError(t, os.WriteFile(futurePath, future, 0o600))
+	_, _, err = database.Restore(futurePath, dbPath)
+	assert.ErrorContains(t, err, "99991231000000")
+
+	// So are files that do not match their checksum or are not databases
+	require.NoError(t, os.WriteFile(futurePath+".sha256", []byte("0000  future.db\n"), 0o600))
+	_, _, err = database.Restore(futurePath, dbPath)
+	assert.ErrorContains(t, err, "checksum mismatch")
+	notDB := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(notDB, bytes.Repeat([]byte("not a database "), 100), 0o600))
+	_, _, err = database.Restore(notDB, dbPath)
+	assert.Error(t, err)
+
+	// The database is untouched by refused restores
+	after, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+	assert.Equal(t, future, after)
+}
+
+func TestScheduledBackups(t *testing.T) {
+	db := openTestDB(t)
+	schedule := database.BackupSchedule{Dir: filepath.Join(t.TempDir(), "backups"), Interval: time.Hour, Keep: 2}
+
+	var written []string
+	for range 3 {
+		info, err := database.ScheduledBackup(db, schedule)
+		require.NoError(t, err)
+		written = append(written, info.Path)
+	}
+
+	entries, err := os.ReadDir(schedule.Dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{
+		filepath.Base(written[1]), filepath.Base(written[1]) + ".sha256",
+		filepath.Base(written[2]), filepath.Base(written[2]) + ".sha256",
+	}, names)
+}
@@ -1,7 +1,8 @@
 package database
 
 import (
-	"github.com/glebarez/sqlite"
+	"fmt"
+
 	"gorm.io/gorm"
 	"gorm.io/plugin/opentelemetry/tracing"
 )
@@ -9,21 +10,28 @@ import (
 // DB is the global database instance.
 var DB *gorm.DB
 
-// InitDB initializes the SQLite database connection and runs migrations.
-func InitDB(path string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+// InitDB connects to the database at the URL and brings its schema up to
+// date. See Dialector for the supported URLs. Without autoMigrate, pending
+// migrations are not applied and ErrPendingMigrations is returned instead, so
+// deploys can run them as a separate step.
+func InitDB(databaseURL string, autoMigrate bool) (*gorm.DB, error) {
+	db, err := Open(databaseURL)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Use(tracing.NewPlugin()); err != nil {
-		return nil, err
-	}
-
-	// Auto-migrate models
-	err = db.AutoMigrate(&Product{}, &User{}, &APIKey{}, &AppSettings{})
-	if err != nil {
-		return nil, err
+	if autoMigrate {
+		if _, err := Migrate(db); err != nil {
+			return nil, err
+		}
+	} else {
+		pending, err := PendingMigrations(db)
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) > 0 {
+			return nil, fmt.Errorf("%w: %d to apply, run the migrate up command", ErrPendingMigrations, len(pending))
+		}
 	}
 
 	DB = db
@@ -35,6 +43,22 @@ func InitDB(path string) (*gorm.DB, error) {
 	return db, nil
 }
 
+// Open connects to the database at the URL without migrating it.
+func Open(databaseURL string) (*gorm.DB, error) {
+	dialector, err := Dialector(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Use(tracing.NewPlugin()); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
 // seedDB populates the database with initial data if empty.
 func seedDB(db *gorm.DB) error {
 	// Add initial seed data here if needed.
@@ -0,0 +1,27 @@
+package database_test
+
+import (
+	"testing"
+
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// openTestDB returns an empty, migrated in-memory SQLite database for a test.
+// The handler tests cover the other databases.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		t.Cleanup(func() { sqlDB.Close() })
+	}
+	if _, err := database.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	return db
+}
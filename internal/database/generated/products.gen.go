@@ -32,6 +32,7 @@ func newProduct(db *gorm.DB, opts ...gen.DOOption) product {
 	_product.CreatedAt = field.NewTime(tableName, "created_at")
 	_product.UpdatedAt = field.NewTime(tableName, "updated_at")
 	_product.DeletedAt = field.NewField(tableName, "deleted_at")
+	_product.OrganizationID = field.NewUint(tableName, "organization_id")
 	_product.Code = field.NewString(tableName, "code")
 	_product.Price = field.NewUint(tableName, "price")
 
@@ -43,13 +44,14 @@ func newProduct(db *gorm.DB, opts ...gen.DOOption) product {
 type product struct {
 	productDo
 
-	ALL       field.Asterisk
-	ID        field.Uint
-	CreatedAt field.Time
-	UpdatedAt field.Time
-	DeletedAt field.Field
-	Code      field.String
-	Price     field.Uint
+	ALL            field.Asterisk
+	ID             field.Uint
+	CreatedAt      field.Time
+	UpdatedAt      field.Time
+	DeletedAt      field.Field
+	OrganizationID field.Uint
+	Code           field.String
+	Price          field.Uint
 
 	fieldMap map[string]field.Expr
 }
@@ -70,6 +72,7 @@ func (p *product) updateTableName(table string) *product {
 	p.CreatedAt = field.NewTime(table, "created_at")
 	p.UpdatedAt = field.NewTime(table, "updated_at")
 	p.DeletedAt = field.NewField(table, "deleted_at")
+	p.OrganizationID = field.NewUint(table, "organization_id")
 	p.Code = field.NewString(table, "code")
 	p.Price = field.NewUint(table, "price")
 
@@ -88,11 +91,12 @@ func (p *product) GetFieldByName(fieldName string) (field.OrderExpr, bool) {
 }
 
 func (p *product) fillFieldMap() {
-	p.fieldMap = make(map[string]field.Expr, 6)
+	p.fieldMap = make(map[string]field.Expr, 7)
 	p.fieldMap["id"] = p.ID
 	p.fieldMap["created_at"] = p.CreatedAt
 	p.fieldMap["updated_at"] = p.UpdatedAt
 	p.fieldMap["deleted_at"] = p.DeletedAt
+	p.fieldMap["organization_id"] = p.OrganizationID
 	p.fieldMap["code"] = p.Code
 	p.fieldMap["price"] = p.Price
 }
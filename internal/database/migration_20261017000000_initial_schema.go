@@ -0,0 +1,457 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The initial migration creates the schema, and upgrades databases created by
+// AutoMigrate before versioned migrations existed. It works on frozen copies
+// of the models as they were at this version, so later changes to the models
+// do not change what it does; those changes are migrations of their own.
+func init() {
+	registerMigration(Migration{
+		Version: "20261017000000",
+		Name:    "initial_schema",
+		Up: func(tx *gorm.DB) error {
+			// Users created before email verification existed are treated as verified
+			backfillVerified := tx.Migrator().HasTable(&initialUser{}) && !tx.Migrator().HasColumn(&initialUser{}, "EmailVerifiedAt")
+
+			// Single-tenant installs from before organizations move into a default one
+			migrateOrganizations := tx.Migrator().HasTable(&initialUser{}) && !tx.Migrator().HasTable(&initialOrganization{})
+
+			// The settings key column was renamed, as "key" is reserved in MySQL
+			if tx.Migrator().HasColumn(&initialAppSettings{}, "key") && !tx.Migrator().HasColumn(&initialAppSettings{}, "setting_key") {
+				if err := tx.Migrator().RenameColumn(&initialAppSettings{}, "key", "setting_key"); err != nil {
+					return err
+				}
+			}
+
+			// Product codes were unique across the install before organizations
+			if tx.Migrator().HasConstraint(&initialProduct{}, "uni_products_code") {
+				if err := tx.Migrator().DropConstraint(&initialProduct{}, "uni_products_code"); err != nil {
+					return err
+				}
+			}
+
+			if err := tx.AutoMigrate(initialModels()...); err != nil {
+				return err
+			}
+			if err := seedInitialRoles(tx); err != nil {
+				return err
+			}
+
+			if backfillVerified {
+				if err := tx.Model(&initialUser{}).Where("email_verified_at IS NULL").
+					Update("email_verified_at", gorm.Expr("created_at")).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := migrateLegacyData(tx); err != nil {
+				return err
+			}
+
+			if migrateOrganizations {
+				if err := migrateDefaultOrganization(tx); err != nil {
+					return err
+				}
+			}
+			return migrateLegacyProducts(tx)
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(initialModels()...)
+		},
+	})
+}
+
+// initialModels returns the frozen models with a table of their own.
+func initialModels() []any {
+	return []any{&initialProduct{}, &initialUser{}, &initialAPIKey{}, &initialAppSettings{}, &initialSession{}, &initialRefreshToken{}, &initialSigningKey{}, &initialPendingLogin{}, &initialOIDCProviderConfig{}, &initialIdentity{}, &initialMFAEnrollment{}, &initialRecoveryCode{}, &initialMFAChallenge{}, &initialPasskey{}, &initialWebAuthnSession{}, &initialLoginThrottle{}, &initialAuditEvent{}, &initialOrganization{}, &initialMembership{}, &initialOrgInvitation{}, &initialRole{}, &initialInvitation{}, &initialSCIMToken{}, &initialLDAPConfig{}}
+}
+
+// seedInitialRoles creates the built-in roles that do not exist yet. Changes
+// made to the user role before versioned migrations existed are kept.
+func seedInitialRoles(db *gorm.DB) error {
+	roles := []initialRole{
+		{Name: RoleAdmin, Description: "Full access, including every admin endpoint", Permissions: `["*"]`, BuiltIn: true},
+		{Name: RoleUser, Description: "Standard user access", Permissions: `[]`, BuiltIn: true},
+	}
+	for _, role := range roles {
+		if err := db.Where(initialRole{Name: role.Name}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyAPIKeyScopes are granted to API keys from before scopes existed, which
+// could call every endpoint their owner could: every scope there was then.
+const legacyAPIKeyScopes = `["profile:read","profile:write","keys:read","keys:write","products:write","users:read","users:write","settings:read","settings:write","audit:read","orgs:read","orgs:write","roles:read","roles:write"]`
+
+// migrateLegacyData backfills columns added after data was already written.
+func migrateLegacyData(db *gorm.DB) error {
+	// OIDC users created before named providers belong to the env-configured provider
+	if err := db.Model(&initialUser{}).
+		Where("internal_id IS NOT NULL AND (provider IS NULL OR provider = '')").
+		Update("provider", DefaultOIDCProvider).Error; err != nil {
+		return err
+	}
+
+	// API keys created before scopes acted with the full access of their owner
+	if err := db.Model(&initialAPIKey{}).
+		Where("scopes IS NULL OR scopes = '' OR scopes = 'null'").
+		Update("scopes", legacyAPIKeyScopes).Error; err != nil {
+		return err
+	}
+
+	// Service accounts kept their client ID in the email column before it had its own
+	if err := db.Model(&initialUser{}).
+		Where("service_account = ? AND client_id IS NULL", true).
+		Update("client_id", gorm.Expr("email")).Error; err != nil {
+		return err
+	}
+
+	// OIDC users created before the identities table get the identity they signed up with
+	var users []initialUser
+	if err := db.Where("internal_id IS NOT NULL AND NOT EXISTS (?)",
+		db.Model(&initialIdentity{}).Select("1").Where("identities.user_id = users.id"),
+	).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		identity := initialIdentity{UserID: user.ID, Provider: user.Provider, Subject: *user.InternalID, Email: user.Email}
+		if err := db.Create(&identity).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDefaultOrganization moves every existing user into the default
+// organization. Site admins become its owners. It does nothing if there are
+// no users.
+func migrateDefaultOrganization(db *gorm.DB) error {
+	var users []initialUser
+	if err := db.Find(&users).Error; err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	org := initialOrganization{Slug: DefaultOrganization, Name: "Default"}
+	if err := db.Create(&org).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		role := OrgRoleMember
+		if user.Role == RoleAdmin {
+			role = OrgRoleOwner
+		}
+		if err := db.Create(&initialMembership{OrganizationID: org.ID, UserID: user.ID, Role: role}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLegacyProducts moves products from before organizations into the
+// default organization, creating it if there is none.
+func migrateLegacyProducts(db *gorm.DB) error {
+	const legacy = "organization_id IS NULL OR organization_id = 0"
+	var count int64
+	if err := db.Unscoped().Model(&initialProduct{}).Where(legacy).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	var org initialOrganization
+	if err := db.Where(initialOrganization{Slug: DefaultOrganization}).Attrs(initialOrganization{Name: "Default"}).
+		FirstOrCreate(&org).Error; err != nil {
+		return err
+	}
+	return db.Unscoped().Model(&initialProduct{}).Where(legacy).Update("organization_id", org.ID).Error
+}
+
+// The models as of the initial migration. Do not change them: they describe
+// the schema this migration creates, not the current one.
+
+type initialProduct struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"uniqueIndex:idx_products_org_code"`
+	Code           string `gorm:"uniqueIndex:idx_products_org_code"`
+	Price          uint
+}
+
+type initialUser struct {
+	gorm.Model
+	Email           string `gorm:"unique;index"`
+	EmailVerifiedAt *time.Time
+	Name            string
+	PasswordHash    string
+	Provider        string  `gorm:"size:255;uniqueIndex:idx_users_identity"`
+	InternalID      *string `gorm:"index;uniqueIndex:idx_users_identity"`
+	Role            string  `gorm:"default:'user'"`
+	RoleLocked      bool
+	WebAuthnID      string  `gorm:"column:webauthn_id;index"`
+	ServiceAccount  bool    `gorm:"index"`
+	ClientID        *string `gorm:"uniqueIndex"`
+	ExternalID      string  `gorm:"index"`
+	DisabledAt      *time.Time
+	APIKeys         []initialAPIKey `gorm:"foreignKey:UserID"`
+}
+
+type initialRole struct {
+	gorm.Model
+	Name        string `gorm:"size:255;uniqueIndex"`
+	Description string
+	Permissions string
+	BuiltIn     bool
+}
+
+type initialAPIKey struct {
+	gorm.Model
+	UserID         uint `gorm:"index"`
+	Name           string
+	Prefix         string
+	KeyHash        string `gorm:"unique;index"`
+	Scopes         string
+	LastUsed       *time.Time
+	ExpiresAt      *time.Time
+	OrganizationID *uint `gorm:"index"`
+	CreatedByID    *uint
+}
+
+type initialAppSettings struct {
+	gorm.Model
+	Key   string `gorm:"column:setting_key;unique;index"`
+	Value string
+}
+
+type initialSession struct {
+	gorm.Model
+	UserID         uint  `gorm:"index"`
+	ImpersonatorID *uint `gorm:"index"`
+	APIKeyID       *uint `gorm:"index"`
+	UserAgent      string
+	IPAddress      string
+	LastUsedAt     time.Time
+	ExpiresAt      time.Time `gorm:"index"`
+	RevokedAt      *time.Time
+}
+
+type initialRefreshToken struct {
+	gorm.Model
+	SessionID uint      `gorm:"index"`
+	TokenHash string    `gorm:"unique;index"`
+	ExpiresAt time.Time `gorm:"index"`
+	UsedAt    *time.Time
+}
+
+type initialSigningKey struct {
+	gorm.Model
+	KID        string `gorm:"unique;index"`
+	Algorithm  string
+	PrivateKey string
+	PublicKey  string
+	Encrypted  bool
+	RotatedAt  *time.Time
+	ExpiresAt  *time.Time
+}
+
+type initialPendingLogin struct {
+	gorm.Model
+	State        string `gorm:"unique;index"`
+	Nonce        string
+	CodeVerifier string
+	Provider     string
+	LinkUserID   *uint
+	Invitation   string
+	ReturnTo     string
+	ExpiresAt    time.Time
+}
+
+type initialIdentity struct {
+	gorm.Model
+	UserID      uint   `gorm:"index"`
+	Provider    string `gorm:"size:255;uniqueIndex:idx_identities_subject"`
+	Subject     string `gorm:"size:255;uniqueIndex:idx_identities_subject"`
+	Email       string
+	LastLoginAt *time.Time
+}
+
+type initialOIDCProviderConfig struct {
+	gorm.Model
+	Slug         string `gorm:"unique;index"`
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Enabled      bool
+}
+
+type initialMFAEnrollment struct {
+	gorm.Model
+	UserID       uint `gorm:"unique;index"`
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+type initialRecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	CodeHash string `gorm:"unique;index"`
+	UsedAt   *time.Time
+}
+
+type initialMFAChallenge struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"unique;index"`
+	ReturnTo  string
+	Attempts  int
+	ExpiresAt time.Time
+}
+
+type initialPasskey struct {
+	gorm.Model
+	UserID          uint `gorm:"index"`
+	Name            string
+	CredentialID    string `gorm:"unique;index"`
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	SignCount       uint32
+	Transports      string
+	BackupEligible  bool
+	BackupState     bool
+	LastUsedAt      *time.Time
+}
+
+type initialWebAuthnSession struct {
+	gorm.Model
+	TokenHash string `gorm:"unique;index"`
+	UserID    uint
+	Kind      string
+	Data      string
+	ExpiresAt time.Time
+}
+
+type initialLoginThrottle struct {
+	gorm.Model
+	Key           string `gorm:"column:throttle_key;unique;index"`
+	Scope         string
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+type initialAuditEvent struct {
+	ID         uint      `gorm:"primarykey"`
+	CreatedAt  time.Time `gorm:"index"`
+	ActorID    *uint     `gorm:"index"`
+	ActorEmail string
+	Action     string `gorm:"index"`
+	Outcome    string
+	TargetType string `gorm:"index:idx_audit_target"`
+	TargetID   string `gorm:"index:idx_audit_target"`
+	IPAddress  string
+	UserAgent  string
+	RequestID  string
+	Changes    string
+	Details    string
+}
+
+type initialOrganization struct {
+	gorm.Model
+	Slug       string `gorm:"unique;index"`
+	Name       string
+	ExternalID string `gorm:"index"`
+}
+
+type initialMembership struct {
+	gorm.Model
+	OrganizationID uint `gorm:"uniqueIndex:idx_memberships_org_user"`
+	UserID         uint `gorm:"index;uniqueIndex:idx_memberships_org_user"`
+	Role           string
+}
+
+type initialOrgInvitation struct {
+	gorm.Model
+	OrganizationID uint `gorm:"index"`
+	Email          string
+	Role           string
+	TokenHash      string `gorm:"unique;index"`
+	InvitedByID    uint
+	ExpiresAt      time.Time
+	AcceptedAt     *time.Time
+}
+
+type initialInvitation struct {
+	gorm.Model
+	Email          string `gorm:"index"`
+	Role           string
+	TokenHash      string `gorm:"unique;index"`
+	InvitedByID    uint
+	ExpiresAt      time.Time
+	AcceptedAt     *time.Time
+	AcceptedUserID *uint
+}
+
+type initialSCIMToken struct {
+	gorm.Model
+	Name        string
+	Prefix      string
+	TokenHash   string `gorm:"unique;index"`
+	CreatedByID uint
+	LastUsed    *time.Time
+	ExpiresAt   *time.Time
+}
+
+type initialLDAPConfig struct {
+	gorm.Model
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+	EmailAttribute     string
+	NameAttribute      string
+	GroupAttribute     string
+	GroupRoles         string
+	Enabled            bool
+}
+
+func (initialProduct) TableName() string            { return "products" }
+func (initialUser) TableName() string               { return "users" }
+func (initialRole) TableName() string               { return "roles" }
+func (initialAPIKey) TableName() string             { return "api_keys" }
+func (initialAppSettings) TableName() string        { return "app_settings" }
+func (initialSession) TableName() string            { return "sessions" }
+func (initialRefreshToken) TableName() string       { return "refresh_tokens" }
+func (initialSigningKey) TableName() string         { return "signing_keys" }
+func (initialPendingLogin) TableName() string       { return "pending_logins" }
+func (initialIdentity) TableName() string           { return "identities" }
+func (initialOIDCProviderConfig) TableName() string { return "o_id_c_provider_configs" }
+func (initialMFAEnrollment) TableName() string      { return "mfa_enrollments" }
+func (initialRecoveryCode) TableName() string       { return "recovery_codes" }
+func (initialMFAChallenge) TableName() string       { return "mfa_challenges" }
+func (initialPasskey) TableName() string            { return "passkeys" }
+func (initialWebAuthnSession) TableName() string    { return "web_authn_sessions" }
+func (initialLoginThrottle) TableName() string      { return "login_throttles" }
+func (initialAuditEvent) TableName() string         { return "audit_events" }
+func (initialOrganization) TableName() string       { return "organizations" }
+func (initialMembership) TableName() string         { return "memberships" }
+func (initialOrgInvitation) TableName() string      { return "org_invitations" }
+func (initialInvitation) TableName() string         { return "invitations" }
+func (initialSCIMToken) TableName() string          { return "scim_tokens" }
+func (initialLDAPConfig) TableName() string         { return "ldap_configs" }
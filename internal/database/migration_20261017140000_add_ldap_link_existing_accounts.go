@@ -0,0 +1,28 @@
+package database
+
+import "gorm.io/gorm"
+
+// ldapLinkExistingAccounts is the column added to the LDAP settings, frozen at
+// this version.
+type ldapLinkExistingAccounts struct {
+	LinkExistingAccounts bool
+}
+
+func (ldapLinkExistingAccounts) TableName() string { return "ldap_configs" }
+
+func init() {
+	registerMigration(Migration{
+		Version: "20261017140000",
+		Name:    "add_ldap_link_existing_accounts",
+		Up: func(tx *gorm.DB) error {
+			// Databases upgraded from before versioned migrations may have it
+			if tx.Migrator().HasColumn(&ldapLinkExistingAccounts{}, "LinkExistingAccounts") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&ldapLinkExistingAccounts{}, "LinkExistingAccounts")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&ldapLinkExistingAccounts{}, "LinkExistingAccounts")
+		},
+	})
+}
@@ -0,0 +1,42 @@
+package database
+
+import "gorm.io/gorm"
+
+// oidcProviderRoleMappings are the columns added to the stored OIDC
+// providers, frozen at this version.
+type oidcProviderRoleMappings struct {
+	RoleMappings string
+	DefaultRole  string
+}
+
+func (oidcProviderRoleMappings) TableName() string { return "o_id_c_provider_configs" }
+
+// Role mappings used to be a single setting applied to every provider. The
+// setting now applies to the env-configured provider only, so stored
+// providers start without mappings and keep their users' roles.
+func init() {
+	registerMigration(Migration{
+		Version: "20261017150000",
+		Name:    "add_oidc_provider_role_mappings",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"RoleMappings", "DefaultRole"} {
+				// Databases upgraded from before versioned migrations may have it
+				if tx.Migrator().HasColumn(&oidcProviderRoleMappings{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&oidcProviderRoleMappings{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"RoleMappings", "DefaultRole"} {
+				if err := tx.Migrator().DropColumn(&oidcProviderRoleMappings{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
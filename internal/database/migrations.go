@@ -0,0 +1,258 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrPendingMigrations is returned by InitDB when migrations are not applied
+// automatically and the schema is behind.
+var ErrPendingMigrations = errors.New("database has pending migrations")
+
+// Migration is a versioned, reversible schema change. Migrations live in
+// migration_<version>_<name>.go files in this package, register themselves
+// from init and run in version order.
+type Migration struct {
+	Version string // UTC timestamp, e.g. "20261017000000"
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error // Nil for migrations that cannot be reverted
+}
+
+// SchemaMigration records an applied migration in the schema_migrations table.
+type SchemaMigration struct {
+	Version   string `gorm:"primaryKey;size:64"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationState is a migration as reported by MigrationStatus.
+type MigrationState struct {
+	Version   string
+	Name      string
+	AppliedAt *time.Time // Nil while pending
+	Unknown   bool       // Applied, but not part of this build
+}
+
+// migrations are the registered migrations, in version order.
+var migrations []Migration
+
+// registerMigration adds a migration. It is called from init, so mistakes in
+// a migration file panic at startup rather than half-applying later.
+func registerMigration(m Migration) {
+	if !migrationVersionPattern.MatchString(m.Version) || m.Up == nil {
+		panic(fmt.Sprintf("invalid migration %s_%s", m.Version, m.Name))
+	}
+	for _, existing := range migrations {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("duplicate migration version %s", m.Version))
+		}
+	}
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+}
+
+// Migrations returns the registered migrations, in version order.
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// appliedMigrations returns the applied migrations by version.
+func appliedMigrations(db *gorm.DB) (map[string]SchemaMigration, error) {
+	applied := map[string]SchemaMigration{}
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return applied, nil
+	}
+	var records []SchemaMigration
+	if err := db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// Migrate applies the pending migrations in order, each in a transaction of
+// its own, and returns the ones it applied.
+func Migrate(db *gorm.DB) ([]Migration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+	pending, err := PendingMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range pending {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %s_%s failed: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Rollback reverts the last steps applied migrations, newest first, and
+// returns the ones it reverted.
+func Rollback(db *gorm.DB, steps int) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	if steps < len(versions) {
+		versions = versions[:steps]
+	}
+
+	var done []Migration
+	for _, version := range versions {
+		m, ok := findMigration(version)
+		if !ok {
+			return done, fmt.Errorf("migration %s is not part of this build", version)
+		}
+		if m.Down == nil {
+			return done, fmt.Errorf("migration %s_%s cannot be reverted", m.Version, m.Name)
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{Version: m.Version}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("reverting migration %s_%s failed: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// PendingMigrations returns the migrations not applied yet, in order.
+func PendingMigrations(db *gorm.DB) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// MigrationStatus returns every registered migration and whether it is
+// applied, followed by applied migrations this build does not know about.
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if record, ok := applied[m.Version]; ok {
+			state.AppliedAt = &record.AppliedAt
+			delete(applied, m.Version)
+		}
+		states = append(states, state)
+	}
+
+	var unknown []MigrationState
+	for _, record := range applied {
+		unknown = append(unknown, MigrationState{Version: record.Version, Name: record.Name, AppliedAt: &record.AppliedAt, Unknown: true})
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].Version < unknown[j].Version })
+	return append(states, unknown...), nil
+}
+
+// SchemaVersion returns the version of the newest applied migration, or an
+// empty string for an unmigrated database.
+func SchemaVersion(db *gorm.DB) (string, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return "", err
+	}
+	version := ""
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// findMigration returns the registered migration with the version.
+func findMigration(version string) (Migration, bool) {
+	for _, m := range migrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+var (
+	migrationVersionPattern = regexp.MustCompile(`^\d{14}$`)
+	migrationNamePattern    = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// migrationTemplate is the skeleton written by CreateMigration.
+const migrationTemplate = `package database
+
+import "gorm.io/gorm"
+
+func init() {
+	registerMigration(Migration{
+		Version: %q,
+		Name:    %q,
+		Up: func(tx *gorm.DB) error {
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	})
+}
+`
+
+// CreateMigration writes an empty migration named e.g. "add_user_locale" to
+// dir, versioned with the current time, and returns its path.
+func CreateMigration(dir, name string) (string, error) {
+	if !migrationNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid migration name %q, use lower case letters, digits and underscores", name)
+	}
+	version := time.Now().UTC().Format("20060102150405")
+	path := filepath.Join(dir, fmt.Sprintf("migration_%s_%s.go", version, name))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, migrationTemplate, version, name); err != nil {
+		return "", err
+	}
+	return path, nil
+}
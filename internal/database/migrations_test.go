@@ -0,0 +1,121 @@
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+)
+
+func TestMigrations(t *testing.T) {
+	db := openTestDB(t)
+	all := database.Migrations()
+	require.NotEmpty(t, all)
+	latest := all[len(all)-1].Version
+
+	// openTestDB applied everything
+	pending, err := database.PendingMigrations(db)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	version, err := database.SchemaVersion(db)
+	require.NoError(t, err)
+	assert.Equal(t, latest, version)
+
+	applied, err := database.Migrate(db)
+	require.NoError(t, err)
+	assert.Empty(t, applied, "migrating twice is a no-op")
+
+	// Reverting the initial migration drops the tables
+	reverted, err := database.Rollback(db, len(all))
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(all))
+	assert.False(t, db.Migrator().HasTable(&database.User{}))
+	states, err := database.MigrationStatus(db)
+	require.NoError(t, err)
+	for _, state := range states {
+		assert.Nil(t, state.AppliedAt, state.Version)
+	}
+
+	// And applying it again restores them
+	applied, err = database.Migrate(db)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(all))
+	assert.True(t, db.Migrator().HasTable(&database.User{}))
+	var roles int64
+	db.Model(&database.Role{}).Count(&roles)
+	assert.Equal(t, int64(2), roles, "built-in roles are seeded")
+}
+
+func TestMigrationsUnknownVersion(t *testing.T) {
+	db := openTestDB(t)
+
+	// A newer build applied a migration this one does not have
+	require.NoError(t, db.Create(&database.SchemaMigration{Version: "29991231000000", Name: "from_the_future", AppliedAt: time.Now()}).Error)
+
+	states, err := database.MigrationStatus(db)
+	require.NoError(t, err)
+	last := states[len(states)-1]
+	assert.Equal(t, "29991231000000", last.Version)
+	assert.True(t, last.Unknown)
+
+	_, err = database.Rollback(db, 1)
+	assert.ErrorContains(t, err, "not part of this build")
+}
+
+func TestMigrationsUpgradeExistingDatabase(t *testing.T) {
+	db := openTestDB(t)
+
+	// Databases from before versioned migrations have the tables but no
+	// schema_migrations rows
+	existing := database.User{Email: "existing@example.com"}
+	require.NoError(t, db.Create(&existing).Error)
+	legacyKey := database.APIKey{UserID: existing.ID, KeyHash: "legacy"}
+	require.NoError(t, db.Create(&legacyKey).Error)
+	legacyProduct := database.Product{Code: "LEGACY", Price: 1}
+	require.NoError(t, db.Create(&legacyProduct).Error)
+	require.NoError(t, db.Where("1 = 1").Delete(&database.SchemaMigration{}).Error)
+
+	applied, err := database.Migrate(db)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(database.Migrations()))
+
+	var user database.User
+	require.NoError(t, db.Where("email = ?", "existing@example.com").First(&user).Error)
+
+	// Keys from before scopes keep the access they had
+	require.NoError(t, db.First(&legacyKey, legacyKey.ID).Error)
+	assert.ElementsMatch(t, auth.AllScopes, auth.ParseScopes(legacyKey.Scopes))
+
+	// Products from before organizations move into the default one
+	var org database.Organization
+	require.NoError(t, db.Where("slug = ?", database.DefaultOrganization).First(&org).Error)
+	require.NoError(t, db.First(&legacyProduct, legacyProduct.ID).Error)
+	assert.Equal(t, org.ID, legacyProduct.OrganizationID)
+}
+
+func TestMigrationsUpgradeFromBeforeOrganizations(t *testing.T) {
+	db := openTestDB(t)
+
+	// Single-tenant installs had users but no organizations
+	admin := database.User{Email: "admin@example.com", Role: database.RoleAdmin}
+	user := database.User{Email: "user@example.com", Role: database.RoleUser}
+	require.NoError(t, db.Create(&admin).Error)
+	require.NoError(t, db.Create(&user).Error)
+	require.NoError(t, db.Migrator().DropTable(&database.Membership{}, &database.Organization{}))
+	require.NoError(t, db.Where("1 = 1").Delete(&database.SchemaMigration{}).Error)
+
+	_, err := database.Migrate(db)
+	require.NoError(t, err)
+
+	// Everyone moves into the default organization, site admins as its owners
+	var org database.Organization
+	require.NoError(t, db.Where("slug = ?", database.DefaultOrganization).First(&org).Error)
+	var memberships []database.Membership
+	db.Where("organization_id = ?", org.ID).Order("user_id").Find(&memberships)
+	require.Len(t, memberships, 2)
+	assert.Equal(t, database.OrgRoleOwner, memberships[0].Role)
+	assert.Equal(t, database.OrgRoleMember, memberships[1].Role)
+}
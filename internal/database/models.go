@@ -9,28 +9,70 @@ import (
 // Product represents a simple product model for demonstration.
 type Product struct {
 	gorm.Model
-	Code  string `json:"code" gorm:"unique"`
-	Price uint   `json:"price"`
+	OrganizationID uint   `json:"organization_id" gorm:"uniqueIndex:idx_products_org_code"`
+	Code           string `json:"code" gorm:"uniqueIndex:idx_products_org_code"` // Unique within the organization
+	Price          uint   `json:"price"`
 }
 
-// UserRole constants
+// UserRole constants, the built-in roles seeded on startup
 const (
 	RoleAdmin = "admin"
 	RoleUser  = "user"
 )
 
+// PermissionAll is the wildcard permission granted to the built-in admin role.
+// It covers every permission, including ones added later.
+const PermissionAll = "*"
+
+// Organization role constants, from most to least privileged
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// DefaultOrganization is the slug of the organization that users of an
+// install from before organizations existed were moved into.
+const DefaultOrganization = "default"
+
+// DefaultOIDCProvider is the slug of the provider configured through the OIDC_*
+// environment variables.
+const DefaultOIDCProvider = "default"
+
+// LDAPProvider is the provider of users who sign in against the LDAP
+// directory. Their internal ID is their distinguished name.
+const LDAPProvider = "ldap"
+
 // User represents a user in the system, primarily authenticated via OIDC.
 type User struct {
 	gorm.Model
-	Email        string   `json:"email" gorm:"unique;index"`
-	Name         string   `json:"name"`
-	PasswordHash string   `json:"-"`                          // Hashed password for email login
-	InternalID   *string  `json:"internal_id" gorm:"index"`   // OIDC 'sub' claim (nil for email/password users)
-	Role         string   `json:"role" gorm:"default:'user'"` // "admin" or "user"
-	APIKeys      []APIKey `json:"-"`
+	Email           string     `json:"email" gorm:"unique;index"` // A placeholder under .invalid for service accounts
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Name            string     `json:"name"`
+	PasswordHash    string     `json:"-"`                                                       // Hashed password for email login
+	Provider        string     `json:"provider" gorm:"size:255;uniqueIndex:idx_users_identity"` // Slug of the OIDC provider the user signed in with
+	InternalID      *string    `json:"internal_id" gorm:"index;uniqueIndex:idx_users_identity"` // OIDC 'sub' claim (nil for email/password users)
+	Role            string     `json:"role" gorm:"default:'user'"`                              // Name of a Role, e.g. "admin" or "user"
+	RoleLocked      bool       `json:"role_locked"`                                             // Set by an admin to stop identity provider claims and groups from changing the role
+	WebAuthnID      string     `json:"-" gorm:"column:webauthn_id;index"`                       // Random WebAuthn user handle, set on first passkey registration
+	ServiceAccount  bool       `json:"service_account" gorm:"index"`                            // Machine account; authenticates with its own API keys only
+	ClientID        *string    `json:"client_id,omitempty" gorm:"uniqueIndex"`                  // OAuth2 client ID of a service account (nil for people)
+	ExternalID      string     `json:"external_id" gorm:"index"`                                // ID assigned by the SCIM provisioning client
+	DisabledAt      *time.Time `json:"disabled_at"`                                             // Set while the account is deactivated; it cannot sign in or use its keys
+	APIKeys         []APIKey   `json:"-"`
 }
 
-// APIKey represents a programmatic access key for a user.
+// Role is a named set of permissions assigned to users. The built-in admin
+// and user roles cannot be deleted, and admin always grants every permission.
+type Role struct {
+	gorm.Model
+	Name        string `json:"name" gorm:"size:255;uniqueIndex"`
+	Description string `json:"description"`
+	Permissions string `json:"permissions"` // JSON string of permission names
+	BuiltIn     bool   `json:"built_in"`
+}
+
+// APIKey represents a programmatic access key for a user or an organization.
 type APIKey struct {
 	gorm.Model
 	UserID    uint       `json:"user_id" gorm:"index"`
@@ -40,4 +82,236 @@ type APIKey struct {
 	Scopes    string     `json:"scopes"`                // JSON string of scopes
 	LastUsed  *time.Time `json:"last_used"`
 	ExpiresAt *time.Time `json:"expires_at"`
+
+	OrganizationID *uint `json:"organization_id" gorm:"index"` // Set for keys owned by an organization; UserID is then 0
+	CreatedByID    *uint `json:"created_by_id"`                // Who created an organization or service account key
+}
+
+// Session represents a login session. Every access token carries the ID of the
+// session it was issued for, so revoking the session invalidates the token.
+type Session struct {
+	gorm.Model
+	UserID         uint       `json:"user_id" gorm:"index"`
+	ImpersonatorID *uint      `json:"impersonator_id" gorm:"index"` // Set when an admin is acting as the user
+	APIKeyID       *uint      `json:"api_key_id" gorm:"index"`      // Set for client credentials tokens, issued for a service account key
+	UserAgent      string     `json:"user_agent"`
+	IPAddress      string     `json:"ip_address"`
+	LastUsedAt     time.Time  `json:"last_used_at"`
+	ExpiresAt      time.Time  `json:"expires_at" gorm:"index"` // Absolute expiry of the refresh token family; expired sessions are deleted
+	RevokedAt      *time.Time `json:"revoked_at"`
+}
+
+// RefreshToken is a single-use token in a session's rotation family.
+type RefreshToken struct {
+	gorm.Model
+	SessionID uint       `json:"session_id" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"unique;index"` // SHA256 hash of the raw token
+	ExpiresAt time.Time  `json:"expires_at" gorm:"index"`
+	UsedAt    *time.Time `json:"used_at"` // Set once rotated; presenting it again revokes the session
+}
+
+// SigningKey is an asymmetric key used to sign and verify access tokens.
+type SigningKey struct {
+	gorm.Model
+	KID        string     `json:"kid" gorm:"unique;index"` // Key ID, sent in the JWT "kid" header
+	Algorithm  string     `json:"algorithm"`               // "EdDSA" or "RS256"
+	PrivateKey string     `json:"-"`                       // PKCS#8 PEM, encrypted when a master secret is configured
+	PublicKey  string     `json:"public_key"`              // PKIX PEM
+	Encrypted  bool       `json:"encrypted"`
+	RotatedAt  *time.Time `json:"rotated_at"` // When the key stopped signing new tokens
+	ExpiresAt  *time.Time `json:"expires_at"` // When the key stops being accepted for verification
+}
+
+// PendingLogin tracks an OIDC authorization request until its callback arrives.
+type PendingLogin struct {
+	gorm.Model
+	State        string    `json:"-" gorm:"unique;index"`
+	Nonce        string    `json:"-"`
+	CodeVerifier string    `json:"-"`            // PKCE verifier, sent with the code exchange
+	Provider     string    `json:"provider"`     // Slug of the provider the login was started with
+	LinkUserID   *uint     `json:"link_user_id"` // Set when an authenticated user is linking a new identity
+	Invitation   string    `json:"-"`            // Hash of the invitation token the login was started with, if any
+	ReturnTo     string    `json:"return_to"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Identity links a user to their account at an OIDC provider. A user can have
+// several identities alongside an optional password.
+type Identity struct {
+	gorm.Model
+	UserID      uint       `json:"user_id" gorm:"index"`
+	Provider    string     `json:"provider" gorm:"size:255;uniqueIndex:idx_identities_subject"` // Provider slug
+	Subject     string     `json:"subject" gorm:"size:255;uniqueIndex:idx_identities_subject"`  // OIDC 'sub' claim
+	Email       string     `json:"email"`                                                       // Email reported by the provider at the last login
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// OIDCProviderConfig is an OIDC provider added at runtime by an admin.
+type OIDCProviderConfig struct {
+	gorm.Model
+	Slug         string `json:"slug" gorm:"unique;index"` // URL-safe identifier used in /auth/{slug}/login
+	DisplayName  string `json:"display_name"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"-"`             // Encrypted when a master secret is configured
+	RedirectURL  string `json:"redirect_url"`  // Optional override of the derived callback URL
+	RoleMappings string `json:"role_mappings"` // JSON list of {"claim", "value", "role"} mappings, the first match wins
+	DefaultRole  string `json:"default_role"`  // Given when no mapping matches; empty keeps the user's role
+	Enabled      bool   `json:"enabled"`
+}
+
+// MFAEnrollment holds a user's TOTP secret. MFA is enabled once the enrollment
+// is confirmed with a valid code.
+type MFAEnrollment struct {
+	gorm.Model
+	UserID       uint       `json:"user_id" gorm:"unique;index"`
+	Secret       string     `json:"-"` // Base32 TOTP secret, encrypted when a master secret is configured
+	ConfirmedAt  *time.Time `json:"confirmed_at"`
+	LastUsedStep int64      `json:"-"` // Time step of the last accepted code, to prevent replays
+}
+
+// RecoveryCode is a single-use code that can stand in for a TOTP code.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint       `json:"user_id" gorm:"index"`
+	CodeHash string     `json:"-" gorm:"unique;index"` // SHA256 hash of the raw code
+	UsedAt   *time.Time `json:"used_at"`
+}
+
+// MFAChallenge is issued after a successful first login step for a user with
+// MFA enabled, and is exchanged for a session together with a valid code.
+type MFAChallenge struct {
+	gorm.Model
+	UserID    uint      `json:"user_id" gorm:"index"`
+	TokenHash string    `json:"-" gorm:"unique;index"` // SHA256 hash of the raw challenge token
+	ReturnTo  string    `json:"return_to"`
+	Attempts  int       `json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Passkey is a WebAuthn credential registered by a user.
+type Passkey struct {
+	gorm.Model
+	UserID          uint       `json:"user_id" gorm:"index"`
+	Name            string     `json:"name"`
+	CredentialID    string     `json:"-" gorm:"unique;index"` // Base64url credential ID
+	PublicKey       []byte     `json:"-"`                     // COSE-encoded public key
+	AttestationType string     `json:"attestation_type"`
+	AAGUID          []byte     `json:"-"`
+	SignCount       uint32     `json:"sign_count"` // Must increase on every login, unless the authenticator always reports 0
+	Transports      string     `json:"transports"` // Comma-separated transport hints
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+}
+
+// WebAuthnSession holds the challenge of a WebAuthn ceremony until it is finished.
+type WebAuthnSession struct {
+	gorm.Model
+	TokenHash string    `json:"-" gorm:"unique;index"` // SHA256 hash of the raw session token
+	UserID    uint      `json:"user_id"`               // Registering user; 0 for login ceremonies
+	Kind      string    `json:"kind"`                  // "registration" or "login"
+	Data      string    `json:"-"`                     // JSON-encoded webauthn.SessionData
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoginThrottle counts recent failed logins for a client IP or an account.
+type LoginThrottle struct {
+	gorm.Model
+	Key           string     `json:"-" gorm:"column:throttle_key;unique;index"` // Scope and subject, e.g. "ip:203.0.113.7"
+	Scope         string     `json:"scope"`                                     // "ip" or "account"
+	Subject       string     `json:"subject"`                                   // IP address or lowercased email
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// AuditEvent is a durable record of a security-relevant action. Events are
+// append-only: they are never updated or deleted.
+type AuditEvent struct {
+	ID         uint      `json:"id" gorm:"primarykey"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+	ActorID    *uint     `json:"actor_id" gorm:"index"` // User who acted; nil for anonymous requests such as failed logins
+	ActorEmail string    `json:"actor_email"`
+	Action     string    `json:"action" gorm:"index"`                       // e.g. "user.role_update"
+	Outcome    string    `json:"outcome"`                                   // "success", "failure" or "mfa_required"
+	TargetType string    `json:"target_type" gorm:"index:idx_audit_target"` // e.g. "user", "api_key", "settings"
+	TargetID   string    `json:"target_id" gorm:"index:idx_audit_target"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	RequestID  string    `json:"request_id"`
+	Changes    string    `json:"changes"` // JSON object of changed fields, each with "before" and "after"
+	Details    string    `json:"details"` // JSON object with action-specific context
+}
+
+// Organization groups users who share access to the same resources.
+type Organization struct {
+	gorm.Model
+	Slug       string `json:"slug" gorm:"unique;index"` // URL-safe identifier used in /orgs/{slug} and the X-Organization header
+	Name       string `json:"name"`
+	ExternalID string `json:"external_id" gorm:"index"` // ID assigned by the SCIM provisioning client
+}
+
+// Membership gives a user a role in an organization.
+type Membership struct {
+	gorm.Model
+	OrganizationID uint   `json:"organization_id" gorm:"uniqueIndex:idx_memberships_org_user"`
+	UserID         uint   `json:"user_id" gorm:"index;uniqueIndex:idx_memberships_org_user"`
+	Role           string `json:"role"` // "owner", "admin" or "member"
+}
+
+// OrgInvitation invites an email address to join an organization.
+type OrgInvitation struct {
+	gorm.Model
+	OrganizationID uint       `json:"organization_id" gorm:"index"`
+	Email          string     `json:"email"`
+	Role           string     `json:"role"`
+	TokenHash      string     `json:"-" gorm:"unique;index"` // SHA256 hash of the raw invitation token
+	InvitedByID    uint       `json:"invited_by_id"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	AcceptedAt     *time.Time `json:"accepted_at"`
+}
+
+// Invitation lets someone register with a pre-assigned role, even while open
+// registration is disabled. Only a hash of the token is stored.
+type Invitation struct {
+	gorm.Model
+	Email          string     `json:"email" gorm:"index"`
+	Role           string     `json:"role"`
+	TokenHash      string     `json:"-" gorm:"unique;index"` // SHA256 hash of the raw invitation token
+	InvitedByID    uint       `json:"invited_by_id"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	AcceptedAt     *time.Time `json:"accepted_at"`
+	AcceptedUserID *uint      `json:"accepted_user_id"`
+}
+
+// SCIMToken authenticates an identity provider's SCIM provisioning requests.
+// It is only accepted by the /scim/v2 endpoints.
+type SCIMToken struct {
+	gorm.Model
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`                // First few chars of the token for identification
+	TokenHash   string     `json:"-" gorm:"unique;index"` // SHA256 hash of the raw token
+	CreatedByID uint       `json:"created_by_id"`
+	LastUsed    *time.Time `json:"last_used"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// LDAPConfig is the directory used to authenticate email logins. There is at
+// most one row.
+type LDAPConfig struct {
+	gorm.Model
+	URL                  string `json:"url"`                  // ldap://host:389 or ldaps://host:636
+	StartTLS             bool   `json:"start_tls"`            // Upgrade ldap:// connections with StartTLS
+	InsecureSkipVerify   bool   `json:"insecure_skip_verify"` // Skip server certificate verification
+	BindDN               string `json:"bind_dn"`              // Service account used to search for users
+	BindPassword         string `json:"-"`                    // Encrypted when a master secret is configured
+	BaseDN               string `json:"base_dn"`
+	UserFilter           string `json:"user_filter"`            // Search filter, {email} is replaced by the escaped login email
+	EmailAttribute       string `json:"email_attribute"`        // e.g. "mail"
+	NameAttribute        string `json:"name_attribute"`         // e.g. "displayName"
+	GroupAttribute       string `json:"group_attribute"`        // e.g. "memberOf"
+	GroupRoles           string `json:"group_roles"`            // JSON list of {"group", "role"} mappings, the first match wins
+	LinkExistingAccounts bool   `json:"link_existing_accounts"` // Link directory logins to the local account with the same email
+	Enabled              bool   `json:"enabled"`
 }
@@ -0,0 +1,359 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/techsquidtv/inkling/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// replicaResolver is the dbresolver name the replicas are registered under.
+// Queries only reach them through Replica; everything else uses the primary.
+const replicaResolver = "replicas"
+
+// replicaCheckInterval is the time between replica health checks.
+const replicaCheckInterval = 5 * time.Second
+
+// ReplicaConfig configures read replicas.
+type ReplicaConfig struct {
+	URLs   []string      // Database URLs of the replicas, see Dialector
+	MaxLag time.Duration // Replicas further behind the primary are not read from
+}
+
+// Replicas tracks the health of the read replicas registered with UseReplicas.
+type Replicas struct {
+	primary   gorm.ConnPool
+	replicas  []*replica
+	maxLag    time.Duration
+	next      atomic.Uint64
+	fallbacks metric.Int64Counter
+}
+
+// replica is a read replica and its last health check.
+type replica struct {
+	name    string // URL without credentials
+	dialect string
+	db      *sql.DB
+	conn    replicaConn
+	healthy atomic.Bool
+	lag     atomic.Int64 // Nanoseconds, -1 when unknown
+}
+
+// replicaConn is a replica's connection pool as handed to dbresolver. It
+// hides Ping, so a replica that is down at startup fails its health check
+// rather than the startup.
+type replicaConn struct {
+	gorm.ConnPool
+}
+
+// ReplicaStatus is a replica as reported by Status.
+type ReplicaStatus struct {
+	Name    string
+	Healthy bool
+	Lag     time.Duration // -1 when unknown
+}
+
+// UseReplicas registers read replicas with the database. Reads go to them
+// only through Replica; replicas that are down or lag behind by more than
+// MaxLag are skipped, and reads go to the primary while none is healthy.
+// Call Start to keep checking their health.
+func UseReplicas(db *gorm.DB, cfg ReplicaConfig) (*Replicas, error) {
+	r := &Replicas{primary: db.Config.ConnPool, maxLag: cfg.MaxLag}
+
+	// dbresolver skips the policy when there is a single replica, so the
+	// primary is listed last to always let pick choose
+	dialectors := make([]gorm.Dialector, len(cfg.URLs), len(cfg.URLs)+1)
+	for i, replicaURL := range cfg.URLs {
+		dialector, err := Dialector(replicaURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read replica URL: %w", err)
+		}
+		replicaDB, err := gorm.Open(dialector, &gorm.Config{DisableAutomaticPing: true})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open read replica %s: %w", redactURL(replicaURL), err)
+		}
+		sqlDB, err := replicaDB.DB()
+		if err != nil {
+			return nil, err
+		}
+
+		rep := &replica{name: redactURL(replicaURL), dialect: dialector.Name(), db: sqlDB, conn: replicaConn{sqlDB}}
+		rep.lag.Store(-1)
+		r.replicas = append(r.replicas, rep)
+		dialectors[i] = openedDialector{Dialector: dialector, conn: rep.conn}
+	}
+
+	dialectors = append(dialectors, openedDialector{Dialector: db.Dialector, conn: r.primary})
+
+	err := db.Use(dbresolver.Register(dbresolver.Config{
+		Replicas: dialectors,
+		Policy:   dbresolver.PolicyFunc(r.pick),
+	}, replicaResolver))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Callback().Query().After("gorm:query").Register("inkling:replica_errors", r.checkError); err != nil {
+		return nil, err
+	}
+	if err := db.Callback().Row().After("gorm:row").Register("inkling:replica_errors", r.checkError); err != nil {
+		return nil, err
+	}
+	if err := r.registerMetrics(); err != nil {
+		return nil, err
+	}
+
+	r.Check(context.Background())
+	return r, nil
+}
+
+// Replica returns the database for reads that may be slightly stale, such as
+// list endpoints. They go to a healthy read replica, or to the primary when
+// there is none. Reads that must see a write just made stay on db.
+func Replica(db *gorm.DB) *gorm.DB {
+	if _, ok := db.Config.Plugins["gorm:db_resolver"]; !ok {
+		return db
+	}
+	return db.Clauses(dbresolver.Use(replicaResolver))
+}
+
+// pick returns the connection pool for a read: the next healthy replica in
+// turn, or the primary. The pools are those of r.replicas followed by the
+// primary's.
+func (r *Replicas) pick(pools []gorm.ConnPool) gorm.ConnPool {
+	n := uint64(len(r.replicas))
+	start := r.next.Add(1)
+	for i := range n {
+		if rep := r.replicas[(start+i)%n]; rep.healthy.Load() {
+			return rep.conn
+		}
+	}
+	r.fallbacks.Add(context.Background(), 1)
+	return r.primary
+}
+
+// checkError marks a replica unhealthy when a query on it fails to reach it,
+// so the following reads fall back without waiting for the next check.
+func (r *Replicas) checkError(db *gorm.DB) {
+	if db.Error == nil || !isConnectionError(db.Error) {
+		return
+	}
+	for _, rep := range r.replicas {
+		if db.Statement.ConnPool == rep.conn && rep.healthy.Swap(false) {
+			log.Warn("read replica unavailable, reading from the primary", "replica", rep.name, "err", db.Error)
+		}
+	}
+}
+
+// isConnectionError reports whether err means the database could not be
+// reached, as opposed to a failed statement.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.As(err, &netErr)
+}
+
+// Start checks the health of the replicas until the context is cancelled.
+func (r *Replicas) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(replicaCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Check(ctx)
+			}
+		}
+	}()
+}
+
+// Check checks the health of every replica once. A replica is healthy when
+// it answers and lags behind the primary by at most the maximum lag.
+func (r *Replicas) Check(ctx context.Context) {
+	for _, rep := range r.replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, replicaCheckInterval)
+		lag, err := rep.measureLag(checkCtx)
+		cancel()
+
+		healthy := err == nil && lag <= r.maxLag
+		if err != nil {
+			lag = -1
+		}
+		rep.lag.Store(int64(lag))
+		switch was := rep.healthy.Swap(healthy); {
+		case was && err != nil:
+			log.Warn("read replica unavailable, reading from the primary", "replica", rep.name, "err", err)
+		case was && !healthy:
+			log.Warn("read replica lagging, reading from the primary", "replica", rep.name, "lag", lag)
+		case !was && healthy:
+			log.Info("read replica available", "replica", rep.name)
+		}
+	}
+}
+
+// Status returns the result of the last health check of every replica.
+func (r *Replicas) Status() []ReplicaStatus {
+	status := make([]ReplicaStatus, len(r.replicas))
+	for i, rep := range r.replicas {
+		status[i] = ReplicaStatus{Name: rep.name, Healthy: rep.healthy.Load(), Lag: time.Duration(rep.lag.Load())}
+	}
+	return status
+}
+
+// Close closes the connections to the replicas. Reads go to the primary
+// afterwards.
+func (r *Replicas) Close() error {
+	var errs []error
+	for _, rep := range r.replicas {
+		rep.healthy.Store(false)
+		errs = append(errs, rep.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// measureLag returns how far the replica is behind its primary. A database
+// that is not replicating has no lag.
+func (rep *replica) measureLag(ctx context.Context) (time.Duration, error) {
+	if err := rep.db.PingContext(ctx); err != nil {
+		return 0, err
+	}
+
+	switch rep.dialect {
+	case "postgres":
+		// Replay timestamps only advance with new writes, so a replica that
+		// has replayed everything it received is caught up
+		var seconds float64
+		err := rep.db.QueryRowContext(ctx, `SELECT CASE
+			WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END`).Scan(&seconds)
+		return time.Duration(seconds * float64(time.Second)), err
+	case "mysql":
+		return mysqlReplicaLag(ctx, rep.db)
+	}
+	return 0, nil
+}
+
+// mysqlReplicaLag reads Seconds_Behind_Source from SHOW REPLICA STATUS, or
+// SHOW SLAVE STATUS before MySQL 8.0.22. It needs the REPLICATION CLIENT
+// privilege.
+func mysqlReplicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		if rows, err = db.QueryContext(ctx, "SHOW SLAVE STATUS"); err != nil {
+			return 0, err
+		}
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, column := range columns {
+		if column != "Seconds_Behind_Source" && column != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errors.New("replication is not running")
+		}
+		var seconds int64
+		if _, err := fmt.Sscan(values[i].String, &seconds); err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.New("replica status has no Seconds_Behind_Source")
+}
+
+// registerMetrics reports replica health and lag, and reads that fell back
+// to the primary.
+func (r *Replicas) registerMetrics() error {
+	// The global meter forwards to the provider set in telemetry.Init
+	meter := otel.Meter(config.ServiceName)
+	var err error
+	r.fallbacks, err = meter.Int64Counter("db.replica.fallbacks",
+		metric.WithDescription("Replica reads sent to the primary because no replica was healthy"))
+	if err != nil {
+		return err
+	}
+	healthy, err := meter.Int64ObservableGauge("db.replica.healthy",
+		metric.WithDescription("Whether the read replica passed its last health check (1) or not (0)"))
+	if err != nil {
+		return err
+	}
+	lag, err := meter.Float64ObservableGauge("db.replica.lag",
+		metric.WithDescription("Replication lag of the read replica at its last health check, -1 when unknown"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		for _, status := range r.Status() {
+			attrs := metric.WithAttributes(attribute.String("replica", status.Name))
+			var up int64
+			if status.Healthy {
+				up = 1
+			}
+			o.ObserveInt64(healthy, up, attrs)
+			seconds := -1.0
+			if status.Lag >= 0 {
+				seconds = status.Lag.Seconds()
+			}
+			o.ObserveFloat64(lag, seconds, attrs)
+		}
+		return nil
+	}, healthy, lag)
+	return err
+}
+
+// openedDialector hands dbresolver a connection that is already open, which
+// it would otherwise open a second time.
+type openedDialector struct {
+	gorm.Dialector
+	conn gorm.ConnPool
+}
+
+// Initialize implements gorm.Dialector.
+func (d openedDialector) Initialize(db *gorm.DB) error {
+	db.ConnPool = d.conn
+	return nil
+}
+
+// redactURL returns a database URL without its credentials, for logs and
+// metrics.
+func redactURL(databaseURL string) string {
+	if !strings.Contains(databaseURL, "://") {
+		return databaseURL
+	}
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return "invalid URL"
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
@@ -0,0 +1,89 @@
+package database_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/techsquidtv/inkling/internal/database"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// openReplicaDB creates a migrated SQLite database file to register as a
+// read replica, holding a product the primary does not have.
+func openReplicaDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "replica.db")
+	replica, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	require.NoError(t, err)
+	_, err = database.Migrate(replica)
+	require.NoError(t, err)
+	require.NoError(t, replica.Create(&database.Product{OrganizationID: 1, Code: "REPLICA", Price: 1}).Error)
+	if sqlDB, err := replica.DB(); err == nil {
+		sqlDB.Close()
+	}
+	return path
+}
+
+func productCodes(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var codes []string
+	require.NoError(t, db.Model(&database.Product{}).Order("code").Pluck("code", &codes).Error)
+	return codes
+}
+
+func TestReadReplicas(t *testing.T) {
+	db := openTestDB(t)
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	replicas, err := database.UseReplicas(db, database.ReplicaConfig{URLs: []string{openReplicaDB(t)}, MaxLag: time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() { replicas.Close() })
+
+	// Writes and plain reads use the primary
+	require.NoError(t, db.Create(&database.Product{OrganizationID: 1, Code: "PRIMARY", Price: 2}).Error)
+	assert.Equal(t, []string{"PRIMARY"}, productCodes(t, db))
+
+	// Reads routed to the replicas use them
+	assert.Equal(t, []string{"REPLICA"}, productCodes(t, database.Replica(db)))
+	status := replicas.Status()
+	require.Len(t, status, 1)
+	assert.True(t, status[0].Healthy)
+	assert.Equal(t, time.Duration(0), status[0].Lag)
+
+	var metrics metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &metrics))
+	assert.Equal(t, int64(1), replicaGauge(t, metrics, "db.replica.healthy"))
+
+	// Without a healthy replica they fall back to the primary
+	require.NoError(t, replicas.Close())
+	replicas.Check(context.Background())
+	assert.False(t, replicas.Status()[0].Healthy)
+	assert.Equal(t, []string{"PRIMARY"}, productCodes(t, database.Replica(db)))
+
+	require.NoError(t, reader.Collect(context.Background(), &metrics))
+	assert.Equal(t, int64(0), replicaGauge(t, metrics, "db.replica.healthy"))
+}
+
+// replicaGauge returns the value of an integer replica gauge.
+func replicaGauge(t *testing.T, metrics metricdata.ResourceMetrics, name string) int64 {
+	t.Helper()
+	for _, scope := range metrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if gauge, ok := m.Data.(metricdata.Gauge[int64]); ok && m.Name == name {
+				require.Len(t, gauge.DataPoints, 1)
+				return gauge.DataPoints[0].Value
+			}
+		}
+	}
+	t.Fatalf("metric %s not reported", name)
+	return 0
+}
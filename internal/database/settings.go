@@ -1,59 +1,268 @@
 package database
 
 import (
-	"gorm.io/gorm"
-)
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
-// Setting keys
-const (
-	SettingRegistrationEnabled = "registration_enabled"
+	"github.com/techsquidtv/inkling/internal/config"
+	"gorm.io/gorm"
 )
 
-// AppSettings stores application-wide settings as key-value pairs.
+// AppSettings stores application-wide settings as key-value pairs. Values are
+// JSON encoded; use the settings declared with RegisterSetting to read and
+// write them.
 type AppSettings struct {
 	gorm.Model
-	Key   string `json:"key" gorm:"unique;index"`
+	Key   string `json:"key" gorm:"column:setting_key;unique;index"` // "key" is reserved in MySQL
 	Value string `json:"value"`
 }
 
-// GetSetting retrieves a setting value by key. Returns defaultValue if not found.
-func GetSetting(db *gorm.DB, key string, defaultValue string) string {
-	var setting AppSettings
-	if err := db.Where("key = ?", key).Limit(1).Find(&setting).Error; err != nil {
-		return defaultValue
+// Settings.
+var (
+	AppName = RegisterSetting(Setting[string]{
+		Key:         "app_name",
+		Description: "Name of the application shown in the web app",
+		Default:     config.AppName,
+		Public:      true,
+		Validate: func(name string) error {
+			if strings.TrimSpace(name) == "" || utf8.RuneCountInString(name) > 100 {
+				return errors.New("must be 1 to 100 characters")
+			}
+			return nil
+		},
+	})
+	RegistrationEnabled = RegisterSetting(Setting[bool]{
+		Key:         "registration_enabled",
+		Description: "Whether user registration is enabled",
+		Default:     true,
+		Public:      true,
+	})
+	AutoLinkVerifiedEmail = RegisterSetting(Setting[bool]{
+		Key:         "auto_link_verified_email",
+		Description: "Whether OIDC logins with a verified email are linked to the existing user with that email",
+	})
+	RequireAdminMFA = RegisterSetting(Setting[bool]{
+		Key:         "require_admin_mfa",
+		Description: "Whether admins must have MFA enabled to use admin endpoints. You must have MFA enabled yourself to turn this on.",
+	})
+	RequireEmailVerification = RegisterSetting(Setting[bool]{
+		Key:         "require_email_verification",
+		Description: "Whether password logins are refused until the user verifies their email. Your own email must be verified to turn this on.",
+	})
+)
+
+// settingsCacheTTL is how long cached settings are used. Writes through this
+// process invalidate the cache right away; the TTL bounds how long other
+// server instances keep serving the old value.
+const settingsCacheTTL = 30 * time.Second
+
+// Setting declares a typed application setting. Values are stored as JSON,
+// so T may be any JSON type, including slices and structs.
+type Setting[T any] struct {
+	Key         string
+	Description string
+	Default     T             // Returned while the setting is not stored
+	Public      bool          // Readable without authentication, e.g. by the web app before login
+	Validate    func(T) error // Optional, run before every write
+}
+
+// SettingInfo describes a registered setting.
+type SettingInfo struct {
+	Key         string
+	Description string
+	Default     any
+	Public      bool
+	Type        reflect.Type
+}
+
+// AnySetting is a registered setting of any type, for code that handles all
+// settings alike, such as the admin settings endpoints.
+type AnySetting interface {
+	Info() SettingInfo
+	// GetAny returns the setting's value.
+	GetAny(db *gorm.DB) (any, error)
+	// ParseJSON decodes and validates a JSON value for the setting.
+	ParseJSON(data []byte) (any, error)
+	// SetAny stores a value returned by ParseJSON.
+	SetAny(db *gorm.DB, value any) error
+}
+
+// settings are the registered settings, in registration order.
+var settings []AnySetting
+
+// RegisterSetting adds a setting to the registry. It is called from package
+// variable declarations, so a duplicate key panics at startup.
+func RegisterSetting[T any](s Setting[T]) *Setting[T] {
+	if _, ok := FindSetting(s.Key); ok || s.Key == "" {
+		panic(fmt.Sprintf("invalid or duplicate setting %q", s.Key))
 	}
-	if setting.ID == 0 {
-		return defaultValue
+	setting := &s
+	settings = append(settings, setting)
+	return setting
+}
+
+// Settings returns the registered settings, in registration order.
+func Settings() []AnySetting {
+	return append([]AnySetting(nil), settings...)
+}
+
+// FindSetting returns the registered setting with the key.
+func FindSetting(key string) (AnySetting, bool) {
+	for _, s := range settings {
+		if s.Info().Key == key {
+			return s, true
+		}
 	}
-	return setting.Value
+	return nil, false
 }
 
-// SetSetting creates or updates a setting.
-func SetSetting(db *gorm.DB, key string, value string) error {
-	var setting AppSettings
-	result := db.Where("key = ?", key).Limit(1).Find(&setting)
-	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
-		return result.Error
+// Get returns the setting's value, or its default while it is not stored.
+// Values are cached; see settingsCacheTTL.
+func (s *Setting[T]) Get(db *gorm.DB) (T, error) {
+	raw, ok, err := cachedSettings(db).get(db, s.Key)
+	if err != nil || !ok || raw == "" || raw == "null" {
+		return s.Default, err
+	}
+	var value T
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return s.Default, fmt.Errorf("setting %s has an invalid stored value: %w", s.Key, err)
 	}
+	return value, nil
+}
+
+// Set validates and stores the setting's value.
+func (s *Setting[T]) Set(db *gorm.DB, value T) error {
+	if s.Validate != nil {
+		if err := s.Validate(value); err != nil {
+			return fmt.Errorf("invalid %s: %w", s.Key, err)
+		}
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return setSetting(db, s.Key, string(data))
+}
 
+// Info implements AnySetting.
+func (s *Setting[T]) Info() SettingInfo {
+	return SettingInfo{
+		Key:         s.Key,
+		Description: s.Description,
+		Default:     s.Default,
+		Public:      s.Public,
+		Type:        reflect.TypeFor[T](),
+	}
+}
+
+// GetAny implements AnySetting.
+func (s *Setting[T]) GetAny(db *gorm.DB) (any, error) {
+	return s.Get(db)
+}
+
+// ParseJSON implements AnySetting.
+func (s *Setting[T]) ParseJSON(data []byte) (any, error) {
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	if s.Validate != nil {
+		if err := s.Validate(value); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// SetAny implements AnySetting.
+func (s *Setting[T]) SetAny(db *gorm.DB, value any) error {
+	typed, ok := value.(T)
+	if !ok {
+		return fmt.Errorf("setting %s takes a %s, not %T", s.Key, reflect.TypeFor[T](), value)
+	}
+	return s.Set(db, typed)
+}
+
+// InvalidateSettings drops the cached settings of the database. Call it after
+// committing a transaction that changed settings, as a read between the write
+// and the commit may have cached the old values.
+func InvalidateSettings(db *gorm.DB) {
+	cachedSettings(db).invalidate()
+}
+
+// setSetting creates or updates a stored setting and invalidates the cache.
+func setSetting(db *gorm.DB, key string, value string) error {
+	defer cachedSettings(db).invalidate()
+
+	var setting AppSettings
+	if err := db.Where("setting_key = ?", key).Limit(1).Find(&setting).Error; err != nil {
+		return err
+	}
 	if setting.ID == 0 {
-		setting = AppSettings{Key: key, Value: value}
-		return db.Create(&setting).Error
+		return db.Create(&AppSettings{Key: key, Value: value}).Error
 	}
 	setting.Value = value
 	return db.Save(&setting).Error
 }
 
-// IsRegistrationEnabled checks if user registration is enabled.
-func IsRegistrationEnabled(db *gorm.DB) bool {
-	return GetSetting(db, SettingRegistrationEnabled, "true") == "true"
+// settingsCache holds the stored settings of a database, loaded at once.
+type settingsCache struct {
+	mu         sync.Mutex
+	values     map[string]string
+	loadedAt   time.Time
+	generation uint64 // Incremented by invalidate, so loads racing a write are dropped
 }
 
-// SetRegistrationEnabled sets the registration enabled status.
-func SetRegistrationEnabled(db *gorm.DB, enabled bool) error {
-	value := "false"
-	if enabled {
-		value = "true"
+// settingsCaches are the caches by database, keyed by its dialector: sessions
+// and transactions copy the *gorm.Config, but share the dialector.
+var settingsCaches sync.Map
+
+// cachedSettings returns the settings cache of the database.
+func cachedSettings(db *gorm.DB) *settingsCache {
+	cache, _ := settingsCaches.LoadOrStore(db.Dialector, &settingsCache{})
+	return cache.(*settingsCache)
+}
+
+// get returns the stored value of a setting, loading every setting if the
+// cache is empty or expired.
+func (c *settingsCache) get(db *gorm.DB, key string) (string, bool, error) {
+	c.mu.Lock()
+	if c.values != nil && time.Since(c.loadedAt) < settingsCacheTTL {
+		value, ok := c.values[key]
+		c.mu.Unlock()
+		return value, ok, nil
 	}
-	return SetSetting(db, SettingRegistrationEnabled, value)
+	generation := c.generation
+	c.mu.Unlock()
+
+	var stored []AppSettings
+	if err := db.Find(&stored).Error; err != nil {
+		return "", false, fmt.Errorf("failed to load settings: %w", err)
+	}
+	values := make(map[string]string, len(stored))
+	for _, setting := range stored {
+		values[setting.Key] = setting.Value
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.values, c.loadedAt = values, time.Now()
+	}
+	c.mu.Unlock()
+	value, ok := values[key]
+	return value, ok, nil
+}
+
+// invalidate drops the cached settings.
+func (c *settingsCache) invalidate() {
+	c.mu.Lock()
+	c.values = nil
+	c.generation++
+	c.mu.Unlock()
 }
@@ -8,12 +8,13 @@ import (
 
 // Standard log keys
 const (
-	UserID = "user_id"
-	Status = "status"
-	Path   = "path"
-	Method = "method"
-	Error  = "error"
-	Email  = "email"
+	UserID    = "user_id"
+	Status    = "status"
+	Path      = "path"
+	Method    = "method"
+	Error     = "error"
+	Email     = "email"
+	RequestID = "request_id"
 )
 
 type contextKey string
@@ -0,0 +1,48 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// LogSender writes messages to the application log instead of sending them.
+// It is the default in development when no mail transport is configured.
+// Messages hold live tokens, so it must not be used in production.
+type LogSender struct{}
+
+// NewLogSender creates a sender that logs messages.
+func NewLogSender() *LogSender {
+	return &LogSender{}
+}
+
+// Send logs the message, including its body.
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	log.Info("email not sent (no SMTP_HOST configured)", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileSender writes each message to a .eml file, for inspecting mail in
+// development.
+type FileSender struct {
+	dir  string
+	from string
+}
+
+// NewFileSender creates a sender that writes into dir, creating it if needed.
+func NewFileSender(dir, from string) (*FileSender, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &FileSender{dir: dir, from: from}, nil
+}
+
+// Send writes the message to a new file named after the current time.
+func (s *FileSender) Send(ctx context.Context, msg Message) error {
+	name := fmt.Sprintf("%s.eml", time.Now().Format("20060102T150405.000000000"))
+	return os.WriteFile(filepath.Join(s.dir, name), render(s.from, msg.To, msg), 0o640)
+}
@@ -0,0 +1,125 @@
+// Package mail sends transactional email, such as password reset and email
+// verification links.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/techsquidtv/inkling/internal/config"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewSenderFromEnv returns the sender configured through the environment:
+// SMTP when SMTP_HOST is set, otherwise files in MAIL_DIR. In development it
+// falls back to the log; elsewhere it returns nil, as logged emails would put
+// live reset and verification links in the application log.
+func NewSenderFromEnv(environment string) (Sender, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = config.AppName + " <no-reply@localhost>"
+	}
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := 587
+		if p := os.Getenv("SMTP_PORT"); p != "" {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SMTP_PORT %q", p)
+			}
+			port = n
+		}
+		return NewSMTPSender(SMTPConfig{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}), nil
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return NewFileSender(dir, from)
+	}
+	if environment == config.EnvDevelopment {
+		return NewLogSender(), nil
+	}
+	return nil, nil
+}
+
+// Mailer renders the application's emails and hands them to a Sender.
+type Mailer struct {
+	sender    Sender
+	publicURL string
+}
+
+// NewMailer creates a mailer whose links point at publicURL.
+func NewMailer(sender Sender, publicURL string) *Mailer {
+	return &Mailer{sender: sender, publicURL: strings.TrimSuffix(publicURL, "/")}
+}
+
+// SendPasswordReset sends a link to choose a new password.
+func (m *Mailer) SendPasswordReset(ctx context.Context, to, token string, ttl time.Duration) error {
+	return m.sender.Send(ctx, Message{
+		To:      to,
+		Subject: "Reset your " + config.AppName + " password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your %s account.\n\n"+
+			"Choose a new password here:\n%s\n\n"+
+			"The link expires in %s. If this wasn't you, you can ignore this email.\n",
+			config.AppName, m.link("/reset-password", token), ttl),
+	})
+}
+
+// SendVerification sends a link to confirm an email address.
+func (m *Mailer) SendVerification(ctx context.Context, to, token string, ttl time.Duration) error {
+	return m.sender.Send(ctx, Message{
+		To:      to,
+		Subject: "Verify your " + config.AppName + " email address",
+		Body: fmt.Sprintf("Confirm your email address for %s:\n%s\n\n"+
+			"The link expires in %s.\n",
+			config.AppName, m.link("/verify-email", token), ttl),
+	})
+}
+
+// SendOrgInvitation sends a link to join an organization.
+func (m *Mailer) SendOrgInvitation(ctx context.Context, to, orgName, inviter, token string, ttl time.Duration) error {
+	return m.sender.Send(ctx, Message{
+		To:      to,
+		Subject: "Join " + orgName + " on " + config.AppName,
+		Body: fmt.Sprintf("%s invited you to join %s on %s.\n\n"+
+			"Accept the invitation here:\n%s\n\n"+
+			"The link expires in %s.\n",
+			inviter, orgName, config.AppName, m.link("/accept-invitation", token), ttl),
+	})
+}
+
+// SendInvitation sends a link to create an account.
+func (m *Mailer) SendInvitation(ctx context.Context, to, inviter, token string, ttl time.Duration) error {
+	return m.sender.Send(ctx, Message{
+		To:      to,
+		Subject: "You're invited to " + config.AppName,
+		Body: fmt.Sprintf("%s invited you to create an account on %s.\n\n"+
+			"Sign up here:\n%s\n\n"+
+			"The link expires in %s.\n",
+			inviter, config.AppName, m.link("/signup", token), ttl),
+	})
+}
+
+func (m *Mailer) link(path, token string) string {
+	return m.publicURL + path + "?token=" + url.QueryEscape(token)
+}
@@ -3,7 +3,9 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/techsquidtv/inkling/internal/auth"
@@ -13,10 +15,45 @@ import (
 
 type UserContextKey struct{}
 
+type SessionContextKey struct{}
+
+type APIKeyContextKey struct{}
+
+type OrganizationContextKey struct{}
+
+type MembershipContextKey struct{}
+
+type PermissionsContextKey struct{}
+
+// adminMFAMissingContextKey marks admins who must enroll in MFA before using
+// admin endpoints.
+type adminMFAMissingContextKey struct{}
+
+// APIKeySecurityScheme is the name of the security scheme for X-API-Key
+// authentication. An operation accepts API keys by listing the scopes it
+// requires under this scheme, e.g. {"apiKey": {auth.ScopeKeysRead}}.
+const APIKeySecurityScheme = "apiKey"
+
+// PermissionExtension is the operation extension naming the permission a
+// user's role must grant to call it, e.g.
+// Extensions: map[string]any{PermissionExtension: auth.PermissionUsersRead}.
+// It is enforced by the auth middleware and shown in the OpenAPI spec.
+const PermissionExtension = "x-permission"
+
+// OrganizationHeader selects the active organization by slug for operations
+// without an {org} path segment.
+const OrganizationHeader = "X-Organization"
+
+// apiKeyLastUsedInterval throttles how often a key's last use is written back.
+const apiKeyLastUsedInterval = time.Minute
+
 // NewAuthMiddleware creates a new authentication middleware.
 func NewAuthMiddleware(api huma.API, db *gorm.DB) func(huma.Context, func(huma.Context)) {
 	return func(ctx huma.Context, next func(huma.Context)) {
 		var user *database.User
+		var impersonator *database.User
+		var sessionID uint
+		var org *database.Organization
 
 		// 1. Check X-API-Key
 		apiKey := ctx.Header("X-API-Key")
@@ -24,24 +61,63 @@ func NewAuthMiddleware(api huma.API, db *gorm.DB) func(huma.Context, func(huma.C
 			hash := auth.HashKey(apiKey)
 			var keyRecord database.APIKey
 			if err := db.Where("key_hash = ?", hash).First(&keyRecord).Error; err == nil {
-				// Key found, get user
-				if err := db.First(&user, keyRecord.UserID).Error; err == nil {
-					// User found
-				} else {
+				// Key found, but past its expiry
+				if keyRecord.ExpiresAt != nil && time.Now().After(*keyRecord.ExpiresAt) {
+					huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: API key expired")
+					return
+				}
+
+				if keyRecord.OrganizationID != nil {
+					// Organization key, acts for the organization rather than a user
+					if err := db.First(&org, *keyRecord.OrganizationID).Error; err != nil {
+						huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: organization not found")
+						return
+					}
+				} else if err := db.First(&user, keyRecord.UserID).Error; err != nil {
 					// Key valid, but user not found (deleted)
 					huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: user not found")
 					return
 				}
+
+				// Key valid, check it grants the scopes the operation requires
+				if status, msg := checkScopes(ctx.Operation(), auth.ParseScopes(keyRecord.Scopes)); status != 0 {
+					huma.WriteErr(api, ctx, status, msg)
+					return
+				}
+
+				touchAPIKey(db, &keyRecord)
+				ctx = huma.WithValue(ctx, APIKeyContextKey{}, &keyRecord)
 			}
 		}
 
 		// 2. Check Authorization Bearer (if not already authenticated by API Key)
-		if user == nil {
+		if user == nil && org == nil {
 			authHeader := ctx.Header("Authorization")
-			if after, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
-				token := after
-				claims, err := auth.ValidateJWT(token)
-				if err == nil {
+			token, ok := strings.CutPrefix(authHeader, "Bearer ")
+			fromCookie := false
+			if authHeader == "" && auth.SessionCookiesEnabled() {
+				// Browser sessions carry the access token in a cookie instead
+				if cookie, err := huma.ReadCookie(ctx, auth.SessionCookie); err == nil && cookie.Value != "" {
+					token, ok, fromCookie = cookie.Value, true, true
+				}
+			}
+			if ok {
+				if auth.IsSCIMToken(token) && !fromCookie {
+					// SCIM tokens authenticate the identity provider rather than a user
+					scimToken, status, msg := resolveSCIMToken(db, ctx.Operation(), token)
+					if status != 0 {
+						huma.WriteErr(api, ctx, status, msg)
+						return
+					}
+					ctx = huma.WithValue(ctx, SCIMTokenContextKey{}, scimToken)
+				} else if claims, err := auth.ValidateJWT(token); err == nil {
+					// Browsers send cookies on cross-site requests too, so unsafe
+					// requests must prove they come from the app
+					if fromCookie && !checkCSRF(ctx) {
+						huma.WriteErr(api, ctx, http.StatusForbidden, "forbidden: missing or invalid CSRF token")
+						return
+					}
+
 					if err := db.First(&user, claims.UserID).Error; err == nil {
 						// User found
 					} else {
@@ -49,25 +125,290 @@ func NewAuthMiddleware(api huma.API, db *gorm.DB) func(huma.Context, func(huma.C
 						huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: user not found")
 						return
 					}
+
+					// Token valid, but its session was revoked (logout, sign out everywhere, ...)
+					session, err := auth.ValidateSession(db, claims.SessionID)
+					if err != nil {
+						huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: session revoked")
+						return
+					}
+					sessionID = claims.SessionID
+
+					// A service account's token acts with the scopes of the key it was issued for
+					if session.APIKeyID != nil {
+						keyRecord, status, msg := resolveTokenKey(db, ctx.Operation(), claims, session)
+						if status != 0 {
+							huma.WriteErr(api, ctx, status, msg)
+							return
+						}
+						ctx = huma.WithValue(ctx, APIKeyContextKey{}, keyRecord)
+					} else if user.ServiceAccount {
+						huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: service accounts cannot use interactive sessions")
+						return
+					}
+
+					// An admin acting as the user
+					if claims.Act != nil || session.ImpersonatorID != nil {
+						if impersonator, err = resolveImpersonator(db, claims, session); err != nil {
+							huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: "+err.Error())
+							return
+						}
+						// Audit every impersonated request, refused ones included
+						defer func() { auditImpersonatedRequest(ctx, db, user, impersonator) }()
+					}
+
+					// Admins, by the permissions of their role, may be required to
+					// have MFA enabled; like API keys, service account tokens are exempt
+					if session.APIKeyID == nil {
+						required, err := database.RequireAdminMFA.Get(db)
+						if err != nil {
+							huma.WriteErr(api, ctx, http.StatusInternalServerError, "failed to load settings", err)
+							return
+						}
+						if required && auth.IsAdmin(auth.RolePermissions(db, user.Role)) && !auth.HasMFA(db, user.ID) {
+							ctx = huma.WithValue(ctx, adminMFAMissingContextKey{}, true)
+						}
+					}
 				}
 			}
 		}
 
+		// Deactivated accounts keep their tokens and keys, but cannot use them
+		if user != nil && user.DisabledAt != nil {
+			huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: account deactivated")
+			return
+		}
+
+		// SCIM endpoints only accept SCIM tokens
+		if requiresSCIMToken(ctx.Operation()) && GetSCIMToken(ctx.Context()) == nil {
+			huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized: SCIM token required")
+			return
+		}
+
+		// 3. Resolve the active organization, named by the {org} path segment
+		// or the X-Organization header
+		var membership *database.Membership
+		if slug := activeOrgSlug(ctx); slug != "" {
+			switch {
+			case org != nil:
+				if org.Slug != slug {
+					huma.WriteErr(api, ctx, http.StatusForbidden, "forbidden: API key belongs to another organization")
+					return
+				}
+			case user != nil:
+				var status int
+				var msg string
+				org, membership, status, msg = resolveMembership(ctx, db, user, slug)
+				if status != 0 {
+					huma.WriteErr(api, ctx, status, msg)
+					return
+				}
+			}
+		}
+
+		// 4. Check the user's role, or their role in the active organization,
+		// grants the permission the operation requires
+		var permissions []string
+		if user != nil {
+			permissions = auth.RolePermissions(db, user.Role)
+		}
+		if required := requiredPermission(ctx.Operation()); required != "" {
+			granted := permissions
+			if org != nil {
+				orgRole := database.OrgRoleMember
+				if membership != nil {
+					orgRole = membership.Role
+				}
+				granted = append(slices.Clone(permissions), auth.OrgRolePermissions(orgRole)...)
+			}
+			if status, msg := checkPermission(ctx, user, org, granted, required); status != 0 {
+				huma.WriteErr(api, ctx, status, msg)
+				return
+			}
+		}
+
+		// 5. Refuse operations that change the user's credentials while impersonating
+		if impersonator != nil && isSensitive(ctx.Operation()) {
+			huma.WriteErr(api, ctx, http.StatusForbidden, "forbidden: not allowed while impersonating a user")
+			return
+		}
+
 		// If authenticated, store user in context
 		if user != nil {
 			ctx = huma.WithValue(ctx, UserContextKey{}, user)
+			ctx = huma.WithValue(ctx, PermissionsContextKey{}, permissions)
+		}
+		if sessionID != 0 {
+			ctx = huma.WithValue(ctx, SessionContextKey{}, sessionID)
+		}
+		if org != nil {
+			ctx = huma.WithValue(ctx, OrganizationContextKey{}, org)
+		}
+		if membership != nil {
+			ctx = huma.WithValue(ctx, MembershipContextKey{}, membership)
+		}
+		if impersonator != nil {
+			ctx = huma.WithValue(ctx, ImpersonatorContextKey{}, impersonator)
 		}
 
 		next(ctx)
 	}
 }
 
-// GetUser retrieves the user from the context.
+// GetUser retrieves the user from the context. While an admin impersonates
+// someone this is the impersonated user; GetImpersonator returns the admin.
 func GetUser(ctx context.Context) *database.User {
 	user, _ := ctx.Value(UserContextKey{}).(*database.User)
 	return user
 }
 
+// activeOrgSlug returns the organization the request names, if any.
+func activeOrgSlug(ctx huma.Context) string {
+	if slug := ctx.Param("org"); slug != "" {
+		return slug
+	}
+	return ctx.Header(OrganizationHeader)
+}
+
+// resolveMembership loads the organization and the user's membership in it.
+// Site admins, by the permissions of their role, act as owners of every
+// organization. A non-zero status is the error to respond with.
+func resolveMembership(ctx huma.Context, db *gorm.DB, user *database.User, slug string) (*database.Organization, *database.Membership, int, string) {
+	var org database.Organization
+	if err := db.Where("slug = ?", slug).First(&org).Error; err != nil {
+		return nil, nil, http.StatusNotFound, "organization not found"
+	}
+
+	var membership database.Membership
+	err := db.Where("organization_id = ? AND user_id = ?", org.ID, user.ID).First(&membership).Error
+	if err == nil {
+		return &org, &membership, 0, ""
+	}
+	missingMFA, _ := ctx.Context().Value(adminMFAMissingContextKey{}).(bool)
+	if auth.IsAdmin(auth.RolePermissions(db, user.Role)) && !missingMFA {
+		return &org, &database.Membership{OrganizationID: org.ID, UserID: user.ID, Role: database.OrgRoleOwner}, 0, ""
+	}
+	return nil, nil, http.StatusForbidden, "forbidden: not a member of this organization"
+}
+
+// requiredAPIKeyScopes returns the scopes an operation requires from an API key.
+// Operations without security requirements are public and accept any key; the
+// boolean is false when the operation is protected but does not accept keys.
+func requiredAPIKeyScopes(op *huma.Operation) ([]string, bool) {
+	if op == nil || len(op.Security) == 0 {
+		return nil, true
+	}
+	for _, requirement := range op.Security {
+		if scopes, ok := requirement[APIKeySecurityScheme]; ok {
+			return scopes, true
+		}
+	}
+	return nil, false
+}
+
+// checkScopes decides whether an API key, or a token issued for one, with the
+// granted scopes may call an operation. A non-zero status is the error to
+// respond with.
+func checkScopes(op *huma.Operation, granted []string) (int, string) {
+	required, ok := requiredAPIKeyScopes(op)
+	if !ok {
+		return http.StatusForbidden, "forbidden: operation does not accept API keys"
+	}
+	if !auth.HasScopes(granted, required) {
+		return http.StatusForbidden, "forbidden: API key is missing required scope"
+	}
+	return 0, ""
+}
+
+// resolveTokenKey loads the service account key a client credentials token
+// was issued for and checks the token's scopes against the operation. The
+// returned key carries the token's scopes, which may be narrower than the
+// key's own.
+func resolveTokenKey(db *gorm.DB, op *huma.Operation, claims *auth.Claims, session *database.Session) (*database.APIKey, int, string) {
+	var keyRecord database.APIKey
+	if err := db.Where("id = ? AND user_id = ?", *session.APIKeyID, session.UserID).First(&keyRecord).Error; err != nil {
+		return nil, http.StatusUnauthorized, "unauthorized: API key revoked"
+	}
+	if keyRecord.ExpiresAt != nil && time.Now().After(*keyRecord.ExpiresAt) {
+		return nil, http.StatusUnauthorized, "unauthorized: API key expired"
+	}
+	scopes := auth.ParseScopeList(claims.Scope)
+	if !auth.HasScopes(auth.ParseScopes(keyRecord.Scopes), scopes) {
+		return nil, http.StatusUnauthorized, "unauthorized: token scopes exceed the API key"
+	}
+	if status, msg := checkScopes(op, scopes); status != 0 {
+		return nil, status, msg
+	}
+	keyRecord.Scopes = auth.EncodeScopes(scopes)
+	return &keyRecord, 0, ""
+}
+
+// requiredPermission returns the permission an operation declares, if any.
+func requiredPermission(op *huma.Operation) string {
+	if op == nil {
+		return ""
+	}
+	permission, _ := op.Extensions[PermissionExtension].(string)
+	return permission
+}
+
+// checkPermission decides whether the request may call an operation that
+// requires permission. Organization API keys have no user and are granted
+// what their organization grants its members. A non-zero status is the error
+// to respond with.
+func checkPermission(ctx huma.Context, user *database.User, org *database.Organization, granted []string, permission string) (int, string) {
+	if user == nil && org == nil {
+		return http.StatusUnauthorized, "unauthorized"
+	}
+	if !auth.HasPermission(granted, permission) {
+		return http.StatusForbidden, "forbidden: " + permission + " permission required"
+	}
+	if missing, _ := ctx.Context().Value(adminMFAMissingContextKey{}).(bool); missing {
+		return http.StatusForbidden, "MFA must be enabled to use admin endpoints"
+	}
+	return 0, ""
+}
+
+// touchAPIKey records the key's last use, writing at most once per interval.
+func touchAPIKey(db *gorm.DB, key *database.APIKey) {
+	now := time.Now()
+	if key.LastUsed != nil && now.Sub(*key.LastUsed) < apiKeyLastUsedInterval {
+		return
+	}
+	db.Model(&database.APIKey{}).
+		Where("id = ? AND (last_used IS NULL OR last_used < ?)", key.ID, now.Add(-apiKeyLastUsedInterval)).
+		Update("last_used", now)
+	key.LastUsed = &now
+}
+
+// checkCSRF reports whether a request authenticated by the session cookie may
+// proceed: safe methods always may, others must echo the CSRF cookie in the
+// CSRF header.
+func checkCSRF(ctx huma.Context) bool {
+	switch ctx.Method() {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := huma.ReadCookie(ctx, auth.CSRFCookie)
+	if err != nil {
+		return false
+	}
+	return auth.ValidCSRF(cookie.Value, ctx.Header(auth.CSRFHeader))
+}
+
+// GetAPIKey retrieves the API key the request was authenticated with, if any.
+func GetAPIKey(ctx context.Context) *database.APIKey {
+	key, _ := ctx.Value(APIKeyContextKey{}).(*database.APIKey)
+	return key
+}
+
+// GetSessionID retrieves the ID of the session the request was authenticated
+// with. It returns 0 for requests authenticated by API key.
+func GetSessionID(ctx context.Context) uint {
+	sessionID, _ := ctx.Value(SessionContextKey{}).(uint)
+	return sessionID
+}
+
 // RequireAuth checks if a user is authenticated and returns an error if not.
 func RequireAuth(ctx context.Context) (*database.User, error) {
 	user := GetUser(ctx)
@@ -77,15 +418,60 @@ func RequireAuth(ctx context.Context) (*database.User, error) {
 	return user, nil
 }
 
-// RequireAdmin checks if the authenticated user has admin role.
-// Returns error if not authenticated or not an admin.
-func RequireAdmin(ctx context.Context) (*database.User, error) {
+// GetPermissions returns the permissions granted by the authenticated user's
+// role. It may contain the "*" wildcard.
+func GetPermissions(ctx context.Context) []string {
+	permissions, _ := ctx.Value(PermissionsContextKey{}).([]string)
+	return permissions
+}
+
+// RequirePermission checks that the authenticated user's role grants the
+// permission. Prefer declaring it with PermissionExtension; this is for checks
+// that depend on the request.
+func RequirePermission(ctx context.Context, permission string) (*database.User, error) {
 	user, err := RequireAuth(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if user.Role != database.RoleAdmin {
-		return nil, huma.Error403Forbidden("admin access required")
+	if !auth.HasPermission(GetPermissions(ctx), permission) {
+		return nil, huma.Error403Forbidden(permission + " permission required")
+	}
+	if missing, _ := ctx.Value(adminMFAMissingContextKey{}).(bool); missing {
+		return nil, huma.Error403Forbidden("MFA must be enabled to use admin endpoints")
 	}
 	return user, nil
 }
+
+// GetOrganization retrieves the active organization from the context.
+func GetOrganization(ctx context.Context) *database.Organization {
+	org, _ := ctx.Value(OrganizationContextKey{}).(*database.Organization)
+	return org
+}
+
+// GetMembership retrieves the user's membership in the active organization.
+// It returns nil for requests authenticated by an organization API key.
+func GetMembership(ctx context.Context) *database.Membership {
+	membership, _ := ctx.Value(MembershipContextKey{}).(*database.Membership)
+	return membership
+}
+
+// RequireOrgRole checks that the request acts in an organization with at
+// least the given role. Organization API keys count as members.
+func RequireOrgRole(ctx context.Context, role string) (*database.Organization, error) {
+	org := GetOrganization(ctx)
+	if org == nil {
+		if GetUser(ctx) == nil {
+			return nil, huma.Error401Unauthorized("unauthorized")
+		}
+		return nil, huma.Error400BadRequest("no active organization, set the " + OrganizationHeader + " header")
+	}
+
+	memberRole := database.OrgRoleMember
+	if membership := GetMembership(ctx); membership != nil {
+		memberRole = membership.Role
+	}
+	if !auth.OrgRoleAtLeast(memberRole, role) {
+		return nil, huma.Error403Forbidden("organization " + role + " role required")
+	}
+	return org, nil
+}
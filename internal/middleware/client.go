@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"context"
+	"net"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+type ClientInfoContextKey struct{}
+
+// ClientInfo describes the client that made the current request.
+type ClientInfo struct {
+	IPAddress string
+	UserAgent string
+	RequestID string // Set by chi's RequestID middleware, or taken from X-Request-Id
+	Secure    bool   // Request arrived over TLS, directly or via a proxy
+}
+
+// NewClientInfoMiddleware stores the caller's address, user agent and request
+// ID in the context.
+func NewClientInfoMiddleware() func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		ip := ctx.RemoteAddr()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		requestID := middleware.GetReqID(ctx.Context())
+		if requestID == "" {
+			requestID = ctx.Header(middleware.RequestIDHeader)
+		}
+		ctx = huma.WithValue(ctx, ClientInfoContextKey{}, ClientInfo{
+			IPAddress: ip,
+			UserAgent: ctx.Header("User-Agent"),
+			RequestID: requestID,
+			Secure:    ctx.TLS() != nil || ctx.Header("X-Forwarded-Proto") == "https",
+		})
+		next(ctx)
+	}
+}
+
+// GetClientInfo retrieves the client info from the context.
+func GetClientInfo(ctx context.Context) ClientInfo {
+	info, _ := ctx.Value(ClientInfoContextKey{}).(ClientInfo)
+	return info
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/audit"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+type ImpersonatorContextKey struct{}
+
+// SensitiveExtension marks operations that change the user's credentials,
+// e.g. Extensions: map[string]any{SensitiveExtension: true}. They are refused
+// while an admin is impersonating the user.
+const SensitiveExtension = "x-sensitive"
+
+// auditImpersonatedRequestAction is the audit action recorded for every
+// request made while impersonating.
+const auditImpersonatedRequestAction = "impersonation.request"
+
+// GetImpersonator retrieves the admin acting as the user returned by GetUser,
+// or nil when the request is not impersonated.
+func GetImpersonator(ctx context.Context) *database.User {
+	user, _ := ctx.Value(ImpersonatorContextKey{}).(*database.User)
+	return user
+}
+
+// resolveImpersonator loads the admin an impersonation token was issued to.
+// The token and its session must agree, and the admin must still be allowed
+// to impersonate.
+func resolveImpersonator(db *gorm.DB, claims *auth.Claims, session *database.Session) (*database.User, error) {
+	if claims.Act == nil || session.ImpersonatorID == nil || *session.ImpersonatorID != claims.Act.UserID {
+		return nil, errors.New("invalid impersonation token")
+	}
+	var impersonator database.User
+	if err := db.First(&impersonator, claims.Act.UserID).Error; err != nil {
+		return nil, errors.New("impersonator not found")
+	}
+	if !auth.HasPermission(auth.RolePermissions(db, impersonator.Role), auth.PermissionUsersImpersonate) {
+		return nil, errors.New("impersonator may no longer impersonate")
+	}
+	return &impersonator, nil
+}
+
+// isSensitive reports whether the operation is marked with SensitiveExtension.
+func isSensitive(op *huma.Operation) bool {
+	if op == nil {
+		return false
+	}
+	sensitive, _ := op.Extensions[SensitiveExtension].(bool)
+	return sensitive
+}
+
+// auditImpersonatedRequest records a request made while impersonating. The
+// admin is the actor and the impersonated user the target.
+func auditImpersonatedRequest(ctx huma.Context, db *gorm.DB, user, impersonator *database.User) {
+	outcome := audit.Success
+	if ctx.Status() >= http.StatusBadRequest {
+		outcome = audit.Failure
+	}
+	details := map[string]any{
+		"method": ctx.Method(),
+		"path":   ctx.URL().Path,
+		"status": ctx.Status(),
+	}
+	if op := ctx.Operation(); op != nil {
+		details["operation"] = op.OperationID
+	}
+
+	client := GetClientInfo(ctx.Context())
+	audit.Record(ctx.Context(), db, audit.Entry{
+		Action:     auditImpersonatedRequestAction,
+		Outcome:    outcome,
+		Actor:      impersonator,
+		TargetType: "user",
+		TargetID:   strconv.FormatUint(uint64(user.ID), 10),
+		Details:    details,
+		IPAddress:  client.IPAddress,
+		UserAgent:  client.UserAgent,
+		RequestID:  client.RequestID,
+	})
+}
@@ -18,6 +18,7 @@ func Logging(next http.Handler) http.Handler {
 		l := log.With(
 			logging.Method, r.Method,
 			logging.Path, r.URL.Path,
+			logging.RequestID, middleware.GetReqID(r.Context()),
 		)
 
 		// Inject the logger into the request context
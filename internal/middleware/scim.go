@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/techsquidtv/inkling/internal/auth"
+	"github.com/techsquidtv/inkling/internal/database"
+	"gorm.io/gorm"
+)
+
+type SCIMTokenContextKey struct{}
+
+// SCIMSecurityScheme is the name of the security scheme for SCIM bearer
+// tokens. Operations declaring it, e.g. {"scimAuth": {}}, only accept SCIM
+// tokens, and SCIM tokens are only accepted by those operations.
+const SCIMSecurityScheme = "scimAuth"
+
+// GetSCIMToken retrieves the SCIM token the request was authenticated with, if any.
+func GetSCIMToken(ctx context.Context) *database.SCIMToken {
+	token, _ := ctx.Value(SCIMTokenContextKey{}).(*database.SCIMToken)
+	return token
+}
+
+// requiresSCIMToken reports whether the operation declares the SCIM security scheme.
+func requiresSCIMToken(op *huma.Operation) bool {
+	if op == nil {
+		return false
+	}
+	for _, requirement := range op.Security {
+		if _, ok := requirement[SCIMSecurityScheme]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSCIMToken validates a raw SCIM token for the operation. A non-zero
+// status is the error to respond with.
+func resolveSCIMToken(db *gorm.DB, op *huma.Operation, raw string) (*database.SCIMToken, int, string) {
+	if !requiresSCIMToken(op) {
+		return nil, http.StatusForbidden, "forbidden: operation does not accept SCIM tokens"
+	}
+	token, err := auth.ValidateSCIMToken(db, raw)
+	if err != nil {
+		return nil, http.StatusUnauthorized, "unauthorized: " + auth.ErrInvalidSCIMToken.Error()
+	}
+	return token, 0, ""
+}
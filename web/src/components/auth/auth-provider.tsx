@@ -1,9 +1,21 @@
 import React, { useState, useCallback, useEffect } from 'react'
 import { toast } from 'sonner'
 import { AuthContext, type User } from '@/lib/auth'
-import { client } from '@/lib/api'
+import {
+  client,
+  clearSession,
+  getRefreshToken,
+  getTokenExpiry,
+  refreshSession,
+  storeSession,
+  type SessionTokens,
+} from '@/lib/api'
+import { APP_CONFIG } from '@/constants'
 import { logger, LogKeys } from '@/lib/logger'
 
+// Refresh the access token this long before it expires
+const REFRESH_MARGIN_MS = 60 * 1000
+
 export function AuthProvider({ children }: { children: React.ReactNode }) {
   const [token, setToken] = useState<string | null>(
     localStorage.getItem('token')
@@ -11,7 +23,16 @@ export function AuthProvider({ children }: { children: React.ReactNode }) {
   const [user, setUser] = useState<User | null>(null)
 
   const logout = useCallback(() => {
-    localStorage.removeItem('token')
+    // End the session on the server too, so its refresh token stops working
+    const refreshToken = getRefreshToken()
+    if (refreshToken) {
+      fetch(`${APP_CONFIG.API_BASE_URL}/auth/logout`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refresh_token: refreshToken }),
+      }).catch(() => {})
+    }
+    clearSession()
     setToken(null)
     setUser(null)
     logger.info('User session ended')
@@ -60,9 +81,10 @@ export function AuthProvider({ children }: { children: React.ReactNode }) {
     }
   }, [token, logout])
 
-  const login = useCallback((newToken: string) => {
-    localStorage.setItem('token', newToken)
-    setToken(newToken)
+  const login = useCallback((session: SessionTokens) => {
+    if (!session.token) return
+    storeSession(session)
+    setToken(session.token)
     logger.info('User session started')
   }, [])
 
@@ -81,6 +103,35 @@ export function AuthProvider({ children }: { children: React.ReactNode }) {
     }
   }, [logout])
 
+  // Pick up access tokens renewed by the API client
+  useEffect(() => {
+    const handleRefreshed = (event: Event) => {
+      const newToken = (event as CustomEvent<string | undefined>).detail
+      if (newToken) setToken(newToken)
+    }
+
+    window.addEventListener('auth:refreshed', handleRefreshed)
+    return () => {
+      window.removeEventListener('auth:refreshed', handleRefreshed)
+    }
+  }, [])
+
+  // Refresh the session shortly before the access token expires, so open
+  // tabs stay signed in. Sessions that cannot be refreshed end.
+  useEffect(() => {
+    const expiresAt = getTokenExpiry()
+    if (!token || !expiresAt || !getRefreshToken()) return
+
+    const delay = Math.max(expiresAt - Date.now() - REFRESH_MARGIN_MS, 0)
+    const timer = window.setTimeout(async () => {
+      if (!(await refreshSession())) {
+        logger.warn('failed to refresh session, logging out')
+        logout()
+      }
+    }, delay)
+    return () => window.clearTimeout(timer)
+  }, [token, logout])
+
   // Fetch user info when token changes
   useEffect(() => {
     if (token) {
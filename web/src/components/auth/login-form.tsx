@@ -50,7 +50,7 @@ export function LoginForm({
         }
 
         if (data?.token) {
-          auth.login(data.token)
+          auth.login(data)
           toast.success('Welcome back!')
           // Navigate to redirect URL if present, otherwise dashboard
           const redirectTo = search.redirect || '/dashboard'
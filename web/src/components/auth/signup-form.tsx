@@ -66,7 +66,7 @@ export function SignUpForm({
         }
 
         if (data?.token) {
-          auth.login(data.token)
+          auth.login(data)
           toast.success('Account created successfully!')
           navigate({ to: '/dashboard' })
         }
@@ -22,6 +22,7 @@ import {
 } from '@/components/ui/table'
 import { Input } from '@/components/ui/input'
 import { Label } from '@/components/ui/label'
+import { Checkbox } from '@/components/ui/checkbox'
 import {
   Drawer,
   DrawerClose,
@@ -36,15 +37,38 @@ import {
 interface APIKey {
   id: number
   prefix: string
+  scopes: string[]
   created_at: string
   last_used?: string
   name?: string
 }
 
+// The scopes a key can be granted, as listed by auth.AllScopes. A key never
+// does more than its owner is allowed to.
+const API_KEY_SCOPES = [
+  { scope: 'profile:read', label: 'Read your profile' },
+  { scope: 'profile:write', label: 'Update your profile' },
+  { scope: 'keys:read', label: 'List API keys' },
+  { scope: 'keys:write', label: 'Create and revoke API keys' },
+  { scope: 'products:write', label: 'Manage products' },
+  { scope: 'users:read', label: 'List users' },
+  { scope: 'users:write', label: 'Manage users' },
+  { scope: 'settings:read', label: 'Read settings' },
+  { scope: 'settings:write', label: 'Change settings' },
+  { scope: 'audit:read', label: 'Read the audit log' },
+  { scope: 'orgs:read', label: 'Read organizations' },
+  { scope: 'orgs:write', label: 'Manage organizations' },
+  { scope: 'roles:read', label: 'List roles' },
+  { scope: 'roles:write', label: 'Manage roles' },
+]
+
+const DEFAULT_SCOPES = ['profile:read']
+
 export function ApiKeys() {
   const [keys, setKeys] = useState<APIKey[]>([])
   const [isLoading, setIsLoading] = useState(true)
   const [newKeyName, setNewKeyName] = useState('')
+  const [newKeyScopes, setNewKeyScopes] = useState<string[]>(DEFAULT_SCOPES)
   const [newKey, setNewKey] = useState<string | null>(null)
   const [isCreating, setIsCreating] = useState(false)
   const [isDrawerOpen, setIsDrawerOpen] = useState(false)
@@ -73,7 +97,7 @@ export function ApiKeys() {
       const data = await fetchWithAuth<{ key: string }>('/api/keys', {
         method: 'POST',
         token: auth.token,
-        body: JSON.stringify({ name: newKeyName }),
+        body: JSON.stringify({ name: newKeyName, scopes: newKeyScopes }),
         headers: {
           'Content-Type': 'application/json',
         },
@@ -118,6 +142,12 @@ export function ApiKeys() {
     }
   }
 
+  function toggleScope(scope: string, checked: boolean) {
+    setNewKeyScopes((scopes) =>
+      checked ? [...scopes, scope] : scopes.filter((s) => s !== scope)
+    )
+  }
+
   function handleCopy() {
     if (newKey) {
       navigator.clipboard.writeText(newKey)
@@ -142,6 +172,7 @@ export function ApiKeys() {
               if (!open) {
                 setNewKey(null)
                 setNewKeyName('')
+                setNewKeyScopes(DEFAULT_SCOPES)
               }
             }}
           >
@@ -195,6 +226,31 @@ export function ApiKeys() {
                           onChange={(e) => setNewKeyName(e.target.value)}
                         />
                       </div>
+                      <div className="space-y-2">
+                        <Label>Scopes</Label>
+                        <div className="grid max-h-64 gap-2 overflow-y-auto">
+                          {API_KEY_SCOPES.map(({ scope, label }) => (
+                            <div key={scope} className="flex items-center gap-2">
+                              <Checkbox
+                                id={`scope-${scope}`}
+                                checked={newKeyScopes.includes(scope)}
+                                onCheckedChange={(checked) =>
+                                  toggleScope(scope, checked === true)
+                                }
+                              />
+                              <Label
+                                htmlFor={`scope-${scope}`}
+                                className="font-normal"
+                              >
+                                {label}
+                                <span className="text-muted-foreground font-mono text-xs">
+                                  {scope}
+                                </span>
+                              </Label>
+                            </div>
+                          ))}
+                        </div>
+                      </div>
                     </div>
                   )}
                 </div>
@@ -205,7 +261,10 @@ export function ApiKeys() {
                       <Button>Done</Button>
                     </DrawerClose>
                   ) : (
-                    <Button onClick={createKey} disabled={isCreating}>
+                    <Button
+                      onClick={createKey}
+                      disabled={isCreating || newKeyScopes.length === 0}
+                    >
                       {isCreating ? 'Creating...' : 'Create Key'}
                     </Button>
                   )}
@@ -234,6 +293,7 @@ export function ApiKeys() {
               <TableRow>
                 <TableHead>Name</TableHead>
                 <TableHead>Prefix</TableHead>
+                <TableHead>Scopes</TableHead>
                 <TableHead>Created At</TableHead>
                 <TableHead className="text-right">Actions</TableHead>
               </TableRow>
@@ -247,6 +307,9 @@ export function ApiKeys() {
                   <TableCell className="font-mono text-xs">
                     {key.prefix}***
                   </TableCell>
+                  <TableCell className="font-mono text-xs">
+                    {key.scopes?.join(', ')}
+                  </TableCell>
                   <TableCell>
                     {new Date(key.created_at).toLocaleDateString()}
                   </TableCell>
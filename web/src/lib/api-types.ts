@@ -327,7 +327,23 @@ export interface components {
              * @example https://example.com/schemas/CallbackOutputBody.json
              */
             readonly $schema?: string;
-            token: string;
+            /**
+             * Format: int64
+             * @description Access token lifetime in seconds
+             */
+            expires_in?: number;
+            /** @description Set instead of the tokens when a second factor is needed */
+            mfa_required?: boolean;
+            /** @description Pass to /auth/mfa/verify with a TOTP or recovery code */
+            mfa_token?: string;
+            /** @description Single-use token for obtaining a new access token */
+            refresh_token?: string;
+            /** @description Where to send the user after an OIDC login */
+            return_to?: string;
+            /** @description Short-lived access token */
+            token?: string;
+            /** @description Set instead of the tokens when the email address must be verified before logging in */
+            verification_required?: boolean;
         };
         ChangePasswordInputBody: {
             /**
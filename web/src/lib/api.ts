@@ -20,13 +20,105 @@ const client = createClient<paths>({
   baseUrl: APP_CONFIG.API_BASE_URL,
 })
 
-// Middleware to add auth token
+// Tokens of the browser session, kept in localStorage
+const TOKEN_KEY = 'token'
+const REFRESH_TOKEN_KEY = 'refresh_token'
+const EXPIRES_AT_KEY = 'token_expires_at'
+
+/** The tokens returned by login, signup and /auth/refresh */
+export interface SessionTokens {
+  token?: string
+  refresh_token?: string
+  expires_in?: number
+}
+
+export function storeSession(tokens: SessionTokens) {
+  if (tokens.token) {
+    localStorage.setItem(TOKEN_KEY, tokens.token)
+  }
+  if (tokens.refresh_token) {
+    localStorage.setItem(REFRESH_TOKEN_KEY, tokens.refresh_token)
+  }
+  if (tokens.expires_in) {
+    localStorage.setItem(
+      EXPIRES_AT_KEY,
+      String(Date.now() + tokens.expires_in * 1000)
+    )
+  }
+}
+
+export function clearSession() {
+  localStorage.removeItem(TOKEN_KEY)
+  localStorage.removeItem(REFRESH_TOKEN_KEY)
+  localStorage.removeItem(EXPIRES_AT_KEY)
+}
+
+export function getRefreshToken() {
+  return localStorage.getItem(REFRESH_TOKEN_KEY)
+}
+
+/** When the stored access token expires, in milliseconds since the epoch */
+export function getTokenExpiry() {
+  const expiresAt = Number(localStorage.getItem(EXPIRES_AT_KEY))
+  return expiresAt > 0 ? expiresAt : null
+}
+
+let refreshing: Promise<string | null> | null = null
+
+/**
+ * Exchange the stored refresh token for a new token pair. Refresh tokens are
+ * single-use, so concurrent callers share one request. Resolves to the new
+ * access token, or null if the session could not be refreshed. The new
+ * token is announced with an auth:refreshed event.
+ */
+export function refreshSession(): Promise<string | null> {
+  if (!refreshing) {
+    refreshing = rotateRefreshToken().finally(() => {
+      refreshing = null
+    })
+  }
+  return refreshing
+}
+
+async function rotateRefreshToken(): Promise<string | null> {
+  const refreshToken = getRefreshToken()
+  if (!refreshToken) return null
+
+  // Plain fetch, so a failed refresh does not go through the middleware again
+  const response = await fetch(`${APP_CONFIG.API_BASE_URL}/auth/refresh`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ refresh_token: refreshToken }),
+  }).catch(() => null)
+  if (!response?.ok) {
+    logMilestone('session refresh failed', {
+      [LogKeys.STATUS]: response?.status ?? 0,
+    })
+    return null
+  }
+
+  const tokens: SessionTokens = await response.json()
+  storeSession(tokens)
+  window.dispatchEvent(
+    new CustomEvent('auth:refreshed', { detail: tokens.token })
+  )
+  return tokens.token ?? null
+}
+
+// Copies of outgoing requests, to send again after refreshing the session
+const retries = new WeakMap<Request, Request>()
+
+// Middleware to add auth token, and to refresh the session once when the
+// access token has expired
 export const authMiddleware = {
   async onRequest({ request }: { request: Request }) {
-    const token = localStorage.getItem('token')
+    const token = localStorage.getItem(TOKEN_KEY)
     if (token) {
       request.headers.set('Authorization', `Bearer ${token}`)
     }
+    if (getRefreshToken()) {
+      retries.set(request, request.clone())
+    }
     return request
   },
   async onResponse({
@@ -45,6 +137,15 @@ export const authMiddleware = {
     })
 
     if (response.status === 401) {
+      const retry = retries.get(request)
+      const token = retry ? await refreshSession() : null
+      if (retry && token) {
+        retry.headers.set('Authorization', `Bearer ${token}`)
+        const retried = await fetch(retry)
+        if (retried.status !== 401) {
+          return retried
+        }
+      }
       window.dispatchEvent(new CustomEvent('auth:unauthorized'))
     }
     return response
@@ -61,7 +162,8 @@ export { client }
  */
 export async function fetchWithAuth<T = unknown>(
   url: string,
-  options: RequestInit & { token?: string | null } = {}
+  options: RequestInit & { token?: string | null } = {},
+  canRefresh = true
 ): Promise<T> {
   const { token, headers = {}, ...rest } = options
 
@@ -79,6 +181,11 @@ export async function fetchWithAuth<T = unknown>(
   })
 
   if (response.status === 401) {
+    // The access token may just have expired; retry once with a fresh one
+    const freshToken = token && canRefresh ? await refreshSession() : null
+    if (freshToken) {
+      return fetchWithAuth<T>(url, { ...options, token: freshToken }, false)
+    }
     window.dispatchEvent(new CustomEvent('auth:unauthorized'))
     throw new APIError('Unauthorized', 401)
   }
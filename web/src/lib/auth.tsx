@@ -1,4 +1,5 @@
 import { createContext, useContext } from 'react'
+import type { SessionTokens } from '@/lib/api'
 
 export interface User {
   id: number
@@ -13,7 +14,7 @@ export interface AuthContextType {
   token: string | null
   user: User | null
   isAdmin: boolean
-  login: (token: string) => void
+  login: (session: SessionTokens) => void
   logout: () => void
   refreshUser: () => Promise<void>
 }
@@ -1,10 +1,11 @@
 import { createRootRouteWithContext, Outlet } from '@tanstack/react-router'
+import type { SessionTokens } from '@/lib/api'
 
 interface MyRouterContext {
   auth: {
     isAuthenticated: boolean
     token: string | null
-    login: (token: string) => void
+    login: (session: SessionTokens) => void
     logout: () => void
   }
 }